@@ -0,0 +1,225 @@
+package cacher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Format is the archive format of the cache.
+type Format string
+
+const (
+	// FormatTar stores the cache as a (compressed) tarball. This is the default.
+	FormatTar Format = "tar"
+
+	// FormatZip stores the cache as a zip file. Zip files can be opened natively
+	// on Windows, but they cannot be restored in a streaming fashion and do not
+	// use the configured compression.
+	FormatZip Format = "zip"
+)
+
+// zipContentType is the content type of zip archives.
+const zipContentType = "application/zip"
+
+// zipMagic is the leading bytes of a zip file.
+var zipMagic = []byte("PK\x03\x04")
+
+// ParseFormat parses the given string into a format. The empty string is
+// returned as-is and means "default" when saving and "auto-detect" when
+// restoring.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case "", FormatTar, FormatZip:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown format %q", s)
+	}
+}
+
+// detectFormat determines the format of the archive in br from its magic
+// bytes and content type. The reader is not advanced.
+func detectFormat(contentType string, br *bufio.Reader) (Format, error) {
+	head, err := br.Peek(len(zipMagic))
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read archive header: %w", err)
+	}
+
+	if bytes.Equal(head, zipMagic) || contentType == zipContentType {
+		return FormatZip, nil
+	}
+	return FormatTar, nil
+}
+
+// archiveWriter writes entries to an archive. It is modeled after
+// tar.Writer, which implements it directly.
+type archiveWriter interface {
+	io.Writer
+	WriteHeader(hdr *tar.Header) error
+	Flush() error
+	Close() error
+}
+
+// archiveReader reads entries from an archive. It is modeled after
+// tar.Reader, which implements it directly.
+type archiveReader interface {
+	io.Reader
+	Next() (*tar.Header, error)
+}
+
+// zipArchiveWriter is an archiveWriter that produces a zip file.
+type zipArchiveWriter struct {
+	zw *zip.Writer
+	w  io.Writer
+
+	// store writes the next file without compression.
+	store bool
+}
+
+func newZipArchiveWriter(w io.Writer) *zipArchiveWriter {
+	return &zipArchiveWriter{zw: zip.NewWriter(w)}
+}
+
+// WriteHeader starts a new file in the zip archive.
+func (z *zipArchiveWriter) WriteHeader(hdr *tar.Header) error {
+	fh, err := zip.FileInfoHeader(hdr.FileInfo())
+	if err != nil {
+		return fmt.Errorf("failed to create zip header for %s: %w", hdr.Name, err)
+	}
+	fh.Name = hdr.Name
+	fh.Method = zip.Deflate
+	if z.store {
+		fh.Method = zip.Store
+		z.store = false
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		fh.Name = strings.TrimSuffix(fh.Name, "/") + "/"
+		fh.Method = zip.Store
+	}
+
+	w, err := z.zw.CreateHeader(fh)
+	if err != nil {
+		return fmt.Errorf("failed to write zip header for %s: %w", hdr.Name, err)
+	}
+	z.w = w
+	return nil
+}
+
+// Write writes to the current file in the zip archive.
+func (z *zipArchiveWriter) Write(p []byte) (int, error) {
+	if z.w == nil {
+		return 0, fmt.Errorf("write before header")
+	}
+	return z.w.Write(p)
+}
+
+// Flush flushes any buffered data to the underlying writer.
+func (z *zipArchiveWriter) Flush() error {
+	return z.zw.Flush()
+}
+
+// Close writes the zip central directory. It does not close the underlying
+// writer.
+func (z *zipArchiveWriter) Close() error {
+	return z.zw.Close()
+}
+
+// zipArchiveReader is an archiveReader that reads a zip file. Since zip files
+// store their index at the end, the archive is first spooled to a temporary
+// file on disk.
+type zipArchiveReader struct {
+	spool *os.File
+	files []*zip.File
+	rc    io.ReadCloser
+}
+
+func newZipArchiveReader(r io.Reader) (_ *zipArchiveReader, retErr error) {
+	spool, err := os.CreateTemp("", "gcs-cacher-*.zip")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer func() {
+		if retErr != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+	}()
+
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool zip archive: %w", err)
+	}
+
+	zr, err := zip.NewReader(spool, size)
+	if err != nil {
+		return nil, &corruptError{err: fmt.Errorf("failed to create zip reader: %w", err)}
+	}
+	return &zipArchiveReader{spool: spool, files: zr.File}, nil
+}
+
+// Next advances to the next file in the zip archive.
+func (z *zipArchiveReader) Next() (*tar.Header, error) {
+	if err := z.closeCurrent(); err != nil {
+		return nil, err
+	}
+
+	if len(z.files) == 0 {
+		return nil, io.EOF
+	}
+	f := z.files[0]
+	z.files = z.files[1:]
+
+	hdr, err := tar.FileInfoHeader(f.FileInfo(), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create header for %s: %w", f.Name, err)
+	}
+	hdr.Name = f.Name
+
+	if hdr.Typeflag == tar.TypeReg {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", f.Name, err)
+		}
+		z.rc = rc
+	}
+	return hdr, nil
+}
+
+// Read reads from the current file in the zip archive.
+func (z *zipArchiveReader) Read(p []byte) (int, error) {
+	if z.rc == nil {
+		return 0, io.EOF
+	}
+	return z.rc.Read(p)
+}
+
+// Close closes the current file and removes the spool file.
+func (z *zipArchiveReader) Close() error {
+	if err := z.closeCurrent(); err != nil {
+		return err
+	}
+	if err := z.spool.Close(); err != nil {
+		return fmt.Errorf("failed to close spool file: %w", err)
+	}
+	if err := os.Remove(z.spool.Name()); err != nil {
+		return fmt.Errorf("failed to remove spool file: %w", err)
+	}
+	return nil
+}
+
+func (z *zipArchiveReader) closeCurrent() error {
+	if z.rc == nil {
+		return nil
+	}
+	rc := z.rc
+	z.rc = nil
+	if err := rc.Close(); err != nil {
+		return fmt.Errorf("failed to close zip entry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// defaultAzureBlockSize is the default size of each block of an Azure upload.
+const defaultAzureBlockSize = 16 * 1024 * 1024
+
+// azureStore stores objects in an Azure Blob Storage container. Like S3, Azure
+// does not number the generations of blobs, so all objects are generation
+// zero. Writes which require the object to not exist are atomic.
+type azureStore struct {
+	client    *container.Client
+	container string
+}
+
+// newAzureStore creates the store for a container URL like azblob://my-cache.
+// The storage account is the account query parameter or AZURE_STORAGE_ACCOUNT,
+// and the endpoint query parameter overrides the blob service URL, like
+// azblob://my-cache?endpoint=http://127.0.0.1:10000/devstoreaccount1 for
+// Azurite. Credentials are an account key in AZURE_STORAGE_KEY, a SAS token in
+// AZURE_STORAGE_SAS_TOKEN, or the default Azure credentials, like a managed
+// identity or the Azure CLI. Alternatively AZURE_STORAGE_CONNECTION_STRING
+// configures both the account and the credentials.
+func newAzureStore(bucketURL string, rt http.RoundTripper) (*azureStore, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bucket %q: %w", bucketURL, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("bucket %q is missing a container name", bucketURL)
+	}
+	if strings.Trim(u.Path, "/") != "" {
+		return nil, fmt.Errorf("bucket %q must not have a path", bucketURL)
+	}
+	q := u.Query()
+	name := u.Host
+
+	clientOpts := azcore.ClientOptions{Transport: &http.Client{Transport: rt}}
+	opts := &container.ClientOptions{ClientOptions: clientOpts}
+
+	account := firstNonEmpty(q.Get("account"), os.Getenv("AZURE_STORAGE_ACCOUNT"))
+	if account == "" {
+		if conn := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); conn != "" {
+			client, err := container.NewClientFromConnectionString(conn, name, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create azure client: %w", err)
+			}
+			return &azureStore{client: client, container: name}, nil
+		}
+		return nil, fmt.Errorf("bucket %q is missing a storage account, set AZURE_STORAGE_ACCOUNT "+
+			"or the account query parameter", bucketURL)
+	}
+
+	endpoint := q.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	containerURL := strings.TrimSuffix(endpoint, "/") + "/" + url.PathEscape(name)
+
+	var client *container.Client
+	switch {
+	case os.Getenv("AZURE_STORAGE_KEY") != "":
+		cred, err := container.NewSharedKeyCredential(account, os.Getenv("AZURE_STORAGE_KEY"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse storage account key: %w", err)
+		}
+		client, err = container.NewClientWithSharedKeyCredential(containerURL, cred, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create azure client: %w", err)
+		}
+	case os.Getenv("AZURE_STORAGE_SAS_TOKEN") != "":
+		sas := strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+		client, err = container.NewClientWithNoCredential(containerURL+"?"+sas, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create azure client: %w", err)
+		}
+	default:
+		cred, err := azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+			ClientOptions: clientOpts,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to find azure credentials: %w", err)
+		}
+		client, err = container.NewClient(containerURL, cred, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create azure client: %w", err)
+		}
+	}
+
+	return &azureStore{
+		client:    client,
+		container: name,
+	}, nil
+}
+
+// checkGeneration returns an error if a specific generation was requested.
+func (s *azureStore) checkGeneration(generation int64) error {
+	if generation != 0 {
+		return fmt.Errorf("azure container %s does not support generations", s.container)
+	}
+	return nil
+}
+
+func (s *azureStore) Attrs(ctx context.Context, name string, generation int64) (*ObjectAttrs, error) {
+	if err := s.checkGeneration(generation); err != nil {
+		return nil, err
+	}
+
+	props, err := s.client.NewBlobClient(name).GetProperties(ctx, nil)
+	if err != nil {
+		return nil, azureError(err)
+	}
+
+	return &ObjectAttrs{
+		Bucket:          s.container,
+		Name:            name,
+		Size:            derefInt64(props.ContentLength),
+		ContentType:     derefString(props.ContentType),
+		CacheControl:    derefString(props.CacheControl),
+		ContentEncoding: derefString(props.ContentEncoding),
+		Updated:         derefTime(props.LastModified),
+		KMSKeyName:      derefString(props.EncryptionScope),
+		Metadata:        fromAzureMetadata(props.Metadata),
+	}, nil
+}
+
+func (s *azureStore) List(ctx context.Context, prefix string) ([]*ObjectAttrs, error) {
+	pager := s.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix:  &prefix,
+		Include: container.ListBlobsInclude{Metadata: true},
+	})
+
+	var list []*ObjectAttrs
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, azureError(err)
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			attrs := &ObjectAttrs{
+				Bucket:   s.container,
+				Name:     derefString(item.Name),
+				Metadata: fromAzureMetadata(item.Metadata),
+			}
+			if p := item.Properties; p != nil {
+				attrs.Size = derefInt64(p.ContentLength)
+				attrs.ContentType = derefString(p.ContentType)
+				attrs.CacheControl = derefString(p.CacheControl)
+				attrs.ContentEncoding = derefString(p.ContentEncoding)
+				attrs.Updated = derefTime(p.LastModified)
+				attrs.KMSKeyName = derefString(p.EncryptionScope)
+			}
+			list = append(list, attrs)
+		}
+	}
+	return list, nil
+}
+
+func (s *azureStore) NewReader(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	if err := s.checkGeneration(generation); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	// A count of zero reads to the end of the blob
+	var count int64
+	if length > 0 {
+		count = length
+	}
+
+	// Read the stored bytes, which are what the checksums describe, even if the
+	// blob has a content encoding
+	ctx = policy.WithHTTPHeader(ctx, http.Header{"Accept-Encoding": {"identity"}})
+
+	resp, err := s.client.NewBlobClient(name).DownloadStream(ctx, &blob.DownloadStreamOptions{
+		Range: blob.HTTPRange{Offset: offset, Count: count},
+	})
+	if err != nil {
+		return nil, azureError(err)
+	}
+	return resp.Body, nil
+}
+
+func (s *azureStore) NewWriter(ctx context.Context, name string, opts *WriterOptions) ObjectWriter {
+	blockSize := int64(defaultAzureBlockSize)
+	if opts.ChunkSize > 0 {
+		blockSize = int64(opts.ChunkSize)
+	}
+
+	uploadOpts := &blockblob.UploadStreamOptions{
+		BlockSize: blockSize,
+		HTTPHeaders: &blob.HTTPHeaders{
+			BlobContentType:     nonEmpty(opts.ContentType),
+			BlobCacheControl:    nonEmpty(opts.CacheControl),
+			BlobContentEncoding: nonEmpty(opts.ContentEncoding),
+		},
+		Metadata: azureMetadata(opts.Metadata),
+	}
+	if opts.DoesNotExist {
+		etag := azcore.ETagAny
+		uploadOpts.AccessConditions = &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: &etag},
+		}
+	}
+	if opts.KMSKeyName != "" {
+		uploadOpts.CPKScopeInfo = &blob.CPKScopeInfo{EncryptionScope: &opts.KMSKeyName}
+	}
+
+	pr, pw := io.Pipe()
+	w := &azureWriter{
+		s:         s,
+		name:      name,
+		opts:      opts,
+		ctx:       ctx,
+		blockSize: blockSize,
+		crc:       crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+		pw:        pw,
+		done:      make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+
+		resp, err := s.client.NewBlockBlobClient(name).UploadStream(ctx, pr, uploadOpts)
+		if err != nil {
+			w.err = azureError(err)
+			pr.CloseWithError(w.err)
+			return
+		}
+		pr.Close()
+		w.updated = derefTime(resp.LastModified)
+	}()
+
+	return w
+}
+
+func (s *azureStore) Update(ctx context.Context, name string, generation int64, metadata map[string]string) error {
+	if err := s.checkGeneration(generation); err != nil {
+		return err
+	}
+
+	client := s.client.NewBlobClient(name)
+	props, err := client.GetProperties(ctx, nil)
+	if err != nil {
+		return azureError(err)
+	}
+
+	// Setting metadata replaces all of it, so merge the changes into the
+	// current metadata, as long as the blob was not replaced in the meantime
+	md := fromAzureMetadata(props.Metadata)
+	if md == nil {
+		md = make(map[string]string, len(metadata))
+	}
+	for k, v := range metadata {
+		if v == "" {
+			delete(md, k)
+			continue
+		}
+		md[k] = v
+	}
+
+	if _, err := client.SetMetadata(ctx, azureMetadata(md), &blob.SetMetadataOptions{
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: props.ETag},
+		},
+	}); err != nil {
+		return azureError(err)
+	}
+	return nil
+}
+
+func (s *azureStore) Delete(ctx context.Context, name string, generation int64) error {
+	if err := s.checkGeneration(generation); err != nil {
+		return err
+	}
+
+	snapshots := blob.DeleteSnapshotsOptionTypeInclude
+	if _, err := s.client.NewBlobClient(name).Delete(ctx, &blob.DeleteOptions{
+		DeleteSnapshots: &snapshots,
+	}); err != nil {
+		return azureError(err)
+	}
+	return nil
+}
+
+// azureMetadata converts object metadata to blob metadata. Blob metadata keys
+// must be valid C# identifiers, so dashes are stored as underscores.
+func azureMetadata(md map[string]string) map[string]*string {
+	if len(md) == 0 {
+		return nil
+	}
+
+	out := make(map[string]*string, len(md))
+	for k, v := range md {
+		v := v
+		out[strings.ReplaceAll(k, "-", "_")] = &v
+	}
+	return out
+}
+
+// fromAzureMetadata converts blob metadata to object metadata. Keys are
+// case-insensitive, so they are always lowercase.
+func fromAzureMetadata(md map[string]*string) map[string]string {
+	if len(md) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(md))
+	for k, v := range md {
+		out[strings.ReplaceAll(strings.ToLower(k), "_", "-")] = derefString(v)
+	}
+	return out
+}
+
+// azureError converts Azure errors for missing blobs and failed conditions to
+// the errors returned by stores.
+func azureError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case bloberror.HasCode(err, bloberror.BlobNotFound):
+		return ErrObjectNotExist
+	case bloberror.HasCode(err, bloberror.ConditionNotMet, bloberror.BlobAlreadyExists):
+		return fmt.Errorf("%w: %v", ErrPreconditionFailed, err)
+	default:
+		return err
+	}
+}
+
+// azureWriter streams an object to Azure in blocks, which are committed once
+// the writer is closed.
+type azureWriter struct {
+	s         *azureStore
+	name      string
+	opts      *WriterOptions
+	ctx       context.Context
+	blockSize int64
+
+	crc      hash.Hash32
+	written  int64
+	reported int64
+
+	pw   *io.PipeWriter
+	done chan struct{}
+
+	// updated and err are the result of the upload.
+	updated time.Time
+	err     error
+}
+
+func (w *azureWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.crc.Write(p[:n])
+	w.written += int64(n)
+
+	if w.opts.ProgressFunc != nil && w.written-w.reported >= w.blockSize {
+		w.reported = w.written
+		w.opts.ProgressFunc(w.written)
+	}
+	return n, err
+}
+
+func (w *azureWriter) Close() error {
+	// Fail the upload instead of committing it if it was cancelled
+	if err := w.ctx.Err(); err != nil {
+		w.pw.CloseWithError(err)
+	} else {
+		w.pw.Close()
+	}
+	<-w.done
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.opts.SendCRC32C && w.opts.CRC32C != w.crc.Sum32() {
+		return fmt.Errorf("%s has CRC32C %08x, expected %08x", w.name, w.crc.Sum32(), w.opts.CRC32C)
+	}
+	if w.opts.ProgressFunc != nil {
+		w.opts.ProgressFunc(w.written)
+	}
+	return nil
+}
+
+func (w *azureWriter) Attrs() *ObjectAttrs {
+	if w.err != nil || w.updated.IsZero() {
+		return nil
+	}
+
+	return &ObjectAttrs{
+		Bucket:          w.s.container,
+		Name:            w.name,
+		Size:            w.written,
+		ContentType:     w.opts.ContentType,
+		CacheControl:    w.opts.CacheControl,
+		ContentEncoding: w.opts.ContentEncoding,
+		Updated:         w.updated,
+		KMSKeyName:      w.opts.KMSKeyName,
+		Metadata:        w.opts.Metadata,
+	}
+}
+
+// nonEmpty returns a pointer to the value, or nil if it is empty.
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func derefInt64(i *int64) int64 {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
+func derefTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
@@ -0,0 +1,305 @@
+package cacher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// fakeAzureBlob is a blob in a fakeAzure container.
+type fakeAzureBlob struct {
+	data     []byte
+	header   http.Header
+	modified time.Time
+}
+
+func (b *fakeAzureBlob) etag() string {
+	sum := md5.Sum(append(b.data, []byte(fmt.Sprint(b.header, b.modified.UnixNano()))...))
+	return `"0x` + fmt.Sprintf("%X", sum[:8]) + `"`
+}
+
+// fakeAzure serves the parts of the Blob Storage API which azureStore uses from
+// memory, for a single container.
+type fakeAzure struct {
+	t *testing.T
+
+	mu     sync.Mutex
+	blobs  map[string]*fakeAzureBlob
+	blocks map[string][]byte
+}
+
+// newFakeAzureStore returns a store for the container of a new fakeAzure,
+// which is accessed anonymously.
+func newFakeAzureStore(t *testing.T) (*fakeAzure, *azureStore) {
+	f := &fakeAzure{
+		t:      t,
+		blobs:  make(map[string]*fakeAzureBlob),
+		blocks: make(map[string][]byte),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	client, err := container.NewClientWithNoCredential(srv.URL+"/container", &container.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			Retry: policy.RetryOptions{MaxRetries: -1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, &azureStore{client: client, container: "container"}
+}
+
+func (f *fakeAzure) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("X-Ms-Error-Code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	q := r.URL.Query()
+	if parts[0] != "container" {
+		f.error(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method == http.MethodGet && q.Get("comp") == "list" {
+			f.list(w, q.Get("prefix"))
+			return
+		}
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	name := parts[1]
+
+	switch {
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		f.mu.Lock()
+		f.blocks[name+"/"+q.Get("blockid")] = data
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			f.error(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var data []byte
+		for _, id := range list.Latest {
+			block, ok := f.blocks[name+"/"+id]
+			if !ok {
+				f.error(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		f.put(w, r, name, data)
+
+	case r.Method == http.MethodPut && q.Get("comp") == "metadata":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		b, ok := f.blobs[name]
+		if !ok {
+			f.error(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if m := r.Header.Get("If-Match"); m != "" && m != b.etag() {
+			f.error(w, http.StatusPreconditionFailed, "ConditionNotMet")
+			return
+		}
+		header := make(http.Header)
+		for k, v := range b.header {
+			if !strings.HasPrefix(k, "X-Ms-Meta-") {
+				header[k] = v
+			}
+		}
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Ms-Meta-") {
+				header[k] = v
+			}
+		}
+		b = &fakeAzureBlob{data: b.data, header: header, modified: time.Now()}
+		f.blobs[name] = b
+		w.Header().Set("ETag", b.etag())
+
+	case r.Method == http.MethodPut && q.Get("comp") == "":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.put(w, r, name, data)
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		f.mu.Lock()
+		b, ok := f.blobs[name]
+		f.mu.Unlock()
+		if !ok {
+			f.error(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		for k, v := range b.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", b.etag())
+		w.Header().Set("X-Ms-Blob-Type", "BlockBlob")
+		if rng := r.Header.Get("X-Ms-Range"); rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		http.ServeContent(w, r, "", b.modified, bytes.NewReader(b.data))
+
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		_, ok := f.blobs[name]
+		delete(f.blobs, name)
+		f.mu.Unlock()
+		if !ok {
+			f.error(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// put creates the blob from the headers of the request, unless the request
+// has If-None-Match and the blob exists. The lock must be held.
+func (f *fakeAzure) put(w http.ResponseWriter, r *http.Request, name string, data []byte) {
+	if _, ok := f.blobs[name]; ok && r.Header.Get("If-None-Match") == "*" {
+		f.error(w, http.StatusConflict, "BlobAlreadyExists")
+		return
+	}
+
+	header := make(http.Header)
+	for k, v := range r.Header {
+		switch {
+		case strings.HasPrefix(k, "X-Ms-Meta-"):
+			header[k] = v
+		case strings.HasPrefix(k, "X-Ms-Blob-Content-"), k == "X-Ms-Blob-Cache-Control":
+			header[strings.TrimPrefix(k, "X-Ms-Blob-")] = v
+		}
+	}
+	b := &fakeAzureBlob{data: data, header: header, modified: time.Now()}
+	f.blobs[name] = b
+
+	w.Header().Set("ETag", b.etag())
+	w.Header().Set("Last-Modified", b.modified.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeAzure) list(w http.ResponseWriter, prefix string) {
+	type metadata struct {
+		Inner string `xml:",innerxml"`
+	}
+	type properties struct {
+		LastModified    string `xml:"Last-Modified"`
+		Etag            string `xml:"Etag"`
+		ContentLength   int64  `xml:"Content-Length"`
+		ContentType     string `xml:"Content-Type,omitempty"`
+		ContentEncoding string `xml:"Content-Encoding,omitempty"`
+		CacheControl    string `xml:"Cache-Control,omitempty"`
+		BlobType        string `xml:"BlobType"`
+	}
+	type item struct {
+		Name       string
+		Properties properties
+		Metadata   metadata
+	}
+	result := struct {
+		XMLName       xml.Name `xml:"EnumerationResults"`
+		ContainerName string   `xml:"ContainerName,attr"`
+		Prefix        string
+		Blobs         []item `xml:"Blobs>Blob"`
+		NextMarker    string
+	}{ContainerName: "container", Prefix: prefix}
+
+	f.mu.Lock()
+	for name, b := range f.blobs {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		var md strings.Builder
+		for k, v := range b.header {
+			if key := strings.TrimPrefix(k, "X-Ms-Meta-"); key != k {
+				md.WriteString("<" + key + ">")
+				xml.EscapeText(&md, []byte(v[0]))
+				md.WriteString("</" + key + ">")
+			}
+		}
+		result.Blobs = append(result.Blobs, item{
+			Name: name,
+			Properties: properties{
+				LastModified:    b.modified.UTC().Format(http.TimeFormat),
+				Etag:            b.etag(),
+				ContentLength:   int64(len(b.data)),
+				ContentType:     b.header.Get("Content-Type"),
+				ContentEncoding: b.header.Get("Content-Encoding"),
+				CacheControl:    b.header.Get("Cache-Control"),
+				BlobType:        "BlockBlob",
+			},
+			Metadata: metadata{Inner: md.String()},
+		})
+	}
+	f.mu.Unlock()
+	sort.Slice(result.Blobs, func(i, j int) bool { return result.Blobs[i].Name < result.Blobs[j].Name })
+
+	w.Header().Set("Content-Type", "application/xml")
+	if err := xml.NewEncoder(w).Encode(&result); err != nil {
+		f.t.Error(err)
+	}
+}
+
+func TestAzureStore(t *testing.T) {
+	t.Parallel()
+
+	testStorage(t, func(t *testing.T) Storage {
+		_, st := newFakeAzureStore(t)
+		return st
+	})
+}
+
+func TestAzureMetadata(t *testing.T) {
+	t.Parallel()
+
+	md := map[string]string{"gcs-cacher-sha256": "abc", "key": "value"}
+	if got := fromAzureMetadata(azureMetadata(md)); !reflect.DeepEqual(got, md) {
+		t.Errorf("expected %q to be %q", got, md)
+	}
+	if got := azureMetadata(md)["gcs_cacher_sha256"]; got == nil || *got != "abc" {
+		t.Errorf("expected dashes to be stored as underscores, got %v", got)
+	}
+}
@@ -0,0 +1,183 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// defaultBenchSampleSize is the default number of bytes of the archive which
+// are compressed by a benchmark.
+const defaultBenchSampleSize = 64 * 1024 * 1024
+
+// errSampleFull is returned by sampleWriter once it holds enough bytes.
+var errSampleFull = errors.New("sample is full")
+
+// benchLevels is the list of levels which are benchmarked for each
+// compression. Zero is the default level.
+var benchLevels = []struct {
+	compression Compression
+	levels      []int
+}{
+	{CompressionGzip, []int{1, 0, 9}},
+	{CompressionZstd, []int{1, 0, 7, 19}},
+	{CompressionLZ4, []int{0, 9}},
+}
+
+// BenchRequest is used as input to the Bench operation.
+type BenchRequest struct {
+	// Dir is the directory on disk to sample.
+	Dir string
+
+	// SampleSize is the number of bytes of the uncompressed archive to
+	// compress. The default is 64MiB.
+	SampleSize int64
+
+	// CompressionWorkers is the number of goroutines used to compress the
+	// sample. The default is the cacher's concurrency, or the number of
+	// available CPUs.
+	CompressionWorkers int
+
+	// Include, Exclude, and RespectGitignore select the files to sample, with
+	// the same rules as Save.
+	Include          []string
+	Exclude          []string
+	RespectGitignore bool
+}
+
+// BenchResult is the result of compressing the sample with a single
+// compression and level.
+type BenchResult struct {
+	Compression Compression
+
+	// Level is the compression level, or zero for the default level.
+	Level int
+
+	// InputSize and Size are the size of the sample before and after
+	// compression.
+	InputSize int64
+	Size      int64
+
+	// CompressTime and DecompressTime are how long compressing and
+	// decompressing the sample took.
+	CompressTime   time.Duration
+	DecompressTime time.Duration
+}
+
+// Ratio returns the compressed size as a fraction of the uncompressed size.
+func (r *BenchResult) Ratio() float64 {
+	if r.InputSize == 0 {
+		return 0
+	}
+	return float64(r.Size) / float64(r.InputSize)
+}
+
+// Bench archives a sample of the directory, like Save, and compresses it with
+// each compression at several levels, so the size of the archive can be
+// weighed against the time to save and restore it. Nothing is uploaded.
+func (c *Cacher) Bench(ctx context.Context, i *BenchRequest) ([]*BenchResult, error) {
+	if i == nil {
+		return nil, fmt.Errorf("missing bench options")
+	}
+	if i.Dir == "" {
+		return nil, fmt.Errorf("missing directory")
+	}
+
+	sampleSize := i.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = defaultBenchSampleSize
+	}
+
+	// Archive the directory until the sample is full
+	si := &SaveRequest{
+		Dir:              i.Dir,
+		Include:          i.Include,
+		Exclude:          i.Exclude,
+		RespectGitignore: i.RespectGitignore,
+		ExcludeSecrets:   true,
+	}
+	filter, err := newSaveFilter(si)
+	if err != nil {
+		return nil, err
+	}
+
+	sample := &sampleWriter{limit: sampleSize}
+	c.log("sampling %d bytes of %s", sampleSize, i.Dir)
+	if err := c.writeArchive(ctx, sample, si, filter, nil, CompressionNone, make(map[string]string), true); err != nil && !errors.Is(err, errSampleFull) {
+		return nil, fmt.Errorf("failed to sample directory: %w", err)
+	}
+	data := sample.buf.Bytes()
+
+	var results []*BenchResult
+	for _, b := range benchLevels {
+		for _, level := range b.levels {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			c.log("benchmarking %s at level %d", b.compression, level)
+			r, err := c.benchOne(data, b.compression, level, c.workers(i.CompressionWorkers))
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// benchOne compresses and decompresses the data with the compression.
+func (c *Cacher) benchOne(data []byte, compression Compression, level, workers int) (*BenchResult, error) {
+	var compressed bytes.Buffer
+	start := time.Now()
+	w, err := newCompressWriter(&compressed, compression, workers, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress with %s: %w", compression, err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress with %s: %w", compression, err)
+	}
+	compressTime := time.Since(start)
+
+	start = time.Now()
+	r, err := newDecompressReader(bytes.NewReader(compressed.Bytes()), compression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.copyBuffered(io.Discard, r); err != nil {
+		return nil, fmt.Errorf("failed to decompress with %s: %w", compression, err)
+	}
+	if err := r.Close(); err != nil {
+		return nil, fmt.Errorf("failed to decompress with %s: %w", compression, err)
+	}
+
+	return &BenchResult{
+		Compression:    compression,
+		Level:          level,
+		InputSize:      int64(len(data)),
+		Size:           int64(compressed.Len()),
+		CompressTime:   compressTime,
+		DecompressTime: time.Since(start),
+	}, nil
+}
+
+// sampleWriter keeps up to limit bytes, then fails so that writing stops.
+type sampleWriter struct {
+	buf   bytes.Buffer
+	limit int64
+}
+
+func (s *sampleWriter) Write(p []byte) (int, error) {
+	remaining := s.limit - int64(s.buf.Len())
+	if int64(len(p)) > remaining {
+		s.buf.Write(p[:remaining])
+		return int(remaining), errSampleFull
+	}
+	return s.buf.Write(p)
+}
@@ -0,0 +1,133 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/transport"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CreateBucketRequest is used as input to the CreateBucket operation.
+type CreateBucketRequest struct {
+	// Bucket is the name of the Cloud Storage bucket to create.
+	Bucket string
+
+	// Project is the project in which to create the bucket. The default is the
+	// project of the credentials.
+	Project string
+
+	// Location is the location of the bucket, like "us-central1" or "EU". The
+	// default is the "US" multi-region.
+	Location string
+
+	// StorageClass is the default storage class of the bucket, like "STANDARD"
+	// or "NEARLINE". The default is "STANDARD".
+	StorageClass string
+
+	// UniformAccess enables uniform bucket-level access, so access to the
+	// bucket is only controlled by IAM policies instead of object ACLs.
+	UniformAccess bool
+}
+
+// CreateBucket creates the bucket if it does not exist yet, so saving to a new
+// bucket does not fail on the first save. An existing bucket is left as-is,
+// even if its settings differ.
+func (c *Cacher) CreateBucket(ctx context.Context, i *CreateBucketRequest) (retErr error) {
+	if i == nil {
+		retErr = fmt.Errorf("missing bucket options")
+		return
+	}
+
+	bucket := i.Bucket
+	if bucket == "" {
+		retErr = fmt.Errorf("missing bucket")
+		return
+	}
+
+	st, err := c.bucket(ctx, bucket)
+	if err != nil {
+		retErr = err
+		return
+	}
+	gs, ok := st.(*gcsStore)
+	if !ok {
+		retErr = fmt.Errorf("creating buckets is only supported for Cloud Storage buckets")
+		return
+	}
+
+	if _, err := gs.bucket.Attrs(ctx); err == nil {
+		c.log("bucket %s already exists", bucket)
+		return
+	} else if !errors.Is(err, storage.ErrBucketNotExist) {
+		retErr = fmt.Errorf("failed to get bucket attributes: %w", err)
+		return
+	}
+
+	project := i.Project
+	if project == "" {
+		project, err = c.project(ctx)
+		if err != nil {
+			retErr = err
+			return
+		}
+		if project == "" {
+			retErr = fmt.Errorf("missing project in which to create bucket %s", bucket)
+			return
+		}
+	}
+
+	c.log("creating bucket %s in project %s", bucket, project)
+	if err := gs.bucket.Create(ctx, project, &storage.BucketAttrs{
+		Location:     i.Location,
+		StorageClass: i.StorageClass,
+		UniformBucketLevelAccess: storage.UniformBucketLevelAccess{
+			Enabled: i.UniformAccess,
+		},
+	}); err != nil {
+		// Another build may have created the bucket in the meantime
+		if isConflict(err) {
+			c.log("bucket %s was created by another build", bucket)
+			return
+		}
+		retErr = fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+		return
+	}
+	return
+}
+
+// project returns the project of the credentials used to authenticate to
+// Google Cloud, or an empty string if it cannot be determined.
+func (c *Cacher) project(ctx context.Context) (string, error) {
+	// Unauthenticated requests and emulators have no credentials
+	if c.noAuth || os.Getenv("STORAGE_EMULATOR_HOST") != "" || os.Getenv("STORAGE_EMULATOR_HOST_GRPC") != "" {
+		return "", nil
+	}
+
+	creds, err := transport.Creds(ctx, c.opts...)
+	if err != nil {
+		return "", fmt.Errorf("failed to find credentials: %w", err)
+	}
+	return creds.ProjectID, nil
+}
+
+// isConflict returns true if the Cloud Storage error is because the resource
+// already exists.
+func isConflict(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusConflict
+	}
+
+	// Errors from the gRPC API have a status instead
+	if s, ok := status.FromError(err); ok {
+		return s.Code() == codes.AlreadyExists
+	}
+	return false
+}
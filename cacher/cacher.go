@@ -4,46 +4,237 @@ package cacher
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"golang.org/x/crypto/blake2b"
-	"google.golang.org/api/iterator"
+	"google.golang.org/api/impersonate"
 	"google.golang.org/api/option"
 )
 
 const (
-	contentType  = "application/gzip"
-	cacheControl = "public,max-age=3600"
+	// defaultCacheControl is the default Cache-Control of cached objects.
+	defaultCacheControl = "public,max-age=3600"
+
+	// defaultChunkSize is the default size of each request in a resumable
+	// upload.
+	defaultChunkSize = 128_000_000
+
+	// cleanupTimeout limits how long cleaning up after an operation may take,
+	// which happens even if the operation was cancelled.
+	cleanupTimeout = 30 * time.Second
+
+	// maxConcurrentLookups is the maximum number of restore keys which are
+	// searched at once.
+	maxConcurrentLookups = 16
+
+	// cloudPlatformScope is the OAuth scope for Google Cloud APIs.
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	// reservedMetadataPrefix is the prefix of the metadata keys which the
+	// cacher records, which cannot be set by requests.
+	reservedMetadataPrefix = "gcs-cacher-"
 )
 
+// ErrCacheMiss is returned when no cached object matches the restore keys.
+var ErrCacheMiss = errors.New("cache miss")
+
 // Cacher is responsible for saving and restoring caches.
 type Cacher struct {
-	client *storage.Client
+	// client is the storage client, which is created on first use with
+	// clientCtx. Buckets which are not in Cloud Storage never need it.
+	client     *storage.Client
+	clientCtx  context.Context
+	clientOnce sync.Once
+	clientErr  error
+	grpc       bool
+
+	// endpoint is the Cloud Storage endpoint, or empty for the default.
+	endpoint string
+
+	// billingProject is billed for Cloud Storage requests, if set.
+	billingProject string
+
+	// hmacAccessID and hmacSecret are the HMAC key with which Cloud Storage
+	// buckets are accessed through the XML API, if set.
+	hmacAccessID string
+	hmacSecret   string
+
+	// impersonate is the service account which is impersonated, if any.
+	// accessToken is set if requests use an access token of an unknown
+	// principal instead, and noAuth if they are not authenticated.
+	impersonate string
+	accessToken bool
+	noAuth      bool
+
+	// transport sends HTTP requests through a proxy or with additional trusted
+	// certificates, or is nil to use the default transport.
+	transport *http.Transport
+
+	// storageFunc opens buckets instead of the built-in storage, if set.
+	storageFunc StorageFunc
+
+	// opts are the options used to create the storage client, which are reused
+	// for other Google Cloud clients.
+	opts []option.ClientOption
 
 	debug bool
+
+	// concurrency is the default number of goroutines for parallel work.
+	concurrency int
+
+	// bufferSize is the size of the copy buffers, which are pooled in buffers.
+	bufferSize int
+	buffers    sync.Pool
+
+	// memoryLimit is the approximate maximum number of bytes used for buffers,
+	// or zero for no limit.
+	memoryLimit int64
+
+	// hashCache is the file in which hashes of files are cached, or empty to
+	// always hash files.
+	hashCache string
 }
 
 // New creates a new cacher capable of saving and restoring the cache.
-func New(ctx context.Context) (*Cacher, error) {
-	client, err := storage.NewClient(ctx,
-		option.WithUserAgent("gcs-cacher/1.0"))
+func New(ctx context.Context, options ...Option) (*Cacher, error) {
+	var s settings
+	for _, o := range options {
+		o(&s)
+	}
+
+	if len(s.credentials) > 1 {
+		return nil, fmt.Errorf("%s cannot be used together", strings.Join(s.credentials, " and "))
+	}
+	if s.noAuth && s.impersonate != "" {
+		return nil, fmt.Errorf("impersonation cannot be used without authentication")
+	}
+
+	opts := append([]option.ClientOption{
+		option.WithUserAgent("gcs-cacher/1.0"),
+	}, s.opts...)
+
+	if s.externalAccount != nil {
+		if err := checkExternalAccount(s.externalAccount); err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithCredentialsJSON(s.externalAccount))
+	}
+
+	var endpoint string
+	if s.endpoint != "" {
+		var err error
+		endpoint, err = storageEndpoint(s.endpoint, s.grpc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	transport, err := newTransport(s.proxy, s.caCerts, s.googleAccess)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create storage client: %w", err)
+		return nil, err
+	}
+	if transport != nil && s.grpc {
+		return nil, fmt.Errorf("a proxy, CA certificates, or private google access cannot be used with gRPC")
+	}
+
+	if s.hmacAccessID != "" || s.hmacSecret != "" {
+		if s.hmacAccessID == "" || s.hmacSecret == "" {
+			return nil, fmt.Errorf("an HMAC key needs both an access ID and a secret")
+		}
+		if s.grpc {
+			return nil, fmt.Errorf("an HMAC key cannot be used with gRPC")
+		}
+		if s.billingProject != "" {
+			return nil, fmt.Errorf("an HMAC key cannot be used with a billing project")
+		}
+	}
+
+	c := &Cacher{
+		clientCtx:      ctx,
+		grpc:           s.grpc,
+		endpoint:       endpoint,
+		billingProject: s.billingProject,
+		hmacAccessID:   s.hmacAccessID,
+		hmacSecret:     s.hmacSecret,
+		impersonate:    s.impersonate,
+		accessToken:    s.accessToken,
+		noAuth:         s.noAuth,
+		transport:      transport,
+		storageFunc:    s.storageFunc,
+		opts:           opts,
+	}
+
+	// Tokens for the service account are generated with the other credentials,
+	// which clients use instead
+	if s.impersonate != "" {
+		base, err := c.googleOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: s.impersonate,
+			Delegates:       s.delegates,
+			Scopes:          []string{cloudPlatformScope},
+		}, base...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to impersonate %s: %w", s.impersonate, err)
+		}
+		c.opts = []option.ClientOption{
+			option.WithUserAgent("gcs-cacher/1.0"),
+			option.WithTokenSource(ts),
+		}
 	}
+	return c, nil
+}
+
+// storageClient returns the storage client, creating it on first use.
+func (c *Cacher) storageClient() (*storage.Client, error) {
+	c.clientOnce.Do(func() {
+		newClient := storage.NewClient
+		if c.grpc {
+			newClient = storage.NewGRPCClient
+		}
+		opts, err := c.googleOptions(c.clientCtx)
+		if err != nil {
+			c.clientErr = err
+			return
+		}
 
-	return &Cacher{
-		client: client,
-	}, nil
+		// The endpoint only applies to Cloud Storage, not to other Google
+		// Cloud clients
+		if c.endpoint != "" {
+			opts = append(opts[:len(opts):len(opts)], option.WithEndpoint(c.endpoint))
+		}
+
+		client, err := newClient(c.clientCtx, opts...)
+		if err != nil {
+			c.clientErr = fmt.Errorf("failed to create storage client: %w", err)
+			return
+		}
+		c.client = client
+	})
+	return c.client, c.clientErr
 }
 
 // Debug enables or disables debugging for the cacher.
@@ -51,16 +242,274 @@ func (c *Cacher) Debug(val bool) {
 	c.debug = val
 }
 
+// Concurrency sets the default number of goroutines used for work which can be
+// done in parallel, like compression, parallel uploads and downloads, and
+// extraction, when a request does not set it. If n is less than one, compression uses all
+// available CPUs and objects are transferred as a single stream.
+func (c *Cacher) Concurrency(n int) {
+	c.concurrency = n
+}
+
+// withTimeout returns a context which is cancelled after the timeout, if it is
+// positive.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// workers returns n if it is set, or the default concurrency otherwise.
+func (c *Cacher) workers(n int) int {
+	if n > 0 {
+		return n
+	}
+	return c.concurrency
+}
+
 // SaveRequest is used as input to the Save operation.
 type SaveRequest struct {
 	// Bucket is the name of the bucket from which to cache.
 	Bucket string
 
+	// Replicas is the list of other buckets to which the cache is also saved,
+	// like buckets in other regions, so builds can restore from a nearby
+	// bucket. The archive is built once into a local temporary file and
+	// uploaded to each bucket, which is skipped or replaced independently.
+	Replicas []string
+
 	// Key is the cache key.
 	Key string
 
 	// Dir is the directory on disk to cache.
 	Dir string
+
+	// Compression is the compression to use for the archive. The default is
+	// gzip.
+	Compression Compression
+
+	// CompressionWorkers is the number of goroutines used to compress the
+	// archive. The default is the cacher's concurrency, or the number of
+	// available CPUs.
+	CompressionWorkers int
+
+	// CompressionLevel is the compression level, using the numbers of the
+	// gzip (1-9), zstd (1-22), and lz4 (1-9) command line tools. The default of
+	// zero uses the default level of the compression.
+	CompressionLevel int
+
+	// Format is the archive format. The default is tar. The zip format does not
+	// support the Compression option.
+	Format Format
+
+	// Index writes an index of the archive entries, which allows restoring a
+	// subset of paths with ranged reads instead of downloading the entire
+	// archive. It is only supported for the tar format with gzip, zstd, or no
+	// compression.
+	Index bool
+
+	// ExternalCompressor pipes the archive through an external compression
+	// binary (pigz, zstd, or lz4) if one is installed, falling back to the
+	// native implementation otherwise. It is ignored when Index or
+	// StoreIncompressible is set.
+	ExternalCompressor bool
+
+	// StoreIncompressible stores files which are already compressed, like jars,
+	// images, and wheels, without compressing them again. Files are detected by
+	// their extension or the entropy of their contents. It is only supported
+	// with gzip or zstd compression, or the zip format.
+	StoreIncompressible bool
+
+	// Xattrs records extended attributes, including POSIX ACLs on Linux, in the
+	// archive. It is only supported on Linux and macOS with the tar format.
+	Xattrs bool
+
+	// Sparse writes files with holes, like VM images and preallocated
+	// databases, as sparse entries which only store the blocks with data. It is
+	// only supported on Linux and macOS with the tar format, and is ignored when
+	// Index is set.
+	Sparse bool
+
+	// Dereference follows symlinks and archives the files and directories they
+	// point to instead of skipping them. Symlinks which point to one of their
+	// parent directories are skipped.
+	Dereference bool
+
+	// Normalization is the Unicode normalization applied to file names in the
+	// archive. The default is to store names as-is.
+	Normalization Normalization
+
+	// Strict fails the save if the directory contains files which cannot be
+	// archived, like sockets, named pipes, devices, and (unless Dereference is
+	// set) symlinks. By default, they are skipped and counted in a warning.
+	Strict bool
+
+	// WarnSkipped logs a warning for each file which is skipped, in addition to
+	// the summary.
+	WarnSkipped bool
+
+	// Prefix is a directory within the archive under which entries are stored,
+	// like "gomod". This lets multiple logical caches share one object, which
+	// can be restored separately with RestoreRequest.Subpath.
+	Prefix string
+
+	// OneFileSystem does not descend into directories on other file systems,
+	// like bind mounts or network mounts, when walking Dir. Mount points are
+	// archived as empty directories. This has no effect on Windows.
+	OneFileSystem bool
+
+	// RespectGitignore skips paths which git would ignore, according to the
+	// .gitignore files in Dir and its subdirectories and .git/info/exclude,
+	// and the .git directories themselves.
+	RespectGitignore bool
+
+	// EncryptionKey encrypts the archive client-side with AES-256-GCM before it
+	// is uploaded, so its contents are opaque even to bucket administrators.
+	// It must be 32 bytes. The same key is required to restore the cache.
+	EncryptionKey []byte
+
+	// KMSKey is the name of the Cloud KMS key used to encrypt the archive and
+	// its companion objects, like
+	// "projects/p/locations/l/keyRings/r/cryptoKeys/k". The Cloud Storage
+	// service agent must be able to use the key. The default is the bucket's
+	// default encryption.
+	KMSKey string
+
+	// SigningKey signs the key and SHA256 digest of the archive, so restores
+	// can verify it was created for the key by a trusted writer. It is either a
+	// Cloud KMS asymmetric key version, like
+	// "gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1",
+	// or the path to a PEM-encoded ECDSA, RSA, or Ed25519 private key. The
+	// archive is spooled to a temporary file to sign it before it is uploaded.
+	SigningKey string
+
+	// Provenance records how the cache was built as a SLSA provenance
+	// attestation stored alongside the archive. If SigningKey is set, the
+	// attestation is also signed.
+	Provenance *Provenance
+
+	// Manifest uploads a manifest of the size and SHA256 digest of each file
+	// alongside the archive, which can be used to verify restored files.
+	Manifest bool
+
+	// Metadata is custom metadata for the cached object, like the commit,
+	// branch, or build which created it, so caches can be audited and filtered
+	// later. Keys starting with "gcs-cacher-" are reserved.
+	Metadata map[string]string
+
+	// ContentType is the content type of the cached object. The default
+	// depends on the format and compression, like "application/gzip".
+	ContentType string
+
+	// CacheControl is the Cache-Control of the cached object and its companion
+	// objects. The default is "public,max-age=3600", which lets shared caches
+	// like CDNs store them, so private caches should use "private" or
+	// "no-store".
+	CacheControl string
+
+	// ContentEncoding is the Content-Encoding of the cached object. The only
+	// supported encoding is "gzip", which requires gzip compression and the
+	// tar format, and cannot be used with EncryptionKey. The content type then
+	// defaults to "application/x-tar", and "no-transform" is added to the
+	// Cache-Control so Cloud Storage and CDNs always serve the stored bytes
+	// instead of decompressing them.
+	ContentEncoding string
+
+	// Secrets is the list of patterns for paths which likely contain secrets,
+	// like "*.pem" or "id_rsa", using gitignore syntax. If a path to be
+	// archived matches, the save fails before anything is uploaded unless
+	// ExcludeSecrets is set. DefaultSecretPatterns is a reasonable default.
+	Secrets []string
+
+	// ExcludeSecrets leaves paths which match Secrets out of the archive with a
+	// warning instead of failing the save.
+	ExcludeSecrets bool
+
+	// TemporaryHold and EventBasedHold place holds on the cached object once it
+	// is saved, so it cannot be deleted or replaced, even by Force or Update,
+	// until the holds are released with Release. When an event-based hold is
+	// released, the bucket's retention period starts. Holds are only
+	// supported for Cloud Storage buckets.
+	TemporaryHold  bool
+	EventBasedHold bool
+
+	// Force replaces the cached object if it already exists, even if the
+	// contents did not change. By default, an existing object is never
+	// replaced, and if another save creates it first the upload is discarded.
+	// Objects are only replaced if no other save replaced them first.
+	Force bool
+
+	// ChunkSize is the number of bytes buffered and sent in each request of
+	// the resumable upload. Larger chunks improve throughput for large caches at
+	// the cost of memory. The default is 128MB.
+	ChunkSize int
+
+	// DisableBuffering uploads the archive in a single request without
+	// buffering, which has less latency for small caches, but the upload
+	// cannot be retried if it fails.
+	DisableBuffering bool
+
+	// ParallelUploads uploads archives larger than PartSize as parts, with up
+	// to this many parts in flight at once, and composes them into the cached
+	// object. Each part in flight is buffered in memory. The default is the
+	// cacher's concurrency, or to upload the archive as a single stream.
+	ParallelUploads int
+
+	// PartSize is the size of each part when ParallelUploads or StateFile is
+	// set. The default is 64MiB.
+	PartSize int
+
+	// StateFile is the path to a local file which records the parts of the
+	// archive which were uploaded. If the save is interrupted, for example
+	// because the builder was preempted, saving again with the same state file
+	// only uploads the parts which were not uploaded yet, as long as the
+	// archive is identical. Archives larger than PartSize are uploaded as parts,
+	// even if ParallelUploads is not set. It cannot be used with EncryptionKey,
+	// since encrypted archives differ on every attempt.
+	StateFile string
+
+	// LookupTimeout limits how long checking for an existing object may take.
+	// TransferTimeout limits how long creating and uploading the archive may
+	// take. The default is no limit other than the context.
+	LookupTimeout   time.Duration
+	TransferTimeout time.Duration
+
+	// Lock acquires a lock on the key before uploading, so only one of many
+	// parallel saves uploads the object and the others skip it. The lock is
+	// stored alongside the cache and released once the save completes. It is
+	// not supported for storage which cannot create objects atomically, like
+	// registries and buckets accessed with HMAC keys.
+	Lock bool
+
+	// LockTTL is how long the lock is held if it is never released, for
+	// example because the builder was terminated. The default is one hour.
+	LockTTL time.Duration
+
+	// Update replaces the cached object if it already exists and the contents
+	// of Dir have changed. The archive is built once to compute its digest, and
+	// only uploaded if it differs from the digest recorded by the previous
+	// save. By default, existing objects are never replaced.
+	Update bool
+
+	// Include is the list of glob patterns for paths to archive, like "**/*.o".
+	// If set, only matching paths and the contents of matching directories are
+	// archived. Patterns use the same syntax as Exclude, and Exclude takes
+	// precedence.
+	Include []string
+
+	// Exclude is the list of glob patterns for paths to leave out of the
+	// archive, like "**/*.log". Patterns are matched against slash-separated
+	// paths relative to Dir and support "**" to match any number of
+	// directories. Excluding a directory excludes everything inside it.
+	//
+	// Paths listed in a .gcscacherignore file at the root of Dir, using
+	// gitignore syntax, are also excluded.
+	Exclude []string
+
+	// Marker is the path of the marker file written by restores with
+	// RestoreRequest.Marker, relative to Dir. It is left out of the archive,
+	// since it describes the cache which was restored, not the one saved.
+	Marker string
 }
 
 // Save caches the given directory in storage.
@@ -82,250 +531,1922 @@ func (c *Cacher) Save(ctx context.Context, i *SaveRequest) (retErr error) {
 		return
 	}
 
-	key := i.Key
-	if key == "" {
-		retErr = fmt.Errorf("missing key")
-		return
+	key := i.Key
+	if key == "" {
+		retErr = fmt.Errorf("missing key")
+		return
+	}
+
+	compression := i.Compression
+	contentType := compression.contentType()
+	if i.Format == FormatZip {
+		if compression != "" && compression != CompressionNone {
+			retErr = fmt.Errorf("compression %q is not supported with the zip format", compression)
+			return
+		}
+		compression = CompressionNone
+		contentType = zipContentType
+	}
+
+	headers := &objectHeaders{
+		contentType:  contentType,
+		cacheControl: defaultCacheControl,
+	}
+	switch i.ContentEncoding {
+	case "":
+	case "gzip":
+		if compression != "" && compression != CompressionGzip {
+			retErr = fmt.Errorf("content encoding gzip is not supported with %s compression", compression)
+			return
+		}
+		if i.Format == FormatZip {
+			retErr = fmt.Errorf("content encoding gzip is not supported with the zip format")
+			return
+		}
+		if i.EncryptionKey != nil {
+			retErr = fmt.Errorf("content encoding gzip is not supported with an encryption key")
+			return
+		}
+		headers.contentType = CompressionNone.contentType()
+		headers.contentEncoding = i.ContentEncoding
+	default:
+		retErr = fmt.Errorf("unsupported content encoding %q, expected gzip", i.ContentEncoding)
+		return
+	}
+	if i.ContentType != "" {
+		headers.contentType = i.ContentType
+	}
+	if i.CacheControl != "" {
+		headers.cacheControl = i.CacheControl
+	}
+	if headers.contentEncoding != "" && !hasDirective(headers.cacheControl, "no-transform") {
+		headers.cacheControl += ",no-transform"
+	}
+
+	if err := compression.checkLevel(i.CompressionLevel); err != nil {
+		retErr = err
+		return
+	}
+
+	filter, err := newSaveFilter(i)
+	if err != nil {
+		retErr = err
+		return
+	}
+
+	for k := range i.Metadata {
+		if k == "" {
+			retErr = fmt.Errorf("missing metadata key")
+			return
+		}
+		if strings.HasPrefix(strings.ToLower(k), reservedMetadataPrefix) {
+			retErr = fmt.Errorf("metadata key %q is reserved", k)
+			return
+		}
+	}
+
+	if i.Index {
+		if i.Format == FormatZip {
+			retErr = fmt.Errorf("indexing is not supported with the zip format")
+			return
+		}
+		if !compression.segmentable() {
+			retErr = fmt.Errorf("indexing is not supported with %s compression", compression)
+			return
+		}
+		if i.EncryptionKey != nil {
+			retErr = fmt.Errorf("indexing is not supported with client-side encryption")
+			return
+		}
+	}
+
+	// Encrypted archives differ on every attempt, so uploaded parts could never
+	// be reused
+	if i.StateFile != "" && i.EncryptionKey != nil {
+		retErr = fmt.Errorf("a state file cannot be used with client-side encryption")
+		return
+	}
+
+	if len(i.Replicas) == 0 {
+		retErr = c.saveTo(ctx, bucket, i, filter, compression, headers, nil)
+		return
+	}
+
+	for _, replica := range i.Replicas {
+		if replica == "" {
+			retErr = fmt.Errorf("missing replica bucket")
+			return
+		}
+	}
+	if i.StateFile != "" {
+		retErr = fmt.Errorf("a state file cannot be used with replicas")
+		return
+	}
+
+	// Build the archive once for every bucket, and keep saving to the other
+	// buckets if one fails
+	spool := new(archiveSpool)
+	defer func() {
+		if err := spool.Close(); err != nil {
+			c.warn("%s", err)
+		}
+	}()
+
+	var failed []string
+	for _, b := range append([]string{bucket}, i.Replicas...) {
+		c.log("saving to bucket %s", displayBucket(b))
+		if err := c.saveTo(ctx, b, i, filter, compression, headers, spool); err != nil {
+			if spool.err != nil {
+				retErr = err
+				return
+			}
+			c.warn("failed to save to %s: %s", displayBucket(b), err)
+			failed = append(failed, displayBucket(b))
+		}
+	}
+	if len(failed) > 0 {
+		retErr = fmt.Errorf("failed to save to buckets %q", failed)
+	}
+	return
+}
+
+// saveTo saves the cache to the bucket. If spool is not nil, the archive is
+// built into it the first time it is needed and uploaded from it.
+func (c *Cacher) saveTo(ctx context.Context, bucket string, i *SaveRequest, filter *pathFilter, compression Compression, headers *objectHeaders, spool *archiveSpool) (retErr error) {
+	key := i.Key
+
+	// Check if the object already exists. If it already exists, we do not want to
+	// waste time overwriting the cache. The upload is also conditional on the
+	// generation which was checked, since another build may create or replace
+	// the object in the meantime.
+	st, err := c.bucket(ctx, bucket)
+	if err != nil {
+		retErr = err
+		return
+	}
+	if hs, ok := st.(*httpStore); ok {
+		retErr = fmt.Errorf("cannot save to http bucket %s, it is read-only", hs.bucket)
+		return
+	}
+	gs, isGCS := st.(*gcsStore)
+	if (i.TemporaryHold || i.EventBasedHold) && !isGCS {
+		retErr = fmt.Errorf("holds are only supported for Cloud Storage buckets")
+		return
+	}
+	_, presigned := st.(*presignedStore)
+	switch {
+	case presigned && (i.EncryptionKey != nil || i.SigningKey != ""):
+		retErr = fmt.Errorf("client-side encryption and signing are not supported with signed urls, which cannot record metadata")
+		return
+	case presigned && (i.Lock || i.Manifest || i.Provenance != nil):
+		retErr = fmt.Errorf("locks, manifests, and provenance are not supported with signed urls, which only hold the cache")
+		return
+	case presigned && (i.Force || i.Update):
+		retErr = fmt.Errorf("force and update are not supported with signed urls, which cannot replace the cache conditionally")
+		return
+	case i.Lock && !createsAtomically(st):
+		retErr = fmt.Errorf("locks are not supported for bucket %s, which cannot create objects atomically", displayBucket(bucket))
+		return
+	}
+	lookupCtx, cancel := withTimeout(ctx, i.LookupTimeout)
+	defer cancel()
+	attrs, err := st.Attrs(lookupCtx, key, 0)
+	if err != nil && !errors.Is(err, ErrObjectNotExist) {
+		retErr = fmt.Errorf("failed to check if cached object exists: %w", err)
+		return
+	}
+	cond := &WriterOptions{DoesNotExist: true}
+	switch {
+	case attrs == nil:
+		// The object does not exist yet
+	case (i.Force || i.Update) && (attrs.TemporaryHold || attrs.EventBasedHold):
+		c.warn("cached object is held and cannot be replaced, skipping")
+		return
+	case i.Force:
+		c.log("cached object already exists, replacing")
+		cond = &WriterOptions{GenerationMatch: attrs.Generation}
+	case !i.Update:
+		c.log("cached object already exists, skipping")
+		return
+	default:
+		// Only replace the object if the contents changed, which is much
+		// cheaper than uploading it again
+		digest, err := c.saveDigest(ctx, i, spool)
+		if err != nil {
+			retErr = err
+			return
+		}
+		if attrs.Metadata[contentDigestMetadataKey] == digest {
+			c.log("cached object is unchanged, skipping")
+			return
+		}
+
+		c.log("cached object has changed, replacing")
+		cond = &WriterOptions{GenerationMatch: attrs.Generation}
+	}
+
+	// Only one save uploads the object at a time, the others skip it
+	if i.Lock {
+		release, ok, err := c.acquireLock(ctx, st, key, i.LockTTL)
+		if err != nil {
+			retErr = err
+			return
+		}
+		if !ok {
+			c.log("another save holds the lock, skipping")
+			return
+		}
+		defer release()
+	}
+
+	// Signed archives are spooled, so the signature is written with the object
+	// and restores which verify it never see the object unsigned
+	var sgn signer
+	if i.SigningKey != "" {
+		sgn, err = c.newSigner(ctx, i.SigningKey)
+		if err != nil {
+			retErr = err
+			return
+		}
+
+		if spool == nil {
+			spool = new(archiveSpool)
+			defer func() {
+				if err := spool.Close(); err != nil {
+					c.warn("%s", err)
+				}
+			}()
+		}
+	}
+
+	var m *manifest
+	if i.Manifest {
+		m = new(manifest)
+	}
+
+	// Record who created the cache, so restores can require a trusted creator.
+	// Only Cloud Storage authenticates as a Google Cloud principal.
+	var creator string
+	if isGCS {
+		creator, err = c.identity(ctx)
+		if err != nil {
+			c.warn("failed to determine the creator of the cache: %s", err)
+		}
+	}
+
+	// Upload the archive. The metadata of a spooled archive is known before the
+	// upload, so it is written with the object.
+	transferCtx, cancel := withTimeout(ctx, i.TransferTimeout)
+	defer cancel()
+	written := make(map[string]string)
+	if creator != "" {
+		written[creatorMetadataKey] = creator
+	}
+	if spool != nil {
+		if err := spool.build(transferCtx, c, i, compression); err != nil {
+			retErr = err
+			return
+		}
+		m = spool.manifest
+		for k, v := range spool.metadata {
+			written[k] = v
+		}
+	}
+	if sgn != nil {
+		digest, err := hex.DecodeString(written[sha256MetadataKey])
+		if err != nil {
+			retErr = fmt.Errorf("failed to decode archive digest: %w", err)
+			return
+		}
+
+		c.log("signing archive")
+		sig, err := sgn.sign(ctx, signedDigest(key, digest))
+		if err != nil {
+			retErr = err
+			return
+		}
+		written[signatureMetadataKey] = base64.StdEncoding.EncodeToString(sig)
+	}
+	exists := attrs != nil
+	attrs, metadata, err := c.upload(transferCtx, st, key, cond, i, filter, m, spool, compression, headers, written)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			if !exists {
+				c.log("cached object was created by another save, skipping")
+				return
+			}
+			c.warn("cached object was replaced by another save, skipping")
+			return
+		}
+		retErr = err
+		return
+	}
+
+	// Record any metadata which is only known after the upload completes.
+	// Signed URLs only allow writing the object, so restores rely on the
+	// checksums of the storage instead.
+	pending := make(map[string]string)
+	for k, v := range metadata {
+		if written[k] != v {
+			pending[k] = v
+		}
+	}
+	if len(pending) > 0 && !presigned {
+		c.log("updating object metadata")
+		if err := st.Update(ctx, key, attrs.Generation, pending); err != nil {
+			retErr = fmt.Errorf("failed to update object metadata: %w", err)
+			return
+		}
+	}
+
+	// Holds are placed once the object is complete, so a corrupt upload can
+	// still be removed
+	if i.TemporaryHold || i.EventBasedHold {
+		c.log("placing holds on object")
+		if err := gs.setHolds(ctx, key, attrs.Generation, i.TemporaryHold, i.EventBasedHold); err != nil {
+			retErr = fmt.Errorf("failed to place holds on object: %w", err)
+			return
+		}
+	}
+
+	if i.Provenance != nil {
+		if err := c.writeProvenance(ctx, st, bucket, key, i.KMSKey, headers.cacheControl, metadata[sha256MetadataKey], i.Provenance, sgn); err != nil {
+			retErr = err
+			return
+		}
+	}
+
+	if m != nil {
+		m.Generation = attrs.Generation
+		if err := c.writeManifest(ctx, st, key, i.KMSKey, headers.cacheControl, m); err != nil {
+			retErr = err
+			return
+		}
+	}
+
+	return
+}
+
+// objectHeaders are the HTTP headers of the cached object.
+type objectHeaders struct {
+	contentType     string
+	cacheControl    string
+	contentEncoding string
+}
+
+// hasDirective returns true if the Cache-Control has the directive.
+func hasDirective(cacheControl, directive string) bool {
+	for _, d := range strings.Split(cacheControl, ",") {
+		if strings.EqualFold(strings.TrimSpace(d), directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// saveDigest returns the content digest of the archive for the request,
+// reusing the digest of the spooled archive if it was already built.
+func (c *Cacher) saveDigest(ctx context.Context, i *SaveRequest, spool *archiveSpool) (string, error) {
+	if spool != nil && spool.f != nil {
+		return spool.metadata[contentDigestMetadataKey], nil
+	}
+
+	c.log("computing digest of the archive contents")
+	return c.contentDigest(ctx, i)
+}
+
+// isPreconditionFailed returns true if the error is because the preconditions
+// for a request were not met.
+func isPreconditionFailed(err error) bool {
+	return errors.Is(err, ErrPreconditionFailed) || isGCSPreconditionFailed(err)
+}
+
+// upload writes the archive for the request to the object, with the
+// preconditions for the write in cond and the metadata in written. If spool is
+// not nil, the archive is copied from it instead of being built. It returns the
+// attributes of the created object and any metadata which should be added to
+// the object after the upload.
+func (c *Cacher) upload(ctx context.Context, st Storage, key string, cond *WriterOptions, i *SaveRequest, filter *pathFilter, m *manifest, spool *archiveSpool, compression Compression, headers *objectHeaders, written map[string]string) (attrs *ObjectAttrs, metadata map[string]string, retErr error) {
+	metadata = make(map[string]string)
+
+	// Create the storage writer. Cancelling its context aborts the upload, so
+	// a failed save does not leave a partial object behind.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress := func(soFar int64) {
+		c.log("uploaded %d bytes", soFar)
+	}
+
+	// Encrypted archives are marked when they are written, so restores never
+	// see one without the marker
+	objectMetadata := i.Metadata
+	if i.EncryptionKey != nil || len(written) > 0 {
+		objectMetadata = make(map[string]string, len(i.Metadata)+len(written)+1)
+		for k, v := range i.Metadata {
+			objectMetadata[k] = v
+		}
+		for k, v := range written {
+			objectMetadata[k] = v
+		}
+		if i.EncryptionKey != nil {
+			objectMetadata[encryptionMetadataKey] = encryptionAlgorithm
+		}
+	}
+
+	// Large archives can be uploaded to Cloud Storage as parts in parallel,
+	// which are composed into the object. Uploading parts also allows resuming
+	// the upload.
+	gs, composable := st.(*gcsStore)
+	var gcsw ObjectWriter
+	if parallel := c.workers(i.ParallelUploads); composable && (parallel > 1 || i.StateFile != "") {
+		// Upload fewer or smaller parts to stay within the memory limit. One more
+		// part is buffered while the others are uploaded.
+		partSize := int64(i.PartSize)
+		if partSize <= 0 {
+			partSize = defaultPartSize
+		}
+		parallel = fit(parallel, partSize, c.transferMemory())
+		partSize = shrink(partSize, parallel+1, c.transferMemory())
+
+		handle := gs.conditional(key, cond.DoesNotExist, cond.GenerationMatch)
+		cw, err := c.newCompositeWriter(wctx, gs.bucket, handle, parallel, int(partSize), i.StateFile)
+		if err != nil {
+			retErr = err
+			return
+		}
+		cw.attrs.ContentType = headers.contentType
+		cw.attrs.CacheControl = headers.cacheControl
+		cw.attrs.ContentEncoding = headers.contentEncoding
+		cw.attrs.KMSKeyName = i.KMSKey
+		cw.attrs.Metadata = objectMetadata
+		cw.attrs.CustomTime = time.Now().UTC()
+		cw.progress = progress
+		gcsw = cw
+	} else {
+		chunkSize := defaultChunkSize
+		if i.ChunkSize > 0 {
+			chunkSize = i.ChunkSize
+		}
+		chunkSize = int(shrink(int64(chunkSize), 1, c.transferMemory()))
+		if i.DisableBuffering {
+			chunkSize = -1
+		}
+		gcsw = st.NewWriter(wctx, key, &WriterOptions{
+			DoesNotExist:    cond.DoesNotExist,
+			GenerationMatch: cond.GenerationMatch,
+			ContentType:     headers.contentType,
+			CacheControl:    headers.cacheControl,
+			ContentEncoding: headers.contentEncoding,
+			KMSKeyName:      i.KMSKey,
+			Metadata:        objectMetadata,
+			CustomTime:      time.Now().UTC(),
+			ChunkSize:       chunkSize,
+			ProgressFunc:    progress,
+		})
+	}
+
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	digest := sha256.New()
+	defer func() {
+		if retErr != nil {
+			c.log("aborting storage writer")
+
+			// Parts are only kept to resume the upload if the save was interrupted
+			if cw, ok := gcsw.(*compositeWriter); ok {
+				cw.setError(retErr)
+			}
+			cancel()
+			_ = gcsw.Close()
+			return
+		}
+
+		c.log("closing storage writer")
+		if cerr := gcsw.Close(); cerr != nil {
+			retErr = fmt.Errorf("failed to close storage writer: %w", cerr)
+			return
+		}
+		attrs = gcsw.Attrs()
+
+		// Verify the object matches what was written, and remove it if not so
+		// it is not restored later
+		if attrs.HasCRC32C && attrs.CRC32C != crc.Sum32() {
+			retErr = fmt.Errorf("uploaded object has CRC32C %08x, expected %08x", attrs.CRC32C, crc.Sum32())
+			if err := st.Delete(ctx, key, attrs.Generation); err != nil {
+				retErr = fmt.Errorf("%v: failed to delete corrupt object: %w", retErr, err)
+			}
+			return
+		}
+		metadata[sha256MetadataKey] = hex.EncodeToString(digest.Sum(nil))
+	}()
+	out := io.MultiWriter(gcsw, crc, digest)
+
+	if spool != nil {
+		retErr = spool.copyTo(out, metadata)
+		return
+	}
+	retErr = c.writeEncryptedArchive(ctx, out, i, filter, m, compression, metadata)
+	return
+}
+
+// writeEncryptedArchive writes the archive for the request to out, encrypting
+// it if the request has an encryption key, and records its metadata.
+func (c *Cacher) writeEncryptedArchive(ctx context.Context, out io.Writer, i *SaveRequest, filter *pathFilter, m *manifest, compression Compression, metadata map[string]string) (retErr error) {
+	// Encrypt the compressed archive
+	var archiveOut io.Writer = out
+	if i.EncryptionKey != nil {
+		ew, err := newEncryptWriter(out, i.EncryptionKey)
+		if err != nil {
+			retErr = err
+			return
+		}
+		defer func() {
+			c.log("closing encryption writer")
+			if cerr := ew.Close(); cerr != nil {
+				if retErr != nil {
+					retErr = fmt.Errorf("%v: failed to close encryption writer: %w", retErr, cerr)
+					return
+				}
+				retErr = fmt.Errorf("failed to close encryption writer: %w", cerr)
+			}
+		}()
+		archiveOut = ew
+	}
+
+	if err := c.writeArchive(ctx, archiveOut, i, filter, m, compression, metadata, false); err != nil {
+		retErr = err
+		return
+	}
+
+	return
+}
+
+// writeArchive writes the archive for the request to out, recording the index
+// offset and content digest in metadata. If quiet is set, warnings are only
+// logged in debug mode.
+func (c *Cacher) writeArchive(ctx context.Context, out io.Writer, i *SaveRequest, filter *pathFilter, m *manifest, compression Compression, metadata map[string]string, quiet bool) (retErr error) {
+	dir := i.Dir
+	warn := c.warn
+	if quiet {
+		warn = c.log
+	}
+
+	// Create the compression writer. When indexing, each entry is compressed
+	// independently so it can be read on its own. Incompressible files are
+	// stored in their own uncompressed segments.
+	storeIncompressible := i.StoreIncompressible && i.Format != FormatZip && compression.storable()
+	var cw io.WriteCloser
+	var sw *segmentWriter
+	if i.Index || storeIncompressible {
+		w, err := newSegmentWriter(out, compression, c.workers(i.CompressionWorkers), i.CompressionLevel)
+		if err != nil {
+			retErr = err
+			return
+		}
+		cw, sw = w, w
+	} else {
+		if i.ExternalCompressor {
+			w, ok, err := newExternalCompressWriter(ctx, out, compression, c.workers(i.CompressionWorkers), i.CompressionLevel)
+			if err != nil {
+				retErr = err
+				return
+			}
+			if ok {
+				c.log("using external compressor")
+				cw = w
+			}
+		}
+
+		if cw == nil {
+			w, err := newCompressWriter(out, compression, c.workers(i.CompressionWorkers), i.CompressionLevel)
+			if err != nil {
+				retErr = err
+				return
+			}
+			cw = w
+		}
+	}
+	var index *archiveIndex
+	if i.Index {
+		index = &archiveIndex{Compression: compression}
+	}
+	defer func() {
+		c.log("closing compression writer")
+		if cerr := cw.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: failed to close compression writer: %w", retErr, cerr)
+				return
+			}
+			retErr = fmt.Errorf("failed to close compression writer: %w", cerr)
+			return
+		}
+
+		// The index is the last segment, so it is complete once the
+		// compression writer is closed
+		if retErr == nil && index != nil {
+			metadata[indexChecksumMetadataKey] = fmt.Sprintf("%08x", sw.Checksum())
+		}
+	}()
+
+	// Create the archive writer
+	// The digest of the uncompressed archive is recorded, so later saves can
+	// tell whether the contents changed without downloading the object
+	content := sha256.New()
+	aw := io.MultiWriter(cw, content)
+	var tw archiveWriter = newTarArchiveWriter(aw)
+	if i.Format == FormatZip {
+		tw = newZipArchiveWriter(aw)
+	}
+	defer func() {
+		c.log("closing archive writer")
+		if cerr := tw.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: failed to close archive writer: %w", retErr, cerr)
+				return
+			}
+			retErr = fmt.Errorf("failed to close archive writer: %w", cerr)
+			return
+		}
+		if retErr == nil {
+			metadata[contentDigestMetadataKey] = hex.EncodeToString(content.Sum(nil))
+		}
+	}()
+
+	// links maps files with multiple hard links to the name of the first entry
+	// written for them. Zip files cannot represent hard links.
+	links := make(map[fileID]string)
+	detectLinks := i.Format != FormatZip
+
+	skipped := make(skippedFiles)
+
+	// Walk all files create tar
+	prefix := strings.Trim(path.Clean("/"+i.Prefix), "/")
+	w := &walker{c: c, dereference: i.Dereference, oneFileSystem: i.OneFileSystem}
+
+	// Files are walked and read ahead of the archive writer, so reading small
+	// files overlaps with compressing the previous ones
+	entries := make(chan *archiveEntry, fit(prefetchEntries, maxBufferedFile, c.fileMemory()))
+	done := make(chan struct{})
+	walkErr := make(chan error, 1)
+	go func() {
+		defer close(entries)
+		walkErr <- w.walk(dir, func(name, rel string, f os.FileInfo) error {
+			// Stop promptly if the save is cancelled
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			// The root directory itself is not part of the archive
+			if rel == "" {
+				if i.RespectGitignore {
+					if err := filter.addIgnoreFile(filepath.Join(name, ".git", "info", "exclude"), ""); err != nil {
+						return err
+					}
+					return filter.addIgnoreFile(filepath.Join(name, ".gitignore"), "")
+				}
+				return nil
+			}
+
+			// Git never tracks its own directory, or the .git files which point
+			// worktrees and submodules to theirs
+			excluded := filter.excluded(rel, f.IsDir())
+			if i.RespectGitignore && path.Base(rel) == ".git" {
+				excluded = true
+			}
+			if excluded {
+				c.log("excluding %s", name)
+				if f.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			// Rules in a directory's .gitignore apply to everything below it
+			if i.RespectGitignore && f.IsDir() {
+				if err := filter.addIgnoreFile(filepath.Join(name, ".gitignore"), rel); err != nil {
+					return err
+				}
+			}
+
+			if !filter.included(rel) {
+				c.log("not including %s", name)
+				return nil
+			}
+
+			if filter.secret(rel, f.IsDir()) {
+				if !i.ExcludeSecrets {
+					return fmt.Errorf("refusing to cache %s, which may contain secrets", name)
+				}
+
+				warn("excluding %s, which may contain secrets", name)
+				if f.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !f.IsDir() && !f.Mode().IsRegular() {
+				kind := specialFileType(f.Mode())
+				if i.Strict {
+					return fmt.Errorf("cannot archive %s (%s)", name, kind)
+				}
+
+				if i.WarnSkipped {
+					warn("skipping %s (%s)", name, kind)
+				} else {
+					c.log("skipping %s (%s)", name, kind)
+				}
+				skipped[kind]++
+				return nil
+			}
+
+			// Create the tar header
+			header, err := tar.FileInfoHeader(f, f.Name())
+			if err != nil {
+				return fmt.Errorf("failed to create tar header for %s: %w", f.Name(), err)
+			}
+			header.Name = i.Normalization.apply(path.Join(prefix, rel))
+			if f.IsDir() {
+				header.Name += "/"
+			}
+
+			// Access and change times are not restored, and would make the archive
+			// differ every time the files are read
+			header.AccessTime = time.Time{}
+			header.ChangeTime = time.Time{}
+
+			// Store subsequent hard links to the same file as links instead of
+			// duplicating the content
+			if id, ok := hardLinkID(f); ok && detectLinks && f.Mode().IsRegular() {
+				if first, ok := links[id]; ok {
+					c.log("file %s is a hard link to %s", name, first)
+					header.Typeflag = tar.TypeLink
+					header.Linkname = first
+					header.Size = 0
+				} else {
+					links[id] = header.Name
+				}
+			}
+
+			// Always use PAX headers. Otherwise the tar writer picks the format based
+			// on the header contents and drops sub-second modification times.
+			header.Format = tar.FormatPAX
+
+			// Record extended attributes as PAX records
+			if i.Xattrs && i.Format != FormatZip {
+				c.log("reading extended attributes for %s", name)
+				attrs, err := readXattrs(name)
+				if err != nil {
+					return fmt.Errorf("failed to read extended attributes for %s: %w", name, err)
+				}
+				for k, v := range attrs {
+					if header.PAXRecords == nil {
+						header.PAXRecords = make(map[string]string)
+					}
+					header.PAXRecords[paxXattrPrefix+k] = v
+				}
+			}
+
+			entry := &archiveEntry{name: name, header: header}
+			if header.Typeflag == tar.TypeReg && header.Size <= maxBufferedFile {
+				c.log("reading %s", name)
+				data, err := os.ReadFile(longPath(name))
+				if err != nil {
+					return fmt.Errorf("failed to read %s: %w", name, err)
+				}
+				entry.data = data
+				entry.buffered = true
+			}
+
+			// Check whether large files are already compressed
+			if i.StoreIncompressible && header.Typeflag == tar.TypeReg && header.Size >= minStoredSize {
+				sample := entry.data
+				if !entry.buffered {
+					sample, err = sampleFile(name, entropySampleSize)
+					if err != nil {
+						return err
+					}
+				} else if len(sample) > entropySampleSize {
+					sample = sample[:entropySampleSize]
+				}
+
+				if incompressible(name, sample) {
+					c.log("storing %s without compression", name)
+					entry.store = true
+				}
+			}
+
+			// Only large files are worth checking for holes
+			entry.sparse = i.Sparse && i.Format != FormatZip && !i.Index && !entry.buffered && !entry.store &&
+				header.Typeflag == tar.TypeReg
+
+			select {
+			case entries <- entry:
+				return nil
+			case <-done:
+				return errWriterStopped
+			}
+		})
+	}()
+
+	// Write the entries to the archive. If writing fails, stop the walk and
+	// wait for it to exit.
+	if err := func() error {
+		for entry := range entries {
+			if err := c.writeEntry(tw, sw, index, m, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}(); err != nil {
+		close(done)
+		for range entries {
+		}
+		<-walkErr
+		retErr = fmt.Errorf("failed to walk files: %w", err)
+		return
+	}
+	if err := <-walkErr; err != nil {
+		retErr = fmt.Errorf("failed to walk files: %w", err)
+		return
+	}
+
+	if len(skipped) > 0 {
+		warn("skipped files which cannot be archived: %s", skipped)
+	}
+
+	// Write the index after the end of the archive
+	if index != nil {
+		c.log("writing archive index")
+		if err := tw.Close(); err != nil {
+			retErr = fmt.Errorf("failed to close archive writer: %w", err)
+			return
+		}
+
+		offset, err := index.write(sw)
+		if err != nil {
+			retErr = err
+			return
+		}
+		metadata[indexOffsetMetadataKey] = strconv.FormatInt(offset, 10)
+	}
+
+	return
+}
+
+// writeFile copies the contents of the file at name into w.
+func (c *Cacher) writeFile(w io.Writer, name string) error {
+	c.log("opening %s", name)
+	file, err := os.Open(longPath(name))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", name, err)
+	}
+
+	c.log("copying %s to tar", name)
+	if _, err := c.copyBuffered(w, file); err != nil {
+		if cerr := file.Close(); cerr != nil {
+			return fmt.Errorf("failed to close %s: %v: failed to write tar: %w", name, cerr, err)
+		}
+		return fmt.Errorf("failed to write tar for %s: %w", name, err)
+	}
+
+	// Close tar
+	c.log("closing %s", name)
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close: %w", err)
+	}
+	return nil
+}
+
+// RestoreRequest is used as input to the Restore operation.
+type RestoreRequest struct {
+	// Bucket is the name of the bucket from which to cache. It can also be an
+	// https:// URL, like a CDN in front of a public bucket, from which objects
+	// are read without credentials. Objects cannot be listed over HTTP, so
+	// keys only match objects named exactly after them.
+	Bucket string
+
+	// Fallbacks is the ordered list of other buckets which are searched if no
+	// object in Bucket matches the keys, like a global bucket after a regional
+	// one. The cache is restored from the first bucket with a match.
+	Fallbacks []string
+
+	// Keys is the ordered list of keys to restore. If an object is named
+	// exactly after the first key, it is restored. Otherwise each key is a
+	// prefix, and by default the most recently updated object whose name starts
+	// with any key is restored. If the object was deleted or is corrupt, the
+	// best match for the next key is tried, but other errors, like failing to
+	// write the files, fail the restore. Files from the failed attempt are only
+	// removed if Clean is set.
+	Keys []string
+
+	// Generation restores a specific generation of the object named by the
+	// only key, instead of searching. Older generations are only available in
+	// buckets with object versioning enabled.
+	Generation int64
+
+	// FirstMatch searches the keys strictly in the order given. The most
+	// recently updated object matching the first key with any matches is
+	// restored, so an exact key takes precedence over broader fallbacks.
+	FirstMatch bool
+
+	// Dir is the directory on disk to cache.
+	Dir string
+
+	// Compression is the compression that was used to create the archive. If
+	// empty, the compression is detected from the archive's magic bytes and
+	// content type.
+	Compression Compression
+
+	// Format is the format of the archive. If empty, the format is detected from
+	// the archive's magic bytes and content type.
+	Format Format
+
+	// Paths is the list of files or directories within the archive to restore.
+	// If empty, the entire archive is restored. If the archive was saved with
+	// an index, only the matching entries are downloaded. Otherwise the entire
+	// archive is downloaded and only the matching entries are extracted.
+	Paths []string
+
+	// Subpath is a directory within the archive to restore, like
+	// "pkg/mod/cache/download". Only entries inside it are extracted, and they
+	// are written relative to Dir.
+	Subpath string
+
+	// StripComponents is the number of leading path components to remove from
+	// each entry name, after applying Subpath. Entries with fewer components
+	// are not extracted.
+	StripComponents int
+
+	// Mappings maps directories within the archive to directories on disk,
+	// like "gomod" to "/go/pkg/mod". The entries inside each directory are
+	// extracted to the mapped directory instead of Dir, after applying Subpath
+	// and StripComponents. Other entries are extracted to Dir.
+	Mappings map[string]string
+
+	// Clean removes the contents of Dir and any mapped directories before
+	// extracting, so stale files from previous builds are not mixed with the
+	// restored cache. The directories are only cleaned once a matching cache
+	// is found.
+	Clean bool
+
+	// SkipIfPresent skips the restore if the cache is already on disk. If
+	// Marker is empty, the cache is considered present when Dir is not empty.
+	// Otherwise it is present when the marker file records the object which
+	// would be restored.
+	SkipIfPresent bool
+
+	// Marker is the path of a file, relative to Dir, which records the object
+	// that was restored. It is written after each successful restore.
+	Marker string
+
+	// ExternalCompressor pipes the archive through an external decompression
+	// binary (pigz, zstd, or lz4) if one is installed, falling back to the
+	// native implementation otherwise.
+	ExternalCompressor bool
+
+	// PreserveOwner restores the uid and gid recorded in the archive. It only
+	// takes effect when running as root, since other users cannot change the
+	// ownership of files.
+	PreserveOwner bool
+
+	// Xattrs restores extended attributes recorded in the archive. Some
+	// attributes, like security.capability, can only be set by root.
+	Xattrs bool
+
+	// Sparse writes blocks of zeros as holes instead of allocating them on disk,
+	// which keeps sparse files like VM images and preallocated databases from
+	// inflating to their full size. Sparse entries, written by saves with
+	// Sparse or by other tools, are also restored sparsely.
+	Sparse bool
+
+	// DryRun lists the entries which would be extracted, their sizes, and the
+	// targets of links instead of writing anything to disk. If the archive has
+	// an index, only the index is downloaded. Entries are written to
+	// DryRunOutput, which defaults to stdout.
+	DryRun       bool
+	DryRunOutput io.Writer
+
+	// DisableTouch does not update the custom time of the restored object. By
+	// default, restoring a cache from Cloud Storage sets its custom time to the
+	// current day, at most once a day, so lifecycle rules based on the days
+	// since the custom time only delete caches which are no longer restored.
+	// Touching requires permission to update objects.
+	DisableTouch bool
+
+	// TrustedCreators is the list of principals, like service account emails,
+	// which are allowed to have created the restored archive. The creator is
+	// recorded by Save in the object metadata, so this should be combined with
+	// IAM policies or VerifyKey to prevent writers from forging it.
+	TrustedCreators []string
+
+	// RequireKMSKey refuses to restore archives which are not encrypted with
+	// the Cloud KMS key, like "projects/p/locations/l/keyRings/r/cryptoKeys/k".
+	// Any version of the key is accepted.
+	RequireKMSKey string
+
+	// EncryptionKey decrypts archives which were encrypted client-side when
+	// they were saved. Archives which are not encrypted are rejected, so they
+	// cannot be swapped in for encrypted ones.
+	EncryptionKey []byte
+
+	// VerifyKey requires the archive to be signed by the key, which is either a
+	// Cloud KMS asymmetric key version prefixed with "gcpkms://" or the path to
+	// a PEM-encoded public key. The archive is downloaded and verified before
+	// anything is extracted, so ranged reads from an index are not used.
+	VerifyKey string
+
+	// RequireProvenance rejects archives without a provenance attestation for
+	// their key and the digest of the downloaded archive. The attestation must
+	// be signed by VerifyKey, which is required, since anyone who can write to
+	// the bucket could write an unsigned one. If ProvenanceBuilderID is set,
+	// the attestation must name that builder.
+	RequireProvenance   bool
+	ProvenanceBuilderID string
+
+	// VerifyManifest checks each restored file against the manifest uploaded
+	// with the archive, and fails the restore if any do not match or files in
+	// the manifest which the restore selects are missing. The archive must have
+	// been saved with a manifest.
+	VerifyManifest bool
+
+	// ExtractWorkers is the number of goroutines which write small files in
+	// the background while the archive is read, which is much faster for
+	// archives with many small files. The default is the cacher's concurrency,
+	// or to write files as they are read.
+	ExtractWorkers int
+
+	// LookupTimeout limits how long finding the object to restore may take.
+	// TransferTimeout limits how long downloading and extracting the archive
+	// may take, including any fallbacks. The default is no limit other than the
+	// context.
+	LookupTimeout   time.Duration
+	TransferTimeout time.Duration
+
+	// ParallelDownloads downloads archives larger than SliceSize as byte
+	// ranges, with up to this many ranges in flight at once. Each range in
+	// flight is buffered in memory. The default is the cacher's concurrency,
+	// or to download the archive as a single stream.
+	ParallelDownloads int
+
+	// SliceSize is the size of each range when ParallelDownloads is set. The
+	// default is 64MiB.
+	SliceSize int64
+
+	// MaxBytes and MaxFiles limit the total size of the extracted files and the
+	// number of extracted entries, so a corrupt or malicious archive cannot
+	// fill the disk. The restore fails if a limit is exceeded. They are
+	// unlimited if zero.
+	MaxBytes int64
+	MaxFiles int64
+
+	// Umask is the set of permission bits removed from each restored file and
+	// directory, like 022.
+	Umask os.FileMode
+
+	// FileMode and DirMode replace the permissions recorded in the archive for
+	// files and directories, which is useful when the archive was created in
+	// an environment with different users. They are ignored if zero. Umask is
+	// still applied.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// Normalization is the Unicode normalization applied to file names when
+	// they are written to disk. The default is to use names as-is.
+	Normalization Normalization
+
+	// CaseCollisions is the action taken when the archive contains names which
+	// differ only in case and the target directory is on a case-insensitive
+	// filesystem, like the defaults on macOS and Windows. The default is to
+	// fail the restore.
+	CaseCollisions CaseCollisions
+}
+
+// findCandidates finds the objects to restore, in order of preference. An
+// object named exactly after the first key is always preferred. Otherwise the
+// newest item with each of the provided key fallbacks as a prefix is a
+// candidate, ordered by when it was updated. If firstMatch is true, the
+// candidates are in the order of the keys instead. It returns ErrCacheMiss if
+// there are no matching objects.
+func (c *Cacher) findCandidates(ctx context.Context, st Storage, keys []string, firstMatch bool) ([]*ObjectAttrs, error) {
+	// Check for the exact match and search each key at the same time, so many
+	// fallback keys do not mean as many round trips in a row. The results are
+	// combined in the order of the keys.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var exact *ObjectAttrs
+	matches := make([]*ObjectAttrs, len(keys))
+
+	var once sync.Once
+	var lookupErr error
+	fail := func(err error) {
+		once.Do(func() {
+			lookupErr = err
+			cancel()
+		})
+	}
+
+	sem := make(chan struct{}, maxConcurrentLookups)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sem <- struct{}{}
+		defer func() { <-sem }()
+
+		c.log("checking for object %s", keys[0])
+		attrs, err := st.Attrs(ctx, keys[0], 0)
+		if err != nil && !errors.Is(err, ErrObjectNotExist) {
+			fail(fmt.Errorf("failed to check %s: %w", keys[0], err))
+			return
+		}
+		exact = attrs
+	}()
+	for idx, key := range keys {
+		wg.Add(1)
+		go func(idx int, key string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			match, err := c.newestObject(ctx, st, key)
+			if err != nil {
+				fail(err)
+				return
+			}
+			matches[idx] = match
+		}(idx, key)
+	}
+	wg.Wait()
+
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+
+	var candidates []*ObjectAttrs
+	seen := make(map[string]struct{})
+
+	// An object named exactly after the primary key is always restored first,
+	// even if a fallback matches a newer object.
+	if exact != nil {
+		c.log("found exact match %s", exact.Name)
+		candidates = append(candidates, exact)
+		seen[exact.Name] = struct{}{}
+	}
+
+	var fallbacks []*ObjectAttrs
+	for _, match := range matches {
+		if match == nil {
+			continue
+		}
+		if _, ok := seen[match.Name]; ok {
+			continue
+		}
+		seen[match.Name] = struct{}{}
+		fallbacks = append(fallbacks, match)
+	}
+
+	if !firstMatch {
+		sort.SliceStable(fallbacks, func(i, j int) bool {
+			return fallbacks[i].Updated.After(fallbacks[j].Updated)
+		})
+	}
+	candidates = append(candidates, fallbacks...)
+
+	// Ensure we found one
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("failed to find cached objects among keys %q: %w", keys, ErrCacheMiss)
+	}
+	return candidates, nil
+}
+
+// newestObject returns the most recently updated object whose name starts with
+// the key, or nil if there is none.
+func (c *Cacher) newestObject(ctx context.Context, st Storage, key string) (*ObjectAttrs, error) {
+	c.log("searching for objects with prefix %s", key)
+
+	list, err := st.List(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", key, err)
+	}
+
+	var match *ObjectAttrs
+	for _, attrs := range list {
+		if strings.HasPrefix(attrs.Name, companionPrefix) {
+			continue
+		}
+
+		c.log("found object %s", attrs.Name)
+
+		if match == nil || attrs.Updated.After(match.Updated) {
+			c.log("setting %s as best candidate for %s", attrs.Name, key)
+			match = attrs
+		}
+	}
+	if match == nil {
+		return nil, nil
+	}
+
+	// Listings do not include every attribute in all stores
+	attrs, err := st.Attrs(ctx, match.Name, match.Generation)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotExist) {
+			c.log("%s was removed while searching", match.Name)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get attributes of %s: %w", match.Name, err)
+	}
+	return attrs, nil
+}
+
+// LookupRequest is used as input to the lookup method.
+type LookupRequest struct {
+	// Bucket is the name of the bucket to search.
+	Bucket string
+
+	// Fallbacks is the ordered list of other buckets to search, like Restore.
+	Fallbacks []string
+
+	// Keys is the ordered list of keys to search, using the same rules as
+	// Restore.
+	Keys []string
+
+	// FirstMatch searches the keys strictly in order, like Restore.
+	FirstMatch bool
+}
+
+// Lookup returns the name of the object which Restore would restore, without
+// downloading it. It returns ErrCacheMiss if no object matches the keys.
+func (c *Cacher) Lookup(ctx context.Context, i *LookupRequest) (string, error) {
+	if i == nil {
+		return "", fmt.Errorf("missing lookup options")
+	}
+
+	bucket := i.Bucket
+	if bucket == "" {
+		return "", fmt.Errorf("missing bucket")
+	}
+
+	keys := i.Keys
+	if len(keys) < 1 {
+		return "", fmt.Errorf("expected at least one cache key")
+	}
+
+	_, candidates, err := c.searchBuckets(ctx, append([]string{bucket}, i.Fallbacks...), keys, i.FirstMatch)
+	if err != nil {
+		return "", err
+	}
+	return candidates[0].Name, nil
+}
+
+// searchBuckets finds the objects to restore in the first of the buckets with
+// a match, and returns its storage and the candidates in order of preference.
+// Buckets which cannot be searched are skipped with a warning, and the error is
+// returned if no other bucket matches.
+func (c *Cacher) searchBuckets(ctx context.Context, buckets []string, keys []string, firstMatch bool) (Storage, []*ObjectAttrs, error) {
+	var missErr, searchErr error
+	shown := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		if bucket == "" {
+			return nil, nil, fmt.Errorf("missing fallback bucket")
+		}
+		shown = append(shown, displayBucket(bucket))
+
+		st, err := c.bucket(ctx, bucket)
+		if err == nil {
+			var candidates []*ObjectAttrs
+			if candidates, err = c.findCandidates(ctx, st, keys, firstMatch); err == nil {
+				if len(buckets) > 1 {
+					c.log("found a match in bucket %s", displayBucket(bucket))
+				}
+				return st, candidates, nil
+			}
+		}
+
+		switch {
+		case len(buckets) == 1:
+			return nil, nil, err
+		case errors.Is(err, ErrCacheMiss):
+			c.log("no match in bucket %s", displayBucket(bucket))
+			missErr = err
+		default:
+			c.warn("failed to search bucket %s: %s", displayBucket(bucket), err)
+			if searchErr == nil {
+				searchErr = fmt.Errorf("failed to search bucket %s: %w", displayBucket(bucket), err)
+			}
+		}
+	}
+
+	if searchErr != nil {
+		return nil, nil, searchErr
+	}
+	return nil, nil, fmt.Errorf("no match in buckets %q: %w", shown, missErr)
+}
+
+// Restore restores the key from the cache into the dir on disk.
+func (c *Cacher) Restore(ctx context.Context, i *RestoreRequest) (retErr error) {
+	if i == nil {
+		retErr = fmt.Errorf("missing cache options")
+		return
+	}
+
+	bucket := i.Bucket
+	if bucket == "" {
+		retErr = fmt.Errorf("missing bucket")
+		return
+	}
+
+	dir := i.Dir
+	if dir == "" {
+		retErr = fmt.Errorf("missing directory")
+		return
+	}
+
+	keys := i.Keys
+	if len(keys) < 1 {
+		retErr = fmt.Errorf("expected at least one cache key")
+		return
+	}
+
+	if i.StripComponents < 0 {
+		retErr = fmt.Errorf("strip components must be positive")
+		return
+	}
+
+	if i.RequireProvenance && i.VerifyKey == "" {
+		retErr = fmt.Errorf("requiring provenance requires a verify key")
+		return
+	}
+
+	mappings := make([]*dirMapping, 0, len(i.Mappings))
+	for prefix, d := range i.Mappings {
+		prefix = strings.Trim(path.Clean("/"+prefix), "/")
+		if prefix == "" {
+			retErr = fmt.Errorf("missing prefix for directory %s", d)
+			return
+		}
+		if d == "" {
+			retErr = fmt.Errorf("missing directory for prefix %s", prefix)
+			return
+		}
+		mappings = append(mappings, &dirMapping{prefix: prefix, dir: d})
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return len(mappings[i].prefix) > len(mappings[j].prefix)
+	})
+
+	// Skip before searching if any contents are good enough
+	if i.SkipIfPresent && i.Marker == "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			retErr = fmt.Errorf("failed to read target directory: %w", err)
+			return
+		}
+		if len(entries) > 0 {
+			c.log("target directory is not empty, skipping")
+			return
+		}
+	}
+
+	// Finding the object and restoring it have separate deadlines
+	lookupCtx, cancel := withTimeout(ctx, i.LookupTimeout)
+	defer cancel()
+
+	var st Storage
+	var candidates []*ObjectAttrs
+	var err error
+	if i.Generation != 0 {
+		if len(keys) > 1 {
+			retErr = fmt.Errorf("restoring a generation requires exactly one key")
+			return
+		}
+		if len(i.Fallbacks) > 0 {
+			retErr = fmt.Errorf("restoring a generation cannot use fallback buckets")
+			return
+		}
+
+		// Get the store for the bucket
+		st, err = c.bucket(ctx, bucket)
+		if err != nil {
+			retErr = err
+			return
+		}
+
+		c.log("restoring generation %d of %s", i.Generation, keys[0])
+		attrs, err := st.Attrs(lookupCtx, keys[0], i.Generation)
+		if err != nil {
+			if errors.Is(err, ErrObjectNotExist) {
+				retErr = fmt.Errorf("failed to find generation %d of %s: %w", i.Generation, keys[0], ErrCacheMiss)
+				return
+			}
+			retErr = fmt.Errorf("failed to get generation %d of %s: %w", i.Generation, keys[0], err)
+			return
+		}
+		candidates = append(candidates, attrs)
+	} else {
+		st, candidates, err = c.searchBuckets(lookupCtx, append([]string{bucket}, i.Fallbacks...), keys, i.FirstMatch)
+		if err != nil {
+			retErr = err
+			return
+		}
+	}
+
+	var v verifier
+	if i.VerifyKey != "" {
+		v, err = c.newVerifier(ctx, i.VerifyKey)
+		if err != nil {
+			retErr = err
+			return
+		}
+	}
+
+	transferCtx, cancel := withTimeout(ctx, i.TransferTimeout)
+	defer cancel()
+
+	// Fall back to the next candidate if the object was deleted or is corrupt,
+	// like a truncated upload. Other errors, like a full disk, would fail the
+	// same way for every candidate.
+	for n, match := range candidates {
+		err := c.restoreObject(transferCtx, st, match, i, mappings, v)
+		if err == nil {
+			if !i.DryRun && !i.DisableTouch {
+				c.touch(ctx, st, match)
+			}
+			return
+		}
+		if transferCtx.Err() != nil || n == len(candidates)-1 || !canFallBack(err) {
+			retErr = err
+			return
+		}
+		c.warn("failed to restore %s, trying %s: %s", match.Name, candidates[n+1].Name, err)
+	}
+	return
+}
+
+// touch updates the custom time of the restored object to the current day, if
+// it is older. The time is truncated to the day, so concurrent restores set the
+// same time and the object is updated at most once a day. Failing to touch the
+// object does not fail the restore.
+func (c *Cacher) touch(ctx context.Context, st Storage, match *ObjectAttrs) {
+	gs, ok := st.(*gcsStore)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC().Truncate(24 * time.Hour)
+	if !match.CustomTime.Before(now) {
+		return
+	}
+
+	c.log("updating custom time of %s", match.Name)
+	if err := gs.touch(ctx, match.Name, match.Generation, now); err != nil {
+		if isPreconditionFailed(err) {
+			c.log("object was replaced since it was restored, skipping custom time")
+			return
+		}
+		c.warn("failed to update custom time of %s: %s", match.Name, err)
+	}
+}
+
+// restoreObject restores the object described by match.
+func (c *Cacher) restoreObject(ctx context.Context, st Storage, match *ObjectAttrs, i *RestoreRequest, mappings []*dirMapping, v verifier) (retErr error) {
+	dir := i.Dir
+
+	// Archives must be encrypted if there is a key, so an unencrypted archive
+	// cannot be swapped in for an encrypted one
+	_, encrypted := match.Metadata[encryptionMetadataKey]
+	switch {
+	case encrypted && i.EncryptionKey == nil:
+		retErr = fmt.Errorf("%s is encrypted, an encryption key is required", match.Name)
+		return
+	case !encrypted && i.EncryptionKey != nil:
+		retErr = fmt.Errorf("%s is not encrypted, expected an encrypted archive", match.Name)
+		return
+	}
+
+	if len(i.TrustedCreators) > 0 {
+		if err := checkCreator(match.Metadata, match.Name, i.TrustedCreators); err != nil {
+			retErr = err
+			return
+		}
+	}
+
+	if want := i.RequireKMSKey; want != "" {
+		got := match.KMSKeyName
+		if idx := strings.Index(got, "/cryptoKeyVersions/"); idx >= 0 {
+			got = got[:idx]
+		}
+		if got != want {
+			if got == "" {
+				got = "Google-managed encryption"
+			}
+			retErr = fmt.Errorf("%s is encrypted with %s, expected %s", match.Name, got, want)
+			return
+		}
+	}
+
+	var provenanceDigest string
+	if i.RequireProvenance {
+		digest, err := c.checkProvenance(ctx, st, match, i.ProvenanceBuilderID, v)
+		if err != nil {
+			retErr = err
+			return
+		}
+		provenanceDigest = digest
+	}
+
+	var sig []byte
+	if v != nil {
+		val, ok := match.Metadata[signatureMetadataKey]
+		if !ok {
+			retErr = fmt.Errorf("%s is not signed", match.Name)
+			return
+		}
+
+		var err error
+		sig, err = base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			retErr = fmt.Errorf("failed to decode signature: %w", err)
+			return
+		}
+	}
+
+	// Read the generation which was found, even if the object is overwritten
+	handle := &objectHandle{store: st, name: match.Name, generation: match.Generation}
+
+	e := &extractor{
+		c:               c,
+		dir:             dir,
+		paths:           i.Paths,
+		subpath:         strings.Trim(path.Clean("/"+i.Subpath), "/"),
+		stripComponents: i.StripComponents,
+		mappings:        mappings,
+		maxBytes:        i.MaxBytes,
+		maxFiles:        i.MaxFiles,
+		umask:           i.Umask.Perm(),
+		fileMode:        i.FileMode.Perm(),
+		dirMode:         i.DirMode.Perm(),
+		xattrs:          i.Xattrs,
+		sparse:          i.Sparse,
+		normalization:   i.Normalization,
 	}
 
-	// Check if the object already exists. If it already exists, we do not want to
-	// waste time overwriting the cache.
-	attrs, err := c.client.Bucket(bucket).Object(key).Attrs(ctx)
-	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
-		retErr = fmt.Errorf("failed to check if cached object exists: %w", err)
-		return
+	if i.VerifyManifest && !i.DryRun {
+		e.files = make(map[string]string)
 	}
-	if attrs != nil {
-		c.log("cached object already exists, skipping")
-		return
+
+	// Write files in the background, always waiting for them to finish before
+	// returning
+	workers := fit(c.workers(i.ExtractWorkers), maxBufferedFile, c.fileMemory())
+	if workers > 1 && !i.DryRun {
+		e.pool = newWritePool(workers)
+		defer e.wait()
 	}
 
-	// Create the storage writer
-	dne := storage.Conditions{DoesNotExist: true}
-	gcsw := c.client.Bucket(bucket).Object(key).If(dne).NewWriter(ctx)
-	defer func() {
-		c.log("closing gcs writer")
-		if cerr := gcsw.Close(); cerr != nil {
-			if retErr != nil {
-				retErr = fmt.Errorf("%v: failed to close gcs writer: %w", retErr, cerr)
+	// List the entries instead of extracting them
+	if i.DryRun {
+		e.dryRun = i.DryRunOutput
+		if e.dryRun == nil {
+			e.dryRun = os.Stdout
+		}
+		c.log("dry run, listing entries of %s", match.Name)
+	}
+
+	// Skip if the marker records the same object
+	var marker, markerContents string
+	if i.Marker != "" && !i.DryRun {
+		marker = filepath.Join(dir, i.Marker)
+		markerContents = fmt.Sprintf("%s#%d\n", match.Name, match.Generation)
+
+		if i.SkipIfPresent {
+			b, err := os.ReadFile(marker)
+			if err != nil && !os.IsNotExist(err) {
+				retErr = fmt.Errorf("failed to read marker: %w", err)
+				return
+			}
+			if string(b) == markerContents {
+				c.log("marker matches %s, skipping", match.Name)
 				return
 			}
-			retErr = fmt.Errorf("failed to close gcs writer: %w", cerr)
 		}
-	}()
 
-	gcsw.ChunkSize = 128_000_000
-	gcsw.ObjectAttrs.ContentType = contentType
-	gcsw.ObjectAttrs.CacheControl = cacheControl
-	gcsw.ProgressFunc = func(soFar int64) {
-		fmt.Printf("uploaded %d bytes\n", soFar)
+		// Record the restored object once everything is extracted
+		defer func() {
+			if retErr != nil {
+				return
+			}
+			c.log("writing marker %s", marker)
+			if err := os.WriteFile(marker, []byte(markerContents), 0644); err != nil {
+				retErr = fmt.Errorf("failed to write marker: %w", err)
+			}
+		}()
 	}
 
-	// Create the gzip writer
-	gzw := gzip.NewWriter(gcsw)
-	defer func() {
-		c.log("closing gzip writer")
-		if cerr := gzw.Close(); cerr != nil {
-			if retErr != nil {
-				retErr = fmt.Errorf("%v: failed to close gzip writer: %w", retErr, cerr)
+	// Ensure the output directories exist
+	dirs := []string{dir}
+	for _, m := range mappings {
+		dirs = append(dirs, m.dir)
+	}
+	if i.Clean && !i.DryRun {
+		for _, d := range dirs {
+			if err := c.cleanDir(d); err != nil {
+				retErr = err
 				return
 			}
-			retErr = fmt.Errorf("failed to close gzip writer: %w", cerr)
 		}
-	}()
-
-	// Create the tar writer
-	tw := tar.NewWriter(gzw)
-	defer func() {
-		c.log("closing tar writer")
-		if cerr := tw.Close(); cerr != nil {
-			if retErr != nil {
-				retErr = fmt.Errorf("%v: failed to close tar writer: %w", retErr, cerr)
+	}
+	if !i.DryRun {
+		for _, d := range dirs {
+			c.log("making target directory %s", d)
+			if err := os.MkdirAll(d, 0755); err != nil {
+				retErr = fmt.Errorf("failed to make target directory: %w", err)
 				return
 			}
-			retErr = fmt.Errorf("failed to close tar writer: %w", cerr)
 		}
-	}()
-
-	// Walk all files create tar
-	if err := filepath.Walk(dir, func(name string, f os.FileInfo, err error) error {
-		c.log("walking file %s", name)
+	}
 
-		if err != nil {
-			return err
+	// Check for names which would overwrite each other
+	if i.CaseCollisions != CaseCollisionsIgnore && !i.DryRun {
+		for _, d := range dirs {
+			insensitive, err := isCaseInsensitive(d)
+			if err != nil {
+				retErr = fmt.Errorf("failed to check filesystem case sensitivity: %w", err)
+				return
+			}
+			if insensitive {
+				c.log("target directory %s is case-insensitive", d)
+				e.caseCollisions = i.CaseCollisions
+				e.folded = make(map[string]string)
+				break
+			}
 		}
-
-		if !f.Mode().IsRegular() {
-			c.log("file %s is not regular", name)
-			return nil
+	}
+	if i.PreserveOwner {
+		if os.Geteuid() == 0 {
+			e.preserveOwner = true
+		} else {
+			c.log("not running as root, ignoring archived ownership")
 		}
+	}
 
-		// Create the tar header
-		header, err := tar.FileInfoHeader(f, f.Name())
-		if err != nil {
-			return fmt.Errorf("failed to create tar header for %s: %w", f.Name(), err)
+	// Dry runs of indexed archives only need the index
+	if i.DryRun {
+		err := c.listIndex(ctx, handle, match, e)
+		if err == nil {
+			if len(e.paths) > 0 && e.matched == 0 {
+				retErr = fmt.Errorf("no entries match paths %q", e.paths)
+			}
+			return
 		}
-		header.Name = strings.TrimPrefix(strings.Replace(name, dir, "", -1), string(filepath.Separator))
-
-		// Write header to tar
-		c.log("writing tar header for %s", name)
-		if err := tw.WriteHeader(header); err != nil {
-			return fmt.Errorf("failed to write tar header for %s: %w", f.Name(), err)
+		if !errors.Is(err, errNoIndex) {
+			retErr = fmt.Errorf("failed to list entries: %w", err)
+			return
 		}
+		c.log("archive does not have an index, reading headers")
+	}
 
-		// Open and write file to tar
-		c.log("opening %s", name)
-		file, err := os.Open(name)
-		if err != nil {
-			return fmt.Errorf("failed to open %s: %w", f.Name(), err)
+	// Only download the subpath if the archive has an index. Ranged reads
+	// cannot be verified against the signature.
+	paths := i.Paths
+	if v != nil {
+		paths = nil
+	}
+	if len(paths) == 0 && e.subpath != "" && v == nil {
+		if _, ok := match.Metadata[indexOffsetMetadataKey]; ok {
+			paths = []string{e.subpath}
 		}
+	}
 
-		c.log("copying %s to tar", name)
-		if _, err := io.Copy(tw, file); err != nil {
-			if cerr := file.Close(); cerr != nil {
-				return fmt.Errorf("failed to close %s: %v: failed to write tar: %w", f.Name(), cerr, err)
+	// Restore only the requested paths using the archive index
+	if len(paths) > 0 {
+		err := c.restorePaths(ctx, handle, match, e, paths)
+		if err == nil {
+			if err := e.finish(); err != nil {
+				retErr = err
+				return
+			}
+			if err := c.checkManifest(ctx, st, match, e); err != nil {
+				retErr = err
+				return
 			}
-			return fmt.Errorf("failed to write tar for %s: %w", f.Name(), err)
+			return
 		}
-
-		// Close tar
-		c.log("closing %s", name)
-		if err := file.Close(); err != nil {
-			return fmt.Errorf("failed to close: %w", err)
+		if !errors.Is(err, errNoIndex) {
+			retErr = fmt.Errorf("failed to restore paths: %w", err)
+			return
 		}
-
-		return nil
-	}); err != nil {
-		retErr = fmt.Errorf("failed to walk files: %w", err)
-		return
+		c.log("archive does not have an index, extracting matching paths")
 	}
 
-	return
-}
-
-// RestoreRequest is used as input to the Restore operation.
-type RestoreRequest struct {
-	// Bucket is the name of the bucket from which to cache.
-	Bucket string
-
-	// Keys is the ordered list of keys to restore.
-	Keys []string
-
-	// Dir is the directory on disk to cache.
-	Dir string
-}
-
-// Restore restores the key from the cache into the dir on disk.
-func (c *Cacher) Restore(ctx context.Context, i *RestoreRequest) (retErr error) {
-	if i == nil {
-		retErr = fmt.Errorf("missing cache options")
-		return
+	// Create the gcs reader. Large objects can be downloaded as ranges in
+	// parallel.
+	sliceSize := i.SliceSize
+	if sliceSize <= 0 {
+		sliceSize = defaultSliceSize
 	}
-
-	bucket := i.Bucket
-	if bucket == "" {
-		retErr = fmt.Errorf("missing bucket")
-		return
+	var gcsr io.ReadCloser
+	parallel := fit(c.workers(i.ParallelDownloads), sliceSize, c.transferMemory())
+	if parallel > 1 && match.Size > sliceSize {
+		c.log("downloading object with %d parallel ranges", parallel)
+		gcsr = c.newSlicedReader(ctx, handle, match.Size, parallel, sliceSize)
+	} else {
+		r, err := c.newResumingReader(ctx, handle, 0, -1)
+		if err != nil {
+			retErr = fmt.Errorf("failed to create object reader: %w", err)
+			return
+		}
+		gcsr = r
 	}
+	// Errors closing the readers keep the original error wrapped, so a corrupt
+	// archive is still detected
+	defer func() {
+		c.log("closing gcs reader")
+		if cerr := gcsr.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%w: failed to close gcs reader: %v", retErr, cerr)
+				return
+			}
+			retErr = fmt.Errorf("failed to close gcs reader: %w", cerr)
+		}
+	}()
 
-	dir := i.Dir
-	if dir == "" {
-		retErr = fmt.Errorf("missing directory")
-		return
-	}
+	// Verify the checksum of everything which was read once the archive is
+	// extracted. This runs after the archive readers are closed, since they may
+	// still be reading.
+	dl := &downloadReader{Reader: gcsr}
+	var src io.Reader = dl
+	if v != nil {
+		f, digest, err := c.spoolVerified(ctx, dl, match.Name, sig, v)
+		if err != nil {
+			retErr = err
+			return
+		}
+		defer func() {
+			if cerr := f.Close(); cerr != nil && retErr == nil {
+				retErr = fmt.Errorf("failed to close %s: %w", f.Name(), cerr)
+			}
+			if rerr := os.Remove(f.Name()); rerr != nil && retErr == nil {
+				retErr = fmt.Errorf("failed to remove %s: %w", f.Name(), rerr)
+			}
+		}()
 
-	keys := i.Keys
-	if len(keys) < 1 {
-		retErr = fmt.Errorf("expected at least one cache key")
-		return
+		// The provenance must describe the archive which was downloaded, not
+		// only the digest recorded in its metadata
+		if provenanceDigest != "" && digest != provenanceDigest {
+			retErr = &corruptError{err: fmt.Errorf("downloaded object has SHA256 %s, provenance expects %s", digest, provenanceDigest)}
+			return
+		}
+		src = f
 	}
 
-	// Get the bucket handle
-	bucketHandle := c.client.Bucket(bucket)
-
-	// Try to find an earlier cached item by looking for the "newest" item with
-	// one of the provided key fallbacks as a prefix.
-	var match *storage.ObjectAttrs
-	for _, key := range keys {
-		c.log("searching for objects with prefix %s", key)
+	// Check the contents against the CRC32C computed by the store, or the
+	// SHA256 recorded when the cache was saved if the store has none
+	var sum hash.Hash = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if !match.HasCRC32C {
+		sum = sha256.New()
+	}
+	raw := bufio.NewReader(io.TeeReader(src, sum))
+	defer func() {
+		if retErr != nil {
+			return
+		}
 
-		it := bucketHandle.Objects(ctx, &storage.Query{
-			Prefix: key,
-		})
+		// Read any trailing data which the archive reader did not need
+		if _, err := c.copyBuffered(io.Discard, raw); err != nil {
+			retErr = dl.corrupt(fmt.Errorf("failed to read object: %w", err))
+			return
+		}
 
-		for {
-			attrs, err := it.Next()
-			if err == iterator.Done {
-				break
+		if !match.HasCRC32C {
+			want, ok := match.Metadata[sha256MetadataKey]
+			if !ok {
+				c.log("object does not have a CRC32C or SHA256")
+				return
 			}
-			if err != nil {
-				retErr = fmt.Errorf("failed to list %s: %w", key, err)
+			if got := hex.EncodeToString(sum.Sum(nil)); got != want {
+				retErr = &corruptError{err: fmt.Errorf("downloaded object has SHA256 %s, expected %s", got, want)}
 				return
 			}
+			c.log("verified SHA256 %s", want)
+			return
+		}
 
-			c.log("found object %s", key)
+		crc := sum.(hash.Hash32)
+		if got := crc.Sum32(); got != match.CRC32C {
+			retErr = &corruptError{err: fmt.Errorf("downloaded object has CRC32C %08x, expected %08x", got, match.CRC32C)}
+			return
+		}
+		c.log("verified CRC32C %08x", match.CRC32C)
+	}()
 
-			if match == nil || attrs.Updated.After(match.Updated) {
-				c.log("setting %s as best candidate", key)
-				match = attrs
-				continue
-			}
+	// Decrypt the archive if it was encrypted client-side
+	br := raw
+	if i.EncryptionKey != nil {
+		c.log("decrypting archive")
+		dr, err := newDecryptReader(raw, i.EncryptionKey)
+		if err != nil {
+			retErr = dl.corrupt(err)
+			return
 		}
+		br = bufio.NewReader(&corruptReader{r: dr, dl: dl})
 	}
 
-	// Ensure we found one
-	if match == nil {
-		retErr = fmt.Errorf("failed to find cached objects among keys %q", keys)
-		return
+	// Detect the archive format if it was not given
+	format := i.Format
+	if format == "" {
+		var err error
+		format, err = detectFormat(match.ContentType, br)
+		if err != nil {
+			retErr = dl.corrupt(err)
+			return
+		}
+		c.log("detected %s format", format)
 	}
 
-	// Ensure the output directory exists
-	c.log("making target directory %s", dir)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		retErr = fmt.Errorf("failed to make target directory: %w", err)
-		return
-	}
+	// Create the archive reader
+	var tr archiveReader
+	switch format {
+	case FormatZip:
+		zr, err := newZipArchiveReader(&corruptReader{r: br, dl: dl})
+		if err != nil {
+			retErr = err
+			return
+		}
+		defer func() {
+			c.log("closing zip reader")
+			if cerr := zr.Close(); cerr != nil {
+				if retErr != nil {
+					retErr = fmt.Errorf("%w: failed to close zip reader: %v", retErr, cerr)
+					return
+				}
+				retErr = fmt.Errorf("failed to close zip reader: %w", cerr)
+			}
+		}()
+		tr = zr
+	default:
+		// Detect the compression if it was not given
+		compression := i.Compression
+		if compression == "" {
+			var err error
+			compression, err = detectCompression(match.ContentType, br)
+			if err != nil {
+				retErr = dl.corrupt(err)
+				return
+			}
+			c.log("detected %s compression", compression)
+		}
 
-	// Create the gcs reader
-	gcsr, err := bucketHandle.Object(match.Name).NewReader(ctx)
-	if err != nil {
-		retErr = fmt.Errorf("failed to create object reader: %w", err)
-		return
-	}
-	defer func() {
-		c.log("closing gcs reader")
-		if cerr := gcsr.Close(); cerr != nil {
-			if retErr != nil {
-				retErr = fmt.Errorf("%v: failed to close gcs reader: %w", retErr, cerr)
+		// Create the decompression reader
+		var dr io.ReadCloser
+		if i.ExternalCompressor {
+			r, ok, err := newExternalDecompressReader(ctx, br, compression)
+			if err != nil {
+				retErr = err
 				return
 			}
-			retErr = fmt.Errorf("failed to close gcs reader: %w", cerr)
+			if ok {
+				c.log("using external decompressor")
+				dr = r
+			}
 		}
-	}()
 
-	// Create the gzip reader
-	gzr, err := gzip.NewReader(gcsr)
-	if err != nil {
-		retErr = fmt.Errorf("failed to create gzip reader: %w", err)
-		return
-	}
-	defer func() {
-		c.log("closing gzip reader")
-		if cerr := gzr.Close(); cerr != nil {
-			if retErr != nil {
-				retErr = fmt.Errorf("%v: failed to close gzip reader: %w", retErr, cerr)
+		if dr == nil {
+			r, err := newDecompressReader(br, compression)
+			if err != nil {
+				retErr = dl.corrupt(err)
 				return
 			}
-			retErr = fmt.Errorf("failed to close gzip reader: %w", cerr)
+			dr = r
 		}
-	}()
+		defer func() {
+			// An external decompressor would otherwise decompress the rest of
+			// the archive before it exits
+			if er, ok := dr.(*externalReader); ok && retErr != nil {
+				c.log("stopping external decompressor")
+				er.kill()
+			}
 
-	// Create the tar reader
-	tr := tar.NewReader(gzr)
+			c.log("closing decompression reader")
+			if cerr := dr.Close(); cerr != nil {
+				if retErr != nil {
+					retErr = fmt.Errorf("%w: failed to close decompression reader: %v", retErr, cerr)
+					return
+				}
+				retErr = fmt.Errorf("failed to close decompression reader: %w", cerr)
+			}
+		}()
+
+		tr = tar.NewReader(dr)
+	}
 
 	// Unzip and untar each file into the target directory
 	if err := func() error {
 		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			header, err := tr.Next()
 			if err != nil {
 				if err == io.EOF {
@@ -333,7 +2454,7 @@ func (c *Cacher) Restore(ctx context.Context, i *RestoreRequest) (retErr error)
 					return nil
 				}
 
-				return fmt.Errorf("failed to read header: %w", err)
+				return dl.corrupt(fmt.Errorf("failed to read header: %w", err))
 			}
 
 			// Not entirely sure how this happens? I think it was because I uploaded a
@@ -343,46 +2464,8 @@ func (c *Cacher) Restore(ctx context.Context, i *RestoreRequest) (retErr error)
 				continue
 			}
 
-			target := filepath.Join(dir, header.Name)
-			c.log("working on %s", target)
-
-			switch header.Typeflag {
-			case tar.TypeDir:
-				c.log("creating directory %s", target)
-
-				if err := os.MkdirAll(target, 0755); err != nil {
-					return fmt.Errorf("failed to make directory %s: %w", target, err)
-				}
-			case tar.TypeReg:
-				c.log("creating file %s", target)
-
-				// Create the parent directory in case it does not exist...
-				parent := filepath.Dir(target)
-				if err := os.MkdirAll(parent, 0755); err != nil {
-					return fmt.Errorf("failed to make parent directory %s: %w", parent, err)
-				}
-
-				c.log("opening %s", target)
-				f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-				if err != nil {
-					return fmt.Errorf("failed to open %s: %w", target, err)
-				}
-
-				c.log("copying %s to disk", target)
-				if _, err := io.Copy(f, tr); err != nil {
-					if cerr := f.Close(); cerr != nil {
-						return fmt.Errorf("failed to close %s: %v: failed to untar: %w", target, cerr, err)
-					}
-					return fmt.Errorf("failed to untar %s: %w", target, err)
-				}
-
-				// Close f here instead of deferring
-				c.log("closing %s", target)
-				if err := f.Close(); err != nil {
-					return fmt.Errorf("failed to close %s: %w", target, err)
-				}
-			default:
-				return fmt.Errorf("unknown header type %v for %s", header.Typeflag, target)
+			if err := e.extract(header, &corruptReader{r: tr, dl: dl}); err != nil {
+				return err
 			}
 		}
 	}(); err != nil {
@@ -390,9 +2473,44 @@ func (c *Cacher) Restore(ctx context.Context, i *RestoreRequest) (retErr error)
 		return
 	}
 
+	if len(e.paths) > 0 && e.matched == 0 {
+		retErr = fmt.Errorf("no entries match paths %q", e.paths)
+		return
+	}
+
+	if err := e.finish(); err != nil {
+		retErr = err
+		return
+	}
+
+	if err := c.checkManifest(ctx, st, match, e); err != nil {
+		retErr = err
+		return
+	}
 	return
 }
 
+// checkManifest verifies the extracted files against the manifest of the
+// object, if the extractor is tracking files.
+func (c *Cacher) checkManifest(ctx context.Context, st Storage, match *ObjectAttrs, e *extractor) error {
+	if e.files == nil {
+		return nil
+	}
+
+	m, err := c.readManifest(ctx, st, match.Name)
+	if err != nil {
+		return err
+	}
+	if m.Generation != match.Generation {
+		return fmt.Errorf("manifest is for generation %d of %s, restored %d",
+			m.Generation, match.Name, match.Generation)
+	}
+	if err := e.verifyManifest(m); err != nil {
+		return &corruptError{err: err}
+	}
+	return nil
+}
+
 // HashGlob hashes the files matched by the given glob.
 func (c *Cacher) HashGlob(pattern string) (string, error) {
 	matches, err := filepath.Glob(pattern)
@@ -404,12 +2522,30 @@ func (c *Cacher) HashGlob(pattern string) (string, error) {
 
 // HashFiles hashes the list of file and returns the hex-encoded SHA256.
 func (c *Cacher) HashFiles(files []string) (string, error) {
+	return c.cachedHash(files, func() (string, error) {
+		return c.hashFiles(files)
+	})
+}
+
+// hashFiles hashes the contents of the files, in order, as a single stream.
+// Files are opened and small files are read ahead in parallel, so reading
+// overlaps with hashing.
+func (c *Cacher) hashFiles(files []string) (string, error) {
 	h, err := blake2b.New(16, nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to create hash: %w", err)
 	}
 
-	hashOne := func(name string, h hash.Hash) (retErr error) {
+	// readAhead is a file which was opened, and read if it is small, ahead of
+	// being hashed.
+	type readAhead struct {
+		file *os.File
+		data []byte
+		err  error
+		done chan struct{}
+	}
+
+	readOne := func(name string, r *readAhead) (retErr error) {
 		c.log("opening %s", name)
 		f, err := os.Open(name)
 		if err != nil {
@@ -417,6 +2553,9 @@ func (c *Cacher) HashFiles(files []string) (string, error) {
 			return
 		}
 		defer func() {
+			if r.file == f {
+				return
+			}
 			c.log("closing %s", name)
 			if cerr := f.Close(); cerr != nil {
 				if retErr != nil {
@@ -439,20 +2578,97 @@ func (c *Cacher) HashFiles(files []string) (string, error) {
 			return
 		}
 
-		c.log("hashing %s", name)
-		if _, err := io.Copy(h, f); err != nil {
-			retErr = fmt.Errorf("failed to hash: %w", err)
+		// Large files are read while they are hashed
+		if stat.Size() > maxBufferedFile {
+			r.file = f
 			return
 		}
 
+		c.log("reading %s", name)
+		data, err := io.ReadAll(f)
+		if err != nil {
+			retErr = fmt.Errorf("failed to hash: %w", err)
+			return
+		}
+		r.data = data
 		return
 	}
 
-	for _, name := range files {
-		if err := hashOne(name, h); err != nil {
-			return "", fmt.Errorf("failed to hash %s: %w", name, err)
+	workers := c.workers(0)
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = fit(workers, maxBufferedFile, c.fileMemory())
+
+	// Start reading each file once there is room, which is made as files are
+	// hashed, so at most workers files are held at once
+	reads := make([]*readAhead, len(files))
+	for idx := range reads {
+		reads[idx] = &readAhead{done: make(chan struct{})}
+	}
+	sem := make(chan struct{}, workers)
+	stop := make(chan struct{})
+	started := make(chan int, 1)
+	go func() {
+		n := 0
+		defer func() {
+			started <- n
+		}()
+
+		for idx, name := range files {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+
+			n++
+			go func(name string, r *readAhead) {
+				defer close(r.done)
+				r.err = readOne(name, r)
+			}(name, reads[idx])
+		}
+	}()
+
+	// Hash the files in order
+	var hashErr error
+	idx := 0
+	for ; idx < len(files) && hashErr == nil; idx++ {
+		name, r := files[idx], reads[idx]
+		<-r.done
+
+		switch {
+		case r.err != nil:
+			hashErr = fmt.Errorf("failed to hash %s: %w", name, r.err)
+		case r.file != nil:
+			c.log("hashing %s", name)
+			if _, err := c.copyBuffered(h, r.file); err != nil {
+				hashErr = fmt.Errorf("failed to hash %s: failed to hash: %w", name, err)
+			}
+
+			c.log("closing %s", name)
+			if err := r.file.Close(); err != nil && hashErr == nil {
+				hashErr = fmt.Errorf("failed to hash %s: failed to close file: %w", name, err)
+			}
+		default:
+			c.log("hashing %s", name)
+			h.Write(r.data)
+			r.data = nil
+		}
+		<-sem
+	}
+
+	// Close the files which were opened ahead of a failure
+	close(stop)
+	for n := <-started; idx < n; idx++ {
+		<-reads[idx].done
+		if f := reads[idx].file; f != nil {
+			f.Close()
 		}
 	}
+	if hashErr != nil {
+		return "", hashErr
+	}
 
 	dig := h.Sum(nil)
 	return fmt.Sprintf("%x", dig), nil
@@ -463,3 +2679,8 @@ func (c *Cacher) log(msg string, vars ...interface{}) {
 		log.Printf(msg, vars...)
 	}
 }
+
+// warn logs a message which is shown even when debugging is disabled.
+func (c *Cacher) warn(msg string, vars ...interface{}) {
+	log.Printf("warning: "+msg, vars...)
+}
@@ -0,0 +1,119 @@
+package cacher
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testBucket is the name of the bucket which tests save caches to.
+const testBucket = "test-bucket"
+
+// newTestCacher returns a cacher which keeps its buckets in a new fakeGCS.
+func newTestCacher(t *testing.T) (*Cacher, *fakeGCS) {
+	t.Helper()
+
+	f, srv := newFakeGCS(t)
+	c, err := New(context.Background(), WithEndpoint(srv.URL), WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, f
+}
+
+// writeFiles creates a directory with the files, which map slash-separated
+// paths to their contents, and returns its path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, contents := range files {
+		pth := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(pth, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// readFiles returns the regular files in the directory, mapping
+// slash-separated paths to their contents.
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	if err := filepath.WalkDir(dir, func(pth string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, pth)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(pth)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// writeKeys writes a new PEM-encoded signing key and its public key, and
+// returns their paths.
+func writeKeys(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	privPath := filepath.Join(dir, "key.pem")
+	pubPath := filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return privPath, pubPath
+}
+
+// copyObject copies the object and its metadata in the bucket to the name,
+// like someone who can write to the bucket could.
+func copyObject(t *testing.T, b *fakeGCSBucket, from, to string) {
+	t.Helper()
+
+	data, obj, ok := b.object(from)
+	if !ok {
+		t.Fatalf("missing object %s", from)
+	}
+	b.put(to, data, obj.Metadata)
+}
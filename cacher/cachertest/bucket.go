@@ -0,0 +1,281 @@
+package cachertest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sethvargo/gcs-cacher/cacher"
+)
+
+// crc32cTable is the Castagnoli table, which Cloud Storage uses for checksums.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Bucket is a bucket of objects in memory. It implements cacher.Storage,
+// including generations and the conditions for writes, and only keeps the
+// latest generation of each object.
+type Bucket struct {
+	name string
+
+	mu         sync.Mutex
+	objects    map[string]*object
+	generation int64
+}
+
+var _ cacher.Storage = (*Bucket)(nil)
+
+// object is an object in a bucket. Its contents are never modified after it
+// is written, so they can be read without holding the lock.
+type object struct {
+	data  []byte
+	attrs *cacher.ObjectAttrs
+}
+
+// newBucket creates an empty bucket.
+func newBucket(name string) *Bucket {
+	return &Bucket{
+		name:    name,
+		objects: make(map[string]*object),
+	}
+}
+
+// Put writes the object, replacing any existing object with the name, and
+// returns its attributes. Use it to seed the bucket with objects.
+func (b *Bucket) Put(name string, data []byte, metadata map[string]string) *cacher.ObjectAttrs {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.put(name, data, &cacher.WriterOptions{Metadata: metadata})
+}
+
+// Object returns the contents and attributes of the object, and false if it
+// does not exist.
+func (b *Bucket) Object(name string) ([]byte, *cacher.ObjectAttrs, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.objects[name]
+	if !ok {
+		return nil, nil, false
+	}
+	return append([]byte(nil), o.data...), cloneAttrs(o.attrs), true
+}
+
+// put writes the object. The caller must hold the lock.
+func (b *Bucket) put(name string, data []byte, opts *cacher.WriterOptions) *cacher.ObjectAttrs {
+	b.generation++
+
+	attrs := &cacher.ObjectAttrs{
+		Bucket:          b.name,
+		Name:            name,
+		Size:            int64(len(data)),
+		ContentType:     opts.ContentType,
+		CacheControl:    opts.CacheControl,
+		ContentEncoding: opts.ContentEncoding,
+		Updated:         time.Now().UTC(),
+		Generation:      b.generation,
+		CRC32C:          crc32.Checksum(data, crc32cTable),
+		HasCRC32C:       true,
+		KMSKeyName:      opts.KMSKeyName,
+		Metadata:        cloneMetadata(opts.Metadata),
+	}
+	b.objects[name] = &object{
+		data:  append([]byte(nil), data...),
+		attrs: attrs,
+	}
+	return cloneAttrs(attrs)
+}
+
+// lookup returns the object if it exists at the generation, or at any
+// generation if it is zero. The caller must hold the lock.
+func (b *Bucket) lookup(name string, generation int64) (*object, error) {
+	o, ok := b.objects[name]
+	if !ok || (generation != 0 && o.attrs.Generation != generation) {
+		return nil, cacher.ErrObjectNotExist
+	}
+	return o, nil
+}
+
+// checkGeneration returns an error if the object is not at the generation,
+// unless it is zero. The caller must hold the lock.
+func (b *Bucket) checkGeneration(name string, generation int64) (*object, error) {
+	o, ok := b.objects[name]
+	if !ok {
+		return nil, cacher.ErrObjectNotExist
+	}
+	if generation != 0 && o.attrs.Generation != generation {
+		return nil, fmt.Errorf("%w: %s is generation %d, not %d",
+			cacher.ErrPreconditionFailed, name, o.attrs.Generation, generation)
+	}
+	return o, nil
+}
+
+func (b *Bucket) Attrs(ctx context.Context, name string, generation int64) (*cacher.ObjectAttrs, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, err := b.lookup(name, generation)
+	if err != nil {
+		return nil, err
+	}
+	return cloneAttrs(o.attrs), nil
+}
+
+func (b *Bucket) List(ctx context.Context, prefix string) ([]*cacher.ObjectAttrs, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var list []*cacher.ObjectAttrs
+	for name, o := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			list = append(list, cloneAttrs(o.attrs))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+func (b *Bucket) NewReader(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	o, err := b.lookup(name, generation)
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(len(o.data))
+	if offset < 0 || offset > size {
+		return nil, fmt.Errorf("offset %d is out of range for %s with %d bytes", offset, name, size)
+	}
+	end := size
+	if length >= 0 && offset+length < size {
+		end = offset + length
+	}
+	return io.NopCloser(bytes.NewReader(o.data[offset:end])), nil
+}
+
+func (b *Bucket) NewWriter(ctx context.Context, name string, opts *cacher.WriterOptions) cacher.ObjectWriter {
+	return &writer{
+		b:    b,
+		ctx:  ctx,
+		name: name,
+		opts: opts,
+	}
+}
+
+func (b *Bucket) Update(ctx context.Context, name string, generation int64, metadata map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, err := b.checkGeneration(name, generation)
+	if err != nil {
+		return err
+	}
+
+	attrs := cloneAttrs(o.attrs)
+	if attrs.Metadata == nil {
+		attrs.Metadata = make(map[string]string, len(metadata))
+	}
+	for k, v := range metadata {
+		if v == "" {
+			delete(attrs.Metadata, k)
+			continue
+		}
+		attrs.Metadata[k] = v
+	}
+	o.attrs = attrs
+	return nil
+}
+
+func (b *Bucket) Delete(ctx context.Context, name string, generation int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.checkGeneration(name, generation); err != nil {
+		return err
+	}
+	delete(b.objects, name)
+	return nil
+}
+
+// writer buffers the contents of an object, which is written to the bucket
+// when the writer is closed.
+type writer struct {
+	b    *Bucket
+	ctx  context.Context
+	name string
+	opts *cacher.WriterOptions
+
+	buf   bytes.Buffer
+	attrs *cacher.ObjectAttrs
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *writer) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	data := w.buf.Bytes()
+	if w.opts.SendCRC32C {
+		if got := crc32.Checksum(data, crc32cTable); got != w.opts.CRC32C {
+			return fmt.Errorf("%s has CRC32C %08x, expected %08x", w.name, got, w.opts.CRC32C)
+		}
+	}
+
+	w.b.mu.Lock()
+	defer w.b.mu.Unlock()
+
+	o, exists := w.b.objects[w.name]
+	switch {
+	case w.opts.DoesNotExist && exists:
+		return fmt.Errorf("%w: %s already exists", cacher.ErrPreconditionFailed, w.name)
+	case w.opts.GenerationMatch != 0 && (!exists || o.attrs.Generation != w.opts.GenerationMatch):
+		return fmt.Errorf("%w: %s is not generation %d", cacher.ErrPreconditionFailed, w.name, w.opts.GenerationMatch)
+	}
+
+	w.attrs = w.b.put(w.name, data, w.opts)
+	if w.opts.ProgressFunc != nil {
+		w.opts.ProgressFunc(w.attrs.Size)
+	}
+	return nil
+}
+
+func (w *writer) Attrs() *cacher.ObjectAttrs {
+	return w.attrs
+}
+
+// cloneAttrs returns a copy of the attributes, so callers cannot modify the
+// stored ones.
+func cloneAttrs(attrs *cacher.ObjectAttrs) *cacher.ObjectAttrs {
+	clone := *attrs
+	clone.Metadata = cloneMetadata(attrs.Metadata)
+	return &clone
+}
+
+// cloneMetadata returns a copy of the metadata.
+func cloneMetadata(md map[string]string) map[string]string {
+	if md == nil {
+		return nil
+	}
+
+	clone := make(map[string]string, len(md))
+	for k, v := range md {
+		clone[k] = v
+	}
+	return clone
+}
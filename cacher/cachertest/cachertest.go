@@ -0,0 +1,162 @@
+// Package cachertest keeps caches in memory, so code which saves and restores
+// caches with the cacher package can be tested without network access or
+// credentials.
+package cachertest
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sethvargo/gcs-cacher/cacher"
+)
+
+// companionPrefix is the prefix of the objects which the cacher stores
+// alongside caches, like manifests and locks.
+const companionPrefix = ".gcs-cacher/"
+
+// Storage holds buckets of objects in memory. It is safe for concurrent use.
+type Storage struct {
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// NewStorage creates empty storage.
+func NewStorage() *Storage {
+	return &Storage{
+		buckets: make(map[string]*Bucket),
+	}
+}
+
+// Open returns the bucket with the name, creating it if it does not exist. It
+// is a cacher.StorageFunc, so it can be passed to cacher.WithStorage.
+func (s *Storage) Open(ctx context.Context, bucket string) (cacher.Storage, error) {
+	return s.Bucket(bucket), nil
+}
+
+// Bucket returns the bucket with the name, creating it if it does not exist.
+func (s *Storage) Bucket(name string) *Bucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[name]
+	if !ok {
+		b = newBucket(name)
+		s.buckets[name] = b
+	}
+	return b
+}
+
+// NewCacher creates a cacher which keeps every bucket in the storage.
+func (s *Storage) NewCacher(ctx context.Context, options ...cacher.Option) (*cacher.Cacher, error) {
+	options = append([]cacher.Option{cacher.WithStorage(s.Open)}, options...)
+	return cacher.New(ctx, options...)
+}
+
+// SaveCache saves the files as a cache with the key in the bucket, like a
+// previous build would have. Files map slash-separated paths to their
+// contents.
+func (s *Storage) SaveCache(ctx context.Context, bucket, key string, files map[string]string) error {
+	dir, err := os.MkdirTemp("", "cachertest-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, contents := range files {
+		pth := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0o755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", name, err)
+		}
+		if err := os.WriteFile(pth, []byte(contents), 0o644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+
+	c, err := s.NewCacher(ctx)
+	if err != nil {
+		return err
+	}
+	return c.Save(ctx, &cacher.SaveRequest{
+		Bucket: bucket,
+		Key:    key,
+		Dir:    dir,
+	})
+}
+
+// RestoreCache restores the cache in the bucket which matches the keys, like
+// a build would, and returns its files. Files map slash-separated paths to
+// their contents. It returns cacher.ErrCacheMiss if no cache matches.
+func (s *Storage) RestoreCache(ctx context.Context, bucket string, keys ...string) (map[string]string, error) {
+	dir, err := os.MkdirTemp("", "cachertest-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := s.NewCacher(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Restore(ctx, &cacher.RestoreRequest{
+		Bucket: bucket,
+		Keys:   keys,
+		Dir:    dir,
+	}); err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string)
+	if err := filepath.WalkDir(dir, func(pth string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, pth)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(pth)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read restored files: %w", err)
+	}
+	return files, nil
+}
+
+// Names returns the sorted names of every object in the bucket.
+func (b *Bucket) Names() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	names := make([]string, 0, len(b.objects))
+	for name := range b.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Caches returns the sorted keys of the caches in the bucket, without the
+// objects which are stored alongside them, like manifests and locks.
+func (b *Bucket) Caches() []string {
+	var keys []string
+	for _, name := range b.Names() {
+		if !strings.HasPrefix(name, companionPrefix) {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,44 @@
+package cachertest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sethvargo/gcs-cacher/cacher"
+)
+
+func TestStorage(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := NewStorage()
+
+	files := map[string]string{
+		"a":     "contents of a",
+		"dir/b": "contents of b",
+	}
+	if err := s.SaveCache(ctx, "bucket", "key", files); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.RestoreCache(ctx, "bucket", "other", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("expected %q to be %q", got, files)
+	}
+
+	if _, err := s.RestoreCache(ctx, "bucket", "other"); !errors.Is(err, cacher.ErrCacheMiss) {
+		t.Errorf("expected cache miss, got %v", err)
+	}
+	if _, err := s.RestoreCache(ctx, "other-bucket", "key"); !errors.Is(err, cacher.ErrCacheMiss) {
+		t.Errorf("expected buckets to be separate, got %v", err)
+	}
+
+	if got, want := s.Bucket("bucket").Caches(), []string{"key"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected caches %q to be %q", got, want)
+	}
+}
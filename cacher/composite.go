@@ -0,0 +1,400 @@
+package cacher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultPartSize is the default size of each part of a parallel upload.
+	defaultPartSize = 64 * 1024 * 1024
+
+	// maxComposeSources is the maximum number of objects which can be composed
+	// in a single request.
+	maxComposeSources = 32
+)
+
+// compositeWriter uploads an object as parts of a fixed size, several at a
+// time, and composes them into the final object when it is closed. Objects
+// smaller than a single part are uploaded directly.
+type compositeWriter struct {
+	c *Cacher
+
+	// ctx is used for uploads. Parts are removed even if it is cancelled.
+	ctx context.Context
+
+	// handle is the final object, with any preconditions for the write.
+	handle       *storage.ObjectHandle
+	bucketHandle *storage.BucketHandle
+
+	// attrs are the attributes for the final object. The parts only have its
+	// content type, cache control, and KMS key.
+	attrs storage.ObjectAttrs
+
+	// prefix is the prefix of the names of the parts.
+	prefix string
+
+	partSize int
+	buf      []byte
+	parts    []string
+	sem      chan struct{}
+	wg       sync.WaitGroup
+	total    int64
+
+	// progress is called with the number of bytes uploaded after each part.
+	progress func(int64)
+
+	// statePath is the file which records the uploaded parts, so an
+	// interrupted upload can be resumed. If it is empty, parts are always
+	// uploaded, and are removed if the upload fails.
+	statePath string
+	state     *uploadState
+	stateMu   sync.Mutex
+
+	mu  sync.Mutex
+	err error
+
+	result *storage.ObjectAttrs
+}
+
+// newCompositeWriter creates a writer which uploads to the object in parts of
+// partSize bytes, with up to concurrency parts in flight at once. If statePath
+// is not empty, the uploaded parts are recorded in the file, and parts which
+// were already uploaded by a previous attempt with the same contents are
+// reused.
+func (c *Cacher) newCompositeWriter(ctx context.Context, bucketHandle *storage.BucketHandle, handle *storage.ObjectHandle, concurrency, partSize int, statePath string) (*compositeWriter, error) {
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var state *uploadState
+	if statePath != "" {
+		s, err := readUploadState(statePath)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil && s.Bucket == handle.BucketName() && s.Key == handle.ObjectName() && s.PartSize == partSize {
+			c.log("resuming upload with %d uploaded parts", len(s.Parts))
+			state = s
+		}
+	}
+
+	if state == nil {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, fmt.Errorf("failed to generate upload ID: %w", err)
+		}
+
+		state = &uploadState{
+			Bucket:   handle.BucketName(),
+			Key:      handle.ObjectName(),
+			Prefix:   companionPrefix + "parts/" + handle.ObjectName() + "/" + hex.EncodeToString(id) + "/",
+			PartSize: partSize,
+		}
+	}
+
+	return &compositeWriter{
+		c:            c,
+		ctx:          ctx,
+		handle:       handle,
+		bucketHandle: bucketHandle,
+		prefix:       state.Prefix,
+		partSize:     partSize,
+		buf:          make([]byte, 0, partSize),
+		sem:          make(chan struct{}, concurrency),
+		statePath:    statePath,
+		state:        state,
+	}, nil
+}
+
+// Write buffers p, uploading each part once it is full.
+func (w *compositeWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if err := w.error(); err != nil {
+			return n, err
+		}
+
+		l := w.partSize - len(w.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		w.buf = append(w.buf, p[:l]...)
+		p = p[l:]
+		n += l
+
+		if len(w.buf) == w.partSize {
+			w.flush()
+		}
+	}
+	return n, nil
+}
+
+// flush uploads the buffered part in the background.
+func (w *compositeWriter) flush() {
+	index := len(w.parts)
+	name := fmt.Sprintf("%s%06d", w.prefix, index)
+	w.parts = append(w.parts, name)
+
+	buf := w.buf
+	w.buf = make([]byte, 0, w.partSize)
+
+	w.sem <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			<-w.sem
+			w.wg.Done()
+		}()
+
+		crc := crc32.Checksum(buf, crc32.MakeTable(crc32.Castagnoli))
+		if w.uploaded(index, name, len(buf), crc) {
+			w.c.log("part %s was already uploaded", name)
+		} else {
+			if _, err := w.upload(w.bucketHandle.Object(name), buf, crc, nil); err != nil {
+				w.setError(fmt.Errorf("failed to upload part %s: %w", name, err))
+				return
+			}
+			if err := w.record(&uploadedPart{Index: index, Name: name, Size: len(buf), CRC32C: crc}); err != nil {
+				w.setError(err)
+				return
+			}
+		}
+
+		total := atomic.AddInt64(&w.total, int64(len(buf)))
+		if w.progress != nil {
+			w.progress(total)
+		}
+	}()
+}
+
+// uploaded returns true if a previous attempt uploaded the part with the same
+// contents.
+func (w *compositeWriter) uploaded(index int, name string, size int, crc uint32) bool {
+	w.stateMu.Lock()
+	p := w.state.part(index)
+	w.stateMu.Unlock()
+	if p == nil || p.Name != name || p.Size != size || p.CRC32C != crc {
+		return false
+	}
+
+	// The part may have been removed since, for example by a lifecycle rule
+	attrs, err := w.bucketHandle.Object(name).Attrs(w.ctx)
+	return err == nil && attrs.CRC32C == crc
+}
+
+// record records the part as uploaded in the state file.
+func (w *compositeWriter) record(p *uploadedPart) error {
+	if w.statePath == "" {
+		return nil
+	}
+
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	w.state.add(p)
+	return w.state.write(w.statePath)
+}
+
+// upload writes buf, which has the CRC32C checksum crc, to the object with the
+// metadata.
+func (w *compositeWriter) upload(handle *storage.ObjectHandle, buf []byte, crc uint32, metadata map[string]string) (*storage.ObjectAttrs, error) {
+	ow := handle.NewWriter(w.ctx)
+	ow.ObjectAttrs.ContentType = w.attrs.ContentType
+	ow.ObjectAttrs.CacheControl = w.attrs.CacheControl
+	ow.ObjectAttrs.ContentEncoding = w.attrs.ContentEncoding
+	ow.ObjectAttrs.KMSKeyName = w.attrs.KMSKeyName
+	ow.ObjectAttrs.Metadata = metadata
+	ow.ObjectAttrs.CustomTime = w.attrs.CustomTime
+	ow.ObjectAttrs.CRC32C = crc
+	ow.SendCRC32C = true
+
+	if _, err := ow.Write(buf); err != nil {
+		ow.Close()
+		return nil, err
+	}
+	if err := ow.Close(); err != nil {
+		return nil, err
+	}
+	return ow.Attrs(), nil
+}
+
+// Close uploads the last part, waits for all parts to finish, and composes
+// them into the final object. The parts are removed, unless the upload was
+// interrupted and can be resumed.
+func (w *compositeWriter) Close() (retErr error) {
+	defer func() {
+		if retErr != nil && w.statePath != "" && len(w.state.Parts) > 0 && resumable(retErr) {
+			w.c.warn("upload can be resumed using the state in %s", w.statePath)
+			return
+		}
+		w.cleanup()
+	}()
+
+	// Small objects are uploaded directly
+	if len(w.parts) == 0 {
+		crc := crc32.Checksum(w.buf, crc32.MakeTable(crc32.Castagnoli))
+		attrs, err := w.upload(w.handle, w.buf, crc, w.attrs.Metadata)
+		if err != nil {
+			return err
+		}
+		w.result = attrs
+		return nil
+	}
+
+	if len(w.buf) > 0 {
+		w.flush()
+	}
+	w.wg.Wait()
+
+	if err := w.error(); err != nil {
+		return err
+	}
+
+	attrs, err := w.compose(w.parts)
+	if err != nil {
+		return err
+	}
+	w.result = attrs
+	return nil
+}
+
+// compose composes the sources into the final object. If there are more
+// sources than can be composed at once, they are first composed into
+// intermediate objects.
+func (w *compositeWriter) compose(sources []string) (*storage.ObjectAttrs, error) {
+	for level := 0; len(sources) > maxComposeSources; level++ {
+		var next []string
+		for i := 0; i < len(sources); i += maxComposeSources {
+			end := i + maxComposeSources
+			if end > len(sources) {
+				end = len(sources)
+			}
+
+			name := fmt.Sprintf("%scompose-%d-%06d", w.prefix, level, len(next))
+			if _, err := w.composer(w.bucketHandle.Object(name), sources[i:end]).Run(w.ctx); err != nil {
+				return nil, fmt.Errorf("failed to compose parts: %w", err)
+			}
+			w.parts = append(w.parts, name)
+			next = append(next, name)
+		}
+		sources = next
+	}
+
+	w.c.log("composing %d parts", len(sources))
+	composer := w.composer(w.handle, sources)
+	composer.Metadata = w.attrs.Metadata
+	attrs, err := composer.Run(w.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compose parts: %w", err)
+	}
+	return attrs, nil
+}
+
+// composer returns a composer for the sources into the destination object.
+func (w *compositeWriter) composer(dst *storage.ObjectHandle, sources []string) *storage.Composer {
+	srcs := make([]*storage.ObjectHandle, 0, len(sources))
+	for _, name := range sources {
+		srcs = append(srcs, w.bucketHandle.Object(name))
+	}
+
+	composer := dst.ComposerFrom(srcs...)
+	composer.ContentType = w.attrs.ContentType
+	composer.CacheControl = w.attrs.CacheControl
+	composer.ContentEncoding = w.attrs.ContentEncoding
+	composer.KMSKeyName = w.attrs.KMSKeyName
+	composer.Metadata = w.attrs.Metadata
+	composer.CustomTime = w.attrs.CustomTime
+	return composer
+}
+
+// cleanup removes the parts and intermediate objects, including any which were
+// uploaded by a previous attempt, and the state file.
+func (w *compositeWriter) cleanup() {
+	names := make(map[string]struct{}, len(w.parts))
+	for _, name := range w.parts {
+		names[name] = struct{}{}
+	}
+	for _, p := range w.state.Parts {
+		names[p.Name] = struct{}{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	w.c.log("removing %d parts", len(names))
+	for name := range names {
+		if err := w.bucketHandle.Object(name).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			w.c.warn("failed to remove part %s: %s", name, err)
+		}
+	}
+
+	if w.statePath != "" {
+		if err := os.Remove(w.statePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			w.c.warn("failed to remove upload state: %s", err)
+		}
+	}
+}
+
+// Attrs returns the attributes of the final object after it is closed.
+func (w *compositeWriter) Attrs() *ObjectAttrs {
+	return fromGCSAttrs(w.result)
+}
+
+func (w *compositeWriter) error() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *compositeWriter) setError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// resumable returns true if the error interrupted an upload, like a
+// cancellation or a network or server error, so saving again may succeed.
+// Other errors, like a failed precondition or a missing permission, would
+// happen again.
+func resumable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusRequestTimeout || gerr.Code == http.StatusTooManyRequests || gerr.Code >= 500
+	}
+
+	// Errors from the gRPC API have a status instead
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		switch s.Code() {
+		case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.Unavailable:
+			return true
+		}
+		return false
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
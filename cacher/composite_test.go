@@ -0,0 +1,116 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSave_composite(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c, f := newTestCacher(t)
+
+	// More parts than can be composed at once
+	const partSize = 1024
+	data := make([]byte, 40*partSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Save(ctx, &SaveRequest{
+		Bucket:          "bucket",
+		Dir:             src,
+		Key:             "a",
+		Compression:     CompressionNone,
+		ParallelUploads: 4,
+		PartSize:        partSize,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	composed := f.composed
+	f.mu.Unlock()
+	var names []string
+	for _, name := range f.bucket("bucket").names() {
+		if !strings.HasPrefix(name, companionPrefix) || strings.HasPrefix(name, companionPrefix+"parts/") {
+			names = append(names, name)
+		}
+	}
+
+	if len(composed) < 2 || composed[0] != maxComposeSources {
+		t.Errorf("expected parts to be composed in groups of %d, got %d", maxComposeSources, composed)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected parts to be removed, got %q", names)
+	}
+
+	dst := t.TempDir()
+	if err := c.Restore(ctx, &RestoreRequest{
+		Bucket: "bucket",
+		Dir:    dst,
+		Keys:   []string{"a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dst, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("expected restored file to match saved file")
+	}
+}
+
+func TestResumable(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "canceled", err: fmt.Errorf("failed to upload part: %w", context.Canceled), want: true},
+		{name: "deadline", err: context.DeadlineExceeded, want: true},
+		{name: "unexpected_eof", err: io.ErrUnexpectedEOF, want: true},
+		{name: "network", err: &net.OpError{Op: "write", Err: errors.New("connection reset")}, want: true},
+		{name: "server_error", err: &googleapi.Error{Code: 503}, want: true},
+		{name: "rate_limited", err: &googleapi.Error{Code: 429}, want: true},
+		{name: "precondition", err: fmt.Errorf("failed to compose parts: %w", &googleapi.Error{Code: 412})},
+		{name: "forbidden", err: &googleapi.Error{Code: 403}},
+		{name: "grpc_unavailable", err: status.Error(codes.Unavailable, "unavailable"), want: true},
+		{name: "grpc_permission", err: status.Error(codes.PermissionDenied, "denied")},
+		{name: "local", err: errors.New("failed to walk files: permission denied")},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := resumable(tc.err); got != tc.want {
+				t.Errorf("expected %v to be %t", tc.err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package cacher
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression is the algorithm used to compress the cache archive.
+type Compression string
+
+const (
+	// CompressionGzip compresses the archive with gzip. This is the default.
+	CompressionGzip Compression = "gzip"
+
+	// CompressionZstd compresses the archive with zstd.
+	CompressionZstd Compression = "zstd"
+
+	// CompressionLZ4 compresses the archive with lz4. It is much faster than
+	// gzip or zstd, at the expense of a larger archive.
+	CompressionLZ4 Compression = "lz4"
+
+	// CompressionNone stores the archive as a plain tarball.
+	CompressionNone Compression = "none"
+)
+
+// ParseCompression parses the given string into a compression. The empty
+// string is returned as-is and means "default" when saving and "auto-detect"
+// when restoring.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case "", CompressionGzip, CompressionZstd, CompressionLZ4, CompressionNone:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q", s)
+	}
+}
+
+// contentType returns the content type of an archive compressed with c.
+func (c Compression) contentType() string {
+	switch c {
+	case CompressionZstd:
+		return "application/zstd"
+	case CompressionLZ4:
+		return "application/x-lz4"
+	case CompressionNone:
+		return "application/x-tar"
+	default:
+		return "application/gzip"
+	}
+}
+
+// gzipBlockSize is the size of each block compressed in parallel by the gzip
+// writer.
+const gzipBlockSize = 1 << 20
+
+// checkLevel returns an error if the level is not supported by the
+// compression. Levels use the numbers of the gzip, zstd, and lz4 command line
+// tools, and zero means the default level.
+func (c Compression) checkLevel(level int) error {
+	if level == 0 {
+		return nil
+	}
+
+	max := 0
+	switch c {
+	case "", CompressionGzip:
+		max = 9
+	case CompressionZstd:
+		max = 22
+	case CompressionLZ4:
+		max = 9
+	}
+	if level < 1 || level > max {
+		if max == 0 {
+			return fmt.Errorf("compression level is not supported with %s compression", c)
+		}
+		return fmt.Errorf("invalid compression level %d, expected 1-%d", level, max)
+	}
+	return nil
+}
+
+// newCompressWriter returns a writer that compresses into w using the given
+// compression. The workers argument controls how many goroutines are used for
+// compression, if supported by the algorithm. If workers is less than one, it
+// defaults to the number of available CPUs. If level is zero, the default
+// level of the compression is used.
+func newCompressWriter(w io.Writer, c Compression, workers, level int) (io.WriteCloser, error) {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	switch c {
+	case "", CompressionGzip:
+		gzw := pgzip.NewWriter(w)
+		if level != 0 {
+			var err error
+			if gzw, err = pgzip.NewWriterLevel(w, level); err != nil {
+				return nil, fmt.Errorf("failed to create gzip writer: %w", err)
+			}
+		}
+		if err := gzw.SetConcurrency(gzipBlockSize, workers); err != nil {
+			return nil, fmt.Errorf("failed to configure gzip writer: %w", err)
+		}
+		return gzw, nil
+	case CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(workers)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		zw, err := zstd.NewWriter(w, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+		}
+		return zw, nil
+	case CompressionLZ4:
+		lw := lz4.NewWriter(w)
+		if level != 0 {
+			if err := lw.Apply(lz4.CompressionLevelOption(lz4.CompressionLevel(1 << (8 + level)))); err != nil {
+				return nil, fmt.Errorf("failed to configure lz4 writer: %w", err)
+			}
+		}
+		return lw, nil
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c)
+	}
+}
+
+// newDecompressReader returns a reader that decompresses from r using the
+// given compression.
+func newDecompressReader(r io.Reader, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case "", CompressionGzip:
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		return gzr, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	case CompressionLZ4:
+		return io.NopCloser(lz4.NewReader(r)), nil
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c)
+	}
+}
+
+// magic is the list of leading bytes that identify each compression.
+var magic = []struct {
+	compression Compression
+	prefix      []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressionLZ4, []byte{0x04, 0x22, 0x4d, 0x18}},
+}
+
+// tarMagicOffset is the offset of the "ustar" magic in a tar header.
+const tarMagicOffset = 257
+
+// detectCompression determines the compression of the archive in br. The
+// magic bytes at the start of the archive take precedence, falling back to
+// the object's content type. The reader is not advanced.
+func detectCompression(contentType string, br *bufio.Reader) (Compression, error) {
+	head, err := br.Peek(tarMagicOffset + 5)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", fmt.Errorf("failed to read archive header: %w", err)
+	}
+
+	for _, m := range magic {
+		if bytes.HasPrefix(head, m.prefix) {
+			return m.compression, nil
+		}
+	}
+
+	if len(head) >= tarMagicOffset+5 && string(head[tarMagicOffset:]) == "ustar" {
+		return CompressionNone, nil
+	}
+
+	for _, c := range []Compression{CompressionGzip, CompressionZstd, CompressionLZ4, CompressionNone} {
+		if contentType == c.contentType() {
+			return c, nil
+		}
+	}
+
+	return "", fmt.Errorf("failed to detect compression for content type %q", contentType)
+}
+
+// nopWriteCloser is an io.WriteCloser with a no-op Close.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,74 @@
+package cacher
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// corruptError is an error caused by an archive which is corrupt or does not
+// match what was saved, like a truncated upload. Restoring the next candidate
+// may still succeed, unlike after errors writing the files, which would fail
+// the same way.
+type corruptError struct {
+	err error
+}
+
+func (e *corruptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *corruptError) Unwrap() error {
+	return e.err
+}
+
+// canFallBack returns true if the next candidate should be restored after the
+// error, because the object no longer exists or is corrupt.
+func canFallBack(err error) bool {
+	var cerr *corruptError
+	return errors.Is(err, ErrObjectNotExist) || errors.As(err, &cerr)
+}
+
+// downloadReader records whether downloading an object failed, so download
+// errors which pass through the archive readers are not mistaken for a corrupt
+// archive.
+type downloadReader struct {
+	io.Reader
+
+	// failed is set once a read fails. It is accessed atomically, since
+	// external decompressors read in the background.
+	failed int32
+}
+
+func (r *downloadReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		atomic.StoreInt32(&r.failed, 1)
+	}
+	return n, err
+}
+
+// corrupt marks an error reading the archive as caused by a corrupt archive,
+// unless downloading it failed.
+func (r *downloadReader) corrupt(err error) error {
+	var cerr *corruptError
+	if err == nil || atomic.LoadInt32(&r.failed) != 0 || errors.As(err, &cerr) {
+		return err
+	}
+	return &corruptError{err: err}
+}
+
+// corruptReader marks errors reading from an archive reader as caused by a
+// corrupt archive, unless downloading it failed.
+type corruptReader struct {
+	r  io.Reader
+	dl *downloadReader
+}
+
+func (r *corruptReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = r.dl.corrupt(err)
+	}
+	return n, err
+}
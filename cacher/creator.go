@@ -0,0 +1,100 @@
+package cacher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"google.golang.org/api/transport"
+)
+
+// creatorMetadataKey is the object metadata key which records the identity of
+// the principal that saved the archive.
+const creatorMetadataKey = "gcs-cacher-creator"
+
+// identity returns the email of the principal used to authenticate to Google
+// Cloud, or an empty string if it cannot be determined, like for end-user
+// credentials.
+func (c *Cacher) identity(ctx context.Context) (string, error) {
+	// Emulators do not authenticate requests
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" || os.Getenv("STORAGE_EMULATOR_HOST_GRPC") != "" {
+		return "", nil
+	}
+
+	// Requests are authenticated as the impersonated service account
+	if c.impersonate != "" {
+		return c.impersonate, nil
+	}
+	if c.accessToken || c.noAuth {
+		return "", nil
+	}
+
+	creds, err := transport.Creds(ctx, c.opts...)
+	if err != nil {
+		return "", fmt.Errorf("failed to find credentials: %w", err)
+	}
+
+	// Credentials from a file describe the account, otherwise they come from
+	// the metadata server
+	if creds.JSON != nil {
+		var f struct {
+			ClientEmail      string `json:"client_email"`
+			ImpersonationURL string `json:"service_account_impersonation_url"`
+		}
+		if err := json.Unmarshal(creds.JSON, &f); err != nil {
+			return "", fmt.Errorf("failed to parse credentials: %w", err)
+		}
+
+		if f.ImpersonationURL != "" {
+			// https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/EMAIL:generateAccessToken
+			name := f.ImpersonationURL[strings.LastIndex(f.ImpersonationURL, "/")+1:]
+			return strings.TrimSuffix(name, ":generateAccessToken"), nil
+		}
+		return f.ClientEmail, nil
+	}
+
+	if !metadata.OnGCE() {
+		return "", nil
+	}
+
+	email, err := metadata.Email("")
+	if err != nil {
+		return "", fmt.Errorf("failed to get service account from metadata server: %w", err)
+	}
+	return email, nil
+}
+
+// checkCreator returns an error if the object was not created by one of the
+// trusted principals.
+func checkCreator(md map[string]string, name string, trusted []string) error {
+	creator, ok := md[creatorMetadataKey]
+	if !ok || creator == "" {
+		return fmt.Errorf("%s does not record which principal created it", name)
+	}
+
+	for _, t := range trusted {
+		if strings.EqualFold(creator, t) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s was created by untrusted principal %s", name, creator)
+}
+
+// checkExternalAccount returns an error if the configuration is not for an
+// external account, since other credentials, like service account keys, would
+// be accepted in its place.
+func checkExternalAccount(config []byte) error {
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(config, &f); err != nil {
+		return fmt.Errorf("failed to parse external account configuration: %w", err)
+	}
+	if f.Type != "external_account" {
+		return fmt.Errorf("external account configuration has type %q, expected external_account", f.Type)
+	}
+	return nil
+}
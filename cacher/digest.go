@@ -0,0 +1,56 @@
+package cacher
+
+import (
+	"context"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// contentDigestMetadataKey is the object metadata key which holds the
+// hex-encoded SHA256 digest of the uncompressed archive, before any
+// compression or encryption.
+const contentDigestMetadataKey = "gcs-cacher-content-sha256"
+
+// newSaveFilter creates the path filter for the request, including the rules
+// from the ignore file at the root of the directory and the marker file.
+func newSaveFilter(i *SaveRequest) (*pathFilter, error) {
+	filter, err := newPathFilter(i.Include, i.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	if err := filter.addIgnoreFile(filepath.Join(i.Dir, ignoreFileName), ""); err != nil {
+		return nil, err
+	}
+	if err := filter.addSecrets(i.Secrets); err != nil {
+		return nil, err
+	}
+	if i.Marker != "" {
+		filter.marker = strings.Trim(path.Clean("/"+filepath.ToSlash(i.Marker)), "/")
+	}
+	return filter, nil
+}
+
+// contentDigest builds the archive for the request without uploading it and
+// returns its content digest.
+func (c *Cacher) contentDigest(ctx context.Context, i *SaveRequest) (string, error) {
+	// Ignore files found during the walk are added to the filter, so each
+	// walk needs its own
+	filter, err := newSaveFilter(i)
+	if err != nil {
+		return "", err
+	}
+
+	// The content digest is independent of how the archive is stored
+	di := *i
+	di.Index = false
+	di.ExternalCompressor = false
+	di.StoreIncompressible = false
+
+	metadata := make(map[string]string)
+	if err := c.writeArchive(ctx, io.Discard, &di, filter, nil, CompressionNone, metadata, true); err != nil {
+		return "", err
+	}
+	return metadata[contentDigestMetadataKey], nil
+}
@@ -0,0 +1,255 @@
+package cacher
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// encryptionMetadataKey is the object metadata key which records the
+	// algorithm used to encrypt the archive client-side.
+	encryptionMetadataKey = "gcs-cacher-encryption"
+
+	// encryptionAlgorithm is the client-side encryption algorithm. Archives are
+	// split into chunks which are each sealed with AES-256-GCM.
+	encryptionAlgorithm = "aes-256-gcm-stream"
+
+	// encryptionKeySize is the size of encryption keys in bytes.
+	encryptionKeySize = 32
+
+	// encryptionChunkSize is the size of each plaintext chunk.
+	encryptionChunkSize = 64 * 1024
+
+	// encryptionPrefixSize is the size of the random nonce prefix. The rest of
+	// each nonce is the chunk counter and a flag for the last chunk.
+	encryptionPrefixSize = 7
+)
+
+// encryptionMagic is written at the start of encrypted archives.
+var encryptionMagic = []byte("GCSCENC1")
+
+// errDecrypt is returned when an encrypted archive cannot be decrypted, either
+// because the key is wrong or the archive was modified.
+var errDecrypt = errors.New("failed to decrypt archive: wrong key or corrupt archive")
+
+// ParseEncryptionKey parses a client-side encryption key, which is either 32
+// raw bytes or the base64 encoding of 32 bytes.
+func ParseEncryptionKey(b []byte) ([]byte, error) {
+	if len(b) == encryptionKeySize {
+		return b, nil
+	}
+
+	s := string(bytes.TrimSpace(b))
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key must be %d bytes or base64-encoded", encryptionKeySize)
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", encryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+// newAEAD creates the cipher for the key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", encryptionKeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// chunkNonce returns the nonce for the chunk.
+func chunkNonce(nonce, prefix []byte, counter uint32, last bool) []byte {
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], counter)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts data written to it in chunks.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	out     []byte
+}
+
+// newEncryptWriter returns a writer which encrypts data with the key and
+// writes it to w. It must be closed to write the final chunk.
+func newEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	if _, err := w.Write(encryptionMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, 0, encryptionChunkSize),
+		out:    make([]byte, 0, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		// Only seal a full chunk once more data arrives, so the last chunk is
+		// always sealed by Close
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(e.buf[len(e.buf):encryptionChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close seals and writes the last chunk.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	nonce := chunkNonce(e.nonce, e.prefix, e.counter, last)
+	e.out = e.aead.Seal(e.out[:0], nonce, e.buf, nil)
+	if _, err := e.w.Write(e.out); err != nil {
+		return err
+	}
+
+	e.buf = e.buf[:0]
+	e.counter++
+	if e.counter == 0 {
+		return fmt.Errorf("archive is too large to encrypt")
+	}
+	return nil
+}
+
+// decryptReader decrypts data encrypted by encryptWriter.
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	nonce   []byte
+	counter uint32
+	in      []byte
+	buf     []byte
+	done    bool
+}
+
+// newDecryptReader returns a reader which decrypts the data in r with the key.
+func newDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encryptionMagic)+encryptionPrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	if !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+		return nil, fmt.Errorf("archive is not encrypted")
+	}
+
+	// Read one byte past each chunk to know if it is the last one
+	return &decryptReader{
+		r:      r,
+		aead:   aead,
+		prefix: header[len(encryptionMagic):],
+		nonce:  make([]byte, aead.NonceSize()),
+		in:     make([]byte, 0, encryptionChunkSize+aead.Overhead()+1),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (d *decryptReader) open() error {
+	size := encryptionChunkSize + d.aead.Overhead()
+
+	// Keep the extra byte read from the previous chunk
+	n, err := io.ReadFull(d.r, d.in[len(d.in):size+1])
+	d.in = d.in[:len(d.in)+n]
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+
+	last := len(d.in) <= size
+	chunk := d.in
+	if !last {
+		chunk = d.in[:size]
+	}
+
+	nonce := chunkNonce(d.nonce, d.prefix, d.counter, last)
+	plain, err := d.aead.Open(nil, nonce, chunk, nil)
+	if err != nil {
+		return errDecrypt
+	}
+
+	d.buf = plain
+	d.counter++
+	if last {
+		d.done = true
+		d.in = d.in[:0]
+		return nil
+	}
+
+	// Move the extra byte to the start of the buffer
+	d.in[0] = d.in[size]
+	d.in = d.in[:1]
+	return nil
+}
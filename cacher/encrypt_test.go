@@ -0,0 +1,115 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestore_encryptionKey(t *testing.T) {
+	t.Parallel()
+
+	key := bytes.Repeat([]byte{1}, 32)
+
+	cases := []struct {
+		name  string
+		setup func(t *testing.T, b *fakeGCSBucket)
+		key   []byte
+		err   bool
+	}{
+		{
+			name: "valid",
+			key:  key,
+		},
+		{
+			name: "missing_key",
+			err:  true,
+		},
+		{
+			name: "wrong_key",
+			key:  bytes.Repeat([]byte{2}, 32),
+			err:  true,
+		},
+		{
+			name: "unencrypted",
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				copyObject(t, b, "plain", "a")
+			},
+			key: key,
+			err: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c, f := newTestCacher(t)
+
+			if err := c.Save(ctx, &SaveRequest{
+				Bucket:        testBucket,
+				Dir:           writeFiles(t, map[string]string{"file": "secret"}),
+				Key:           "a",
+				EncryptionKey: key,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Save(ctx, &SaveRequest{
+				Bucket: testBucket,
+				Dir:    writeFiles(t, map[string]string{"file": "evil"}),
+				Key:    "plain",
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if tc.setup != nil {
+				tc.setup(t, f.bucket(testBucket))
+			}
+
+			dir := t.TempDir()
+			err := c.Restore(ctx, &RestoreRequest{
+				Bucket:        testBucket,
+				Dir:           dir,
+				Keys:          []string{"a"},
+				EncryptionKey: tc.key,
+			})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if got := readFiles(t, dir); len(got) > 0 {
+					t.Errorf("expected nothing to be restored, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := readFiles(t, dir)["file"], "secret"; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSave_encryptionKeyStateFile(t *testing.T) {
+	t.Parallel()
+
+	// Encrypted archives differ on every attempt, so they cannot be resumed
+	c, f := newTestCacher(t)
+	if err := c.Save(context.Background(), &SaveRequest{
+		Bucket:        testBucket,
+		Dir:           writeFiles(t, map[string]string{"file": "contents"}),
+		Key:           "a",
+		EncryptionKey: bytes.Repeat([]byte{1}, 32),
+		StateFile:     filepath.Join(t.TempDir(), "state.json"),
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+	if names := f.bucket(testBucket).names(); len(names) > 0 {
+		t.Errorf("expected nothing to be saved, got %q", names)
+	}
+}
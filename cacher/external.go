@@ -0,0 +1,198 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// externalCommand describes an external binary which implements a compression.
+type externalCommand struct {
+	name       string
+	compress   []string
+	decompress []string
+
+	// threads returns the arguments to use the given number of threads, if the
+	// binary supports it.
+	threads func(n int) []string
+}
+
+// externalCommands is the list of external binaries which can be used instead
+// of the native Go implementations.
+var externalCommands = map[Compression]externalCommand{
+	CompressionGzip: {
+		name:       "pigz",
+		compress:   []string{"-c"},
+		decompress: []string{"-d", "-c"},
+		threads:    func(n int) []string { return []string{"-p", strconv.Itoa(n)} },
+	},
+	CompressionZstd: {
+		name:       "zstd",
+		compress:   []string{"-c", "-q"},
+		decompress: []string{"-d", "-c", "-q"},
+		threads:    func(n int) []string { return []string{"-T" + strconv.Itoa(n)} },
+	},
+	CompressionLZ4: {
+		name:       "lz4",
+		compress:   []string{"-c", "-q"},
+		decompress: []string{"-d", "-c", "-q"},
+	},
+}
+
+// lookupExternal returns the path to and definition of the external binary for
+// the compression. It returns false if there is no external binary or it is
+// not installed.
+func lookupExternal(c Compression) (string, externalCommand, bool) {
+	if c == "" {
+		c = CompressionGzip
+	}
+
+	cmd, ok := externalCommands[c]
+	if !ok {
+		return "", cmd, false
+	}
+
+	pth, err := exec.LookPath(cmd.name)
+	if err != nil {
+		return "", cmd, false
+	}
+	return pth, cmd, true
+}
+
+// newExternalCompressWriter returns a writer that pipes data through an
+// external compression binary into w. It returns false if no binary is
+// available for the compression.
+func newExternalCompressWriter(ctx context.Context, w io.Writer, c Compression, workers, level int) (io.WriteCloser, bool, error) {
+	pth, def, ok := lookupExternal(c)
+	if !ok {
+		return nil, false, nil
+	}
+
+	args := append([]string{}, def.compress...)
+	if def.threads != nil && workers > 0 {
+		args = append(args, def.threads(workers)...)
+	}
+	if level > 0 {
+		// zstd requires a flag for levels above 19
+		if level > 19 {
+			args = append(args, "--ultra")
+		}
+		args = append(args, "-"+strconv.Itoa(level))
+	}
+
+	cmd := exec.CommandContext(ctx, pth, args...)
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create stdin pipe for %s: %w", def.name, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, false, fmt.Errorf("failed to start %s: %w", def.name, err)
+	}
+
+	return &externalWriter{
+		name:   def.name,
+		cmd:    cmd,
+		stdin:  stdin,
+		stderr: &stderr,
+	}, true, nil
+}
+
+// newExternalDecompressReader returns a reader that pipes data from r through
+// an external decompression binary. It returns false if no binary is available
+// for the compression.
+func newExternalDecompressReader(ctx context.Context, r io.Reader, c Compression) (io.ReadCloser, bool, error) {
+	pth, def, ok := lookupExternal(c)
+	if !ok {
+		return nil, false, nil
+	}
+
+	cmd := exec.CommandContext(ctx, pth, def.decompress...)
+	cmd.Stdin = r
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create stdout pipe for %s: %w", def.name, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, false, fmt.Errorf("failed to start %s: %w", def.name, err)
+	}
+
+	return &externalReader{
+		name:   def.name,
+		cmd:    cmd,
+		stdout: stdout,
+		stderr: &stderr,
+	}, true, nil
+}
+
+// externalWriter writes to the stdin of an external command.
+type externalWriter struct {
+	name   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr *bytes.Buffer
+}
+
+func (w *externalWriter) Write(p []byte) (int, error) {
+	return w.stdin.Write(p)
+}
+
+// Close closes stdin and waits for the command to finish.
+func (w *externalWriter) Close() error {
+	if err := w.stdin.Close(); err != nil {
+		return fmt.Errorf("failed to close stdin for %s: %w", w.name, err)
+	}
+	if err := w.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", w.name, err, strings.TrimSpace(w.stderr.String()))
+	}
+	return nil
+}
+
+// externalReader reads from the stdout of an external command.
+type externalReader struct {
+	name   string
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr *bytes.Buffer
+
+	// killed is set if the command was stopped before its output was read.
+	killed bool
+}
+
+func (r *externalReader) Read(p []byte) (int, error) {
+	return r.stdout.Read(p)
+}
+
+// kill stops the command without reading the rest of its output, so a restore
+// which failed does not decompress the rest of the archive.
+func (r *externalReader) kill() {
+	r.killed = true
+	_ = r.cmd.Process.Kill()
+}
+
+// Close drains any remaining output and waits for the command to finish. If
+// the command was killed, it only waits for it to exit.
+func (r *externalReader) Close() error {
+	if r.killed {
+		_ = r.cmd.Wait()
+		return nil
+	}
+
+	if _, err := io.Copy(io.Discard, r.stdout); err != nil {
+		return fmt.Errorf("failed to drain %s output: %w", r.name, err)
+	}
+	if err := r.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", r.name, err, strings.TrimSpace(r.stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// repeatReader returns the data count times.
+type repeatReader struct {
+	data  []byte
+	count int
+	off   int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.count == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.off:])
+	if r.off += n; r.off == len(r.data) {
+		r.off = 0
+		r.count--
+	}
+	return n, nil
+}
+
+func TestExternalReader(t *testing.T) {
+	t.Parallel()
+
+	if _, _, ok := lookupExternal(CompressionZstd); !ok {
+		t.Skip("zstd is not installed")
+	}
+
+	ctx := context.Background()
+	contents := strings.Repeat("a", 1<<20)
+
+	var frame bytes.Buffer
+	w, _, err := newExternalCompressWriter(ctx, &frame, CompressionZstd, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("eof", func(t *testing.T) {
+		t.Parallel()
+
+		r, _, err := newExternalDecompressReader(ctx, &repeatReader{data: frame.Bytes(), count: 2}, CompressionZstd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if want := contents + contents; string(got) != want {
+			t.Errorf("expected %d bytes, got %d", len(want), len(got))
+		}
+	})
+
+	t.Run("killed", func(t *testing.T) {
+		t.Parallel()
+
+		// Decompressing the whole input would take hours
+		in := &repeatReader{data: frame.Bytes(), count: 1 << 30}
+		r, _, err := newExternalDecompressReader(ctx, in, CompressionZstd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(r, make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			r.(*externalReader).kill()
+			done <- r.Close()
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("expected close to return after killing the command")
+		}
+	})
+}
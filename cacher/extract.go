@@ -0,0 +1,608 @@
+package cacher
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxReported is the maximum number of entries listed in warnings.
+const maxReported = 10
+
+// extractor writes archive entries to disk. It holds the state of a single
+// restore operation.
+type extractor struct {
+	c   *Cacher
+	dir string
+
+	// preserveOwner restores the archived uid and gid of each entry.
+	preserveOwner bool
+
+	// xattrs restores the archived extended attributes of each entry.
+	xattrs bool
+
+	// sparse writes blocks of zeros as holes.
+	sparse bool
+
+	// paths is the list of files or directories within the archive to extract.
+	// It is empty to extract every entry. matched is the number of entries
+	// which matched.
+	paths   []string
+	matched int
+
+	// subpath is the directory within the archive to restore. Only entries
+	// inside it are extracted, relative to it. It is empty to restore the
+	// entire archive.
+	subpath string
+
+	// stripComponents is the number of leading path components removed from
+	// each entry name, after the subpath.
+	stripComponents int
+
+	// mappings is the list of directories within the archive which are
+	// extracted to other directories on disk, longest prefix first.
+	mappings []*dirMapping
+
+	// files maps the archive name of each extracted regular file to its path
+	// on disk, for verifying against a manifest. It is nil if files are not
+	// tracked.
+	files map[string]string
+
+	// dryRun is where entries are listed instead of being extracted. It is nil
+	// to extract entries.
+	dryRun io.Writer
+
+	// maxBytes and maxFiles limit the total size and number of extracted
+	// entries. They are unlimited if zero. written and extracted are the
+	// totals so far.
+	maxBytes  int64
+	maxFiles  int64
+	written   int64
+	extracted int64
+
+	// umask is removed from the mode of each entry. fileMode and dirMode
+	// replace the archived modes of files and directories if they are not zero.
+	umask    os.FileMode
+	fileMode os.FileMode
+	dirMode  os.FileMode
+
+	// normalization is applied to entry names before they are written.
+	normalization Normalization
+
+	// caseCollisions is the action to take when entries collide on a
+	// case-insensitive filesystem. folded maps the lowercased name of each
+	// entry to its original name. It is nil if collisions are not checked.
+	caseCollisions CaseCollisions
+	folded         map[string]string
+
+	// skipped is the list of entries which were skipped because their names
+	// are invalid on this platform.
+	skipped []string
+
+	// pool writes small files in the background. It is nil if files are
+	// written as they are read.
+	pool *writePool
+
+	// dirs is the list of directories extracted from the archive. Their
+	// permissions and modification times are applied after all entries are
+	// extracted, since restrictive permissions could prevent writing children
+	// and writing children changes the modification time.
+	dirs []*extractedDir
+}
+
+// dirMapping extracts the entries inside a directory in the archive to another
+// directory on disk.
+type dirMapping struct {
+	prefix string
+	dir    string
+}
+
+// extractedDir is a directory extracted from the archive.
+type extractedDir struct {
+	target string
+	header *tar.Header
+}
+
+// wait waits for any files being written in the background.
+func (e *extractor) wait() error {
+	if e.pool == nil {
+		return nil
+	}
+	return e.pool.wait()
+}
+
+// extract writes the archive entry described by header, with contents read
+// from r, into the target directory.
+func (e *extractor) extract(header *tar.Header, r io.Reader) error {
+	c := e.c
+	archiveName := header.Name
+
+	// Stop as soon as a file fails to be written in the background
+	if e.pool != nil {
+		if err := e.pool.error(); err != nil {
+			return err
+		}
+	}
+
+	if len(e.paths) > 0 {
+		if !matchesPaths(strings.TrimSuffix(header.Name, "/"), e.paths) {
+			return nil
+		}
+		e.matched++
+		if header.Typeflag == tar.TypeLink && !matchesPaths(header.Linkname, e.paths) {
+			c.warn("skipping %s (links to %s, which is not extracted)", header.Name, header.Linkname)
+			return nil
+		}
+	}
+
+	name, ok := e.rename(header.Name)
+	if !ok {
+		c.log("not extracting %s", header.Name)
+		return nil
+	}
+	dir, name := e.resolve(name)
+	if name == "" {
+		// The entry is the root of a mapped directory, which already exists
+		return nil
+	}
+	header.Name = name
+
+	linkDir := dir
+	if header.Typeflag == tar.TypeLink {
+		linkname, ok := e.rename(header.Linkname)
+		if !ok {
+			c.warn("skipping %s (links to %s, which is not extracted)", header.Name, header.Linkname)
+			return nil
+		}
+		linkDir, header.Linkname = e.resolve(linkname)
+	}
+
+	header.Name = e.normalization.apply(header.Name)
+	header.Linkname = e.normalization.apply(header.Linkname)
+
+	if reason := invalidName(header.Name); reason != "" {
+		c.log("skipping %s (%s)", header.Name, reason)
+		e.skipped = append(e.skipped, header.Name)
+		return nil
+	}
+
+	if err := e.checkCollision(dir, header.Name); err != nil {
+		return err
+	}
+
+	target, err := safeJoin(dir, header.Name)
+	if err != nil {
+		return err
+	}
+	target = longPath(target)
+	if e.dryRun != nil {
+		line := fmt.Sprintf("%12d  %s", header.Size, target)
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			line += " -> " + header.Linkname
+		case tar.TypeLink:
+			line += " link to " + longPath(filepath.Join(linkDir, header.Linkname))
+		}
+		if _, err := fmt.Fprintln(e.dryRun, line); err != nil {
+			return fmt.Errorf("failed to list %s: %w", target, err)
+		}
+		return nil
+	}
+	c.log("working on %s", target)
+
+	e.extracted++
+	if e.maxFiles > 0 && e.extracted > e.maxFiles {
+		return fmt.Errorf("archive exceeds the limit of %d entries", e.maxFiles)
+	}
+	if e.maxBytes > 0 && e.written+header.Size > e.maxBytes {
+		return fmt.Errorf("archive exceeds the limit of %d bytes", e.maxBytes)
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		c.log("creating directory %s", target)
+
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("failed to make directory %s: %w", target, err)
+		}
+		e.dirs = append(e.dirs, &extractedDir{target: target, header: header})
+	case tar.TypeReg, tar.TypeGNUSparse:
+		c.log("creating file %s", target)
+
+		// Create the parent directory in case it does not exist...
+		parent := filepath.Dir(target)
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return fmt.Errorf("failed to make parent directory %s: %w", parent, err)
+		}
+
+		// Small files are read into memory and written in the background, so
+		// reading the archive is not blocked on writing many small files
+		if e.pool != nil && header.Size <= maxBufferedFile {
+			if e.pool.pending(target) {
+				c.log("waiting for pending writes to %s", target)
+				if err := e.pool.wait(); err != nil {
+					return err
+				}
+			}
+
+			src := r
+			if e.maxBytes > 0 {
+				src = io.LimitReader(r, e.maxBytes-e.written+1)
+			}
+			buf, err := io.ReadAll(src)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", archiveName, err)
+			}
+			e.written += int64(len(buf))
+			if e.maxBytes > 0 && e.written > e.maxBytes {
+				return fmt.Errorf("archive exceeds the limit of %d bytes", e.maxBytes)
+			}
+
+			e.pool.run(target, func() error {
+				_, err := e.writeFile(target, bytes.NewReader(buf), header, -1)
+				return err
+			})
+		} else {
+			if e.pool != nil && e.pool.pending(target) {
+				c.log("waiting for pending writes to %s", target)
+				if err := e.pool.wait(); err != nil {
+					return err
+				}
+			}
+
+			limit := int64(-1)
+			if e.maxBytes > 0 {
+				limit = e.maxBytes - e.written
+			}
+			n, err := e.writeFile(target, r, header, limit)
+			e.written += n
+			if err != nil {
+				return err
+			}
+		}
+
+		if e.files != nil {
+			e.files[archiveName] = target
+		}
+	case tar.TypeLink:
+		source, err := safeJoin(linkDir, header.Linkname)
+		if err != nil {
+			return err
+		}
+
+		// The file being linked to may still be written in the background
+		if err := e.wait(); err != nil {
+			return err
+		}
+		source = longPath(source)
+		c.log("linking %s to %s", target, source)
+
+		parent := filepath.Dir(target)
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return fmt.Errorf("failed to make parent directory %s: %w", parent, err)
+		}
+
+		// Replace any existing file, since links cannot be created over them
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove existing %s: %w", target, err)
+		}
+		if err := os.Link(source, target); err != nil {
+			return fmt.Errorf("failed to link %s to %s: %w", target, source, err)
+		}
+	default:
+		return fmt.Errorf("unknown header type %v for %s", header.Typeflag, target)
+	}
+
+	return nil
+}
+
+// writeFile writes the contents of the regular file entry from r to a staging
+// file, which replaces target once it is complete, so an interrupted restore
+// never leaves a truncated file. If limit is not negative, it fails without
+// replacing target if more than limit bytes are read. It returns the number of
+// bytes read.
+func (e *extractor) writeFile(target string, r io.Reader, header *tar.Header, limit int64) (int64, error) {
+	c := e.c
+
+	c.log("creating staging file for %s", target)
+	f, err := os.CreateTemp(filepath.Dir(target), ".gcs-cacher-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create staging file for %s: %w", target, err)
+	}
+	staging := f.Name()
+
+	n, err := e.writeStaging(f, r, header, limit)
+	if err != nil {
+		if rerr := os.Remove(staging); rerr != nil {
+			return n, fmt.Errorf("%v: failed to remove staging file %s: %w", err, staging, rerr)
+		}
+		return n, fmt.Errorf("failed to untar %s: %w", target, err)
+	}
+
+	c.log("moving staging file to %s", target)
+	if err := os.Rename(staging, target); err != nil {
+		if rerr := os.Remove(staging); rerr != nil {
+			return n, fmt.Errorf("failed to move %s to %s: %v: failed to remove staging file: %w", staging, target, err, rerr)
+		}
+		return n, fmt.Errorf("failed to move %s to %s: %w", staging, target, err)
+	}
+	return n, nil
+}
+
+// writeStaging copies the contents of the regular file entry from r to the
+// staging file f, closes it, and applies the entry's metadata.
+func (e *extractor) writeStaging(f *os.File, r io.Reader, header *tar.Header, limit int64) (int64, error) {
+	c := e.c
+	name := f.Name()
+
+	// Do not trust the size in the header
+	src := r
+	if limit >= 0 {
+		src = io.LimitReader(r, limit+1)
+	}
+
+	c.log("copying %s to disk", name)
+	var n int64
+	var err error
+	if e.sparse {
+		n, err = copySparse(f, src)
+	} else {
+		n, err = e.c.copyBuffered(f, src)
+	}
+	if err == nil && limit >= 0 && n > limit {
+		err = fmt.Errorf("archive exceeds the limit of %d bytes", e.maxBytes)
+	}
+	if err != nil {
+		if cerr := f.Close(); cerr != nil {
+			return n, fmt.Errorf("failed to close %s: %v: %w", name, cerr, err)
+		}
+		return n, err
+	}
+
+	// Close f here instead of deferring
+	c.log("closing %s", name)
+	if err := f.Close(); err != nil {
+		return n, fmt.Errorf("failed to close %s: %w", name, err)
+	}
+
+	if err := e.chown(name, header); err != nil {
+		return n, err
+	}
+
+	if err := e.setXattrs(name, header); err != nil {
+		return n, err
+	}
+
+	// Staging files are created with restrictive permissions
+	c.log("setting permissions on %s", name)
+	if err := os.Chmod(name, e.mode(header)); err != nil {
+		return n, fmt.Errorf("failed to set permissions on %s: %w", name, err)
+	}
+
+	c.log("setting modification time on %s", name)
+	if err := os.Chtimes(name, header.ModTime, header.ModTime); err != nil {
+		return n, fmt.Errorf("failed to set modification time on %s: %w", name, err)
+	}
+	return n, nil
+}
+
+// safeJoin joins the archive entry name to dir. It returns an error if the
+// name is absolute or refers to a path outside of dir, which could be used by a
+// malicious archive to overwrite arbitrary files.
+func safeJoin(dir, name string) (string, error) {
+	local := filepath.FromSlash(name)
+	if filepath.IsAbs(local) || filepath.VolumeName(local) != "" ||
+		strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") {
+		return "", fmt.Errorf("refusing to extract %s: absolute paths are not allowed", name)
+	}
+
+	local = filepath.Clean(local)
+	if local == ".." || strings.HasPrefix(local, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to extract %s: path is outside of the target directory", name)
+	}
+	return filepath.Join(dir, local), nil
+}
+
+// mode returns the permissions for the entry, after applying the forced modes
+// and umask.
+func (e *extractor) mode(header *tar.Header) os.FileMode {
+	mode := header.FileInfo().Mode().Perm()
+	if header.Typeflag == tar.TypeDir {
+		if e.dirMode != 0 {
+			mode = e.dirMode
+		}
+	} else if e.fileMode != 0 {
+		mode = e.fileMode
+	}
+	return mode &^ e.umask
+}
+
+// selected returns true if the archive entry with the name is extracted by the
+// paths, subpath, and stripped components of the restore. Mapped directories
+// only change where entries are extracted.
+func (e *extractor) selected(name string) bool {
+	if len(e.paths) > 0 && !matchesPaths(strings.TrimSuffix(name, "/"), e.paths) {
+		return false
+	}
+	_, ok := e.rename(name)
+	return ok
+}
+
+// rename returns the name of the archive entry relative to the target
+// directory, after applying the subpath and stripping components. It returns
+// false if the entry is not extracted.
+func (e *extractor) rename(name string) (string, bool) {
+	if e.subpath == "" && e.stripComponents == 0 {
+		return name, true
+	}
+
+	suffix := ""
+	if strings.HasSuffix(name, "/") {
+		suffix = "/"
+	}
+	name = strings.Trim(name, "/")
+
+	if e.subpath != "" {
+		if !strings.HasPrefix(name, e.subpath+"/") {
+			return "", false
+		}
+		name = strings.TrimPrefix(name, e.subpath+"/")
+	}
+
+	if e.stripComponents > 0 {
+		parts := strings.SplitN(name, "/", e.stripComponents+1)
+		if len(parts) <= e.stripComponents {
+			return "", false
+		}
+		name = parts[e.stripComponents]
+	}
+	return name + suffix, true
+}
+
+// resolve returns the directory on disk in which to extract the entry and its
+// name relative to that directory. Entries which are not inside a mapped
+// prefix are extracted to the target directory.
+func (e *extractor) resolve(name string) (string, string) {
+	for _, m := range e.mappings {
+		trimmed := strings.TrimSuffix(name, "/")
+		if trimmed == m.prefix {
+			return m.dir, ""
+		}
+		if strings.HasPrefix(name, m.prefix+"/") {
+			return m.dir, strings.TrimPrefix(name, m.prefix+"/")
+		}
+	}
+	return e.dir, name
+}
+
+// finish applies the archived permissions and modification times to the
+// extracted directories. Directories are processed deepest first so that
+// restrictive permissions on a parent do not prevent updating its children.
+func (e *extractor) finish() error {
+	c := e.c
+
+	if err := e.wait(); err != nil {
+		return err
+	}
+
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		d := e.dirs[i]
+
+		if err := e.chown(d.target, d.header); err != nil {
+			return err
+		}
+
+		if err := e.setXattrs(d.target, d.header); err != nil {
+			return err
+		}
+
+		c.log("setting permissions on %s", d.target)
+		if err := os.Chmod(d.target, e.mode(d.header)); err != nil {
+			return fmt.Errorf("failed to set permissions on %s: %w", d.target, err)
+		}
+
+		c.log("setting modification time on %s", d.target)
+		if err := os.Chtimes(d.target, d.header.ModTime, d.header.ModTime); err != nil {
+			return fmt.Errorf("failed to set modification time on %s: %w", d.target, err)
+		}
+	}
+
+	if n := len(e.skipped); n > 0 {
+		names := e.skipped
+		if n > maxReported {
+			names = names[:maxReported]
+		}
+		c.warn("skipped %d entries with names which are invalid on this platform: %s",
+			n, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// chown sets the owner of target to the archived uid and gid, if ownership is
+// being preserved.
+func (e *extractor) chown(target string, header *tar.Header) error {
+	if !e.preserveOwner {
+		return nil
+	}
+
+	e.c.log("setting owner of %s to %d:%d", target, header.Uid, header.Gid)
+	if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+		return fmt.Errorf("failed to set owner of %s: %w", target, err)
+	}
+	return nil
+}
+
+// setXattrs sets the archived extended attributes on target, if extended
+// attributes are being restored. It must be called after chown, since changing
+// the owner clears some attributes like security.capability.
+func (e *extractor) setXattrs(target string, header *tar.Header) error {
+	if !e.xattrs {
+		return nil
+	}
+
+	attrs := headerXattrs(header)
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	e.c.log("setting extended attributes on %s", target)
+	if err := writeXattrs(target, attrs); err != nil {
+		return fmt.Errorf("failed to set extended attributes on %s: %w", target, err)
+	}
+	return nil
+}
+
+// checkCollision records the entry name and reports if it collides with a
+// previous entry in the same directory on a case-insensitive filesystem.
+func (e *extractor) checkCollision(dir, name string) error {
+	if e.folded == nil {
+		return nil
+	}
+
+	name = strings.TrimSuffix(name, "/")
+	key := dir + "\x00" + strings.ToLower(name)
+	prev, ok := e.folded[key]
+	e.folded[key] = name
+	if !ok || prev == name {
+		return nil
+	}
+
+	if e.caseCollisions == CaseCollisionsWarn {
+		e.c.warn("%s overwrites %s on a case-insensitive filesystem", name, prev)
+		return nil
+	}
+	return fmt.Errorf("%s collides with %s on a case-insensitive filesystem", name, prev)
+}
+
+// cleanDir removes the contents of dir, but not dir itself, since it may be a
+// mount point. It does nothing if dir does not exist.
+func (c *Cacher) cleanDir(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", dir, err)
+	}
+	if abs == filepath.Dir(abs) {
+		return fmt.Errorf("refusing to clean root directory %s", abs)
+	}
+
+	entries, err := os.ReadDir(longPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+
+	c.log("removing %d entries from %s", len(entries), dir)
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if err := os.RemoveAll(longPath(name)); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package cacher
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.FromSlash("/cache/dir")
+
+	cases := []struct {
+		name  string
+		entry string
+		want  string
+		err   bool
+	}{
+		{
+			name:  "file",
+			entry: "file",
+			want:  "file",
+		},
+		{
+			name:  "nested",
+			entry: "a/b/c",
+			want:  "a/b/c",
+		},
+		{
+			name:  "dot",
+			entry: "./a",
+			want:  "a",
+		},
+		{
+			name:  "inner_parent",
+			entry: "a/../b",
+			want:  "b",
+		},
+		{
+			name:  "parent",
+			entry: "..",
+			err:   true,
+		},
+		{
+			name:  "parent_prefix",
+			entry: "../evil",
+			err:   true,
+		},
+		{
+			name:  "nested_parent",
+			entry: "a/../../evil",
+			err:   true,
+		},
+		{
+			name:  "deep_parent",
+			entry: "a/b/../../../../etc/passwd",
+			err:   true,
+		},
+		{
+			name:  "absolute",
+			entry: "/etc/passwd",
+			err:   true,
+		},
+		{
+			name:  "backslash",
+			entry: `\evil`,
+			err:   true,
+		},
+		{
+			name:  "dot_dot_name",
+			entry: "..evil",
+			want:  "..evil",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := safeJoin(dir, tc.entry)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(dir, filepath.FromSlash(tc.want)); got != want {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+		})
+	}
+}
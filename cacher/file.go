@@ -0,0 +1,69 @@
+package cacher
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// fileID uniquely identifies a file on disk.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// paxXattrPrefix is the prefix of PAX records which hold extended attributes.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// headerXattrs returns the extended attributes stored in the header.
+func headerXattrs(header *tar.Header) map[string]string {
+	var attrs map[string]string
+	for k, v := range header.PAXRecords {
+		if name := strings.TrimPrefix(k, paxXattrPrefix); name != k {
+			if attrs == nil {
+				attrs = make(map[string]string)
+			}
+			attrs[name] = v
+		}
+	}
+	return attrs
+}
+
+// specialFileType returns a human-readable name for the type of a file which
+// is neither a regular file nor a directory.
+func specialFileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	default:
+		return "irregular file"
+	}
+}
+
+// skippedFiles counts the files skipped while saving, by type.
+type skippedFiles map[string]int
+
+// String returns a summary of the skipped files like "2 symlink, 1 socket".
+func (s skippedFiles) String() string {
+	kinds := make([]string, 0, len(s))
+	for kind := range s {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		parts = append(parts, fmt.Sprintf("%d %s", s[kind], kind))
+	}
+	return strings.Join(parts, ", ")
+}
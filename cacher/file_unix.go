@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package cacher
+
+import (
+	"os"
+	"syscall"
+)
+
+// hardLinkID returns the identity of the file if it has more than one hard
+// link.
+func hardLinkID(fi os.FileInfo) (fileID, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// deviceID returns the ID of the device containing the file.
+func deviceID(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package cacher
+
+import (
+	"os"
+)
+
+// hardLinkID returns the identity of the file if it has more than one hard
+// link. Hard links are not detected on Windows.
+func hardLinkID(fi os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// deviceID returns the ID of the device containing the file. Devices are not
+// detected on Windows.
+func deviceID(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
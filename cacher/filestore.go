@@ -0,0 +1,572 @@
+package cacher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// fileAttrsDir is the directory in a file store which holds the attributes
+	// of each object, and fileTempDir holds objects which are being written and
+	// locks.
+	fileAttrsDir = ".gcs-cacher-attrs"
+	fileTempDir  = ".gcs-cacher-tmp"
+
+	// fileLockStale is how old a lock in a file store must be before it is
+	// considered abandoned, like when the process holding it was killed. Locks
+	// are only held while an object is renamed into place.
+	fileLockStale = 30 * time.Second
+
+	// fileRetryInterval is how long to wait before checking a lock or an
+	// object which is being replaced again, and fileRetries is how many times
+	// an object which is being replaced is opened again.
+	fileRetryInterval = 10 * time.Millisecond
+	fileRetries       = 100
+)
+
+// fileStore stores objects as files in a directory, which can be on a local
+// disk or a network share. The attributes of each object are written to a
+// separate file after its contents, so objects without attributes, like those
+// which are still being written, do not exist yet.
+type fileStore struct {
+	bucket string
+	root   string
+}
+
+// newFileStore creates a store for the directory at root. The bucket is the
+// name reported in the attributes of objects.
+func newFileStore(bucket, root string) *fileStore {
+	return &fileStore{
+		bucket: bucket,
+		root:   root,
+	}
+}
+
+// fileAttrs are the attributes of an object in a file store.
+type fileAttrs struct {
+	Generation      int64             `json:"generation"`
+	Size            int64             `json:"size"`
+	ModTime         int64             `json:"modTime"`
+	ContentType     string            `json:"contentType,omitempty"`
+	CacheControl    string            `json:"cacheControl,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	CRC32C          uint32            `json:"crc32c"`
+	Updated         time.Time         `json:"updated"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// paths returns the paths of the file which holds the object's contents and
+// the file which holds its attributes.
+func (s *fileStore) paths(name string) (string, string, error) {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") ||
+		path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") ||
+		(filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator)) {
+		return "", "", fmt.Errorf("invalid object name %q", name)
+	}
+	if first := strings.SplitN(name, "/", 2)[0]; first == fileAttrsDir || first == fileTempDir {
+		return "", "", fmt.Errorf("invalid object name %q", name)
+	}
+
+	local := filepath.FromSlash(name)
+	return filepath.Join(s.root, local), filepath.Join(s.root, fileAttrsDir, local), nil
+}
+
+// readAttrs reads the attributes of the object, or returns ErrObjectNotExist.
+func (s *fileStore) readAttrs(name string) (*fileAttrs, error) {
+	_, attrsPath, err := s.paths(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(attrsPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrObjectNotExist
+		}
+		return nil, fmt.Errorf("failed to read attributes of %s: %w", name, err)
+	}
+
+	var fa fileAttrs
+	if err := json.Unmarshal(b, &fa); err != nil {
+		return nil, fmt.Errorf("failed to parse attributes of %s: %w", name, err)
+	}
+	return &fa, nil
+}
+
+// writeAttrs replaces the attributes of the object.
+func (s *fileStore) writeAttrs(name string, fa *fileAttrs) error {
+	_, attrsPath, err := s.paths(name)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(fa)
+	if err != nil {
+		return fmt.Errorf("failed to encode attributes of %s: %w", name, err)
+	}
+
+	f, err := s.createTemp()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write attributes of %s: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to close attributes of %s: %w", name, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(attrsPath), 0o755); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to create directory for attributes of %s: %w", name, err)
+	}
+	if err := os.Rename(f.Name(), attrsPath); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to save attributes of %s: %w", name, err)
+	}
+	return nil
+}
+
+// createTemp creates a temporary file on the same file system as the objects,
+// so it can be renamed into place.
+func (s *fileStore) createTemp() (*os.File, error) {
+	dir := filepath.Join(s.root, fileTempDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	f, err := os.CreateTemp(dir, "object-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	return f, nil
+}
+
+// lock waits until no other process is changing the object, and returns a
+// function which releases the lock.
+func (s *fileStore) lock(ctx context.Context, name string) (func(), error) {
+	dir := filepath.Join(s.root, fileTempDir, "locks")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	lockPath := filepath.Join(dir, hex.EncodeToString(sum[:]))
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("failed to lock %s: %w", name, err)
+		}
+
+		// Remove locks which were abandoned
+		if stat, err := os.Stat(lockPath); err == nil && time.Since(stat.ModTime()) > fileLockStale {
+			os.Remove(lockPath)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to lock %s: %w", name, ctx.Err())
+		case <-time.After(fileRetryInterval):
+		}
+	}
+}
+
+// objectAttrs converts the attributes of the object.
+func (s *fileStore) objectAttrs(name string, fa *fileAttrs) *ObjectAttrs {
+	return &ObjectAttrs{
+		Bucket:          s.bucket,
+		Name:            name,
+		Size:            fa.Size,
+		ContentType:     fa.ContentType,
+		CacheControl:    fa.CacheControl,
+		ContentEncoding: fa.ContentEncoding,
+		Updated:         fa.Updated,
+		Generation:      fa.Generation,
+		CRC32C:          fa.CRC32C,
+		HasCRC32C:       true,
+		Metadata:        fa.Metadata,
+	}
+}
+
+func (s *fileStore) Attrs(ctx context.Context, name string, generation int64) (*ObjectAttrs, error) {
+	fa, err := s.readAttrs(name)
+	if err != nil {
+		return nil, err
+	}
+	if generation != 0 && fa.Generation != generation {
+		return nil, ErrObjectNotExist
+	}
+	return s.objectAttrs(name, fa), nil
+}
+
+func (s *fileStore) List(ctx context.Context, prefix string) ([]*ObjectAttrs, error) {
+	attrsRoot := filepath.Join(s.root, fileAttrsDir)
+
+	var names []string
+	if err := filepath.WalkDir(attrsRoot, func(pth string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if pth == attrsRoot && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(attrsRoot, pth)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+
+		// Only descend into directories which can hold matching objects
+		if d.IsDir() {
+			if !strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", s.root, err)
+	}
+
+	list := make([]*ObjectAttrs, 0, len(names))
+	for _, name := range names {
+		fa, err := s.readAttrs(name)
+		if err != nil {
+			// The object was deleted while listing
+			if errors.Is(err, ErrObjectNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		list = append(list, s.objectAttrs(name, fa))
+	}
+	return list, nil
+}
+
+func (s *fileStore) NewReader(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	dataPath, _, err := s.paths(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The contents of an object are replaced before its attributes, so the
+	// opened file only belongs to the attributes if it has the recorded size
+	// and modification time. Otherwise it is being replaced.
+	for attempt := 0; ; attempt++ {
+		fa, err := s.readAttrs(name)
+		if err != nil {
+			return nil, err
+		}
+		if generation != 0 && fa.Generation != generation {
+			return nil, ErrObjectNotExist
+		}
+
+		f, err := os.Open(dataPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, ErrObjectNotExist
+			}
+			return nil, fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to stat %s: %w", name, err)
+		}
+		if stat.Size() == fa.Size && stat.ModTime().UnixNano() == fa.ModTime {
+			if offset > fa.Size {
+				offset = fa.Size
+			}
+			n := fa.Size - offset
+			if length >= 0 && length < n {
+				n = length
+			}
+			return &fileReader{
+				ctx: ctx,
+				r:   io.NewSectionReader(f, offset, n),
+				f:   f,
+			}, nil
+		}
+		f.Close()
+
+		if attempt >= fileRetries {
+			return nil, fmt.Errorf("%s does not match its attributes", name)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(fileRetryInterval):
+		}
+	}
+}
+
+func (s *fileStore) NewWriter(ctx context.Context, name string, opts *WriterOptions) ObjectWriter {
+	return &fileWriter{
+		s:    s,
+		ctx:  ctx,
+		name: name,
+		opts: opts,
+		crc:  crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+	}
+}
+
+func (s *fileStore) Update(ctx context.Context, name string, generation int64, metadata map[string]string) error {
+	unlock, err := s.lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fa, err := s.readAttrs(name)
+	if err != nil {
+		return err
+	}
+	if generation != 0 && fa.Generation != generation {
+		return fmt.Errorf("%w: %s is generation %d, not %d", ErrPreconditionFailed, name, fa.Generation, generation)
+	}
+
+	if fa.Metadata == nil {
+		fa.Metadata = make(map[string]string)
+	}
+	for k, v := range metadata {
+		if v == "" {
+			delete(fa.Metadata, k)
+			continue
+		}
+		fa.Metadata[k] = v
+	}
+	return s.writeAttrs(name, fa)
+}
+
+func (s *fileStore) Delete(ctx context.Context, name string, generation int64) error {
+	dataPath, attrsPath, err := s.paths(name)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fa, err := s.readAttrs(name)
+	if err != nil {
+		return err
+	}
+	if generation != 0 && fa.Generation != generation {
+		return fmt.Errorf("%w: %s is generation %d, not %d", ErrPreconditionFailed, name, fa.Generation, generation)
+	}
+
+	// Remove the attributes first, so the object no longer exists even if
+	// removing its contents fails
+	if err := os.Remove(attrsPath); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	if err := os.Remove(dataPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	return nil
+}
+
+// fileReader reads a range of an object in a file store.
+type fileReader struct {
+	ctx context.Context
+	r   *io.SectionReader
+	f   *os.File
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func (r *fileReader) Close() error {
+	return r.f.Close()
+}
+
+// fileWriter writes an object in a file store to a temporary file, which is
+// moved into place when the writer is closed.
+type fileWriter struct {
+	s    *fileStore
+	ctx  context.Context
+	name string
+	opts *WriterOptions
+
+	f    *os.File
+	crc  hash.Hash32
+	size int64
+	err  error
+
+	attrs *ObjectAttrs
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.ctx.Err(); err != nil {
+		w.err = err
+		return 0, err
+	}
+
+	if w.f == nil {
+		f, err := w.s.createTemp()
+		if err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.f = f
+	}
+
+	n, err := w.f.Write(p)
+	w.crc.Write(p[:n])
+	w.size += int64(n)
+	if err != nil {
+		w.err = fmt.Errorf("failed to write %s: %w", w.name, err)
+		return n, w.err
+	}
+	return n, nil
+}
+
+func (w *fileWriter) Close() (retErr error) {
+	if w.f == nil && w.err == nil {
+		// Create empty objects too
+		if _, err := w.Write(nil); err != nil {
+			return err
+		}
+	}
+	if w.f == nil {
+		return w.err
+	}
+
+	// Remove the temporary file unless it was moved into place
+	tmp := w.f.Name()
+	defer func() {
+		if retErr != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	if err := w.f.Sync(); err != nil && w.err == nil {
+		w.err = fmt.Errorf("failed to sync %s: %w", w.name, err)
+	}
+	if err := w.f.Close(); err != nil && w.err == nil {
+		w.err = fmt.Errorf("failed to close %s: %w", w.name, err)
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	opts := w.opts
+	if opts.KMSKeyName != "" {
+		return fmt.Errorf("encryption with %s is not supported for %s", opts.KMSKeyName, w.s.bucket)
+	}
+	if opts.SendCRC32C && opts.CRC32C != w.crc.Sum32() {
+		return fmt.Errorf("%s has CRC32C %08x, expected %08x", w.name, w.crc.Sum32(), opts.CRC32C)
+	}
+
+	dataPath, _, err := w.s.paths(w.name)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := w.s.lock(w.ctx, w.name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cur, err := w.s.readAttrs(w.name)
+	if err != nil && !errors.Is(err, ErrObjectNotExist) {
+		return err
+	}
+	switch {
+	case opts.DoesNotExist && cur != nil:
+		return fmt.Errorf("%w: %s already exists", ErrPreconditionFailed, w.name)
+	case opts.GenerationMatch != 0 && (cur == nil || cur.Generation != opts.GenerationMatch):
+		return fmt.Errorf("%w: %s is not generation %d", ErrPreconditionFailed, w.name, opts.GenerationMatch)
+	}
+
+	// Generations always increase, even if the clock goes backwards
+	now := time.Now()
+	generation := now.UnixNano()
+	if cur != nil && generation <= cur.Generation {
+		generation = cur.Generation + 1
+	}
+
+	// The modification time distinguishes the contents from those of earlier
+	// generations
+	if err := os.Chtimes(tmp, now, time.Unix(0, generation)); err != nil {
+		return fmt.Errorf("failed to set modification time of %s: %w", w.name, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", w.name, err)
+	}
+	if err := os.Rename(tmp, dataPath); err != nil {
+		return fmt.Errorf("failed to save %s: %w", w.name, err)
+	}
+	stat, err := os.Stat(dataPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", w.name, err)
+	}
+
+	fa := &fileAttrs{
+		Generation:      generation,
+		Size:            w.size,
+		ModTime:         stat.ModTime().UnixNano(),
+		ContentType:     opts.ContentType,
+		CacheControl:    opts.CacheControl,
+		ContentEncoding: opts.ContentEncoding,
+		CRC32C:          w.crc.Sum32(),
+		Updated:         now.UTC(),
+		Metadata:        opts.Metadata,
+	}
+	if err := w.s.writeAttrs(w.name, fa); err != nil {
+		return err
+	}
+	w.attrs = w.s.objectAttrs(w.name, fa)
+
+	if opts.ProgressFunc != nil {
+		opts.ProgressFunc(w.size)
+	}
+	return nil
+}
+
+func (w *fileWriter) Attrs() *ObjectAttrs {
+	return w.attrs
+}
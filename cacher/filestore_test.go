@@ -0,0 +1,89 @@
+package cacher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore_paths(t *testing.T) {
+	t.Parallel()
+
+	root := filepath.FromSlash("/var/cache")
+	s := newFileStore("file:///var/cache", root)
+
+	cases := []struct {
+		name   string
+		object string
+		want   string
+		err    bool
+	}{
+		{name: "key", object: "go", want: "go"},
+		{name: "nested", object: "go/linux/amd64", want: "go/linux/amd64"},
+		{name: "companion", object: ".gcs-cacher/manifests/go", want: ".gcs-cacher/manifests/go"},
+		{name: "dot_dot_name", object: "..go", want: "..go"},
+		{name: "empty", object: "", err: true},
+		{name: "absolute", object: "/etc/passwd", err: true},
+		{name: "trailing_slash", object: "go/", err: true},
+		{name: "parent", object: "..", err: true},
+		{name: "parent_prefix", object: "../go", err: true},
+		{name: "nested_parent", object: "go/../../etc/passwd", err: true},
+		{name: "unclean", object: "go//mod", err: true},
+		{name: "dot", object: "./go", err: true},
+		{name: "attrs_dir", object: ".gcs-cacher-attrs/go", err: true},
+		{name: "temp_dir", object: ".gcs-cacher-tmp/go", err: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dataPath, attrsPath, err := s.paths(tc.object)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %s", dataPath)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(root, filepath.FromSlash(tc.want)); dataPath != want {
+				t.Errorf("expected %s to be %s", dataPath, want)
+			}
+			if want := filepath.Join(root, fileAttrsDir, filepath.FromSlash(tc.want)); attrsPath != want {
+				t.Errorf("expected %s to be %s", attrsPath, want)
+			}
+		})
+	}
+}
+
+func TestFileStore_NewWriter_traversal(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	parent := t.TempDir()
+	root := filepath.Join(parent, "cache")
+	s := newFileStore("file://"+filepath.ToSlash(root), root)
+
+	w := s.NewWriter(ctx, "../escape", &WriterOptions{})
+	_, werr := w.Write([]byte("evil"))
+	if cerr := w.Close(); werr == nil && cerr == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escape")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside of the store, got %v", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	t.Parallel()
+
+	testStorage(t, func(t *testing.T) Storage {
+		root := t.TempDir()
+		return newFileStore("file://"+filepath.ToSlash(root), root)
+	})
+}
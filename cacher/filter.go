@@ -0,0 +1,93 @@
+package cacher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// pathFilter decides which paths in the saved directory are archived.
+// Patterns use glob syntax with support for "**" to match any number of
+// directories, and are matched against slash-separated paths relative to the
+// directory.
+type pathFilter struct {
+	include []string
+	exclude []string
+
+	// ignore is the list of rules from ignore files.
+	ignore []*ignoreRule
+
+	// marker is the path of the marker file written by restores, which is
+	// never archived.
+	marker string
+
+	// secrets is the list of rules for paths which likely contain secrets.
+	secrets []*ignoreRule
+}
+
+// newPathFilter creates a new path filter, validating the patterns.
+func newPathFilter(include, exclude []string) (*pathFilter, error) {
+	for _, p := range include {
+		if !doublestar.ValidatePattern(p) {
+			return nil, fmt.Errorf("invalid include pattern %q", p)
+		}
+	}
+	for _, p := range exclude {
+		if !doublestar.ValidatePattern(p) {
+			return nil, fmt.Errorf("invalid exclude pattern %q", p)
+		}
+	}
+	return &pathFilter{include: include, exclude: exclude}, nil
+}
+
+// addIgnoreFile adds the rules from the ignore file at name, if it exists. The
+// base is the relative path of the directory containing the file.
+func (f *pathFilter) addIgnoreFile(name, base string) error {
+	rules, err := readIgnoreFile(name, base)
+	if err != nil {
+		return err
+	}
+	f.ignore = append(f.ignore, rules...)
+	return nil
+}
+
+// excluded returns true if the relative path matches an exclude pattern, is
+// ignored by an ignore file, or is the marker file. Excluding a directory also
+// excludes its contents.
+func (f *pathFilter) excluded(rel string, dir bool) bool {
+	return matchAny(f.exclude, rel) || ignored(f.ignore, rel, dir) || (f.marker != "" && rel == f.marker)
+}
+
+// included returns true if the relative path should be archived. If there are
+// no include patterns, everything is included. Otherwise the path or one of
+// its parent directories must match an include pattern. Directories which do
+// not match are still walked, since their contents may match.
+func (f *pathFilter) included(rel string) bool {
+	if len(f.include) == 0 {
+		return true
+	}
+
+	for {
+		if matchAny(f.include, rel) {
+			return true
+		}
+
+		idx := strings.LastIndex(rel, "/")
+		if idx < 0 {
+			return false
+		}
+		rel = rel[:idx]
+	}
+}
+
+// matchAny returns true if the path matches any of the patterns. The patterns
+// must already be validated.
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if ok, _ := doublestar.Match(p, rel); ok {
+			return true
+		}
+	}
+	return false
+}
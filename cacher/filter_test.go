@@ -0,0 +1,60 @@
+package cacher
+
+import (
+	"testing"
+)
+
+func TestPathFilter(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		rel      string
+		dir      bool
+		included bool
+		excluded bool
+	}{
+		{name: "everything", rel: "a/b", included: true},
+		{name: "included", include: []string{"**/*.o"}, rel: "a/b.o", included: true},
+		{name: "not_included", include: []string{"**/*.o"}, rel: "a/b.c"},
+		{name: "included_parent", include: []string{"vendor"}, rel: "vendor/a/b.go", included: true},
+		{name: "included_prefix", include: []string{"vendor"}, rel: "vendored/a.go"},
+		{name: "excluded", exclude: []string{"**/*.log"}, rel: "a/b.log", included: true, excluded: true},
+		{name: "not_excluded", exclude: []string{"**/*.log"}, rel: "a/b.go", included: true},
+		{name: "excluded_dir", exclude: []string{"tmp"}, rel: "tmp", dir: true, included: true, excluded: true},
+		{name: "alternatives", exclude: []string{"**/*.{log,tmp}"}, rel: "a/b.tmp", included: true, excluded: true},
+		{name: "exclude_wins", include: []string{"**/*.o"}, exclude: []string{"a/**"}, rel: "a/b.o", included: true, excluded: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := newPathFilter(tc.include, tc.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.included(tc.rel); got != tc.included {
+				t.Errorf("expected %s to be included %t, got %t", tc.rel, tc.included, got)
+			}
+			if got := f.excluded(tc.rel, tc.dir); got != tc.excluded {
+				t.Errorf("expected %s to be excluded %t, got %t", tc.rel, tc.excluded, got)
+			}
+		})
+	}
+}
+
+func TestNewPathFilter_invalid(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newPathFilter([]string{"[a"}, nil); err == nil {
+		t.Error("expected error for include pattern")
+	}
+	if _, err := newPathFilter(nil, []string{"[a"}); err == nil {
+		t.Error("expected error for exclude pattern")
+	}
+}
@@ -0,0 +1,266 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// storageEndpoint returns the Cloud Storage endpoint for the URL or host. The
+// JSON API needs the URL of the API, and gRPC only the host and port.
+func storageEndpoint(endpoint string, grpc bool) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse endpoint %q: %w", endpoint, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", fmt.Errorf("endpoint %q must be an http or https URL", endpoint)
+	}
+
+	if grpc {
+		if u.Port() == "" {
+			return net.JoinHostPort(u.Hostname(), "443"), nil
+		}
+		return u.Host, nil
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/storage/v1/"
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String(), nil
+}
+
+// gcsStore stores objects in a Cloud Storage bucket.
+type gcsStore struct {
+	bucket *storage.BucketHandle
+}
+
+// object returns the handle for the generation of the object, or the latest
+// generation if it is zero.
+func (s *gcsStore) object(name string, generation int64) *storage.ObjectHandle {
+	handle := s.bucket.Object(name)
+	if generation != 0 {
+		handle = handle.Generation(generation)
+	}
+	return handle
+}
+
+// conditional returns the handle with preconditions for writing the object.
+func (s *gcsStore) conditional(name string, doesNotExist bool, generation int64) *storage.ObjectHandle {
+	handle := s.bucket.Object(name)
+	switch {
+	case doesNotExist:
+		handle = handle.If(storage.Conditions{DoesNotExist: true})
+	case generation != 0:
+		handle = handle.If(storage.Conditions{GenerationMatch: generation})
+	}
+	return handle
+}
+
+func (s *gcsStore) Attrs(ctx context.Context, name string, generation int64) (*ObjectAttrs, error) {
+	attrs, err := s.object(name, generation).Attrs(ctx)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return fromGCSAttrs(attrs), nil
+}
+
+func (s *gcsStore) List(ctx context.Context, prefix string) ([]*ObjectAttrs, error) {
+	it := s.bucket.Objects(ctx, &storage.Query{
+		Prefix: prefix,
+	})
+
+	var list []*ObjectAttrs
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return list, nil
+		}
+		if err != nil {
+			return nil, gcsError(err)
+		}
+		list = append(list, fromGCSAttrs(attrs))
+	}
+}
+
+// versions returns every generation of the object, including noncurrent
+// generations if the bucket has object versioning.
+func (s *gcsStore) versions(ctx context.Context, name string) ([]*ObjectAttrs, error) {
+	it := s.bucket.Objects(ctx, &storage.Query{
+		Prefix:   name,
+		Versions: true,
+	})
+
+	var list []*ObjectAttrs
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return list, nil
+		}
+		if err != nil {
+			return nil, gcsError(err)
+		}
+		if attrs.Name == name {
+			list = append(list, fromGCSAttrs(attrs))
+		}
+	}
+}
+
+func (s *gcsStore) NewReader(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	// Always read the stored bytes, which are what the checksums describe
+	r, err := s.object(name, generation).ReadCompressed(true).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return r, nil
+}
+
+func (s *gcsStore) NewWriter(ctx context.Context, name string, opts *WriterOptions) ObjectWriter {
+	w := s.conditional(name, opts.DoesNotExist, opts.GenerationMatch).NewWriter(ctx)
+	w.ObjectAttrs.ContentType = opts.ContentType
+	w.ObjectAttrs.CacheControl = opts.CacheControl
+	w.ObjectAttrs.ContentEncoding = opts.ContentEncoding
+	w.ObjectAttrs.KMSKeyName = opts.KMSKeyName
+	w.ObjectAttrs.Metadata = opts.Metadata
+	w.ObjectAttrs.CustomTime = opts.CustomTime
+	w.ObjectAttrs.CRC32C = opts.CRC32C
+	w.SendCRC32C = opts.SendCRC32C
+	switch {
+	case opts.ChunkSize < 0:
+		w.ChunkSize = 0
+	case opts.ChunkSize > 0:
+		w.ChunkSize = opts.ChunkSize
+	}
+	w.ProgressFunc = opts.ProgressFunc
+	return &gcsWriter{w: w}
+}
+
+func (s *gcsStore) Update(ctx context.Context, name string, generation int64, metadata map[string]string) error {
+	if _, err := s.conditional(name, false, generation).Update(ctx, storage.ObjectAttrsToUpdate{
+		Metadata: metadata,
+	}); err != nil {
+		return gcsError(err)
+	}
+	return nil
+}
+
+// touch sets the custom time of the generation of the object, if it is still
+// the latest generation.
+func (s *gcsStore) touch(ctx context.Context, name string, generation int64, t time.Time) error {
+	if _, err := s.conditional(name, false, generation).Update(ctx, storage.ObjectAttrsToUpdate{
+		CustomTime: t,
+	}); err != nil {
+		return gcsError(err)
+	}
+	return nil
+}
+
+// setHolds sets or releases the temporary and event-based holds of the
+// generation of the object, if it is still the latest generation.
+func (s *gcsStore) setHolds(ctx context.Context, name string, generation int64, temporary, eventBased bool) error {
+	if _, err := s.conditional(name, false, generation).Update(ctx, storage.ObjectAttrsToUpdate{
+		TemporaryHold:  temporary,
+		EventBasedHold: eventBased,
+	}); err != nil {
+		return gcsError(err)
+	}
+	return nil
+}
+
+func (s *gcsStore) Delete(ctx context.Context, name string, generation int64) error {
+	if err := s.conditional(name, false, generation).Delete(ctx); err != nil {
+		return gcsError(err)
+	}
+	return nil
+}
+
+// gcsWriter is an ObjectWriter for a Cloud Storage object.
+type gcsWriter struct {
+	w *storage.Writer
+}
+
+func (w *gcsWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (w *gcsWriter) Close() error {
+	return gcsError(w.w.Close())
+}
+
+func (w *gcsWriter) Attrs() *ObjectAttrs {
+	return fromGCSAttrs(w.w.Attrs())
+}
+
+// fromGCSAttrs converts Cloud Storage object attributes.
+func fromGCSAttrs(attrs *storage.ObjectAttrs) *ObjectAttrs {
+	if attrs == nil {
+		return nil
+	}
+
+	return &ObjectAttrs{
+		Bucket:          attrs.Bucket,
+		Name:            attrs.Name,
+		Size:            attrs.Size,
+		ContentType:     attrs.ContentType,
+		CacheControl:    attrs.CacheControl,
+		ContentEncoding: attrs.ContentEncoding,
+		Updated:         attrs.Updated,
+		CustomTime:      attrs.CustomTime,
+		Generation:      attrs.Generation,
+		Deleted:         attrs.Deleted,
+		CRC32C:          attrs.CRC32C,
+		HasCRC32C:       true,
+		KMSKeyName:      attrs.KMSKeyName,
+		TemporaryHold:   attrs.TemporaryHold,
+		EventBasedHold:  attrs.EventBasedHold,
+		Metadata:        attrs.Metadata,
+	}
+}
+
+// gcsError converts Cloud Storage errors for missing objects and failed
+// preconditions to the errors returned by stores.
+func gcsError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, storage.ErrObjectNotExist):
+		return ErrObjectNotExist
+	case isGCSPreconditionFailed(err):
+		return fmt.Errorf("%w: %v", ErrPreconditionFailed, err)
+	default:
+		return err
+	}
+}
+
+// isGCSPreconditionFailed returns true if the Cloud Storage error is because
+// the preconditions for a request were not met.
+func isGCSPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusPreconditionFailed
+	}
+
+	// Errors from the gRPC API have a status instead
+	if s, ok := status.FromError(err); ok {
+		return s.Code() == codes.FailedPrecondition
+	}
+	return false
+}
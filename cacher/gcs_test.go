@@ -0,0 +1,540 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCSObject is an object in a fakeGCS bucket, in the form of the JSON API.
+type fakeGCSObject struct {
+	Bucket          string            `json:"bucket"`
+	Name            string            `json:"name"`
+	Generation      int64             `json:"generation,string"`
+	Metageneration  int64             `json:"metageneration,string"`
+	Size            int64             `json:"size,string"`
+	ContentType     string            `json:"contentType,omitempty"`
+	CacheControl    string            `json:"cacheControl,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	CRC32C          string            `json:"crc32c"`
+	Updated         string            `json:"updated"`
+	CustomTime      string            `json:"customTime,omitempty"`
+	TemporaryHold   bool              `json:"temporaryHold,omitempty"`
+	EventBasedHold  bool              `json:"eventBasedHold,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+
+	data []byte
+}
+
+// fakeGCSUpload is a resumable upload to a fakeGCS bucket.
+type fakeGCSUpload struct {
+	obj   *fakeGCSObject
+	query url.Values
+	data  []byte
+}
+
+// fakeGCS serves the parts of the Cloud Storage JSON and XML APIs which the
+// storage client uses from memory. It keeps only the latest generation of each
+// object.
+type fakeGCS struct {
+	t *testing.T
+
+	mu         sync.Mutex
+	buckets    map[string]*fakeGCSBucket
+	uploads    map[string]*fakeGCSUpload
+	generation int64
+
+	// onRead is called before an object is read from the offset. It returns a
+	// status to fail the read with, or the number of bytes to send before the
+	// connection is dropped, or -1 to send them all.
+	onRead func(name string, offset int64) (status int, limit int64)
+
+	// composed records the number of sources of every compose request, and
+	// patched the names of the objects whose attributes were updated.
+	composed []int
+	patched  []string
+}
+
+// fakeGCSBucket is a bucket of a fakeGCS.
+type fakeGCSBucket struct {
+	f       *fakeGCS
+	name    string
+	objects map[string]*fakeGCSObject
+}
+
+func newFakeGCS(t *testing.T) (*fakeGCS, *httptest.Server) {
+	f := &fakeGCS{
+		t:       t,
+		buckets: make(map[string]*fakeGCSBucket),
+		uploads: make(map[string]*fakeGCSUpload),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// bucket returns the named bucket, creating it if it does not exist.
+func (f *fakeGCS) bucket(name string) *fakeGCSBucket {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lookup(name)
+}
+
+// lookup returns the named bucket, creating it if it does not exist. The lock
+// must be held.
+func (f *fakeGCS) lookup(name string) *fakeGCSBucket {
+	b, ok := f.buckets[name]
+	if !ok {
+		b = &fakeGCSBucket{f: f, name: name, objects: make(map[string]*fakeGCSObject)}
+		f.buckets[name] = b
+	}
+	return b
+}
+
+// object returns a copy of the contents and the attributes of the object.
+func (b *fakeGCSBucket) object(name string) ([]byte, *fakeGCSObject, bool) {
+	b.f.mu.Lock()
+	defer b.f.mu.Unlock()
+
+	obj, ok := b.objects[name]
+	if !ok {
+		return nil, nil, false
+	}
+	return append([]byte(nil), obj.data...), obj, true
+}
+
+// put writes a new generation of the object, like anyone with write access to
+// the bucket could.
+func (b *fakeGCSBucket) put(name string, data []byte, metadata map[string]string) {
+	b.f.mu.Lock()
+	defer b.f.mu.Unlock()
+	b.store(&fakeGCSObject{Name: name, Metadata: metadata, data: data})
+}
+
+// rewrite writes a new generation of the object with the contents and the
+// attributes of the current generation.
+func (b *fakeGCSBucket) rewrite(name string, data []byte) {
+	b.f.mu.Lock()
+	defer b.f.mu.Unlock()
+
+	obj := *b.objects[name]
+	obj.data = data
+	b.store(&obj)
+}
+
+// names returns the sorted names of the objects in the bucket.
+func (b *fakeGCSBucket) names() []string {
+	b.f.mu.Lock()
+	defer b.f.mu.Unlock()
+
+	names := make([]string, 0, len(b.objects))
+	for name := range b.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// store stores the object as a new generation. The lock must be held.
+func (b *fakeGCSBucket) store(obj *fakeGCSObject) {
+	b.f.generation++
+	obj.Bucket = b.name
+	obj.Generation = b.f.generation
+	obj.Metageneration = 1
+	obj.Size = int64(len(obj.data))
+	obj.Updated = time.Now().UTC().Format(time.RFC3339Nano)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(obj.data, crc32.MakeTable(crc32.Castagnoli)))
+	obj.CRC32C = base64.StdEncoding.EncodeToString(crc)
+	b.objects[obj.Name] = obj
+}
+
+// check returns false and writes an error if the object does not meet the
+// generation preconditions of the request. The lock must be held.
+func (b *fakeGCSBucket) check(w http.ResponseWriter, q url.Values, name string) bool {
+	obj := b.objects[name]
+	if v := q.Get("generation"); v != "" && (obj == nil || strconv.FormatInt(obj.Generation, 10) != v) {
+		b.f.error(w, http.StatusNotFound)
+		return false
+	}
+	if v := q.Get("ifGenerationMatch"); v != "" {
+		var gen int64
+		if obj != nil {
+			gen = obj.Generation
+		}
+		if strconv.FormatInt(gen, 10) != v {
+			b.f.error(w, http.StatusPreconditionFailed)
+			return false
+		}
+	}
+	return true
+}
+
+// create stores the object if it meets the preconditions of the request. The
+// lock must be held.
+func (b *fakeGCSBucket) create(w http.ResponseWriter, q url.Values, obj *fakeGCSObject) bool {
+	if !b.check(w, q, obj.Name) {
+		return false
+	}
+	b.store(obj)
+	return true
+}
+
+func (f *fakeGCS) error(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, http.StatusText(status))
+}
+
+func (f *fakeGCS) json(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		f.t.Error(err)
+	}
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var parts []string
+	for _, p := range strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/") {
+		s, err := url.PathUnescape(p)
+		if err != nil {
+			f.error(w, http.StatusBadRequest)
+			return
+		}
+		parts = append(parts, s)
+	}
+	q := r.URL.Query()
+
+	switch {
+	case len(parts) == 6 && parts[0] == "upload" && parts[3] == "b" && parts[5] == "o":
+		f.upload(w, r, parts[4])
+
+	case len(parts) == 5 && parts[0] == "storage" && parts[2] == "b" && parts[4] == "o" && r.Method == http.MethodGet:
+		f.list(w, parts[3], q.Get("prefix"))
+
+	case len(parts) == 7 && parts[0] == "storage" && parts[6] == "compose" && r.Method == http.MethodPost:
+		f.compose(w, r, parts[3], parts[5])
+
+	case len(parts) == 6 && parts[0] == "storage" && parts[2] == "b" && parts[4] == "o":
+		f.object(w, r, parts[3], parts[5])
+
+	case len(parts) >= 2 && parts[0] != "storage" && parts[0] != "upload" &&
+		(r.Method == http.MethodGet || r.Method == http.MethodHead):
+		f.read(w, r, parts[0], strings.Join(parts[1:], "/"))
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		f.error(w, http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeGCS) upload(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+
+	switch {
+	case q.Get("upload_id") != "":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		upload, ok := f.uploads[q.Get("upload_id")]
+		if !ok {
+			f.error(w, http.StatusNotFound)
+			return
+		}
+		upload.data = append(upload.data, data...)
+
+		// The last chunk has the total size
+		if strings.HasSuffix(r.Header.Get("Content-Range"), "/*") {
+			if len(upload.data) > 0 {
+				w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.data)-1))
+			}
+			w.Header().Set("X-Http-Status-Code-Override", "308")
+			return
+		}
+		delete(f.uploads, q.Get("upload_id"))
+		upload.obj.data = upload.data
+		if f.lookup(bucket).create(w, upload.query, upload.obj) {
+			f.json(w, upload.obj)
+		}
+
+	case r.Method == http.MethodPost && q.Get("uploadType") == "multipart":
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			f.error(w, http.StatusBadRequest)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+
+		obj := &fakeGCSObject{}
+		p, err := mr.NextPart()
+		if err != nil {
+			f.error(w, http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(p).Decode(obj); err != nil {
+			f.error(w, http.StatusBadRequest)
+			return
+		}
+		if p, err = mr.NextPart(); err != nil {
+			f.error(w, http.StatusBadRequest)
+			return
+		}
+		if obj.data, err = io.ReadAll(p); err != nil {
+			f.error(w, http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.lookup(bucket).create(w, q, obj) {
+			f.json(w, obj)
+		}
+
+	case r.Method == http.MethodPost && q.Get("uploadType") == "resumable":
+		obj := &fakeGCSObject{}
+		if err := json.NewDecoder(r.Body).Decode(obj); err != nil {
+			f.error(w, http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		f.generation++
+		id := strconv.FormatInt(f.generation, 10)
+		f.uploads[id] = &fakeGCSUpload{obj: obj, query: q}
+		f.mu.Unlock()
+
+		u := *r.URL
+		u.Scheme = "http"
+		u.Host = r.Host
+		u.RawQuery = url.Values{"uploadType": {"resumable"}, "upload_id": {id}}.Encode()
+		w.Header().Set("Location", u.String())
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		f.error(w, http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeGCS) compose(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	var req struct {
+		Destination   *fakeGCSObject `json:"destination"`
+		SourceObjects []struct {
+			Name string `json:"name"`
+		} `json:"sourceObjects"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.error(w, http.StatusBadRequest)
+		return
+	}
+	if len(req.SourceObjects) > 32 {
+		f.error(w, http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := f.lookup(bucket)
+
+	obj := &fakeGCSObject{}
+	if req.Destination != nil {
+		obj = req.Destination
+	}
+	obj.Name = name
+	for _, src := range req.SourceObjects {
+		o, ok := b.objects[src.Name]
+		if !ok {
+			f.error(w, http.StatusNotFound)
+			return
+		}
+		obj.data = append(obj.data, o.data...)
+	}
+	if b.create(w, r.URL.Query(), obj) {
+		f.composed = append(f.composed, len(req.SourceObjects))
+		f.json(w, obj)
+	}
+}
+
+func (f *fakeGCS) object(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	q := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := f.lookup(bucket)
+
+	obj, ok := b.objects[name]
+	if !ok {
+		f.error(w, http.StatusNotFound)
+		return
+	}
+	if !b.check(w, q, name) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		f.json(w, obj)
+
+	case http.MethodPatch:
+		var patch struct {
+			CustomTime     *string            `json:"customTime"`
+			TemporaryHold  *bool              `json:"temporaryHold"`
+			EventBasedHold *bool              `json:"eventBasedHold"`
+			Metadata       map[string]*string `json:"metadata"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			f.error(w, http.StatusBadRequest)
+			return
+		}
+
+		updated := *obj
+		if patch.CustomTime != nil {
+			updated.CustomTime = *patch.CustomTime
+		}
+		if patch.TemporaryHold != nil {
+			updated.TemporaryHold = *patch.TemporaryHold
+		}
+		if patch.EventBasedHold != nil {
+			updated.EventBasedHold = *patch.EventBasedHold
+		}
+		if patch.Metadata != nil {
+			updated.Metadata = make(map[string]string)
+			for k, v := range obj.Metadata {
+				updated.Metadata[k] = v
+			}
+			// Like Cloud Storage, empty values remove keys
+			for k, v := range patch.Metadata {
+				if v == nil || *v == "" {
+					delete(updated.Metadata, k)
+					continue
+				}
+				updated.Metadata[k] = *v
+			}
+		}
+		updated.Metageneration++
+		b.objects[name] = &updated
+		f.patched = append(f.patched, name)
+		f.json(w, &updated)
+
+	case http.MethodDelete:
+		delete(b.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		f.error(w, http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeGCS) list(w http.ResponseWriter, bucket, prefix string) {
+	f.mu.Lock()
+	var items []*fakeGCSObject
+	for name, obj := range f.lookup(bucket).objects {
+		if strings.HasPrefix(name, prefix) {
+			items = append(items, obj)
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+
+	f.json(w, map[string]interface{}{"kind": "storage#objects", "items": items})
+}
+
+func (f *fakeGCS) read(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	f.mu.Lock()
+	b := f.lookup(bucket)
+	obj, ok := b.objects[name]
+	if ok && !b.check(w, r.URL.Query(), name) {
+		f.mu.Unlock()
+		return
+	}
+	onRead := f.onRead
+	f.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var body io.Writer = w
+	if onRead != nil && r.Method == http.MethodGet {
+		var offset int64
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset)
+
+		status, limit := onRead(name, offset)
+		if status != 0 {
+			f.error(w, status)
+			return
+		}
+		if limit >= 0 {
+			body = &limitedWriter{w: w, n: limit}
+		}
+	}
+
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(obj.Generation, 10))
+	w.Header().Set("X-Goog-Metageneration", strconv.FormatInt(obj.Metageneration, 10))
+	w.Header().Set("X-Goog-Hash", "crc32c="+obj.CRC32C)
+	http.ServeContent(&bodyWriter{ResponseWriter: w, body: body}, r, "", time.Time{}, bytes.NewReader(obj.data))
+}
+
+// bodyWriter writes the body of a response to body.
+type bodyWriter struct {
+	http.ResponseWriter
+	body io.Writer
+}
+
+func (w *bodyWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+// limitedWriter fails once n bytes were written, which drops the connection
+// of a response that promised more.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.n {
+		n, _ := w.w.Write(p[:w.n])
+		w.n = 0
+		return n, io.ErrShortWrite
+	}
+	n, err := w.w.Write(p)
+	w.n -= int64(n)
+	return n, err
+}
+
+func TestGCSStore(t *testing.T) {
+	t.Parallel()
+
+	testStorage(t, func(t *testing.T) Storage {
+		c, _ := newTestCacher(t)
+		st, err := c.bucket(context.Background(), "bucket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	})
+}
@@ -0,0 +1,156 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GenerationsRequest is used as input to the Generations operation.
+type GenerationsRequest struct {
+	// Bucket is the name of the Cloud Storage bucket which holds the cache.
+	Bucket string
+
+	// Key is the name of the object.
+	Key string
+}
+
+// Generations returns the generations of the cached object, newest first. If
+// the bucket has object versioning, this includes the generations which were
+// replaced or deleted, which can be restored with RestoreRequest.Generation or
+// made the live generation again with Rollback.
+func (c *Cacher) Generations(ctx context.Context, i *GenerationsRequest) ([]*ObjectAttrs, error) {
+	if i == nil {
+		return nil, fmt.Errorf("missing generations options")
+	}
+
+	bucket := i.Bucket
+	if bucket == "" {
+		return nil, fmt.Errorf("missing bucket")
+	}
+
+	key := i.Key
+	if key == "" {
+		return nil, fmt.Errorf("missing key")
+	}
+
+	st, err := c.bucket(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	gs, ok := st.(*gcsStore)
+	if !ok {
+		return nil, fmt.Errorf("generations are only supported for Cloud Storage buckets")
+	}
+
+	list, err := gs.versions(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list generations of %s: %w", key, err)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Generation > list[j].Generation
+	})
+	return list, nil
+}
+
+// RollbackRequest is used as input to the Rollback operation.
+type RollbackRequest struct {
+	// Bucket is the name of the Cloud Storage bucket which holds the cache.
+	Bucket string
+
+	// Key is the name of the object.
+	Key string
+
+	// Generation is the noncurrent generation of the object to make the live
+	// generation again.
+	Generation int64
+}
+
+// Rollback copies a noncurrent generation of the cached object over the live
+// generation, or undeletes it if the object was deleted, so a bad cache can be
+// replaced with an earlier one. The copy is a new generation, and only
+// replaces the live generation if no other save replaced it first. It returns
+// the attributes of the new generation.
+func (c *Cacher) Rollback(ctx context.Context, i *RollbackRequest) (*ObjectAttrs, error) {
+	if i == nil {
+		return nil, fmt.Errorf("missing rollback options")
+	}
+
+	bucket := i.Bucket
+	if bucket == "" {
+		return nil, fmt.Errorf("missing bucket")
+	}
+
+	key := i.Key
+	if key == "" {
+		return nil, fmt.Errorf("missing key")
+	}
+
+	if i.Generation <= 0 {
+		return nil, fmt.Errorf("missing generation")
+	}
+
+	st, err := c.bucket(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	gs, ok := st.(*gcsStore)
+	if !ok {
+		return nil, fmt.Errorf("generations are only supported for Cloud Storage buckets")
+	}
+
+	src, err := gs.Attrs(ctx, key, i.Generation)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotExist) {
+			return nil, fmt.Errorf("generation %d of %s does not exist", i.Generation, key)
+		}
+		return nil, fmt.Errorf("failed to get generation %d of %s: %w", i.Generation, key, err)
+	}
+
+	live, err := gs.Attrs(ctx, key, 0)
+	if err != nil && !errors.Is(err, ErrObjectNotExist) {
+		return nil, fmt.Errorf("failed to get live generation of %s: %w", key, err)
+	}
+	if live != nil && live.Generation == i.Generation {
+		return nil, fmt.Errorf("generation %d is already the live generation of %s", i.Generation, key)
+	}
+
+	var liveGeneration int64
+	if live != nil {
+		liveGeneration = live.Generation
+	}
+	copier := gs.conditional(key, live == nil, liveGeneration).CopierFrom(gs.object(key, i.Generation))
+
+	// Keep the encryption of the copied generation, which is otherwise the
+	// bucket's default
+	if kmsKey := src.KMSKeyName; kmsKey != "" {
+		if idx := strings.Index(kmsKey, "/cryptoKeyVersions/"); idx >= 0 {
+			kmsKey = kmsKey[:idx]
+		}
+		copier.DestinationKMSKeyName = kmsKey
+	}
+
+	c.log("copying generation %d of %s", i.Generation, key)
+	attrs, err := copier.Run(ctx)
+	if err != nil {
+		err = gcsError(err)
+		if isPreconditionFailed(err) {
+			return nil, fmt.Errorf("%s was replaced by another save, not rolling back: %w", key, err)
+		}
+		return nil, fmt.Errorf("failed to copy generation %d of %s: %w", i.Generation, key, err)
+	}
+	rolled := fromGCSAttrs(attrs)
+
+	// The copy keeps the custom time of the old generation, which lifecycle
+	// rules may already consider unused
+	now := time.Now().UTC().Truncate(24 * time.Hour)
+	if rolled.CustomTime.Before(now) {
+		if err := gs.touch(ctx, key, rolled.Generation, now); err != nil {
+			c.warn("failed to update custom time of %s: %s", key, err)
+		}
+	}
+	return rolled, nil
+}
@@ -0,0 +1,81 @@
+package cacher
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestHashFiles(t *testing.T) {
+	t.Parallel()
+
+	// Keys must not change between versions, so the files are hashed as one
+	// stream in order, skipping directories
+	large := strings.Repeat("large", 1<<20)
+	dir := writeFiles(t, map[string]string{
+		"a":     "a",
+		"b":     large,
+		"dir/c": "c",
+	})
+
+	cases := []struct {
+		name  string
+		files []string
+		want  string
+		err   bool
+	}{
+		{
+			name:  "in_order",
+			files: []string{"a", "b", "dir", "dir/c"},
+			want:  "a" + large + "c",
+		},
+		{
+			name:  "reversed",
+			files: []string{"dir/c", "b", "a"},
+			want:  "c" + large + "a",
+		},
+		{
+			name:  "missing",
+			files: []string{"a", "missing", "b"},
+			err:   true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+
+			files := make([]string, 0, len(tc.files))
+			for _, name := range tc.files {
+				files = append(files, filepath.Join(dir, filepath.FromSlash(name)))
+			}
+
+			got, err := c.HashFiles(files)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h, err := blake2b.New(16, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.Write([]byte(tc.want))
+			if want := fmt.Sprintf("%x", h.Sum(nil)); got != want {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+		})
+	}
+}
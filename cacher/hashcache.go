@@ -0,0 +1,177 @@
+package cacher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hashCacheVersion is the version of the hash cache format. Caches with a
+// different version are ignored, so results are never reused after the way
+// files are hashed changes.
+const hashCacheVersion = 1
+
+// hashCache records the results of hashing lists of files, so they are not
+// read again by later invocations while the files are unchanged.
+type hashCache struct {
+	Version int                        `json:"version"`
+	Entries map[string]*hashCacheEntry `json:"entries"`
+}
+
+// hashCacheEntry is the result of hashing a list of files.
+type hashCacheEntry struct {
+	// Files is the size and modification time of each file when it was hashed.
+	Files []*hashedFile `json:"files"`
+
+	// Hash is the result.
+	Hash string `json:"hash"`
+}
+
+// hashedFile is the state of a single file when it was hashed.
+type hashedFile struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+}
+
+// HashCache sets the file in which the results of HashFiles and HashGlob are
+// cached. Results are reused while the size and modification time of every
+// file are unchanged. If name is empty, files are always hashed.
+func (c *Cacher) HashCache(name string) {
+	c.hashCache = name
+}
+
+// statFiles returns the key for the list of files in the hash cache and the
+// current state of each file.
+func statFiles(files []string) (string, []*hashedFile, error) {
+	key := sha256.New()
+	stats := make([]*hashedFile, 0, len(files))
+	for _, name := range files {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to resolve %s: %w", name, err)
+		}
+		fmt.Fprintf(key, "%s\x00", abs)
+
+		stat, err := os.Stat(name)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to stat %s: %w", name, err)
+		}
+		stats = append(stats, &hashedFile{
+			Name:    abs,
+			Size:    stat.Size(),
+			ModTime: stat.ModTime().UnixNano(),
+		})
+	}
+	return hex.EncodeToString(key.Sum(nil)), stats, nil
+}
+
+// readHashCache reads the hash cache from the file at name. It returns an empty
+// cache if the file does not exist or has a different version.
+func readHashCache(name string) (*hashCache, error) {
+	empty := &hashCache{
+		Version: hashCacheVersion,
+		Entries: make(map[string]*hashCacheEntry),
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return empty, nil
+		}
+		return nil, fmt.Errorf("failed to read hash cache: %w", err)
+	}
+
+	var hc hashCache
+	if err := json.Unmarshal(b, &hc); err != nil {
+		return nil, fmt.Errorf("failed to parse hash cache %s: %w", name, err)
+	}
+	if hc.Version != hashCacheVersion || hc.Entries == nil {
+		return empty, nil
+	}
+	return &hc, nil
+}
+
+// lookup returns the cached hash for the files, if none of them changed.
+func (hc *hashCache) lookup(key string, stats []*hashedFile) (string, bool) {
+	entry, ok := hc.Entries[key]
+	if !ok || len(entry.Files) != len(stats) {
+		return "", false
+	}
+	for i, f := range entry.Files {
+		if *f != *stats[i] {
+			return "", false
+		}
+	}
+	return entry.Hash, true
+}
+
+// write replaces the file at name with the hash cache.
+func (hc *hashCache) write(name string) error {
+	b, err := json.Marshal(hc)
+	if err != nil {
+		return fmt.Errorf("failed to encode hash cache: %w", err)
+	}
+
+	// Write to a temporary file first, so concurrent invocations never read a
+	// partial cache
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create hash cache: %w", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write hash cache: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to close hash cache: %w", err)
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to save hash cache: %w", err)
+	}
+	return nil
+}
+
+// cachedHash returns the result of fn for the files, reusing the result in the
+// hash cache if the files did not change since. Problems with the cache only
+// cause warnings, since the files can always be hashed again.
+func (c *Cacher) cachedHash(files []string, fn func() (string, error)) (string, error) {
+	if c.hashCache == "" {
+		return fn()
+	}
+
+	key, stats, err := statFiles(files)
+	if err != nil {
+		c.warn("not using hash cache: %s", err)
+		return fn()
+	}
+
+	hc, err := readHashCache(c.hashCache)
+	if err != nil {
+		c.warn("not using hash cache: %s", err)
+		return fn()
+	}
+	if hash, ok := hc.lookup(key, stats); ok {
+		c.log("using cached hash for %s", strings.Join(files, ", "))
+		return hash, nil
+	}
+
+	hash, err := fn()
+	if err != nil {
+		return "", err
+	}
+
+	hc.Entries[key] = &hashCacheEntry{Files: stats, Hash: hash}
+	if err := hc.write(c.hashCache); err != nil {
+		c.warn("failed to update hash cache: %s", err)
+	}
+	return hash, nil
+}
@@ -0,0 +1,39 @@
+package cacher
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	// defaultXMLEndpoint is the endpoint of the Cloud Storage XML API.
+	defaultXMLEndpoint = "https://storage.googleapis.com"
+
+	// hmacRegion is the region with which requests to the XML API are signed.
+	hmacRegion = "auto"
+)
+
+// newHMACStore creates the store for a Cloud Storage bucket which is accessed
+// with an HMAC key. Requests signed with HMAC keys are only accepted by the XML
+// API, which is interoperable with S3, so the bucket is an S3 bucket at the
+// endpoint of the XML API. Like other S3 buckets, it does not support
+// generations, and features which need the JSON API, like holds and lifecycle
+// rules, are not available. The XML API does not honor If-None-Match on
+// uploads, so objects cannot be created atomically.
+func newHMACStore(bucket, endpoint, accessID, secret string, rt http.RoundTripper) (*s3Store, error) {
+	if endpoint == "" {
+		endpoint = defaultXMLEndpoint
+	}
+	creds := credentials.NewStaticV4(accessID, secret, "")
+
+	client, err := newS3Client(endpoint, hmacRegion, creds, rt)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{
+		client: client,
+		bucket: strings.TrimPrefix(bucket, "gs://"),
+	}, nil
+}
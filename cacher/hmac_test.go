@@ -0,0 +1,43 @@
+package cacher
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestHMACStore(t *testing.T) {
+	t.Parallel()
+
+	testStorage(t, func(t *testing.T) Storage {
+		_, srv := newFakeS3(t)
+		st, err := newHMACStore("gs://bucket", srv.URL, "GOOG1EXAMPLE", "secret", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	})
+}
+
+func TestSave_hmacLock(t *testing.T) {
+	t.Parallel()
+
+	_, srv := newFakeS3(t)
+
+	ctx := context.Background()
+	c, err := New(ctx, WithHMACKey("GOOG1EXAMPLE", "secret"), WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The XML API cannot create the lock atomically
+	err = c.Save(ctx, &SaveRequest{
+		Bucket: "bucket",
+		Dir:    t.TempDir(),
+		Key:    "key",
+		Lock:   true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "locks are not supported") {
+		t.Errorf("expected lock error, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package cacher
+
+import (
+	"context"
+	"fmt"
+)
+
+// ReleaseRequest is used as input to the Release operation.
+type ReleaseRequest struct {
+	// Bucket is the name of the Cloud Storage bucket which holds the cache.
+	Bucket string
+
+	// Key is the name of the object to release.
+	Key string
+}
+
+// Release releases the temporary and event-based holds on the cached object,
+// so it can be deleted or replaced again. If the bucket has a retention
+// policy, releasing an event-based hold starts the retention period.
+func (c *Cacher) Release(ctx context.Context, i *ReleaseRequest) (retErr error) {
+	if i == nil {
+		retErr = fmt.Errorf("missing release options")
+		return
+	}
+
+	bucket := i.Bucket
+	if bucket == "" {
+		retErr = fmt.Errorf("missing bucket")
+		return
+	}
+
+	key := i.Key
+	if key == "" {
+		retErr = fmt.Errorf("missing key")
+		return
+	}
+
+	st, err := c.bucket(ctx, bucket)
+	if err != nil {
+		retErr = err
+		return
+	}
+	gs, ok := st.(*gcsStore)
+	if !ok {
+		retErr = fmt.Errorf("holds are only supported for Cloud Storage buckets")
+		return
+	}
+
+	c.log("releasing holds on %s", key)
+	if err := gs.setHolds(ctx, key, 0, false, false); err != nil {
+		retErr = fmt.Errorf("failed to release holds on %s: %w", key, err)
+		return
+	}
+	return
+}
@@ -0,0 +1,304 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// httpMetadataPrefixes are the prefixes of the response headers which hold
+// custom metadata in Cloud Storage, S3, and Azure Blob Storage.
+var httpMetadataPrefixes = []string{"X-Goog-Meta-", "X-Amz-Meta-", "X-Ms-Meta-"}
+
+// httpStore reads objects over HTTP from a URL prefix, like a CDN in front of
+// a public bucket, so caches can be restored without any credentials. It is
+// read-only, and since objects cannot be listed over HTTP, keys only match
+// objects named exactly after them. All objects are generation zero.
+type httpStore struct {
+	client *http.Client
+	bucket string
+
+	// base is the URL of the bucket without a trailing slash, and query is
+	// added to the URL of every object, like a token for the CDN.
+	base  string
+	query string
+}
+
+// newHTTPStore creates the store for a bucket URL like
+// https://cdn.example.com/caches. Objects are read from the URL followed by a
+// slash and their name.
+func newHTTPStore(bucketURL string, rt http.RoundTripper) (*httpStore, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bucket %q: %w", bucketURL, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("bucket %q is missing a host", bucketURL)
+	}
+	query := u.RawQuery
+	u.RawQuery = ""
+	u.Fragment = ""
+	base := strings.TrimSuffix(u.String(), "/")
+
+	return &httpStore{
+		client: &http.Client{Transport: rt},
+		bucket: base,
+		base:   base,
+		query:  query,
+	}, nil
+}
+
+// checkGeneration returns an error if a specific generation was requested.
+func (s *httpStore) checkGeneration(generation int64) error {
+	if generation != 0 {
+		return fmt.Errorf("http bucket %s does not support generations", s.bucket)
+	}
+	return nil
+}
+
+// objectURL returns the URL of the object, escaping each segment of its name.
+func (s *httpStore) objectURL(name string) string {
+	segments := strings.Split(name, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+
+	u := s.base + "/" + strings.Join(segments, "/")
+	if s.query != "" {
+		u += "?" + s.query
+	}
+	return u
+}
+
+// do sends a request for the object. Responses are never compressed in
+// transit, so the contents and ranges match the stored object.
+func (s *httpStore) do(ctx context.Context, method, name string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("User-Agent", "gcs-cacher/1.0")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers in front of buckets which cannot be listed, like S3 and
+	// CloudFront, respond with 403 Forbidden for missing objects
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone, http.StatusForbidden:
+		resp.Body.Close()
+		return nil, ErrObjectNotExist
+	}
+
+	if err := checkTranscoding(name, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// checkTranscoding returns an error if the server decompressed the object.
+// Cloud Storage decompresses gzip-encoded objects for clients which do not
+// accept gzip, unless they have the no-transform cache control. The
+// decompressed contents do not match the size, checksums, or ranges of the
+// stored object.
+func checkTranscoding(name string, resp *http.Response) error {
+	if stored := resp.Header.Get("X-Goog-Stored-Content-Encoding"); stored != "" && stored != "identity" &&
+		resp.Header.Get("Content-Encoding") != stored {
+		return fmt.Errorf("%s was decompressed by the server, save it with the no-transform cache control", name)
+	}
+	return nil
+}
+
+func (s *httpStore) Attrs(ctx context.Context, name string, generation int64) (*ObjectAttrs, error) {
+	if err := s.checkGeneration(generation); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(ctx, http.MethodHead, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get %s: %s", name, resp.Status)
+	}
+	return httpObjectAttrs(s.bucket, name, resp), nil
+}
+
+// List returns the object named exactly after the prefix, if it exists, since
+// objects cannot be listed over HTTP.
+func (s *httpStore) List(ctx context.Context, prefix string) ([]*ObjectAttrs, error) {
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return nil, nil
+	}
+
+	attrs, err := s.Attrs(ctx, prefix, 0)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return []*ObjectAttrs{attrs}, nil
+}
+
+func (s *httpStore) NewReader(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	if err := s.checkGeneration(generation); err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("offset %d is out of range for %s", offset, name)
+	}
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, name, rangeHeader(offset, length))
+	if err != nil {
+		return nil, err
+	}
+	return rangeBody(name, resp, offset, length)
+}
+
+// rangeHeader returns the header which requests length bytes starting at
+// offset, or the rest of the object if length is negative.
+func rangeHeader(offset, length int64) http.Header {
+	header := make(http.Header)
+	switch {
+	case length > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return header
+}
+
+// rangeBody returns the requested range of the object from the response to a
+// request with the header from rangeHeader, skipping to the offset if the
+// server ignored the range.
+func rangeBody(name string, resp *http.Response, offset, length int64) (io.ReadCloser, error) {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range, so skip to it
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to skip to offset %d: %w", offset, err)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The offset is the end of the object
+		resp.Body.Close()
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to read %s: %s", name, resp.Status)
+	}
+
+	if length < 0 {
+		return resp.Body, nil
+	}
+	return &struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.LimitReader(resp.Body, length),
+		Closer: resp.Body,
+	}, nil
+}
+
+func (s *httpStore) NewWriter(ctx context.Context, name string, opts *WriterOptions) ObjectWriter {
+	return &readOnlyWriter{err: s.readOnly(name)}
+}
+
+func (s *httpStore) Update(ctx context.Context, name string, generation int64, metadata map[string]string) error {
+	return s.readOnly(name)
+}
+
+func (s *httpStore) Delete(ctx context.Context, name string, generation int64) error {
+	return s.readOnly(name)
+}
+
+// readOnly returns the error for writing to the object.
+func (s *httpStore) readOnly(name string) error {
+	return fmt.Errorf("cannot write %s: http bucket %s is read-only", name, s.bucket)
+}
+
+// httpObjectAttrs converts the headers of a response for the object. Custom
+// metadata is read from the headers of the common storage services, and the
+// CRC32C from the hashes which Cloud Storage reports.
+func httpObjectAttrs(bucket, name string, resp *http.Response) *ObjectAttrs {
+	attrs := &ObjectAttrs{
+		Bucket:          bucket,
+		Name:            name,
+		Size:            resp.ContentLength,
+		ContentType:     resp.Header.Get("Content-Type"),
+		CacheControl:    resp.Header.Get("Cache-Control"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		attrs.Updated = t.UTC()
+	}
+
+	for k, v := range resp.Header {
+		for _, prefix := range httpMetadataPrefixes {
+			if !strings.HasPrefix(k, prefix) || len(v) == 0 {
+				continue
+			}
+
+			key := strings.ToLower(strings.TrimPrefix(k, prefix))
+			if prefix == "X-Ms-Meta-" {
+				key = strings.ReplaceAll(key, "_", "-")
+			}
+			if attrs.Metadata == nil {
+				attrs.Metadata = make(map[string]string)
+			}
+			attrs.Metadata[key] = v[0]
+		}
+	}
+
+	for _, v := range resp.Header.Values("X-Goog-Hash") {
+		for _, hash := range strings.Split(v, ",") {
+			hash = strings.TrimSpace(hash)
+			if !strings.HasPrefix(hash, "crc32c=") {
+				continue
+			}
+			if b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "crc32c=")); err == nil && len(b) == 4 {
+				attrs.CRC32C = binary.BigEndian.Uint32(b)
+				attrs.HasCRC32C = true
+			}
+		}
+	}
+	return attrs
+}
+
+// readOnlyWriter fails every write to a read-only store.
+type readOnlyWriter struct {
+	err error
+}
+
+func (w *readOnlyWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func (w *readOnlyWriter) Close() error {
+	return w.err
+}
+
+func (w *readOnlyWriter) Attrs() *ObjectAttrs {
+	return nil
+}
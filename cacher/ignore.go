@@ -0,0 +1,126 @@
+package cacher
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// ignoreFileName is the name of the file at the root of the saved directory
+// which lists paths to leave out of the archive, using gitignore syntax.
+const ignoreFileName = ".gcscacherignore"
+
+// ignoreRule is a single pattern from an ignore file.
+type ignoreRule struct {
+	// pattern is the doublestar pattern, relative to the root of the walk.
+	pattern string
+
+	// negate re-includes paths which match the pattern.
+	negate bool
+
+	// dirOnly only matches directories.
+	dirOnly bool
+}
+
+// parseIgnore parses rules in gitignore syntax from r. The base is the
+// slash-separated path of the directory containing the file, relative to the
+// root of the walk, and is empty for the root.
+func parseIgnore(r io.Reader, base string) ([]*ignoreRule, error) {
+	var rules []*ignoreRule
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := new(ignoreRule)
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		// Patterns with a slash are relative to the directory containing the
+		// file, others match at any depth.
+		if strings.Contains(line, "/") {
+			line = strings.TrimLeft(line, "/")
+		} else {
+			line = "**/" + line
+		}
+		if base != "" {
+			line = escapeGlob(base) + "/" + line
+		}
+
+		if !doublestar.ValidatePattern(line) {
+			return nil, fmt.Errorf("invalid ignore pattern %q", scanner.Text())
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// readIgnoreFile parses the ignore file at name, if it exists.
+func readIgnoreFile(name, base string) ([]*ignoreRule, error) {
+	f, err := os.Open(longPath(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	rules, err := parseIgnore(f, base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return rules, nil
+}
+
+// ignored returns true if the relative path is ignored by the rules. Later
+// rules take precedence over earlier ones.
+func ignored(rules []*ignoreRule, rel string, dir bool) bool {
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		if rule.dirOnly && !dir {
+			continue
+		}
+		if ok, _ := doublestar.Match(rule.pattern, rel); ok {
+			return !rule.negate
+		}
+	}
+	return false
+}
+
+// escapeGlob escapes the glob metacharacters in a path.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '{', '}', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
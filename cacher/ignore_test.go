@@ -0,0 +1,66 @@
+package cacher
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIgnored(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		rules string
+		base  string
+		rel   string
+		dir   bool
+		want  bool
+	}{
+		{name: "any_depth", rules: "*.log", rel: "a/b/c.log", want: true},
+		{name: "no_match", rules: "*.log", rel: "a/b/c.txt"},
+		{name: "anchored", rules: "/build", rel: "build", dir: true, want: true},
+		{name: "anchored_nested", rules: "/build", rel: "a/build", dir: true},
+		{name: "relative", rules: "a/b", rel: "a/b", want: true},
+		{name: "relative_nested", rules: "a/b", rel: "x/a/b"},
+		{name: "double_star", rules: "a/**/z", rel: "a/b/c/z", want: true},
+		{name: "dir_only_dir", rules: "out/", rel: "out", dir: true, want: true},
+		{name: "dir_only_file", rules: "out/", rel: "out"},
+		{name: "negated", rules: "*.log\n!keep.log", rel: "keep.log"},
+		{name: "negated_other", rules: "*.log\n!keep.log", rel: "drop.log", want: true},
+		{name: "negation_overridden", rules: "!keep.log\n*.log", rel: "keep.log", want: true},
+		{name: "negated_dir_only", rules: "*\n!*/", rel: "dir", dir: true},
+		{name: "negated_dir_only_file", rules: "*\n!*/", rel: "dir/file", want: true},
+		{name: "base", rules: "*.o", base: "sub", rel: "sub/x/a.o", want: true},
+		{name: "base_outside", rules: "*.o", base: "sub", rel: "a.o"},
+		{name: "base_anchored", rules: "/a.o", base: "sub", rel: "sub/a.o", want: true},
+		{name: "base_escaped", rules: "*.o", base: "[sub]", rel: "[sub]/a.o", want: true},
+		{name: "comment", rules: "# a.o", rel: "# a.o"},
+		{name: "escaped_hash", rules: `\#a`, rel: "#a", want: true},
+		{name: "escaped_bang", rules: `\!a`, rel: "!a", want: true},
+		{name: "trailing_space", rules: "a.o  ", rel: "a.o", want: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rules, err := parseIgnore(strings.NewReader(tc.rules), tc.base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ignored(rules, tc.rel, tc.dir); got != tc.want {
+				t.Errorf("expected %s to be ignored %t, got %t", tc.rel, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseIgnore_invalid(t *testing.T) {
+	t.Parallel()
+
+	if _, err := parseIgnore(strings.NewReader("[a"), ""); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,83 @@
+package cacher
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// minStoredSize is the size of the smallest file which is stored without
+	// compression. Smaller files are always compressed, since finishing the
+	// compressed stream around them costs more than it saves.
+	minStoredSize = 64 * 1024
+
+	// entropySampleSize is the number of leading bytes of a file which are
+	// checked to tell whether it is compressible.
+	entropySampleSize = 64 * 1024
+
+	// maxCompressibleEntropy is the highest entropy, in bits per byte, of a
+	// sample which is considered compressible. Compressed and encrypted data is
+	// very close to eight.
+	maxCompressibleEntropy = 7.8
+)
+
+// incompressibleExtensions is the list of file extensions of formats which are
+// already compressed.
+var incompressibleExtensions = map[string]struct{}{
+	".7z": {}, ".aar": {}, ".apk": {}, ".br": {}, ".bz2": {}, ".deb": {},
+	".ear": {}, ".gif": {}, ".gz": {}, ".jar": {}, ".jpeg": {}, ".jpg": {},
+	".lz4": {}, ".mp3": {}, ".mp4": {}, ".nupkg": {}, ".png": {}, ".rpm": {},
+	".tgz": {}, ".war": {}, ".webm": {}, ".webp": {}, ".whl": {}, ".woff": {},
+	".woff2": {}, ".xz": {}, ".zip": {}, ".zst": {},
+}
+
+// incompressible returns true if the file is already compressed, judging by
+// its extension or the entropy of a sample of its contents.
+func incompressible(name string, sample []byte) bool {
+	if _, ok := incompressibleExtensions[strings.ToLower(filepath.Ext(name))]; ok {
+		return true
+	}
+	return entropy(sample) > maxCompressibleEntropy
+}
+
+// sampleFile reads up to n leading bytes of the file.
+func sampleFile(name string, n int) ([]byte, error) {
+	f, err := os.Open(longPath(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, n)
+	l, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return buf[:l], nil
+}
+
+// entropy returns the Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, v := range b {
+		counts[v]++
+	}
+
+	var e float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(b))
+		e -= p * math.Log2(p)
+	}
+	return e
+}
@@ -0,0 +1,464 @@
+package cacher
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// indexOffsetMetadataKey is the object metadata key which holds the offset
+	// of the archive index within the object.
+	indexOffsetMetadataKey = "gcs-cacher-index-offset"
+
+	// indexChecksumMetadataKey is the object metadata key which holds the
+	// CRC32C of the archive index, in hex.
+	indexChecksumMetadataKey = "gcs-cacher-index-crc32c"
+)
+
+// errNoIndex is returned when an archive does not have an index.
+var errNoIndex = errors.New("archive does not have an index")
+
+// archiveIndex is the index of an archive. It records where each entry lives in
+// the compressed object so entries can be read with ranged requests.
+type archiveIndex struct {
+	// Compression is the compression of each entry.
+	Compression Compression `json:"compression"`
+
+	// Entries is the list of entries, in archive order.
+	Entries []*indexEntry `json:"entries"`
+}
+
+// indexEntry is the location of a single entry in the archive.
+type indexEntry struct {
+	// Name is the name of the entry in the archive.
+	Name string `json:"name"`
+
+	// Offset is the byte offset of the entry's segment in the object.
+	Offset int64 `json:"offset"`
+
+	// Length is the length in bytes of the entry's segment in the object.
+	Length int64 `json:"length"`
+
+	// Size is the uncompressed size of the entry's contents.
+	Size int64 `json:"size,omitempty"`
+
+	// Typeflag is the type of the entry, and Linkname is the target of a link,
+	// so entries can be listed without reading their headers.
+	Typeflag byte   `json:"typeflag,omitempty"`
+	Linkname string `json:"linkname,omitempty"`
+
+	// CRC32C is the checksum of the entry's segment in the object, which is
+	// verified when the entry is read.
+	CRC32C uint32 `json:"crc32c"`
+}
+
+// add finishes the segment for the current entry and records it in the index.
+// The offset is the offset of the segment when the entry's header was written.
+func (x *archiveIndex) add(tw archiveWriter, sw *segmentWriter, header *tar.Header, offset int64) error {
+	name := header.Name
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("failed to flush %s: %w", name, err)
+	}
+	if err := sw.Cut(); err != nil {
+		return fmt.Errorf("failed to finish segment for %s: %w", name, err)
+	}
+
+	x.Entries = append(x.Entries, &indexEntry{
+		Name:     name,
+		Offset:   offset,
+		Length:   sw.Offset() - offset,
+		Size:     header.Size,
+		Typeflag: header.Typeflag,
+		Linkname: header.Linkname,
+		CRC32C:   sw.Checksum(),
+	})
+	return nil
+}
+
+// write finishes the current segment and writes the index into its own
+// segment. It returns the offset of the index in the object. The checksum of
+// the index is only known once the segment writer is closed.
+func (x *archiveIndex) write(sw *segmentWriter) (int64, error) {
+	if err := sw.Cut(); err != nil {
+		return 0, fmt.Errorf("failed to finish archive segment: %w", err)
+	}
+
+	offset := sw.Offset()
+	sw.Checksum()
+	if err := json.NewEncoder(sw).Encode(x); err != nil {
+		return 0, fmt.Errorf("failed to write index: %w", err)
+	}
+	return offset, nil
+}
+
+// segmentWriter is a compression writer which can finish the current
+// compressed stream and start a new one at any point. The resulting segments
+// are concatenated, which gzip and zstd readers treat as a single stream.
+type segmentWriter struct {
+	counter     *countingWriter
+	compression Compression
+	cw          io.WriteCloser
+
+	// stored writes the current segment without compression, if it is not nil.
+	stored io.WriteCloser
+}
+
+func newSegmentWriter(w io.Writer, compression Compression, workers, level int) (*segmentWriter, error) {
+	counter := &countingWriter{
+		w:   w,
+		crc: crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+	}
+	cw, err := newCompressWriter(counter, compression, workers, level)
+	if err != nil {
+		return nil, err
+	}
+
+	return &segmentWriter{
+		counter:     counter,
+		compression: compression,
+		cw:          cw,
+	}, nil
+}
+
+// Write writes to the current segment.
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	if s.stored != nil {
+		return s.stored.Write(p)
+	}
+	return s.cw.Write(p)
+}
+
+// Offset returns the number of bytes written to the underlying writer. It is
+// only accurate immediately after a call to Cut.
+func (s *segmentWriter) Offset() int64 {
+	return s.counter.n
+}
+
+// Checksum returns the CRC32C of the bytes written to the underlying writer
+// since the last call to Checksum. Like Offset, it is only accurate
+// immediately after a call to Cut.
+func (s *segmentWriter) Checksum() uint32 {
+	sum := s.counter.crc.Sum32()
+	s.counter.crc.Reset()
+	return sum
+}
+
+// Cut finishes the current segment and starts a new one.
+func (s *segmentWriter) Cut() error {
+	if s.stored != nil {
+		err := s.stored.Close()
+		s.stored = nil
+		return err
+	}
+
+	r, ok := s.cw.(interface{ Reset(io.Writer) })
+	if !ok {
+		// The writer does not compress, so there is nothing to finish.
+		return nil
+	}
+
+	if err := s.cw.Close(); err != nil {
+		return err
+	}
+	r.Reset(s.counter)
+	return nil
+}
+
+// Store finishes the current segment and starts one which is stored without
+// compression, until the next call to Cut. It does nothing if the compression
+// cannot store data.
+func (s *segmentWriter) Store() error {
+	if !s.compression.storable() {
+		return nil
+	}
+
+	if err := s.Cut(); err != nil {
+		return err
+	}
+	stored, err := newStoreWriter(s.counter, s.compression)
+	if err != nil {
+		return err
+	}
+	s.stored = stored
+	return nil
+}
+
+// Close finishes the current segment.
+func (s *segmentWriter) Close() error {
+	if s.stored != nil {
+		if err := s.stored.Close(); err != nil {
+			return err
+		}
+		s.stored = nil
+	}
+	return s.cw.Close()
+}
+
+// segmentable returns true if archives with the compression can be split into
+// independently-readable segments.
+func (c Compression) segmentable() bool {
+	switch c {
+	case "", CompressionGzip, CompressionZstd, CompressionNone:
+		return true
+	default:
+		return false
+	}
+}
+
+// countingWriter counts the number of bytes written through it, and computes
+// their checksum.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	crc hash.Hash32
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.crc.Write(p[:n])
+	return n, err
+}
+
+// readIndex reads the index of the object with the given attributes, and
+// verifies it against the checksum in the object metadata.
+func (c *Cacher) readIndex(ctx context.Context, handle *objectHandle, attrs *ObjectAttrs) (_ *archiveIndex, retErr error) {
+	val, ok := attrs.Metadata[indexOffsetMetadataKey]
+	if !ok {
+		return nil, errNoIndex
+	}
+	offset, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse index offset: %w", err)
+	}
+
+	// An index which cannot be verified is not used
+	val, ok = attrs.Metadata[indexChecksumMetadataKey]
+	if !ok {
+		return nil, errNoIndex
+	}
+	want, err := strconv.ParseUint(val, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse index checksum: %w", err)
+	}
+
+	c.log("reading index at offset %d", offset)
+	r, err := c.newResumingReader(ctx, handle, offset, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index reader: %w", err)
+	}
+	defer func() {
+		if cerr := r.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: failed to close index reader: %w", retErr, cerr)
+				return
+			}
+			retErr = fmt.Errorf("failed to close index reader: %w", cerr)
+		}
+	}()
+
+	// The index is verified before it is decoded, since it is the last segment
+	// of the object
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	if got := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)); got != uint32(want) {
+		return nil, &corruptError{err: fmt.Errorf("index has CRC32C %08x, expected %08x", got, want)}
+	}
+
+	br := bufio.NewReader(bytes.NewReader(data))
+	compression, err := detectCompression(attrs.ContentType, br)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := newDecompressReader(br, compression)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	var index archiveIndex
+	if err := json.NewDecoder(dr).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to decode index: %w", err)
+	}
+	return &index, nil
+}
+
+// listIndex passes each entry in the object's index to the extractor, which
+// must be a dry run. The entry contents are not downloaded.
+func (c *Cacher) listIndex(ctx context.Context, handle *objectHandle, attrs *ObjectAttrs, e *extractor) error {
+	index, err := c.readIndex(ctx, handle, attrs)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range index.Entries {
+		header := &tar.Header{
+			Name:     entry.Name,
+			Size:     entry.Size,
+			Typeflag: entry.Typeflag,
+			Linkname: entry.Linkname,
+		}
+
+		// Older indexes only record the names
+		if header.Typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+			if strings.HasSuffix(entry.Name, "/") {
+				header.Typeflag = tar.TypeDir
+			}
+		}
+		if err := e.extract(header, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restorePaths restores only the entries which match the given paths, using
+// ranged reads from the object's index.
+func (c *Cacher) restorePaths(ctx context.Context, handle *objectHandle, attrs *ObjectAttrs, e *extractor, paths []string) error {
+	index, err := c.readIndex(ctx, handle, attrs)
+	if err != nil {
+		return err
+	}
+
+	// Group matching entries into contiguous spans to minimize the number of
+	// requests.
+	var spans [][]*indexEntry
+	for _, entry := range index.Entries {
+		if !matchesPaths(entry.Name, paths) {
+			continue
+		}
+
+		if n := len(spans); n > 0 {
+			last := spans[n-1][len(spans[n-1])-1]
+			if last.Offset+last.Length == entry.Offset {
+				spans[n-1] = append(spans[n-1], entry)
+				continue
+			}
+		}
+		spans = append(spans, []*indexEntry{entry})
+	}
+
+	if len(spans) == 0 {
+		return fmt.Errorf("no entries match paths %q", paths)
+	}
+
+	for _, entries := range spans {
+		if err := c.restoreSpan(ctx, handle, index.Compression, e, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreSpan extracts the entries, which are contiguous in the object, with a
+// single ranged read.
+func (c *Cacher) restoreSpan(ctx context.Context, handle *objectHandle, compression Compression, e *extractor, entries []*indexEntry) (retErr error) {
+	first, last := entries[0], entries[len(entries)-1]
+	offset, length := first.Offset, last.Offset+last.Length-first.Offset
+
+	c.log("reading %d entries at offset %d", len(entries), offset)
+	r, err := c.newResumingReader(ctx, handle, offset, length)
+	if err != nil {
+		return fmt.Errorf("failed to create range reader: %w", err)
+	}
+	defer func() {
+		if cerr := r.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%w: failed to close range reader: %v", retErr, cerr)
+				return
+			}
+			retErr = fmt.Errorf("failed to close range reader: %w", cerr)
+		}
+	}()
+
+	dl := &downloadReader{Reader: r}
+	sr := &spanReader{r: dl, entries: entries, crc: crc32.New(crc32.MakeTable(crc32.Castagnoli))}
+	dr, err := newDecompressReader(sr, compression)
+	if err != nil {
+		return dl.corrupt(err)
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	for range entries {
+		header, err := tr.Next()
+		if err != nil {
+			return dl.corrupt(fmt.Errorf("failed to read header: %w", err))
+		}
+		if err := e.extract(header, &corruptReader{r: tr, dl: dl}); err != nil {
+			return err
+		}
+	}
+
+	// Verify the rest of the span, which the decompressor may not have read
+	if _, err := io.Copy(io.Discard, sr); err != nil {
+		return dl.corrupt(fmt.Errorf("failed to read span: %w", err))
+	}
+	return nil
+}
+
+// spanReader reads the segments of contiguous entries, verifying the checksum
+// of each segment once it is read. It returns io.ErrUnexpectedEOF if the span
+// ends early.
+type spanReader struct {
+	r       io.Reader
+	entries []*indexEntry
+
+	// n is the number of bytes read of the first entry's segment, and crc is
+	// their checksum.
+	n   int64
+	crc hash.Hash32
+}
+
+func (s *spanReader) Read(p []byte) (int, error) {
+	if len(s.entries) == 0 {
+		return 0, io.EOF
+	}
+
+	entry := s.entries[0]
+	if remaining := entry.Length - s.n; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := s.r.Read(p)
+	s.crc.Write(p[:n])
+	s.n += int64(n)
+
+	if s.n == entry.Length {
+		if got := s.crc.Sum32(); got != entry.CRC32C {
+			return n, &corruptError{err: fmt.Errorf("segment of %s has CRC32C %08x, expected %08x", entry.Name, got, entry.CRC32C)}
+		}
+		s.entries = s.entries[1:]
+		s.n = 0
+		s.crc.Reset()
+	}
+	if err == io.EOF && len(s.entries) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// matchesPaths returns true if the archive entry name is one of the paths or
+// is inside one of the paths.
+func matchesPaths(name string, paths []string) bool {
+	for _, p := range paths {
+		p = strings.Trim(path.Clean("/"+p), "/")
+		if p == "" || name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
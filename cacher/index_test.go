@@ -0,0 +1,179 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRestore_index(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{
+		"a/1": "contents of a/1",
+		"a/2": "contents of a/2",
+		"b/1": "contents of b/1",
+	}
+
+	// Archives without compression are changed in place, which the
+	// decompressor would otherwise detect
+	tamper := func(t *testing.T, b *fakeGCSBucket, old, new string) {
+		data, _, _ := b.object("a")
+		if bytes.Count(data, []byte(old)) != 1 {
+			t.Fatalf("expected %q once in the archive", old)
+		}
+		b.rewrite("a", bytes.Replace(data, []byte(old), []byte(new), 1))
+	}
+
+	cases := []struct {
+		name    string
+		paths   []string
+		subpath string
+		setup   func(t *testing.T, b *fakeGCSBucket)
+		want    map[string]string
+		err     bool
+	}{
+		{
+			name:  "paths",
+			paths: []string{"a"},
+			want:  map[string]string{"a/1": "contents of a/1", "a/2": "contents of a/2"},
+		},
+		{
+			name:  "file",
+			paths: []string{"a/2", "b/1"},
+			want:  map[string]string{"a/2": "contents of a/2", "b/1": "contents of b/1"},
+		},
+		{
+			name:    "subpath",
+			subpath: "a",
+			want:    map[string]string{"1": "contents of a/1", "2": "contents of a/2"},
+		},
+		{
+			name:  "other_entry_changed",
+			paths: []string{"a"},
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				tamper(t, b, "contents of b/1", "CONTENTS OF B/1")
+			},
+			want: map[string]string{"a/1": "contents of a/1", "a/2": "contents of a/2"},
+		},
+		{
+			name:  "entry_changed",
+			paths: []string{"b"},
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				tamper(t, b, "contents of b/1", "CONTENTS OF B/1")
+			},
+			err: true,
+		},
+		{
+			name:  "index_changed",
+			paths: []string{"a"},
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				tamper(t, b, `"name":"a/2"`, `"name":"a/3"`)
+			},
+			err: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c, f := newTestCacher(t)
+
+			if err := c.Save(ctx, &SaveRequest{
+				Bucket:      testBucket,
+				Dir:         writeFiles(t, files),
+				Key:         "a",
+				Compression: CompressionNone,
+				Index:       true,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if tc.setup != nil {
+				tc.setup(t, f.bucket(testBucket))
+			}
+
+			dir := t.TempDir()
+			err := c.Restore(ctx, &RestoreRequest{
+				Bucket:  testBucket,
+				Dir:     dir,
+				Keys:    []string{"a"},
+				Paths:   tc.paths,
+				Subpath: tc.subpath,
+			})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readFiles(t, dir); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %q to be %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRestore_dryRunIndex(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are not archived on Windows")
+	}
+
+	ctx := context.Background()
+	c, _ := newTestCacher(t)
+
+	src := writeFiles(t, map[string]string{"dir/file": "file"})
+	if err := os.Link(filepath.Join(src, "dir", "file"), filepath.Join(src, "dir", "hard")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Listing the index must match listing the headers of the archive
+	dir := t.TempDir()
+	var want string
+	for _, index := range []bool{false, true} {
+		if err := c.Save(ctx, &SaveRequest{
+			Bucket: testBucket,
+			Dir:    src,
+			Key:    fmt.Sprintf("index-%t", index),
+			Index:  index,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := c.Restore(ctx, &RestoreRequest{
+			Bucket:       testBucket,
+			Dir:          dir,
+			Keys:         []string{fmt.Sprintf("index-%t", index)},
+			DryRun:       true,
+			DryRunOutput: &buf,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if !index {
+			want = buf.String()
+			if s := "hard link to " + filepath.Join(dir, "dir", "file"); !strings.Contains(want, s) {
+				t.Errorf("expected %q to contain %q", want, s)
+			}
+			continue
+		}
+		if got := buf.String(); got != want {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package cacher
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// defaultLifecycleDays is the default number of days after which caches
+	// which were not saved or restored are deleted.
+	defaultLifecycleDays = 30
+
+	// defaultIncompleteDays is the default number of days after which
+	// incomplete uploads are removed.
+	defaultIncompleteDays = 1
+)
+
+// LifecycleRequest is used as input to the ConfigureLifecycle operation.
+type LifecycleRequest struct {
+	// Bucket is the name of the Cloud Storage bucket which holds the caches.
+	Bucket string
+
+	// Days is the number of days after which caches which were not saved or
+	// restored are deleted, using the custom time which Save sets and Restore
+	// updates. The default is 30.
+	Days int
+
+	// IncompleteDays is the number of days after which the parts of
+	// incomplete parallel uploads, stale locks, and incomplete multipart
+	// uploads are removed. The default is 1.
+	IncompleteDays int
+}
+
+// ConfigureLifecycle adds lifecycle rules to the bucket which delete unused
+// caches and clean up after incomplete uploads. Other rules on the bucket are
+// kept, and rules previously added by ConfigureLifecycle are replaced, so it
+// can be run again to change the number of days.
+func (c *Cacher) ConfigureLifecycle(ctx context.Context, i *LifecycleRequest) (retErr error) {
+	if i == nil {
+		retErr = fmt.Errorf("missing lifecycle options")
+		return
+	}
+
+	bucket := i.Bucket
+	if bucket == "" {
+		retErr = fmt.Errorf("missing bucket")
+		return
+	}
+
+	days := i.Days
+	if days == 0 {
+		days = defaultLifecycleDays
+	}
+	if days < 0 {
+		retErr = fmt.Errorf("days must be positive")
+		return
+	}
+
+	incompleteDays := i.IncompleteDays
+	if incompleteDays == 0 {
+		incompleteDays = defaultIncompleteDays
+	}
+	if incompleteDays < 0 {
+		retErr = fmt.Errorf("incomplete days must be positive")
+		return
+	}
+
+	st, err := c.bucket(ctx, bucket)
+	if err != nil {
+		retErr = err
+		return
+	}
+	gs, ok := st.(*gcsStore)
+	if !ok {
+		retErr = fmt.Errorf("lifecycle rules are only supported for Cloud Storage buckets")
+		return
+	}
+
+	attrs, err := gs.bucket.Attrs(ctx)
+	if err != nil {
+		retErr = fmt.Errorf("failed to get bucket attributes: %w", err)
+		return
+	}
+
+	want := lifecycleRules(int64(days), int64(incompleteDays))
+	var rules []storage.LifecycleRule
+	for _, r := range attrs.Lifecycle.Rules {
+		managed := false
+		for _, w := range want {
+			if sameLifecycleRule(r, w) {
+				managed = true
+				break
+			}
+		}
+		if !managed {
+			rules = append(rules, r)
+		}
+	}
+	rules = append(rules, want...)
+
+	// Do not overwrite changes to the bucket made in the meantime
+	c.log("updating lifecycle rules of bucket %s", bucket)
+	if _, err := gs.bucket.If(storage.BucketConditions{MetagenerationMatch: attrs.MetaGeneration}).
+		Update(ctx, storage.BucketAttrsToUpdate{
+			Lifecycle: &storage.Lifecycle{Rules: rules},
+		}); err != nil {
+		retErr = fmt.Errorf("failed to update bucket lifecycle: %w", gcsError(err))
+		return
+	}
+	return
+}
+
+// lifecycleRules returns the lifecycle rules which delete caches after days
+// without being saved or restored, and clean up after incomplete uploads.
+func lifecycleRules(days, incompleteDays int64) []storage.LifecycleRule {
+	return []storage.LifecycleRule{
+		{
+			Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+			Condition: storage.LifecycleCondition{DaysSinceCustomTime: days},
+		},
+		{
+			Action: storage.LifecycleAction{Type: storage.DeleteAction},
+			Condition: storage.LifecycleCondition{
+				AgeInDays:     incompleteDays,
+				MatchesPrefix: []string{companionPrefix + "parts/", companionPrefix + "locks/"},
+			},
+		},
+		{
+			Action:    storage.LifecycleAction{Type: storage.AbortIncompleteMPUAction},
+			Condition: storage.LifecycleCondition{AgeInDays: incompleteDays},
+		},
+	}
+}
+
+// sameLifecycleRule returns true if rule a only differs from rule b in the
+// number of days of the condition which b uses.
+func sameLifecycleRule(a, b storage.LifecycleRule) bool {
+	if b.Condition.DaysSinceCustomTime != 0 {
+		a.Condition.DaysSinceCustomTime = b.Condition.DaysSinceCustomTime
+	} else {
+		a.Condition.AgeInDays = b.Condition.AgeInDays
+	}
+	return reflect.DeepEqual(a, b)
+}
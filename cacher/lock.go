@@ -0,0 +1,145 @@
+package cacher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// lockExpiresMetadataKey is the object metadata key which holds the time at
+	// which a lock expires, in RFC 3339 format.
+	lockExpiresMetadataKey = "gcs-cacher-lock-expires"
+
+	// lockIDMetadataKey is the object metadata key which holds a random ID of
+	// the save which holds the lock.
+	lockIDMetadataKey = "gcs-cacher-lock-id"
+
+	// defaultLockTTL is how long a lock is held if the save which acquired it
+	// never releases it, like when the builder is terminated.
+	defaultLockTTL = time.Hour
+)
+
+// lockName returns the name of the lock object for the cache key.
+func lockName(key string) string {
+	return companionPrefix + "locks/" + key
+}
+
+// createsAtomically returns true if the storage creates objects only if they
+// do not exist atomically, so only one of many saves can acquire a lock. S3
+// buckets only do so for objects uploaded in a single request, which locks
+// are, and registries only check for the tag before pushing.
+func createsAtomically(st Storage) bool {
+	switch s := st.(type) {
+	case *s3Store:
+		return s.atomicCreate
+	case *ociStore, *presignedStore, *httpStore:
+		return false
+	default:
+		return true
+	}
+}
+
+// acquireLock creates the lock object for the cache key, which expires after
+// the ttl. It returns false if another save holds the lock. Expired locks are
+// removed and acquired again. Storage without generations cannot remove them
+// conditionally, so saves which find the same expired lock may all acquire it.
+// The returned function releases the lock.
+func (c *Cacher) acquireLock(ctx context.Context, st Storage, key string, ttl time.Duration) (func(), bool, error) {
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, false, fmt.Errorf("failed to generate lock ID: %w", err)
+	}
+	id := hex.EncodeToString(b)
+
+	name := lockName(key)
+	for {
+		c.log("acquiring lock %s", name)
+
+		until := time.Now().Add(ttl)
+		w := st.NewWriter(ctx, name, &WriterOptions{
+			DoesNotExist: true,
+			CacheControl: "no-store",
+			Metadata: map[string]string{
+				lockExpiresMetadataKey: until.UTC().Format(time.RFC3339),
+				lockIDMetadataKey:      id,
+			},
+		})
+		err := w.Close()
+		if err == nil {
+			generation := w.Attrs().Generation
+			release := func() {
+				// Release the lock even if the save was cancelled
+				ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+				defer cancel()
+
+				c.log("releasing lock %s", name)
+				if err := c.releaseLock(ctx, st, name, generation, id, until); err != nil {
+					c.warn("failed to release lock %s: %s", name, err)
+				}
+			}
+			return release, true, nil
+		}
+		if !isPreconditionFailed(err) {
+			return nil, false, fmt.Errorf("failed to create lock: %w", err)
+		}
+
+		// Another save holds the lock, unless it expired
+		attrs, err := st.Attrs(ctx, name, 0)
+		if err != nil {
+			if errors.Is(err, ErrObjectNotExist) {
+				continue
+			}
+			return nil, false, fmt.Errorf("failed to check lock: %w", err)
+		}
+
+		expires, err := time.Parse(time.RFC3339, attrs.Metadata[lockExpiresMetadataKey])
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to parse lock expiration: %w", err)
+		}
+		if time.Now().Before(expires) {
+			return nil, false, nil
+		}
+
+		c.log("removing expired lock %s", name)
+		if err := st.Delete(ctx, name, attrs.Generation); err != nil &&
+			!errors.Is(err, ErrObjectNotExist) && !isPreconditionFailed(err) {
+			return nil, false, fmt.Errorf("failed to remove expired lock: %w", err)
+		}
+	}
+}
+
+// releaseLock removes the lock object which was created with the generation
+// and ID. Storage without generations cannot delete it conditionally, so the
+// lock is only removed if it still holds the ID and has not expired, since
+// another save may have taken it over once it expired.
+func (c *Cacher) releaseLock(ctx context.Context, st Storage, name string, generation int64, id string, expires time.Time) error {
+	if generation == 0 {
+		if time.Now().After(expires) {
+			return fmt.Errorf("lock expired before the save completed")
+		}
+
+		attrs, err := st.Attrs(ctx, name, 0)
+		if err != nil {
+			if errors.Is(err, ErrObjectNotExist) {
+				return nil
+			}
+			return err
+		}
+		if attrs.Metadata[lockIDMetadataKey] != id {
+			return fmt.Errorf("lock is held by another save")
+		}
+	}
+
+	if err := st.Delete(ctx, name, generation); err != nil && !errors.Is(err, ErrObjectNotExist) {
+		return err
+	}
+	return nil
+}
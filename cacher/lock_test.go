@@ -0,0 +1,135 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	t.Parallel()
+
+	stores := map[string]func(t *testing.T) Storage{
+		"gcs": func(t *testing.T) Storage {
+			c, _ := newTestCacher(t)
+			st, err := c.bucket(context.Background(), testBucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return st
+		},
+		"file": func(t *testing.T) Storage {
+			root := t.TempDir()
+			return newFileStore("file://"+filepath.ToSlash(root), root)
+		},
+		"no_generations": func(t *testing.T) Storage {
+			_, st := newFakeS3Store(t)
+			return st
+		},
+	}
+
+	// writeLock replaces the lock object of the key
+	writeLock := func(t *testing.T, st Storage, key, id string, expires time.Time) {
+		t.Helper()
+
+		w := st.NewWriter(context.Background(), lockName(key), &WriterOptions{
+			Metadata: map[string]string{
+				lockExpiresMetadataKey: expires.UTC().Format(time.RFC3339),
+				lockIDMetadataKey:      id,
+			},
+		})
+		if _, err := io.WriteString(w, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, newStore := range stores {
+		newStore := newStore
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c := new(Cacher)
+
+			t.Run("held", func(t *testing.T) {
+				st := newStore(t)
+
+				release, ok, err := c.acquireLock(ctx, st, "key", time.Hour)
+				if err != nil || !ok {
+					t.Fatalf("expected lock, got %t: %v", ok, err)
+				}
+				if _, ok, err := c.acquireLock(ctx, st, "key", time.Hour); err != nil || ok {
+					t.Fatalf("expected lock to be held, got %t: %v", ok, err)
+				}
+
+				release()
+				if _, err := st.Attrs(ctx, lockName("key"), 0); !errors.Is(err, ErrObjectNotExist) {
+					t.Errorf("expected lock to be released, got %v", err)
+				}
+				if _, ok, err := c.acquireLock(ctx, st, "key", time.Hour); err != nil || !ok {
+					t.Errorf("expected lock after release, got %t: %v", ok, err)
+				}
+			})
+
+			t.Run("expired", func(t *testing.T) {
+				st := newStore(t)
+
+				writeLock(t, st, "key", "other", time.Now().Add(-time.Minute))
+				if _, ok, err := c.acquireLock(ctx, st, "key", time.Hour); err != nil || !ok {
+					t.Errorf("expected expired lock to be acquired, got %t: %v", ok, err)
+				}
+			})
+
+			t.Run("taken_over", func(t *testing.T) {
+				st := newStore(t)
+
+				release, ok, err := c.acquireLock(ctx, st, "key", time.Hour)
+				if err != nil || !ok {
+					t.Fatalf("expected lock, got %t: %v", ok, err)
+				}
+
+				// Another save took over the lock, which releasing must not
+				// remove
+				writeLock(t, st, "key", "other", time.Now().Add(time.Hour))
+				release()
+
+				attrs, err := st.Attrs(ctx, lockName("key"), 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := attrs.Metadata[lockIDMetadataKey]; got != "other" {
+					t.Errorf("expected lock of %q to be kept, got %q", "other", got)
+				}
+			})
+		})
+	}
+}
+
+func TestSave_lockNotAtomic(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c, err := New(ctx, WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Registries only check for the tag before pushing it
+	err = c.Save(ctx, &SaveRequest{
+		Bucket: "oci://127.0.0.1:1/caches?plain-http=true",
+		Dir:    t.TempDir(),
+		Key:    "key",
+		Lock:   true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "locks are not supported") {
+		t.Errorf("expected lock error, got %v", err)
+	}
+}
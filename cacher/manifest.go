@@ -0,0 +1,154 @@
+package cacher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// companionPrefix is the prefix of objects which are stored alongside caches,
+// like manifests. They are never restored as caches themselves.
+const companionPrefix = ".gcs-cacher/"
+
+// manifestName returns the name of the manifest object for the cache key.
+func manifestName(key string) string {
+	return companionPrefix + "manifests/" + key
+}
+
+// manifest lists the files in an archive and their digests, so restored files
+// can be verified.
+type manifest struct {
+	// Generation is the generation of the archive the manifest describes.
+	Generation int64 `json:"generation"`
+
+	// Files is the list of regular files in the archive.
+	Files []*manifestFile `json:"files"`
+}
+
+// manifestFile is a single file in the manifest.
+type manifestFile struct {
+	// Name is the name of the entry in the archive.
+	Name string `json:"name"`
+
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+
+	// SHA256 is the hex-encoded SHA256 digest of the file's contents.
+	SHA256 string `json:"sha256"`
+}
+
+// writeManifest uploads the manifest for the cache key with the Cache-Control,
+// encrypted with the KMS key if it is not empty.
+func (c *Cacher) writeManifest(ctx context.Context, st Storage, key, kmsKey, cacheControl string, m *manifest) (retErr error) {
+	name := manifestName(key)
+	c.log("writing manifest %s", name)
+
+	w := st.NewWriter(ctx, name, &WriterOptions{
+		ContentType:  "application/json",
+		CacheControl: cacheControl,
+		KMSKeyName:   kmsKey,
+	})
+	defer func() {
+		if cerr := w.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: failed to close manifest writer: %w", retErr, cerr)
+				return
+			}
+			retErr = fmt.Errorf("failed to close manifest writer: %w", cerr)
+		}
+	}()
+
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		retErr = fmt.Errorf("failed to write manifest: %w", err)
+		return
+	}
+	return
+}
+
+// readManifest downloads the manifest for the cache object with the given
+// name.
+func (c *Cacher) readManifest(ctx context.Context, st Storage, key string) (_ *manifest, retErr error) {
+	name := manifestName(key)
+	c.log("reading manifest %s", name)
+
+	r, err := st.NewReader(ctx, name, 0, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	defer func() {
+		if cerr := r.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: failed to close manifest reader: %w", retErr, cerr)
+				return
+			}
+			retErr = fmt.Errorf("failed to close manifest reader: %w", cerr)
+		}
+	}()
+
+	var m manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// verifyManifest checks each regular file in the manifest against the file
+// which was extracted, and returns an error describing any discrepancies.
+// Files which the restore does not select, like those outside of the subpath,
+// are skipped, and any other file which was not extracted is missing.
+func (e *extractor) verifyManifest(m *manifest) error {
+	c := e.c
+
+	var problems []string
+	for _, f := range m.Files {
+		target, ok := e.files[f.Name]
+		if !ok {
+			if e.selected(f.Name) {
+				problems = append(problems, fmt.Sprintf("%s (missing)", f.Name))
+			}
+			continue
+		}
+
+		c.log("verifying %s", target)
+		if problem := checkFile(target, f); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	if n := len(problems); n > 0 {
+		if n > maxReported {
+			problems = problems[:maxReported]
+		}
+		return fmt.Errorf("%d restored files do not match the manifest: %s",
+			n, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// checkFile compares the file at target with the manifest entry. It returns a
+// description of the problem, or the empty string if the file matches.
+func checkFile(target string, f *manifestFile) string {
+	file, err := os.Open(target)
+	if err != nil {
+		return fmt.Sprintf("%s (%s)", f.Name, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, file)
+	if err != nil {
+		return fmt.Sprintf("%s (%s)", f.Name, err)
+	}
+	if n != f.Size {
+		return fmt.Sprintf("%s (size %d, expected %d)", f.Name, n, f.Size)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != f.SHA256 {
+		return fmt.Sprintf("%s (digest %s, expected %s)", f.Name, got, f.SHA256)
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package cacher
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRestore_verifyManifest(t *testing.T) {
+	t.Parallel()
+
+	// addFile lists a file in the manifest which is not in the archive
+	addFile := func(t *testing.T, b *fakeGCSBucket, name string) {
+		data, obj, ok := b.object(".gcs-cacher/manifests/a")
+		if !ok {
+			t.Fatal("missing manifest")
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		m["files"] = append(m["files"].([]interface{}), map[string]interface{}{
+			"name":   name,
+			"size":   1,
+			"sha256": strings.Repeat("0", 64),
+		})
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.put(".gcs-cacher/manifests/a", data, obj.Metadata)
+	}
+
+	cases := []struct {
+		name    string
+		setup   func(t *testing.T, b *fakeGCSBucket)
+		paths   []string
+		subpath string
+		err     string
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name: "missing",
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				addFile(t, b, "missing")
+			},
+			err: "missing (missing)",
+		},
+		{
+			name: "missing_in_subpath",
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				addFile(t, b, "sub/missing")
+			},
+			subpath: "sub",
+			err:     "sub/missing (missing)",
+		},
+		{
+			name: "outside_of_subpath",
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				addFile(t, b, "missing")
+			},
+			subpath: "sub",
+		},
+		{
+			name: "outside_of_paths",
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				addFile(t, b, "missing")
+			},
+			paths: []string{"sub"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c, f := newTestCacher(t)
+
+			if err := c.Save(ctx, &SaveRequest{
+				Bucket:   testBucket,
+				Dir:      writeFiles(t, map[string]string{"a": "a", "sub/b": "b"}),
+				Key:      "a",
+				Manifest: true,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if tc.setup != nil {
+				tc.setup(t, f.bucket(testBucket))
+			}
+
+			err := c.Restore(ctx, &RestoreRequest{
+				Bucket:         testBucket,
+				Dir:            t.TempDir(),
+				Keys:           []string{"a"},
+				Paths:          tc.paths,
+				Subpath:        tc.subpath,
+				VerifyManifest: true,
+			})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
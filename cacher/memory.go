@@ -0,0 +1,92 @@
+package cacher
+
+import (
+	"io"
+)
+
+const (
+	// defaultBufferSize is the default size of the buffers used to copy files
+	// and objects.
+	defaultBufferSize = 256 * 1024
+
+	// minBufferSize is the smallest buffer used for parts and slices when they
+	// are reduced to fit in the memory limit.
+	minBufferSize = 256 * 1024
+)
+
+// BufferSize sets the size in bytes of the buffers used to copy files and
+// objects. Larger buffers mean fewer system calls, at the cost of memory. If n
+// is less than one, the default of 256KiB is used.
+func (c *Cacher) BufferSize(n int) {
+	c.bufferSize = n
+}
+
+// MemoryLimit sets the approximate maximum number of bytes used for buffers.
+// Half of it is available to parallel uploads and downloads, and a quarter to
+// files which are read ahead or written in the background. They use fewer or
+// smaller buffers to stay within it, which is slower but lets small builders
+// restore large caches. If n is less than one, there is no limit.
+func (c *Cacher) MemoryLimit(n int64) {
+	c.memoryLimit = n
+}
+
+// copyBuffered copies from src to dst using a pooled buffer.
+func (c *Cacher) copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	size := c.bufferSize
+	if size < 1 {
+		size = defaultBufferSize
+	}
+
+	buf, ok := c.buffers.Get().(*[]byte)
+	if !ok || len(*buf) != size {
+		b := make([]byte, size)
+		buf = &b
+	}
+	defer c.buffers.Put(buf)
+
+	// Hide any ReadFrom and WriteTo methods, which would use their own buffers
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// transferMemory returns the number of bytes available to parallel uploads and
+// downloads, or zero if there is no limit.
+func (c *Cacher) transferMemory() int64 {
+	return c.memoryLimit / 2
+}
+
+// fileMemory returns the number of bytes available to files which are read
+// ahead or written in the background, or zero if there is no limit.
+func (c *Cacher) fileMemory() int64 {
+	return c.memoryLimit / 4
+}
+
+// fit returns the number of buffers of size bytes, up to n, which fit in the
+// memory. It returns n if memory is zero, and at least one otherwise.
+func fit(n int, size, memory int64) int {
+	if memory <= 0 || size <= 0 {
+		return n
+	}
+	if max := memory / size; int64(n) > max {
+		n = int(max)
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// shrink returns size, reduced so that n buffers fit in the memory, but no
+// smaller than minBufferSize. It returns size if memory is zero.
+func shrink(size int64, n int, memory int64) int64 {
+	if memory <= 0 || n < 1 {
+		return size
+	}
+	max := memory / int64(n)
+	if max < minBufferSize {
+		max = minBufferSize
+	}
+	if size > max {
+		size = max
+	}
+	return size
+}
@@ -0,0 +1,103 @@
+package cacher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalization is a Unicode normalization form applied to file names in the
+// archive. macOS stores file names in decomposed form (NFD) while most Linux
+// tools produce composed form (NFC), so the same tree can otherwise produce
+// archives with different names depending on where it was saved.
+type Normalization string
+
+const (
+	// NormalizationNone stores and restores file names as-is. This is the
+	// default.
+	NormalizationNone Normalization = ""
+
+	// NormalizationNFC normalizes file names to the composed form.
+	NormalizationNFC Normalization = "nfc"
+
+	// NormalizationNFD normalizes file names to the decomposed form.
+	NormalizationNFD Normalization = "nfd"
+)
+
+// ParseNormalization parses the given string into a normalization.
+func ParseNormalization(s string) (Normalization, error) {
+	switch n := Normalization(s); n {
+	case NormalizationNone, NormalizationNFC, NormalizationNFD:
+		return n, nil
+	default:
+		return "", fmt.Errorf("unknown normalization %q", s)
+	}
+}
+
+// apply normalizes the name.
+func (n Normalization) apply(name string) string {
+	switch n {
+	case NormalizationNFC:
+		return norm.NFC.String(name)
+	case NormalizationNFD:
+		return norm.NFD.String(name)
+	default:
+		return name
+	}
+}
+
+// CaseCollisions is the action taken when the archive contains entries whose
+// names differ only in case and the destination filesystem is case-insensitive.
+type CaseCollisions string
+
+const (
+	// CaseCollisionsError fails the restore. This is the default.
+	CaseCollisionsError CaseCollisions = "error"
+
+	// CaseCollisionsWarn logs a warning and continues, so later entries
+	// overwrite earlier ones.
+	CaseCollisionsWarn CaseCollisions = "warn"
+
+	// CaseCollisionsIgnore does not check for collisions.
+	CaseCollisionsIgnore CaseCollisions = "ignore"
+)
+
+// ParseCaseCollisions parses the given string into a case collision action.
+// The empty string is treated as the default.
+func ParseCaseCollisions(s string) (CaseCollisions, error) {
+	switch c := CaseCollisions(s); c {
+	case "":
+		return CaseCollisionsError, nil
+	case CaseCollisionsError, CaseCollisionsWarn, CaseCollisionsIgnore:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown case collision action %q", s)
+	}
+}
+
+// isCaseInsensitive returns true if the filesystem containing dir treats names
+// which differ only in case as the same file.
+func isCaseInsensitive(dir string) (bool, error) {
+	f, err := os.CreateTemp(dir, ".gcs-cacher-case-")
+	if err != nil {
+		return false, fmt.Errorf("failed to create file: %w", err)
+	}
+	name := f.Name()
+	defer os.Remove(name)
+
+	if err := f.Close(); err != nil {
+		return false, fmt.Errorf("failed to close file: %w", err)
+	}
+
+	upper := filepath.Join(filepath.Dir(name), strings.ToUpper(filepath.Base(name)))
+	if _, err := os.Stat(upper); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,622 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+const (
+	// ociConfigMediaType is the media type of the config of the artifacts
+	// which hold objects, which identifies them as cacher objects, and
+	// ociObjectMediaType is the media type of their only layer, which holds
+	// the contents.
+	ociConfigMediaType = "application/vnd.gcs-cacher.config.v1+json"
+	ociObjectMediaType = "application/vnd.gcs-cacher.object.v1"
+
+	// ociAnnotationPrefix is the prefix of the manifest annotations which hold
+	// the attributes of an object, and ociMetadataPrefix the prefix of those
+	// which hold its custom metadata.
+	ociAnnotationPrefix = "com.github.sethvargo.gcs-cacher."
+	ociMetadataPrefix   = ociAnnotationPrefix + "metadata."
+
+	// ociMaxTagLength is the maximum length of a tag.
+	ociMaxTagLength = 128
+
+	// ociProgressInterval is how many bytes are uploaded between calls to the
+	// progress function.
+	ociProgressInterval = 16 * 1024 * 1024
+)
+
+var (
+	// ociEmptyConfig is the config of the artifacts which hold objects.
+	ociEmptyConfig = []byte("{}")
+
+	// errNotOCIObject is returned for artifacts which were not pushed by the
+	// cacher.
+	errNotOCIObject = errors.New("not a cacher object")
+)
+
+// ociStore stores objects as OCI artifacts in a repository of a registry, like
+// Artifact Registry. Each object is an artifact tagged with its escaped name,
+// whose manifest annotations hold the attributes of the object and whose only
+// layer holds the contents. Like S3, registries do not number the generations
+// of artifacts, so all objects are generation zero and writes which require the
+// object to not exist are checked before the upload rather than atomically.
+type ociStore struct {
+	repo   *remote.Repository
+	bucket string
+}
+
+// newOCIStore creates the store for a repository URL like
+// oci://us-docker.pkg.dev/my-project/my-repo/caches. Artifact Registry and
+// Container Registry are accessed with the Google Cloud credentials from the
+// options, unless there are no options, and other registries anonymously. The
+// plain-http query parameter accesses the registry over HTTP, like a local
+// registry in tests.
+func newOCIStore(ctx context.Context, bucketURL string, opts []option.ClientOption, rt http.RoundTripper) (*ociStore, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bucket %q: %w", bucketURL, err)
+	}
+	name := u.Host + "/" + strings.Trim(u.Path, "/")
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("bucket %q must be a registry and repository, like oci://us-docker.pkg.dev/project/repo", bucketURL)
+	}
+
+	repo, err := remote.NewRepository(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse repository %q: %w", name, err)
+	}
+	repo.PlainHTTP, _ = strconv.ParseBool(u.Query().Get("plain-http"))
+
+	client := &auth.Client{
+		Client: &http.Client{Transport: rt},
+		Header: http.Header{"User-Agent": {"gcs-cacher/1.0"}},
+		Cache:  auth.NewCache(),
+	}
+	if isGoogleRegistry(u.Host) && len(opts) > 0 {
+		creds, err := transport.Creds(ctx, append([]option.ClientOption{
+			option.WithScopes(cloudPlatformScope),
+		}, opts...)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find credentials for %s: %w", u.Host, err)
+		}
+		ts := oauth2.ReuseTokenSource(nil, creds.TokenSource)
+
+		// Google registries accept access tokens as the password of a
+		// special user
+		client.Credential = func(ctx context.Context, registry string) (auth.Credential, error) {
+			token, err := ts.Token()
+			if err != nil {
+				return auth.EmptyCredential, fmt.Errorf("failed to get access token: %w", err)
+			}
+			return auth.Credential{
+				Username: "oauth2accesstoken",
+				Password: token.AccessToken,
+			}, nil
+		}
+	}
+	repo.Client = client
+
+	return &ociStore{
+		repo:   repo,
+		bucket: name,
+	}, nil
+}
+
+// isGoogleRegistry returns true if the registry is Artifact Registry or
+// Container Registry.
+func isGoogleRegistry(host string) bool {
+	host = strings.Split(host, ":")[0]
+	return strings.HasSuffix(host, ".pkg.dev") || host == "gcr.io" || strings.HasSuffix(host, ".gcr.io")
+}
+
+// ociTag returns the tag for the object. Letters, digits, dots, and dashes are
+// kept, and other bytes, or a leading dot or dash, are escaped as an
+// underscore and their hex value. The tag of a prefix of a name is a prefix of
+// the name's tag, so objects can be found by the tags of their prefixes.
+func ociTag(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+			b.WriteByte(ch)
+		case (ch == '.' || ch == '-') && i > 0:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "_%02x", ch)
+		}
+	}
+	return b.String()
+}
+
+// checkName returns an error if the name of the object is too long for a tag.
+func (s *ociStore) checkName(name string) (string, error) {
+	tag := ociTag(name)
+	if name == "" || len(tag) > ociMaxTagLength {
+		return "", fmt.Errorf("object name %q cannot be stored in %s, tags are limited to %d characters",
+			name, s.bucket, ociMaxTagLength)
+	}
+	return tag, nil
+}
+
+// checkGeneration returns an error if a specific generation was requested.
+func (s *ociStore) checkGeneration(generation int64) error {
+	if generation != 0 {
+		return fmt.Errorf("repository %s does not support generations", s.bucket)
+	}
+	return nil
+}
+
+// manifest returns the manifest of the artifact with the tag.
+func (s *ociStore) manifest(ctx context.Context, tag string) (*ocispec.Manifest, error) {
+	_, rc, err := s.repo.FetchReference(ctx, tag)
+	if err != nil {
+		return nil, ociError(err)
+	}
+	defer rc.Close()
+
+	var m ocispec.Manifest
+	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest of %s: %w", tag, err)
+	}
+	if m.Config.MediaType != ociConfigMediaType || len(m.Layers) != 1 {
+		return nil, fmt.Errorf("%s:%s: %w", s.bucket, tag, errNotOCIObject)
+	}
+	return &m, nil
+}
+
+// objectAttrs converts the manifest of an artifact.
+func (s *ociStore) objectAttrs(m *ocispec.Manifest) *ObjectAttrs {
+	a := m.Annotations
+	attrs := &ObjectAttrs{
+		Bucket:          s.bucket,
+		Name:            a[ociAnnotationPrefix+"name"],
+		Size:            m.Layers[0].Size,
+		ContentType:     a[ociAnnotationPrefix+"content-type"],
+		CacheControl:    a[ociAnnotationPrefix+"cache-control"],
+		ContentEncoding: a[ociAnnotationPrefix+"content-encoding"],
+	}
+	if t, err := time.Parse(time.RFC3339Nano, a[ocispec.AnnotationCreated]); err == nil {
+		attrs.Updated = t
+	}
+	if crc, err := strconv.ParseUint(a[ociAnnotationPrefix+"crc32c"], 16, 32); err == nil {
+		attrs.CRC32C = uint32(crc)
+		attrs.HasCRC32C = true
+	}
+	for k, v := range a {
+		if strings.HasPrefix(k, ociMetadataPrefix) {
+			if attrs.Metadata == nil {
+				attrs.Metadata = make(map[string]string)
+			}
+			attrs.Metadata[strings.TrimPrefix(k, ociMetadataPrefix)] = v
+		}
+	}
+	return attrs
+}
+
+// pushManifest tags the manifest for the object's layer and attributes.
+func (s *ociStore) pushManifest(ctx context.Context, tag string, config, layer ocispec.Descriptor, attrs *ObjectAttrs) error {
+	annotations := map[string]string{
+		ocispec.AnnotationCreated:    attrs.Updated.UTC().Format(time.RFC3339Nano),
+		ociAnnotationPrefix + "name": attrs.Name,
+	}
+	if attrs.ContentType != "" {
+		annotations[ociAnnotationPrefix+"content-type"] = attrs.ContentType
+	}
+	if attrs.CacheControl != "" {
+		annotations[ociAnnotationPrefix+"cache-control"] = attrs.CacheControl
+	}
+	if attrs.ContentEncoding != "" {
+		annotations[ociAnnotationPrefix+"content-encoding"] = attrs.ContentEncoding
+	}
+	if attrs.HasCRC32C {
+		annotations[ociAnnotationPrefix+"crc32c"] = fmt.Sprintf("%08x", attrs.CRC32C)
+	}
+	for k, v := range attrs.Metadata {
+		annotations[ociMetadataPrefix+k] = v
+	}
+
+	b, err := json.Marshal(&ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      config,
+		Layers:      []ocispec.Descriptor{layer},
+		Annotations: annotations,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	if err := s.repo.PushReference(ctx, desc, bytes.NewReader(b), tag); err != nil {
+		return fmt.Errorf("failed to push manifest: %w", err)
+	}
+	return nil
+}
+
+func (s *ociStore) Attrs(ctx context.Context, name string, generation int64) (*ObjectAttrs, error) {
+	if err := s.checkGeneration(generation); err != nil {
+		return nil, err
+	}
+	tag, err := s.checkName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := s.manifest(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	return s.objectAttrs(m), nil
+}
+
+func (s *ociStore) List(ctx context.Context, prefix string) ([]*ObjectAttrs, error) {
+	tagPrefix := ociTag(prefix)
+
+	var tags []string
+	if err := s.repo.Tags(ctx, "", func(page []string) error {
+		for _, tag := range page {
+			if strings.HasPrefix(tag, tagPrefix) {
+				tags = append(tags, tag)
+			}
+		}
+		return nil
+	}); err != nil {
+		// Repositories only exist once something is pushed to them
+		if err := ociError(err); errors.Is(err, ErrObjectNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+	sort.Strings(tags)
+
+	var list []*ObjectAttrs
+	for _, tag := range tags {
+		m, err := s.manifest(ctx, tag)
+		if err != nil {
+			// Skip artifacts which were removed while listing, or which were
+			// not pushed by the cacher
+			if errors.Is(err, ErrObjectNotExist) || errors.Is(err, errNotOCIObject) {
+				continue
+			}
+			return nil, err
+		}
+
+		attrs := s.objectAttrs(m)
+		if strings.HasPrefix(attrs.Name, prefix) {
+			list = append(list, attrs)
+		}
+	}
+	return list, nil
+}
+
+func (s *ociStore) NewReader(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	if err := s.checkGeneration(generation); err != nil {
+		return nil, err
+	}
+	tag, err := s.checkName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := s.manifest(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	layer := m.Layers[0]
+	if offset < 0 || offset > layer.Size {
+		return nil, fmt.Errorf("offset %d is out of range for %s with %d bytes", offset, name, layer.Size)
+	}
+	if length == 0 || offset == layer.Size {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if length < 0 || offset+length > layer.Size {
+		length = layer.Size - offset
+	}
+
+	// Request the range directly, since fetching blobs always starts reading
+	// from the beginning
+	scheme := "https"
+	if s.repo.PlainHTTP {
+		scheme = "http"
+	}
+	ref := s.repo.Reference
+	blobURL := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", scheme, ref.Host(), ref.Repository, layer.Digest)
+
+	ctx = auth.AppendScopes(ctx, auth.ScopeRepository(ref.Repository, auth.ActionPull))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := s.repo.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The registry ignored the range, so skip to it
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to skip to offset %d: %w", offset, err)
+		}
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrObjectNotExist
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to read %s: %s", name, resp.Status)
+	}
+
+	return &struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.LimitReader(resp.Body, length),
+		Closer: resp.Body,
+	}, nil
+}
+
+func (s *ociStore) NewWriter(ctx context.Context, name string, opts *WriterOptions) ObjectWriter {
+	return &ociWriter{
+		s:    s,
+		ctx:  ctx,
+		name: name,
+		opts: opts,
+		sha:  sha256.New(),
+		crc:  crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+	}
+}
+
+func (s *ociStore) Update(ctx context.Context, name string, generation int64, metadata map[string]string) error {
+	if err := s.checkGeneration(generation); err != nil {
+		return err
+	}
+	tag, err := s.checkName(name)
+	if err != nil {
+		return err
+	}
+
+	m, err := s.manifest(ctx, tag)
+	if err != nil {
+		return err
+	}
+
+	// Artifacts cannot be changed, so tag a new manifest for the same contents
+	attrs := s.objectAttrs(m)
+	if attrs.Metadata == nil {
+		attrs.Metadata = make(map[string]string, len(metadata))
+	}
+	for k, v := range metadata {
+		if v == "" {
+			delete(attrs.Metadata, k)
+			continue
+		}
+		attrs.Metadata[k] = v
+	}
+	return s.pushManifest(ctx, tag, m.Config, m.Layers[0], attrs)
+}
+
+func (s *ociStore) Delete(ctx context.Context, name string, generation int64) error {
+	if err := s.checkGeneration(generation); err != nil {
+		return err
+	}
+	tag, err := s.checkName(name)
+	if err != nil {
+		return err
+	}
+
+	desc, err := s.repo.Resolve(ctx, tag)
+	if err != nil {
+		return ociError(err)
+	}
+	if err := s.repo.Delete(ctx, desc); err != nil {
+		return ociError(err)
+	}
+	return nil
+}
+
+// ociError converts registry errors for missing artifacts and repositories to
+// the errors returned by stores.
+func ociError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var resp *errcode.ErrorResponse
+	if errors.Is(err, errdef.ErrNotFound) || (errors.As(err, &resp) && resp.StatusCode == http.StatusNotFound) {
+		return ErrObjectNotExist
+	}
+	return err
+}
+
+// ociWriter spools the contents of an object to a temporary file, since blobs
+// can only be pushed once their digest is known, and pushes the artifact when
+// it is closed.
+type ociWriter struct {
+	s    *ociStore
+	ctx  context.Context
+	name string
+	opts *WriterOptions
+
+	f    *os.File
+	size int64
+	sha  hash.Hash
+	crc  hash.Hash32
+
+	attrs *ObjectAttrs
+}
+
+func (w *ociWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if w.f == nil {
+		f, err := os.CreateTemp("", "gcs-cacher-oci-*")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create temporary file: %w", err)
+		}
+		w.f = f
+	}
+
+	n, err := w.f.Write(p)
+	w.sha.Write(p[:n])
+	w.crc.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *ociWriter) Close() error {
+	if w.f != nil {
+		defer os.Remove(w.f.Name())
+		defer w.f.Close()
+	}
+
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	opts := w.opts
+	if opts.KMSKeyName != "" {
+		return fmt.Errorf("encryption with %s is not supported for %s", opts.KMSKeyName, w.s.bucket)
+	}
+	if opts.SendCRC32C && opts.CRC32C != w.crc.Sum32() {
+		return fmt.Errorf("%s has CRC32C %08x, expected %08x", w.name, w.crc.Sum32(), opts.CRC32C)
+	}
+
+	tag, err := w.s.checkName(w.name)
+	if err != nil {
+		return err
+	}
+	repo := w.s.repo
+
+	if opts.DoesNotExist {
+		_, err := repo.Resolve(w.ctx, tag)
+		if err == nil {
+			return fmt.Errorf("%w: %s already exists", ErrPreconditionFailed, w.name)
+		}
+		if err := ociError(err); !errors.Is(err, ErrObjectNotExist) {
+			return fmt.Errorf("failed to check for %s: %w", w.name, err)
+		}
+	}
+
+	// Push the contents, unless an identical object was already pushed
+	layer := ocispec.Descriptor{
+		MediaType: ociObjectMediaType,
+		Digest:    digest.NewDigest(digest.SHA256, w.sha),
+		Size:      w.size,
+	}
+	exists, err := repo.Blobs().Exists(w.ctx, layer)
+	if err != nil {
+		return fmt.Errorf("failed to check for blob: %w", err)
+	}
+	if !exists {
+		var r io.Reader = bytes.NewReader(nil)
+		if w.f != nil {
+			if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to rewind temporary file: %w", err)
+			}
+			r = w.f
+		}
+		if opts.ProgressFunc != nil {
+			r = &ociProgress{r: r, fn: opts.ProgressFunc}
+		}
+		if err := repo.Blobs().Push(w.ctx, layer, r); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return fmt.Errorf("failed to push blob: %w", err)
+		}
+	}
+
+	config := ocispec.Descriptor{
+		MediaType: ociConfigMediaType,
+		Digest:    digest.FromBytes(ociEmptyConfig),
+		Size:      int64(len(ociEmptyConfig)),
+	}
+	if exists, err := repo.Blobs().Exists(w.ctx, config); err != nil {
+		return fmt.Errorf("failed to check for config: %w", err)
+	} else if !exists {
+		if err := repo.Blobs().Push(w.ctx, config, bytes.NewReader(ociEmptyConfig)); err != nil &&
+			!errors.Is(err, errdef.ErrAlreadyExists) {
+			return fmt.Errorf("failed to push config: %w", err)
+		}
+	}
+
+	attrs := &ObjectAttrs{
+		Bucket:          w.s.bucket,
+		Name:            w.name,
+		Size:            w.size,
+		ContentType:     opts.ContentType,
+		CacheControl:    opts.CacheControl,
+		ContentEncoding: opts.ContentEncoding,
+		Updated:         time.Now(),
+		CRC32C:          w.crc.Sum32(),
+		HasCRC32C:       true,
+		Metadata:        opts.Metadata,
+	}
+	if err := w.s.pushManifest(w.ctx, tag, config, layer, attrs); err != nil {
+		return err
+	}
+	w.attrs = attrs
+
+	if opts.ProgressFunc != nil {
+		opts.ProgressFunc(w.size)
+	}
+	return nil
+}
+
+func (w *ociWriter) Attrs() *ObjectAttrs {
+	return w.attrs
+}
+
+// ociProgress reports the number of bytes read every ociProgressInterval.
+type ociProgress struct {
+	r  io.Reader
+	fn func(int64)
+
+	total    int64
+	reported int64
+}
+
+func (p *ociProgress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.total += int64(n)
+	if p.total-p.reported >= ociProgressInterval {
+		p.reported = p.total
+		p.fn(p.total)
+	}
+	return n, err
+}
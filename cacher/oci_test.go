@@ -0,0 +1,202 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeRegistry serves the parts of the OCI distribution API which ociStore
+// uses from memory, for a single repository named caches.
+type fakeRegistry struct {
+	t *testing.T
+
+	mu        sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[digest.Digest][]byte
+	tags      map[string]digest.Digest
+	uploads   int
+}
+
+// newFakeOCIStore returns a store for the repository of a new fakeRegistry,
+// which is accessed anonymously over HTTP.
+func newFakeOCIStore(t *testing.T) (*fakeRegistry, *ociStore) {
+	f := &fakeRegistry{
+		t:         t,
+		blobs:     make(map[digest.Digest][]byte),
+		manifests: make(map[digest.Digest][]byte),
+		tags:      make(map[string]digest.Digest),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	st, err := newOCIStore(context.Background(), "oci://"+strings.TrimPrefix(srv.URL, "http://")+"/caches?plain-http=true",
+		nil, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, st
+}
+
+func (f *fakeRegistry) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, code)
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/v2/caches/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		f.error(w, http.StatusNotFound, "NAME_UNKNOWN")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, prefix), "/", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case parts[0] == "tags" && parts[1] == "list" && r.Method == http.MethodGet:
+		tags := []string{}
+		for tag := range f.tags {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"name": "caches", "tags": tags}); err != nil {
+			f.t.Error(err)
+		}
+
+	case parts[0] == "manifests" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		dgst, ok := f.tags[parts[1]]
+		if !ok {
+			dgst = digest.Digest(parts[1])
+		}
+		b, ok := f.manifests[dgst]
+		if !ok {
+			f.error(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+
+	case parts[0] == "manifests" && r.Method == http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "MANIFEST_INVALID")
+			return
+		}
+		dgst := digest.FromBytes(b)
+		f.manifests[dgst] = b
+		if parts[1] != dgst.String() {
+			f.tags[parts[1]] = dgst
+		}
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+
+	case parts[0] == "manifests" && r.Method == http.MethodDelete:
+		dgst := digest.Digest(parts[1])
+		if _, ok := f.manifests[dgst]; !ok {
+			f.error(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		delete(f.manifests, dgst)
+		for tag, d := range f.tags {
+			if d == dgst {
+				delete(f.tags, tag)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	case parts[0] == "blobs" && parts[1] == "uploads/" && r.Method == http.MethodPost:
+		f.uploads++
+		w.Header().Set("Location", fmt.Sprintf("%suploads/%d", prefix+"blobs/", f.uploads))
+		w.WriteHeader(http.StatusAccepted)
+
+	case parts[0] == "blobs" && strings.HasPrefix(parts[1], "uploads/") && r.Method == http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID")
+			return
+		}
+		dgst := digest.Digest(r.URL.Query().Get("digest"))
+		if dgst != digest.FromBytes(b) {
+			f.error(w, http.StatusBadRequest, "DIGEST_INVALID")
+			return
+		}
+		f.blobs[dgst] = b
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+
+	case parts[0] == "blobs" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		dgst := digest.Digest(parts[1])
+		b, ok := f.blobs[dgst]
+		if !ok {
+			f.error(w, http.StatusNotFound, "BLOB_UNKNOWN")
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		f.error(w, http.StatusNotImplemented, "UNSUPPORTED")
+	}
+}
+
+func TestOCIStore(t *testing.T) {
+	t.Parallel()
+
+	testStorage(t, func(t *testing.T) Storage {
+		_, st := newFakeOCIStore(t)
+		return st
+	})
+}
+
+func TestOCITag(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		want string
+	}{
+		{name: "a", want: "a"},
+		{name: "a.b-c", want: "a.b-c"},
+		{name: ".a", want: "_2ea"},
+		{name: "-a", want: "_2da"},
+		{name: "dir/a", want: "dir_2fa"},
+		{name: "a_b", want: "a_5fb"},
+	}
+
+	for _, tc := range cases {
+		if got := ociTag(tc.name); got != tc.want {
+			t.Errorf("expected tag of %q to be %q, got %q", tc.name, tc.want, got)
+		}
+	}
+
+	// Tags of prefixes are prefixes of tags
+	if got := ociTag("dir/a"); !strings.HasPrefix(got, ociTag("dir/")) {
+		t.Errorf("expected %q to start with %q", got, ociTag("dir/"))
+	}
+}
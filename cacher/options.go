@@ -0,0 +1,208 @@
+package cacher
+
+import (
+	"context"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+// Option configures how New creates the cacher and its storage client.
+type Option func(*settings)
+
+// settings are the settings used to create the storage client.
+type settings struct {
+	// grpc creates the client with the gRPC API instead of JSON.
+	grpc bool
+
+	// opts are additional options for the storage client and other Google
+	// Cloud clients.
+	opts []option.ClientOption
+
+	// credentials describes each of the options which set the Google Cloud
+	// credentials, since only one can be used.
+	credentials []string
+
+	// externalAccount is the external account configuration used as the
+	// credentials, if set.
+	externalAccount []byte
+
+	// accessToken is set if the credentials are an OAuth access token, and
+	// noAuth if requests are not authenticated.
+	accessToken bool
+	noAuth      bool
+
+	// endpoint overrides the Cloud Storage endpoint.
+	endpoint string
+
+	// hmacAccessID and hmacSecret are the HMAC key with which Cloud Storage
+	// buckets are accessed through the XML API, if set.
+	hmacAccessID string
+	hmacSecret   string
+
+	// billingProject is billed for requests to requester pays buckets.
+	billingProject string
+
+	// impersonate is the service account to impersonate, through the chain of
+	// delegates, if set.
+	impersonate string
+	delegates   []string
+
+	// proxy is the URL of the proxy for HTTP requests, and caCerts are
+	// PEM-encoded certificates which are trusted for TLS connections.
+	proxy   string
+	caCerts []byte
+
+	// googleAccess is the virtual IP for Private Google Access through which
+	// Google APIs are reached, if set.
+	googleAccess string
+
+	// storageFunc opens buckets instead of the built-in storage.
+	storageFunc StorageFunc
+}
+
+// WithGRPC creates the storage client with the gRPC API. On Compute Engine and
+// GKE it connects over DirectPath when available, which gives much higher
+// throughput for large objects.
+func WithGRPC() Option {
+	return func(s *settings) {
+		s.grpc = true
+	}
+}
+
+// WithEndpoint sends Cloud Storage requests to the endpoint instead of the
+// default, like a Private Service Connect endpoint. The endpoint is a URL like
+// https://storage-example.p.googleapis.com, or a host and port for the gRPC
+// API. Emulators which do not authenticate requests, like fake-gcs-server, are
+// configured with STORAGE_EMULATOR_HOST instead.
+func WithEndpoint(endpoint string) Option {
+	return func(s *settings) {
+		s.endpoint = endpoint
+	}
+}
+
+// WithCredentialsFile authenticates to Google Cloud with the credentials in
+// the JSON file, like a service account key, instead of Application Default
+// Credentials.
+func WithCredentialsFile(path string) Option {
+	return func(s *settings) {
+		s.credentials = append(s.credentials, "a credentials file")
+		s.opts = append(s.opts, option.WithCredentialsFile(path))
+	}
+}
+
+// WithExternalAccount authenticates to Google Cloud with the external account
+// configuration for workload identity federation, like the JSON file created
+// by "gcloud iam workload-identity-pools create-cred-config". This lets
+// runners with their own OIDC or cloud identity, like GitHub Actions, use
+// short-lived tokens instead of service account keys.
+func WithExternalAccount(config []byte) Option {
+	return func(s *settings) {
+		s.credentials = append(s.credentials, "an external account configuration")
+		s.externalAccount = config
+	}
+}
+
+// WithAccessToken authenticates to Google Cloud with the OAuth access token,
+// like one minted by an orchestrator for the build. The token is not
+// refreshed, so it must be valid until the operation completes. The principal
+// of the token is not known, so saves do not record their creator.
+func WithAccessToken(token string) Option {
+	return func(s *settings) {
+		s.credentials = append(s.credentials, "an access token")
+		s.accessToken = true
+		s.opts = append(s.opts, option.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{
+			AccessToken: token,
+			TokenType:   "Bearer",
+		})))
+	}
+}
+
+// WithoutAuthentication sends Google Cloud requests without credentials, so
+// caches can be restored from public buckets by builds which have none, like
+// builds of pull requests from forks. Saving requires a bucket which allows
+// anyone to create objects, which is not recommended.
+func WithoutAuthentication() Option {
+	return func(s *settings) {
+		s.credentials = append(s.credentials, "no authentication")
+		s.noAuth = true
+		s.opts = append(s.opts, option.WithoutAuthentication())
+	}
+}
+
+// WithHMACKey accesses Cloud Storage buckets through the XML API, which is
+// interoperable with S3, using the HMAC key instead of Google Cloud
+// credentials. This supports environments which only have interoperability
+// credentials. Buckets are then treated like S3 buckets, so they do not
+// support generations, and features which need the JSON API, like holds,
+// lifecycle rules, and creating buckets, are not available. Other Google Cloud
+// clients, like Cloud KMS, still use the Google Cloud credentials.
+func WithHMACKey(accessID, secret string) Option {
+	return func(s *settings) {
+		s.hmacAccessID = accessID
+		s.hmacSecret = secret
+	}
+}
+
+// WithImpersonation authenticates to Google Cloud as the service account,
+// using tokens for it generated with the other credentials. The credentials
+// need the Service Account Token Creator role on the service account, or on
+// the first delegate, with each delegate having the role on the next one.
+func WithImpersonation(serviceAccount string, delegates ...string) Option {
+	return func(s *settings) {
+		s.impersonate = serviceAccount
+		s.delegates = delegates
+	}
+}
+
+// WithBillingProject bills the project for requests to Cloud Storage buckets,
+// which is required to read and write buckets with requester pays enabled.
+// The caller needs the serviceusage.services.use permission on the project.
+func WithBillingProject(project string) Option {
+	return func(s *settings) {
+		s.billingProject = project
+	}
+}
+
+// WithProxy sends HTTP requests through the proxy, like
+// http://proxy.example.com:3128, instead of the proxy from the HTTPS_PROXY and
+// HTTP_PROXY environment variables. It is not supported with gRPC.
+func WithProxy(proxyURL string) Option {
+	return func(s *settings) {
+		s.proxy = proxyURL
+	}
+}
+
+// WithCACertificates trusts the PEM-encoded certificates for TLS connections in
+// addition to the system's, like the certificate authority of a proxy which
+// intercepts TLS. It is not supported with gRPC.
+func WithCACertificates(pem []byte) Option {
+	return func(s *settings) {
+		s.caCerts = pem
+	}
+}
+
+// WithPrivateGoogleAccess connects to Google APIs, like Cloud Storage and Cloud
+// KMS, through the virtual IPs for Private Google Access instead of their
+// default addresses. It is "private" for private.googleapis.com, or
+// "restricted" for restricted.googleapis.com, which is required inside VPC
+// Service Controls perimeters. Requests still use the names of the APIs. It
+// does not apply to requests sent through a proxy, and is not supported with
+// gRPC.
+func WithPrivateGoogleAccess(vip string) Option {
+	return func(s *settings) {
+		s.googleAccess = vip
+	}
+}
+
+// StorageFunc returns the storage for a bucket, as named in a request.
+type StorageFunc func(ctx context.Context, bucket string) (Storage, error)
+
+// WithStorage opens every bucket with fn instead of the built-in Cloud Storage,
+// S3, Azure, and file storage. This supports other backends, or keeping caches
+// in memory in tests without network access.
+func WithStorage(fn StorageFunc) Option {
+	return func(s *settings) {
+		s.storageFunc = fn
+	}
+}
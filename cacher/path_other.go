@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package cacher
+
+// longPath returns p unchanged. Only Windows limits the length of paths.
+func longPath(p string) string {
+	return p
+}
+
+// invalidName returns a reason if the slash-separated archive name cannot be
+// represented on this platform, or the empty string if it can. All names are
+// valid outside of Windows.
+func invalidName(name string) string {
+	return ""
+}
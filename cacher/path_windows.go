@@ -0,0 +1,74 @@
+//go:build windows
+// +build windows
+
+package cacher
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPath is the length at which Windows paths must use the extended-length
+// prefix. It is shorter than MAX_PATH to leave room for file names when
+// creating directories.
+const maxPath = 248
+
+// longPath returns the extended-length form of p if it is too long for the
+// Windows APIs. Relative paths are made absolute first.
+func longPath(p string) string {
+	if len(p) < maxPath || strings.HasPrefix(p, `\\?\`) {
+		return p
+	}
+
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// reservedNames is the list of device names which cannot be used as file
+// names on Windows, with or without an extension.
+var reservedNames = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {},
+	"COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {},
+	"LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// invalidName returns a reason if the slash-separated archive name cannot be
+// represented on this platform, or the empty string if it can.
+func invalidName(name string) string {
+	for _, part := range strings.Split(strings.TrimSuffix(name, "/"), "/") {
+		if part == "" {
+			continue
+		}
+
+		base := strings.ToUpper(part)
+		if i := strings.IndexByte(base, '.'); i >= 0 {
+			base = base[:i]
+		}
+		if _, ok := reservedNames[strings.TrimRight(base, " ")]; ok {
+			return "reserved name " + part
+		}
+
+		if strings.ContainsAny(part, `<>:"\|?*`) {
+			return "invalid character in " + part
+		}
+		for _, r := range part {
+			if r < 32 {
+				return "control character in " + part
+			}
+		}
+
+		if strings.HasSuffix(part, ".") || strings.HasSuffix(part, " ") {
+			return "trailing dot or space in " + part
+		}
+	}
+	return ""
+}
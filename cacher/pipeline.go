@@ -0,0 +1,163 @@
+package cacher
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// prefetchEntries is the number of entries which are walked and read ahead of
+// the archive writer.
+const prefetchEntries = 32
+
+// errWriterStopped is returned to stop walking files when the archive writer
+// failed.
+var errWriterStopped = errors.New("archive writer stopped")
+
+// archiveEntry is a single file to write to the archive.
+type archiveEntry struct {
+	// name is the path to the file on disk.
+	name string
+
+	header *tar.Header
+
+	// data is the contents of a regular file if buffered is set. Otherwise the
+	// contents are read from the file when the entry is written.
+	data     []byte
+	buffered bool
+
+	// store writes the contents without compression.
+	store bool
+
+	// sparse writes a regular file with holes as a sparse entry.
+	sparse bool
+}
+
+// writeEntry writes the entry to the archive, recording it in the index and
+// manifest if they are not nil.
+func (c *Cacher) writeEntry(tw archiveWriter, sw *segmentWriter, index *archiveIndex, m *manifest, entry *archiveEntry) error {
+	name, header := entry.name, entry.header
+
+	// Write header to tar
+	c.log("writing tar header for %s", name)
+	offset := int64(0)
+	if sw != nil {
+		offset = sw.Offset()
+	}
+	if zw, ok := tw.(*zipArchiveWriter); ok {
+		zw.store = entry.store
+	}
+	// Sparse entries are written along with their contents
+	if !entry.sparse {
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write tar header for %s: %w", name, err)
+		}
+	}
+	if entry.store && sw != nil {
+		if err := sw.Store(); err != nil {
+			return fmt.Errorf("failed to start segment for %s: %w", name, err)
+		}
+	}
+
+	// Directories and hard links have no contents, but are still recorded so
+	// they survive a restore
+	if header.Typeflag == tar.TypeReg {
+		var w io.Writer = tw
+		h := sha256.New()
+		if m != nil {
+			w = io.MultiWriter(tw, h)
+		}
+
+		if entry.buffered {
+			c.log("copying %s to tar", name)
+			if _, err := w.Write(entry.data); err != nil {
+				return fmt.Errorf("failed to write tar for %s: %w", name, err)
+			}
+		} else if entry.sparse {
+			var sum io.Writer = io.Discard
+			if m != nil {
+				sum = h
+			}
+			if err := c.writeSparseFile(tw.(*tarArchiveWriter), w, sum, entry); err != nil {
+				return err
+			}
+		} else {
+			if err := c.writeFile(w, name); err != nil {
+				return err
+			}
+		}
+
+		if m != nil {
+			m.Files = append(m.Files, &manifestFile{
+				Name:   header.Name,
+				Size:   header.Size,
+				SHA256: hex.EncodeToString(h.Sum(nil)),
+			})
+		}
+	}
+
+	// Finish the segment for this entry
+	if index != nil {
+		if err := index.add(tw, sw, header, offset); err != nil {
+			return err
+		}
+	} else if entry.store && sw != nil {
+		if err := tw.Flush(); err != nil {
+			return fmt.Errorf("failed to flush %s: %w", name, err)
+		}
+		if err := sw.Cut(); err != nil {
+			return fmt.Errorf("failed to finish segment for %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// writeSparseFile writes the entry as a sparse entry if the file has holes,
+// also writing its contents to sum. Otherwise it writes the entry like any
+// other file to w.
+func (c *Cacher) writeSparseFile(tw *tarArchiveWriter, w, sum io.Writer, entry *archiveEntry) (retErr error) {
+	name, header := entry.name, entry.header
+
+	c.log("opening %s", name)
+	file, err := os.Open(longPath(name))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer func() {
+		c.log("closing %s", name)
+		if cerr := file.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: failed to close %s: %w", retErr, name, cerr)
+				return
+			}
+			retErr = fmt.Errorf("failed to close %s: %w", name, cerr)
+		}
+	}()
+
+	segments, ok, err := sparseSegments(file, header.Size)
+	if err != nil {
+		return fmt.Errorf("failed to find holes in %s: %w", name, err)
+	}
+
+	if ok {
+		c.log("writing %s as a sparse file", name)
+		if err := tw.writeSparse(header, file, segments, sum); err != nil {
+			return fmt.Errorf("failed to write tar for %s: %w", name, err)
+		}
+		return nil
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", name, err)
+	}
+	c.log("copying %s to tar", name)
+	if _, err := c.copyBuffered(w, file); err != nil {
+		return fmt.Errorf("failed to write tar for %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package cacher
+
+import (
+	"sync"
+)
+
+// maxBufferedFile is the size of the largest file which is read into memory
+// and written in the background when extracting in parallel. Larger files are
+// written as they are read.
+const maxBufferedFile = 1024 * 1024
+
+// writePool runs file writes in the background, with a limited number in
+// flight at once. It is not safe for concurrent use, other than by the writes
+// themselves.
+type writePool struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	// targets is the set of paths being written since the last wait.
+	targets map[string]struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// newWritePool creates a pool which runs up to workers writes at once.
+func newWritePool(workers int) *writePool {
+	return &writePool{
+		sem:     make(chan struct{}, workers),
+		targets: make(map[string]struct{}),
+	}
+}
+
+// run runs fn, which writes to target, in the background. It blocks if too
+// many writes are in flight.
+func (p *writePool) run(target string, fn func() error) {
+	p.targets[target] = struct{}{}
+
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.sem
+			p.wg.Done()
+		}()
+
+		if err := fn(); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// pending returns true if target may still be being written.
+func (p *writePool) pending(target string) bool {
+	_, ok := p.targets[target]
+	return ok
+}
+
+// wait waits for all writes to finish, returning the first error.
+func (p *writePool) wait() error {
+	p.wg.Wait()
+	p.targets = make(map[string]struct{})
+	return p.error()
+}
+
+// error returns the first error from a write.
+func (p *writePool) error() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
@@ -0,0 +1,340 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// presignedStore reads and writes a single object through a signed URL, like
+// a Cloud Storage or S3 signed URL or an Azure SAS URL, so an orchestrator
+// which holds the credentials can hand out URLs and the build needs none.
+// Every cache key names the signed object, and companion objects, like
+// manifests and locks, do not exist and cannot be written. Signed URLs only
+// allow the method they were signed for, so URLs for saving are signed for
+// PUT and URLs for restoring for GET. The object cannot be deleted, its
+// metadata cannot be updated, and it is generation zero. Writes are not
+// atomically conditional, the save checks that the object does not exist
+// before it starts, if the URL allows reading it.
+type presignedStore struct {
+	client *http.Client
+
+	// bucket is the URL without the query, which is safe to show, and url is
+	// the signed URL.
+	bucket string
+	url    string
+
+	// azure is set for Azure SAS URLs, which need the blob type on writes.
+	azure bool
+}
+
+// isPresignedURL returns true if the bucket is a URL with the query parameters
+// of a Cloud Storage or S3 signed URL, or an Azure SAS URL.
+func isPresignedURL(bucket string) bool {
+	if !strings.HasPrefix(bucket, "https://") && !strings.HasPrefix(bucket, "http://") {
+		return false
+	}
+	u, err := url.Parse(bucket)
+	if err != nil {
+		return false
+	}
+
+	has := make(map[string]bool)
+	for k := range u.Query() {
+		has[strings.ToLower(k)] = true
+	}
+	switch {
+	case has["x-goog-signature"], has["x-amz-signature"]:
+		return true
+	case has["signature"] && (has["googleaccessid"] || has["awsaccesskeyid"]):
+		return true
+	case has["sig"] && has["sv"]:
+		return true
+	}
+	return false
+}
+
+// newPresignedStore creates the store for the signed URL of an object.
+func newPresignedStore(signedURL string, rt http.RoundTripper) (*presignedStore, error) {
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signed url: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("signed url is missing a host")
+	}
+	_, azure := u.Query()["sv"]
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return &presignedStore{
+		client: &http.Client{Transport: rt},
+		bucket: u.String(),
+		url:    signedURL,
+		azure:  azure,
+	}, nil
+}
+
+// checkObject returns an error if the object is not the signed object or a
+// specific generation was requested.
+func (s *presignedStore) checkObject(name string, generation int64) error {
+	if strings.HasPrefix(name, companionPrefix) {
+		return ErrObjectNotExist
+	}
+	if generation != 0 {
+		return fmt.Errorf("signed url %s does not support generations", s.bucket)
+	}
+	return nil
+}
+
+// do sends a request to the signed URL. Responses are never compressed in
+// transit, so the contents and ranges match the stored object.
+func (s *presignedStore) do(ctx context.Context, method string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("User-Agent", "gcs-cacher/1.0")
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// Errors include the URL, which must not be shown
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return nil, fmt.Errorf("failed to send request to %s: %w", s.bucket, err)
+	}
+	return resp, nil
+}
+
+func (s *presignedStore) Attrs(ctx context.Context, name string, generation int64) (*ObjectAttrs, error) {
+	if err := s.checkObject(name, generation); err != nil {
+		return nil, err
+	}
+
+	// Signed URLs are signed for a method, so read the first byte instead of
+	// sending a HEAD request
+	resp, err := s.do(ctx, http.MethodGet, rangeHeader(0, 1), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	// URLs signed for writing, or which expired, cannot be read
+	var size int64
+	switch resp.StatusCode {
+	case http.StatusOK:
+		size = resp.ContentLength
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// Content-Range is "bytes 0-0/SIZE", or "bytes */0" if empty
+		cr := resp.Header.Get("Content-Range")
+		size, err = strconv.ParseInt(cr[strings.LastIndex(cr, "/")+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse size of %s from %q", name, cr)
+		}
+	case http.StatusNotFound, http.StatusForbidden, http.StatusUnauthorized:
+		return nil, ErrObjectNotExist
+	default:
+		return nil, fmt.Errorf("failed to get %s: %s", name, resp.Status)
+	}
+	if err := checkTranscoding(name, resp); err != nil {
+		return nil, err
+	}
+
+	attrs := httpObjectAttrs(s.bucket, name, resp)
+	attrs.Size = size
+	return attrs, nil
+}
+
+// List returns the signed object, named after the prefix, if it exists.
+func (s *presignedStore) List(ctx context.Context, prefix string) ([]*ObjectAttrs, error) {
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return nil, nil
+	}
+
+	attrs, err := s.Attrs(ctx, prefix, 0)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return []*ObjectAttrs{attrs}, nil
+}
+
+func (s *presignedStore) NewReader(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	if err := s.checkObject(name, generation); err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("offset %d is out of range for %s", offset, name)
+	}
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, rangeHeader(offset, length), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusForbidden, http.StatusUnauthorized:
+		resp.Body.Close()
+		return nil, ErrObjectNotExist
+	}
+	if err := checkTranscoding(name, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return rangeBody(name, resp, offset, length)
+}
+
+func (s *presignedStore) NewWriter(ctx context.Context, name string, opts *WriterOptions) ObjectWriter {
+	if strings.HasPrefix(name, companionPrefix) {
+		return &readOnlyWriter{err: fmt.Errorf("cannot write %s: signed url %s only holds the cache", name, s.bucket)}
+	}
+	return &presignedWriter{
+		s:    s,
+		ctx:  ctx,
+		name: name,
+		opts: opts,
+		crc:  crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+	}
+}
+
+func (s *presignedStore) Update(ctx context.Context, name string, generation int64, metadata map[string]string) error {
+	return fmt.Errorf("cannot update %s: signed url %s does not allow updating metadata", name, s.bucket)
+}
+
+func (s *presignedStore) Delete(ctx context.Context, name string, generation int64) error {
+	return fmt.Errorf("cannot delete %s: signed url %s does not allow deleting", name, s.bucket)
+}
+
+// presignedWriter spools the contents of the object to a temporary file, since
+// signed URLs only allow uploading in a single request with a known length,
+// and uploads it when it is closed.
+type presignedWriter struct {
+	s    *presignedStore
+	ctx  context.Context
+	name string
+	opts *WriterOptions
+
+	f    *os.File
+	size int64
+	crc  hash.Hash32
+
+	attrs *ObjectAttrs
+}
+
+func (w *presignedWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if w.f == nil {
+		f, err := os.CreateTemp("", "gcs-cacher-upload-*")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create temporary file: %w", err)
+		}
+		w.f = f
+	}
+
+	n, err := w.f.Write(p)
+	w.crc.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *presignedWriter) Close() error {
+	if w.f != nil {
+		defer os.Remove(w.f.Name())
+		defer w.f.Close()
+	}
+
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	opts := w.opts
+	if opts.KMSKeyName != "" {
+		return fmt.Errorf("encryption with %s is not supported for signed urls", opts.KMSKeyName)
+	}
+	if opts.SendCRC32C && opts.CRC32C != w.crc.Sum32() {
+		return fmt.Errorf("%s has CRC32C %08x, expected %08x", w.name, w.crc.Sum32(), opts.CRC32C)
+	}
+
+	var body io.Reader = bytes.NewReader(nil)
+	if w.f != nil {
+		if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind temporary file: %w", err)
+		}
+		body = w.f
+	}
+
+	// Only send standard headers, since signed URLs reject extension headers,
+	// like custom metadata, which were not signed
+	header := make(http.Header)
+	if opts.ContentType != "" {
+		header.Set("Content-Type", opts.ContentType)
+	}
+	if opts.CacheControl != "" {
+		header.Set("Cache-Control", opts.CacheControl)
+	}
+	if opts.ContentEncoding != "" {
+		header.Set("Content-Encoding", opts.ContentEncoding)
+	}
+	if w.s.azure {
+		header.Set("X-Ms-Blob-Type", "BlockBlob")
+	}
+
+	resp, err := w.s.do(w.ctx, http.MethodPut, header, body, w.size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return fmt.Errorf("%w: %s", ErrPreconditionFailed, resp.Status)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to upload %s: %s: %s", w.name, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	// Cloud Storage reports the CRC32C of the stored object, which the save
+	// verifies
+	attrs := httpObjectAttrs(w.s.bucket, w.name, resp)
+	attrs.Size = w.size
+	attrs.ContentType = opts.ContentType
+	attrs.CacheControl = opts.CacheControl
+	attrs.ContentEncoding = opts.ContentEncoding
+	attrs.Updated = time.Now()
+	w.attrs = attrs
+
+	if opts.ProgressFunc != nil {
+		opts.ProgressFunc(w.size)
+	}
+	return nil
+}
+
+func (w *presignedWriter) Attrs() *ObjectAttrs {
+	return w.attrs
+}
@@ -0,0 +1,40 @@
+package cacher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSave_presignedConditional(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	c, err := New(ctx, WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signed URLs cannot make the upload conditional on the checked object
+	for _, i := range []*SaveRequest{
+		{Force: true},
+		{Update: true},
+	} {
+		i.Bucket = srv.URL + "/my-bucket/key?X-Goog-Signature=abc"
+		i.Dir = writeFiles(t, map[string]string{"a": "a"})
+		i.Key = "key"
+
+		err := c.Save(ctx, i)
+		if err == nil || !strings.Contains(err.Error(), "not supported with signed urls") {
+			t.Errorf("expected signed url error, got %v", err)
+		}
+	}
+}
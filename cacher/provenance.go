@@ -0,0 +1,220 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// provenanceContentType is the content type of provenance documents.
+	provenanceContentType = "application/vnd.in-toto+json"
+
+	// inTotoStatementType and slsaProvenanceType identify the format of
+	// provenance documents.
+	inTotoStatementType = "https://in-toto.io/Statement/v0.1"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v0.2"
+
+	// provenanceBuildType is the build type recorded in provenance documents.
+	provenanceBuildType = "https://github.com/sethvargo/gcs-cacher/save@v1"
+)
+
+// provenanceName returns the name of the provenance object for the cache key.
+func provenanceName(key string) string {
+	return companionPrefix + "provenance/" + key
+}
+
+// Provenance describes how a cache was built. It is recorded as a SLSA
+// provenance attestation alongside the archive.
+type Provenance struct {
+	// BuilderID identifies the builder which created the cache, like the
+	// service account or build trigger.
+	BuilderID string
+
+	// SourceURI is the location of the source the cache was built from, like
+	// "git+https://github.com/org/repo".
+	SourceURI string
+
+	// SourceCommit is the commit of the source the cache was built from.
+	SourceCommit string
+}
+
+// provenanceStatement is an in-toto statement with a SLSA provenance
+// predicate.
+type provenanceStatement struct {
+	Type          string               `json:"_type"`
+	PredicateType string               `json:"predicateType"`
+	Subject       []*provenanceSubject `json:"subject"`
+	Predicate     *provenancePredicate `json:"predicate"`
+}
+
+type provenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenancePredicate struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string `json:"buildType"`
+	Invocation struct {
+		ConfigSource struct {
+			URI    string            `json:"uri,omitempty"`
+			Digest map[string]string `json:"digest,omitempty"`
+		} `json:"configSource"`
+		Parameters map[string]string `json:"parameters,omitempty"`
+	} `json:"invocation"`
+	Metadata struct {
+		BuildFinishedOn time.Time `json:"buildFinishedOn"`
+	} `json:"metadata"`
+}
+
+// writeProvenance uploads the provenance for the archive with the
+// Cache-Control, encrypted with the KMS key if it is not empty. If sgn is not
+// nil, the document is signed.
+func (c *Cacher) writeProvenance(ctx context.Context, st Storage, bucket, key, kmsKey, cacheControl, digest string, p *Provenance, sgn signer) (retErr error) {
+	stmt := &provenanceStatement{
+		Type:          inTotoStatementType,
+		PredicateType: slsaProvenanceType,
+		Subject: []*provenanceSubject{{
+			Name:   objectURL(bucket, key),
+			Digest: map[string]string{"sha256": digest},
+		}},
+		Predicate: new(provenancePredicate),
+	}
+	stmt.Predicate.Builder.ID = p.BuilderID
+	stmt.Predicate.BuildType = provenanceBuildType
+	stmt.Predicate.Invocation.ConfigSource.URI = p.SourceURI
+	if p.SourceCommit != "" {
+		stmt.Predicate.Invocation.ConfigSource.Digest = map[string]string{"sha1": p.SourceCommit}
+	}
+	stmt.Predicate.Invocation.Parameters = map[string]string{"key": key}
+	stmt.Predicate.Metadata.BuildFinishedOn = time.Now().UTC()
+
+	b, err := json.Marshal(stmt)
+	if err != nil {
+		return fmt.Errorf("failed to encode provenance: %w", err)
+	}
+
+	name := provenanceName(key)
+	c.log("writing provenance %s", name)
+
+	opts := &WriterOptions{
+		ContentType:  provenanceContentType,
+		CacheControl: cacheControl,
+		KMSKeyName:   kmsKey,
+	}
+	if sgn != nil {
+		d := sha256.Sum256(b)
+		sig, err := sgn.sign(ctx, d[:])
+		if err != nil {
+			return err
+		}
+		opts.Metadata = map[string]string{
+			signatureMetadataKey: base64.StdEncoding.EncodeToString(sig),
+		}
+	}
+	w := st.NewWriter(ctx, name, opts)
+	defer func() {
+		if cerr := w.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: failed to close provenance writer: %w", retErr, cerr)
+				return
+			}
+			retErr = fmt.Errorf("failed to close provenance writer: %w", cerr)
+		}
+	}()
+
+	if _, err := w.Write(b); err != nil {
+		retErr = fmt.Errorf("failed to write provenance: %w", err)
+		return
+	}
+	return
+}
+
+// checkProvenance verifies that the object has signed provenance for its key,
+// and returns the hex-encoded SHA256 digest of the archive the provenance
+// describes, which the caller must compare with the downloaded archive. If
+// builderID is not empty, the provenance must have been recorded by that
+// builder.
+func (c *Cacher) checkProvenance(ctx context.Context, st Storage, match *ObjectAttrs, builderID string, v verifier) (digest string, retErr error) {
+	if v == nil {
+		return "", fmt.Errorf("a verify key is required to check provenance")
+	}
+
+	name := provenanceName(match.Name)
+	c.log("reading provenance %s", name)
+
+	attrs, err := st.Attrs(ctx, name, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to get provenance for %s: %w", match.Name, err)
+	}
+
+	r, err := st.NewReader(ctx, name, attrs.Generation, 0, -1)
+	if err != nil {
+		return "", fmt.Errorf("failed to read provenance for %s: %w", match.Name, err)
+	}
+	defer func() {
+		if cerr := r.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: failed to close provenance reader: %w", retErr, cerr)
+				return
+			}
+			retErr = fmt.Errorf("failed to close provenance reader: %w", cerr)
+		}
+	}()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return "", fmt.Errorf("failed to read provenance for %s: %w", match.Name, err)
+	}
+
+	val, ok := attrs.Metadata[signatureMetadataKey]
+	if !ok {
+		return "", fmt.Errorf("provenance for %s is not signed", match.Name)
+	}
+	sig, err := base64.StdEncoding.DecodeString(val)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode provenance signature: %w", err)
+	}
+	d := sha256.Sum256(buf.Bytes())
+	if err := v.verify(ctx, d[:], sig); err != nil {
+		return "", fmt.Errorf("failed to verify provenance signature: %w", err)
+	}
+
+	var stmt provenanceStatement
+	if err := json.Unmarshal(buf.Bytes(), &stmt); err != nil {
+		return "", fmt.Errorf("failed to decode provenance: %w", err)
+	}
+	if stmt.PredicateType != slsaProvenanceType || stmt.Predicate == nil {
+		return "", fmt.Errorf("provenance for %s has unsupported type %q", match.Name, stmt.PredicateType)
+	}
+
+	// The statement must be for this key, so one which was signed for another
+	// key cannot be copied alongside its archive
+	if key := stmt.Predicate.Invocation.Parameters["key"]; key != match.Name {
+		return "", fmt.Errorf("provenance for %s was recorded for key %q", match.Name, key)
+	}
+	for _, subject := range stmt.Subject {
+		if strings.HasSuffix(subject.Name, "/"+match.Name) && subject.Digest["sha256"] != "" {
+			digest = subject.Digest["sha256"]
+			break
+		}
+	}
+	if digest == "" {
+		return "", fmt.Errorf("provenance for %s does not have a subject for it", match.Name)
+	}
+
+	if builderID != "" && stmt.Predicate.Builder.ID != builderID {
+		return "", fmt.Errorf("%s was built by %q, expected %q", match.Name, stmt.Predicate.Builder.ID, builderID)
+	}
+	c.log("verified provenance for %s", match.Name)
+	return digest, nil
+}
@@ -0,0 +1,115 @@
+package cacher
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRestore_provenance(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		setup     func(t *testing.T, b *fakeGCSBucket)
+		verifyKey bool
+		builderID string
+		err       bool
+	}{
+		{
+			name:      "valid",
+			verifyKey: true,
+			builderID: "builder",
+		},
+		{
+			name: "no_verify_key",
+			err:  true,
+		},
+		{
+			name:      "wrong_builder",
+			verifyKey: true,
+			builderID: "other-builder",
+			err:       true,
+		},
+		{
+			name: "unsigned",
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				data, _, _ := b.object(".gcs-cacher/provenance/a")
+				b.put(".gcs-cacher/provenance/a", data, nil)
+			},
+			verifyKey: true,
+			err:       true,
+		},
+		{
+			name: "swapped_archive",
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				copyObject(t, b, "b", "a")
+			},
+			verifyKey: true,
+			err:       true,
+		},
+		{
+			name: "other_key",
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				copyObject(t, b, "b", "a")
+				copyObject(t, b, ".gcs-cacher/provenance/b", ".gcs-cacher/provenance/a")
+			},
+			verifyKey: true,
+			err:       true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c, f := newTestCacher(t)
+			priv, pub := writeKeys(t)
+
+			for key, contents := range map[string]string{"a": "good", "b": "evil"} {
+				if err := c.Save(ctx, &SaveRequest{
+					Bucket:     testBucket,
+					Dir:        writeFiles(t, map[string]string{"file": contents}),
+					Key:        key,
+					SigningKey: priv,
+					Provenance: &Provenance{BuilderID: "builder"},
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.setup != nil {
+				tc.setup(t, f.bucket(testBucket))
+			}
+
+			req := &RestoreRequest{
+				Bucket:              testBucket,
+				Dir:                 t.TempDir(),
+				Keys:                []string{"a"},
+				RequireProvenance:   true,
+				ProvenanceBuilderID: tc.builderID,
+			}
+			if tc.verifyKey {
+				req.VerifyKey = pub
+			}
+
+			err := c.Restore(ctx, req)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if got := readFiles(t, req.Dir); len(got) > 0 {
+					t.Errorf("expected nothing to be restored, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := readFiles(t, req.Dir)["file"], "good"; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package cacher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// tarEntry is an entry of a test archive.
+type tarEntry struct {
+	header   *tar.Header
+	contents string
+}
+
+// tarGz returns a gzip-compressed tar archive of the entries.
+func tarGz(t *testing.T, entries []*tarEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		if e.header.Typeflag == tar.TypeReg {
+			e.header.Size = int64(len(e.contents))
+		}
+		if e.header.Mode == 0 {
+			e.header.Mode = 0o644
+		}
+		if err := tw.WriteHeader(e.header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRestore_pathTraversal(t *testing.T) {
+	t.Parallel()
+
+	// Each archive is restored into root/dir, next to root/outside/secret,
+	// which must not be overwritten or linked to
+	cases := []struct {
+		name    string
+		entries func(root string) []*tarEntry
+	}{
+		{
+			name: "parent",
+			entries: func(root string) []*tarEntry {
+				return []*tarEntry{
+					{header: &tar.Header{Name: "../outside/secret", Typeflag: tar.TypeReg}, contents: "evil"},
+				}
+			},
+		},
+		{
+			name: "nested_parent",
+			entries: func(root string) []*tarEntry {
+				return []*tarEntry{
+					{header: &tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0o755}},
+					{header: &tar.Header{Name: "a/../../outside/secret", Typeflag: tar.TypeReg}, contents: "evil"},
+				}
+			},
+		},
+		{
+			name: "absolute",
+			entries: func(root string) []*tarEntry {
+				return []*tarEntry{
+					{header: &tar.Header{Name: filepath.ToSlash(filepath.Join(root, "outside", "secret")), Typeflag: tar.TypeReg}, contents: "evil"},
+				}
+			},
+		},
+		{
+			name: "symlink_then_file",
+			entries: func(root string) []*tarEntry {
+				return []*tarEntry{
+					{header: &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(root, "outside")}},
+					{header: &tar.Header{Name: "link/secret", Typeflag: tar.TypeReg}, contents: "evil"},
+				}
+			},
+		},
+		{
+			name: "relative_symlink_then_file",
+			entries: func(root string) []*tarEntry {
+				return []*tarEntry{
+					{header: &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+					{header: &tar.Header{Name: "link/secret", Typeflag: tar.TypeReg}, contents: "evil"},
+				}
+			},
+		},
+		{
+			name: "hardlink_parent",
+			entries: func(root string) []*tarEntry {
+				return []*tarEntry{
+					{header: &tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../outside/secret"}},
+				}
+			},
+		},
+		{
+			name: "hardlink_absolute",
+			entries: func(root string) []*tarEntry {
+				return []*tarEntry{
+					{header: &tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: filepath.ToSlash(filepath.Join(root, "outside", "secret"))}},
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c, f := newTestCacher(t)
+
+			root := t.TempDir()
+			dir := filepath.Join(root, "dir")
+			secret := filepath.Join(root, "outside", "secret")
+			if err := os.MkdirAll(filepath.Dir(secret), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(secret, []byte("secret"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			f.bucket(testBucket).put("evil", tarGz(t, tc.entries(root)), nil)
+
+			if err := c.Restore(ctx, &RestoreRequest{
+				Bucket: testBucket,
+				Dir:    dir,
+				Keys:   []string{"evil"},
+			}); err == nil {
+				t.Fatal("expected error")
+			}
+
+			b, err := os.ReadFile(secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(b), "secret"; got != want {
+				t.Errorf("expected %s to be %q, got %q", secret, want, got)
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "link")); !os.IsNotExist(err) {
+				t.Errorf("expected link not to be extracted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRestore_zipPathTraversal(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c, f := newTestCacher(t)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("../secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("evil")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.bucket(testBucket).put("evil", buf.Bytes(), nil)
+
+	root := t.TempDir()
+	if err := c.Restore(ctx, &RestoreRequest{
+		Bucket: testBucket,
+		Dir:    filepath.Join(root, "dir"),
+		Keys:   []string{"evil"},
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := os.Stat(filepath.Join(root, "secret")); !os.IsNotExist(err) {
+		t.Errorf("expected file outside of the directory not to be written, got %v", err)
+	}
+}
+
+func TestRestore_fallback(t *testing.T) {
+	t.Parallel()
+
+	// The archive for key a is restored first, and the one for key b only if
+	// restoring a fails in a way which b may not
+	cases := []struct {
+		name  string
+		setup func(t *testing.T, b *fakeGCSBucket, dir string)
+		want  map[string]string
+		err   bool
+	}{
+		{
+			name: "valid",
+			want: map[string]string{"a": "a"},
+		},
+		{
+			name: "corrupt",
+			setup: func(t *testing.T, b *fakeGCSBucket, dir string) {
+				b.put("a", []byte("not an archive"), nil)
+			},
+			want: map[string]string{"b": "b"},
+		},
+		{
+			name: "truncated",
+			setup: func(t *testing.T, b *fakeGCSBucket, dir string) {
+				data, obj, _ := b.object("a")
+				b.put("a", data[:len(data)/2], obj.Metadata)
+			},
+			want: map[string]string{"b": "b"},
+		},
+		{
+			name: "local_error",
+			setup: func(t *testing.T, b *fakeGCSBucket, dir string) {
+				// The file in a cannot replace a directory which is not empty
+				if err := os.MkdirAll(filepath.Join(dir, "a", "child"), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c, f := newTestCacher(t)
+			dir := t.TempDir()
+
+			for _, key := range []string{"a", "b"} {
+				if err := c.Save(ctx, &SaveRequest{
+					Bucket: testBucket,
+					Dir:    writeFiles(t, map[string]string{key: key}),
+					Key:    key,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.setup != nil {
+				tc.setup(t, f.bucket(testBucket), dir)
+			}
+
+			err := c.Restore(ctx, &RestoreRequest{
+				Bucket:     testBucket,
+				Dir:        dir,
+				Keys:       []string{"a", "b"},
+				FirstMatch: true,
+			})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if _, err := os.Stat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+					t.Errorf("expected b not to be restored, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readFiles(t, dir); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %q to be %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package cacher
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// maxResumeAttempts is the number of times a download is resumed after it is
+// interrupted without reading anything in between.
+const maxResumeAttempts = 5
+
+// resumingReader reads a range of an object. If the download is interrupted,
+// for example because of a flaky network, it is resumed from the last byte
+// which was read. The handle should be for a specific generation, so the
+// contents cannot change between requests.
+type resumingReader struct {
+	c      *Cacher
+	ctx    context.Context
+	handle *objectHandle
+
+	r io.ReadCloser
+
+	// offset is the offset of the next byte to read, and remaining is the
+	// number of bytes left to read, or -1 to read to the end of the object.
+	offset    int64
+	remaining int64
+
+	// attempts is the number of times the download was resumed since anything
+	// was last read.
+	attempts int
+}
+
+// newResumingReader starts reading length bytes from the object at offset, or
+// the rest of the object if length is negative.
+func (c *Cacher) newResumingReader(ctx context.Context, handle *objectHandle, offset, length int64) (*resumingReader, error) {
+	if length < 0 {
+		length = -1
+	}
+
+	r, err := handle.NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resumingReader{
+		c:         c,
+		ctx:       ctx,
+		handle:    handle,
+		r:         r,
+		offset:    offset,
+		remaining: length,
+	}, nil
+}
+
+// Read reads from the object, resuming the download if it fails.
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.r.Read(p)
+		r.offset += int64(n)
+		if r.remaining > 0 {
+			r.remaining -= int64(n)
+		}
+		if n > 0 {
+			r.attempts = 0
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		// Give up if the restore was cancelled or the download keeps failing
+		if r.ctx.Err() != nil || r.attempts >= maxResumeAttempts {
+			return n, err
+		}
+		r.attempts++
+
+		r.c.warn("download of %s interrupted at byte %d, resuming: %s", r.handle.ObjectName(), r.offset, err)
+		r.r.Close()
+
+		nr, rerr := r.handle.NewRangeReader(r.ctx, r.offset, r.remaining)
+		if rerr != nil {
+			return n, fmt.Errorf("%v: failed to resume download: %w", err, rerr)
+		}
+		r.r = nr
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close closes the current reader.
+func (r *resumingReader) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,522 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+const (
+	// defaultS3Endpoint is the endpoint of Amazon S3.
+	defaultS3Endpoint = "https://s3.amazonaws.com"
+
+	// defaultS3PartSize is the default size of each part of an S3 upload, and
+	// minS3PartSize is the smallest part S3 accepts.
+	defaultS3PartSize = 16 * 1024 * 1024
+	minS3PartSize     = 5 * 1024 * 1024
+
+	// maxS3CopySize is the largest object S3 copies in a single request.
+	maxS3CopySize = 5 * 1024 * 1024 * 1024
+
+	// s3KMSKeyHeader is the response header with the KMS key which encrypts an
+	// object.
+	s3KMSKeyHeader = "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"
+)
+
+// s3Store stores objects in an S3 bucket, in AWS or a compatible service like
+// MinIO. S3 does not number the generations of objects, so all objects are
+// generation zero and writes can only be conditional on the object not
+// existing. That is checked before the upload starts, and objects uploaded in
+// a single request are also created with If-None-Match, so S3 rejects them
+// atomically if another upload created the object in the meantime.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+
+	// atomicCreate is set if the service honors If-None-Match on uploads.
+	atomicCreate bool
+}
+
+// newS3Store creates the store for a bucket URL like s3://my-bucket. The
+// endpoint and region are the endpoint and region query parameters, like
+// s3://my-bucket?endpoint=http://localhost:9000, or come from the same
+// environment variables as the AWS CLI. Credentials are read from the
+// environment, the shared credentials file, or the instance's IAM role.
+func newS3Store(bucketURL string, rt http.RoundTripper) (*s3Store, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bucket %q: %w", bucketURL, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("bucket %q is missing a bucket name", bucketURL)
+	}
+	if strings.Trim(u.Path, "/") != "" {
+		return nil, fmt.Errorf("bucket %q must not have a path", bucketURL)
+	}
+	q := u.Query()
+
+	endpoint := firstNonEmpty(q.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"),
+		os.Getenv("AWS_ENDPOINT_URL"), defaultS3Endpoint)
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{Client: &http.Client{Transport: rt}},
+	})
+	region := firstNonEmpty(q.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"))
+
+	client, err := newS3Client(endpoint, region, creds, rt)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{
+		client:       client,
+		bucket:       u.Host,
+		atomicCreate: true,
+	}, nil
+}
+
+// newS3Client creates the client for the S3 endpoint, which is a URL or a host
+// which uses HTTPS.
+func newS3Client(endpoint, region string, creds *credentials.Credentials, rt http.RoundTripper) (*minio.Client, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	eu, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse endpoint %q: %w", endpoint, err)
+	}
+	if eu.Scheme != "https" && eu.Scheme != "http" {
+		return nil, fmt.Errorf("endpoint %q must be an http or https URL", endpoint)
+	}
+
+	client, err := minio.New(eu.Host, &minio.Options{
+		Creds:     creds,
+		Secure:    eu.Scheme == "https",
+		Transport: rt,
+		Region:    region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+	return client, nil
+}
+
+// firstNonEmpty returns the first value which is not empty.
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// checkGeneration returns an error if a specific generation was requested.
+func (s *s3Store) checkGeneration(generation int64) error {
+	if generation != 0 {
+		return fmt.Errorf("s3 bucket %s does not support generations", s.bucket)
+	}
+	return nil
+}
+
+func (s *s3Store) Attrs(ctx context.Context, name string, generation int64) (*ObjectAttrs, error) {
+	if err := s.checkGeneration(generation); err != nil {
+		return nil, err
+	}
+
+	info, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return s.objectAttrs(&info), nil
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]*ObjectAttrs, error) {
+	// Stop listing if returning early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var list []*ObjectAttrs
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if info.Err != nil {
+			return nil, s3Error(info.Err)
+		}
+		info := info
+		list = append(list, s.objectAttrs(&info))
+	}
+	return list, nil
+}
+
+func (s *s3Store) NewReader(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error) {
+	if err := s.checkGeneration(generation); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	var opts minio.GetObjectOptions
+	switch {
+	case length > 0:
+		if err := opts.SetRange(offset, offset+length-1); err != nil {
+			return nil, err
+		}
+	case offset > 0:
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	// Read the stored bytes, which are what the checksums describe, even if the
+	// object has a content encoding
+	opts.Set("Accept-Encoding", "identity")
+
+	// Objects from the client ignore the range once they are stat'ed, so send
+	// the request directly
+	rc, _, _, err := minio.Core{Client: s.client}.GetObject(ctx, s.bucket, name, opts)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return rc, nil
+}
+
+func (s *s3Store) NewWriter(ctx context.Context, name string, opts *WriterOptions) ObjectWriter {
+	return &s3Writer{
+		s:    s,
+		ctx:  ctx,
+		name: name,
+		opts: opts,
+		crc:  crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+	}
+}
+
+func (s *s3Store) Update(ctx context.Context, name string, generation int64, metadata map[string]string) error {
+	if err := s.checkGeneration(generation); err != nil {
+		return err
+	}
+
+	info, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return s3Error(err)
+	}
+
+	// Objects cannot be changed in place, so copy the object onto itself with
+	// the new metadata, as long as it was not replaced in the meantime
+	attrs := s.objectAttrs(&info)
+	md := make(map[string]string, len(attrs.Metadata)+len(metadata)+2)
+	for k, v := range attrs.Metadata {
+		md[k] = v
+	}
+	for k, v := range metadata {
+		if v == "" {
+			delete(md, k)
+			continue
+		}
+		md[k] = v
+	}
+	if attrs.ContentType != "" {
+		md["Content-Type"] = attrs.ContentType
+	}
+	if attrs.CacheControl != "" {
+		md["Cache-Control"] = attrs.CacheControl
+	}
+	if attrs.ContentEncoding != "" {
+		md["Content-Encoding"] = attrs.ContentEncoding
+	}
+
+	dst := minio.CopyDestOptions{
+		Bucket:          s.bucket,
+		Object:          name,
+		UserMetadata:    md,
+		ReplaceMetadata: true,
+	}
+	if attrs.KMSKeyName != "" {
+		if dst.Encryption, err = encrypt.NewSSEKMS(attrs.KMSKeyName, nil); err != nil {
+			return fmt.Errorf("failed to configure encryption: %w", err)
+		}
+	}
+
+	src := minio.CopySrcOptions{
+		Bucket:    s.bucket,
+		Object:    name,
+		MatchETag: info.ETag,
+	}
+
+	// Larger objects have to be copied in parts
+	if info.Size > maxS3CopySize {
+		_, err = s.client.ComposeObject(ctx, dst, src)
+	} else {
+		_, err = s.client.CopyObject(ctx, dst, src)
+	}
+	if err != nil {
+		return s3Error(err)
+	}
+	return nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, name string, generation int64) error {
+	if err := s.checkGeneration(generation); err != nil {
+		return err
+	}
+
+	if err := s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{}); err != nil {
+		return s3Error(err)
+	}
+	return nil
+}
+
+// objectAttrs converts the S3 object information. User metadata keys are
+// case-insensitive in S3, so they are always lowercase.
+func (s *s3Store) objectAttrs(info *minio.ObjectInfo) *ObjectAttrs {
+	var md map[string]string
+	if len(info.UserMetadata) > 0 {
+		md = make(map[string]string, len(info.UserMetadata))
+		for k, v := range info.UserMetadata {
+			md[strings.ToLower(k)] = v
+		}
+	}
+
+	attrs := &ObjectAttrs{
+		Bucket:          s.bucket,
+		Name:            info.Key,
+		Size:            info.Size,
+		ContentType:     info.ContentType,
+		CacheControl:    info.Metadata.Get("Cache-Control"),
+		ContentEncoding: info.Metadata.Get("Content-Encoding"),
+		Updated:         info.LastModified,
+		KMSKeyName:      info.Metadata.Get(s3KMSKeyHeader),
+		Metadata:        md,
+	}
+
+	// Only objects uploaded in a single part with a checksum have the CRC32C of
+	// their entire contents
+	if b, err := base64.StdEncoding.DecodeString(info.ChecksumCRC32C); err == nil && len(b) == 4 {
+		attrs.CRC32C = binary.BigEndian.Uint32(b)
+		attrs.HasCRC32C = true
+	}
+	return attrs
+}
+
+// s3Error converts S3 errors for missing objects and failed preconditions to
+// the errors returned by stores.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	resp := minio.ToErrorResponse(err)
+	switch {
+	case resp.Code == "NoSuchKey":
+		return ErrObjectNotExist
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return fmt.Errorf("%w: %v", ErrPreconditionFailed, err)
+	default:
+		return err
+	}
+}
+
+// s3Writer writes an object to S3. Objects smaller than a single part are
+// uploaded in one request once the writer is closed, larger objects are
+// streamed in parts.
+type s3Writer struct {
+	s    *s3Store
+	ctx  context.Context
+	name string
+	opts *WriterOptions
+
+	// buf holds the contents until they no longer fit in a single part.
+	buf []byte
+	crc hash.Hash32
+
+	// pw streams the rest of the contents to the upload once it started.
+	pw   *io.PipeWriter
+	done chan struct{}
+
+	// info and err are the result of the upload.
+	info minio.UploadInfo
+	err  error
+}
+
+// partSize returns the size of each part of the upload.
+func (w *s3Writer) partSize() int {
+	if w.opts.ChunkSize <= 0 {
+		return defaultS3PartSize
+	}
+	if w.opts.ChunkSize < minS3PartSize {
+		return minS3PartSize
+	}
+	return w.opts.ChunkSize
+}
+
+// stream starts uploading the buffered contents followed by everything which
+// is written next in the background.
+func (w *s3Writer) stream() {
+	pr, pw := io.Pipe()
+	w.pw = pw
+	w.done = make(chan struct{})
+
+	r := io.MultiReader(bytes.NewReader(w.buf), pr)
+	go func() {
+		defer close(w.done)
+
+		if err := w.upload(r, -1); err != nil {
+			w.err = err
+			pr.CloseWithError(err)
+			return
+		}
+		pr.Close()
+	}()
+}
+
+// upload checks the preconditions and uploads the size bytes read from r, or
+// everything if size is negative.
+func (w *s3Writer) upload(r io.Reader, size int64) error {
+	s := w.s
+	opts := w.opts
+
+	putOpts := minio.PutObjectOptions{
+		ContentType:     opts.ContentType,
+		CacheControl:    opts.CacheControl,
+		ContentEncoding: opts.ContentEncoding,
+		UserMetadata:    opts.Metadata,
+		PartSize:        uint64(w.partSize()),
+	}
+	if opts.KMSKeyName != "" {
+		sse, err := encrypt.NewSSEKMS(opts.KMSKeyName, nil)
+		if err != nil {
+			return fmt.Errorf("failed to configure encryption: %w", err)
+		}
+		putOpts.ServerSideEncryption = sse
+	}
+	if opts.ProgressFunc != nil {
+		putOpts.Progress = &s3Progress{fn: opts.ProgressFunc, interval: int64(w.partSize())}
+	}
+
+	if opts.DoesNotExist {
+		_, err := s.client.StatObject(w.ctx, s.bucket, w.name, minio.StatObjectOptions{})
+		if err == nil {
+			return fmt.Errorf("%w: %s already exists", ErrPreconditionFailed, w.name)
+		}
+		if err := s3Error(err); !errors.Is(err, ErrObjectNotExist) {
+			return err
+		}
+
+		// Only single requests can be conditional, the condition is not sent
+		// when completing uploads in parts
+		if s.atomicCreate && size >= 0 {
+			putOpts.SetMatchETagExcept("*")
+		}
+	}
+
+	info, err := s.client.PutObject(w.ctx, s.bucket, w.name, r, size, putOpts)
+	if err != nil {
+		return s3Error(err)
+	}
+	w.info = info
+	return nil
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.pw == nil {
+		if err := w.ctx.Err(); err != nil {
+			return 0, err
+		}
+		if len(w.buf)+len(p) < w.partSize() {
+			w.buf = append(w.buf, p...)
+			w.crc.Write(p)
+			return len(p), nil
+		}
+		w.stream()
+	}
+
+	n, err := w.pw.Write(p)
+	w.crc.Write(p[:n])
+	return n, err
+}
+
+func (w *s3Writer) Close() error {
+	if w.pw == nil {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+		w.err = w.upload(bytes.NewReader(w.buf), int64(len(w.buf)))
+	} else {
+		// Fail the upload instead of completing it if it was cancelled
+		if err := w.ctx.Err(); err != nil {
+			w.pw.CloseWithError(err)
+		} else {
+			w.pw.Close()
+		}
+		<-w.done
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.opts.SendCRC32C && w.opts.CRC32C != w.crc.Sum32() {
+		return fmt.Errorf("%s has CRC32C %08x, expected %08x", w.name, w.crc.Sum32(), w.opts.CRC32C)
+	}
+	if w.opts.ProgressFunc != nil {
+		w.opts.ProgressFunc(w.info.Size)
+	}
+	return nil
+}
+
+func (w *s3Writer) Attrs() *ObjectAttrs {
+	if w.err != nil || (w.info == minio.UploadInfo{}) {
+		return nil
+	}
+
+	updated := w.info.LastModified
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	return &ObjectAttrs{
+		Bucket:          w.s.bucket,
+		Name:            w.name,
+		Size:            w.info.Size,
+		ContentType:     w.opts.ContentType,
+		CacheControl:    w.opts.CacheControl,
+		ContentEncoding: w.opts.ContentEncoding,
+		Updated:         updated,
+		KMSKeyName:      w.opts.KMSKeyName,
+		Metadata:        w.opts.Metadata,
+	}
+}
+
+// s3Progress reports the progress of an upload each time another interval of
+// bytes is read.
+type s3Progress struct {
+	fn       func(int64)
+	interval int64
+
+	total    int64
+	reported int64
+}
+
+func (p *s3Progress) Read(b []byte) (int, error) {
+	p.total += int64(len(b))
+	if p.total-p.reported >= p.interval {
+		p.reported = p.total
+		p.fn(p.total)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,332 @@
+package cacher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// fakeS3Object is an object in a fakeS3 bucket.
+type fakeS3Object struct {
+	data     []byte
+	header   http.Header
+	modified time.Time
+}
+
+func (o *fakeS3Object) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// fakeS3 serves the parts of the S3 API which s3Store uses from memory, with
+// path-style bucket names. Uploads fail with 412 if they are sent with
+// If-None-Match and the object exists, unless ignoreIfNoneMatch is set.
+type fakeS3 struct {
+	t *testing.T
+
+	mu                sync.Mutex
+	objects           map[string]*fakeS3Object
+	uploads           map[string]map[int][]byte
+	ignoreIfNoneMatch bool
+
+	// beforePut is called before an object is created, outside of the lock.
+	beforePut func(name string)
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		t:       t,
+		objects: make(map[string]*fakeS3Object),
+		uploads: make(map[string]map[int][]byte),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// newFakeS3Store returns a store for the bucket in a new fakeS3, which is
+// accessed anonymously.
+func newFakeS3Store(t *testing.T) (*fakeS3, *s3Store) {
+	f, srv := newFakeS3(t)
+	client, err := newS3Client(srv.URL, "us-east-1", credentials.NewStaticV4("", "", ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, &s3Store{client: client, bucket: "bucket", atomicCreate: true}
+}
+
+// readS3Body reads the body of the request, decoding the aws-chunked encoding
+// of signed streaming uploads.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	q := r.URL.Query()
+	if len(parts) == 1 || parts[1] == "" {
+		if r.Method == http.MethodGet && q.Get("list-type") == "2" {
+			f.list(w, q.Get("prefix"))
+			return
+		}
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	name := parts[1]
+
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		id := strconv.FormatInt(time.Now().UnixNano(), 10)
+		f.mu.Lock()
+		f.uploads[id] = make(map[int][]byte)
+		f.mu.Unlock()
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>",
+			parts[0], name, id)
+
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		data, err := readS3Body(r)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.mu.Lock()
+		f.uploads[q.Get("uploadId")][n] = data
+		f.mu.Unlock()
+		w.Header().Set("ETag", (&fakeS3Object{data: data}).etag())
+
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		f.mu.Lock()
+		upload := f.uploads[q.Get("uploadId")]
+		delete(f.uploads, q.Get("uploadId"))
+		f.mu.Unlock()
+
+		var nums []int
+		for n := range upload {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		var data []byte
+		for _, n := range nums {
+			data = append(data, upload[n]...)
+		}
+		// The headers were sent when the upload was initiated, which the fake
+		// does not keep
+		obj := &fakeS3Object{data: data, header: http.Header{}, modified: time.Now()}
+		if !f.put(w, r, name, obj) {
+			return
+		}
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>",
+			parts[0], name, obj.etag())
+
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		f.mu.Lock()
+		delete(f.uploads, q.Get("uploadId"))
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.mu.Lock()
+		src, ok := f.objects[name]
+		f.mu.Unlock()
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if m := r.Header.Get("X-Amz-Copy-Source-If-Match"); m != "" && strings.Trim(m, `"`) != strings.Trim(src.etag(), `"`) {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		obj := &fakeS3Object{data: src.data, header: fakeS3Header(r.Header), modified: time.Now()}
+		f.mu.Lock()
+		f.objects[name] = obj
+		f.mu.Unlock()
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>",
+			obj.etag(), obj.modified.UTC().Format(time.RFC3339))
+
+	case r.Method == http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		obj := &fakeS3Object{data: data, header: fakeS3Header(r.Header), modified: time.Now()}
+		if !f.put(w, r, name, obj) {
+			return
+		}
+		w.Header().Set("ETag", obj.etag())
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		f.mu.Lock()
+		obj, ok := f.objects[name]
+		f.mu.Unlock()
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for k, v := range obj.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", obj.etag())
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		http.ServeContent(w, r, "", obj.modified, bytes.NewReader(obj.data))
+
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, name)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// put creates the object, unless the request has If-None-Match and the object
+// exists. It returns false if it wrote an error.
+func (f *fakeS3) put(w http.ResponseWriter, r *http.Request, name string, obj *fakeS3Object) bool {
+	if f.beforePut != nil {
+		f.beforePut(name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.objects[name]; ok && r.Header.Get("If-None-Match") == "*" && !f.ignoreIfNoneMatch {
+		f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return false
+	}
+	f.objects[name] = obj
+	return true
+}
+
+// fakeS3Header returns the headers of the request which are stored with an
+// object.
+func fakeS3Header(h http.Header) http.Header {
+	stored := make(http.Header)
+	for k, v := range h {
+		switch {
+		case strings.HasPrefix(k, "X-Amz-Meta-"), k == "Content-Type", k == "Cache-Control", k == "Content-Encoding":
+			stored[k] = v
+		}
+	}
+	return stored
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []content
+	}{}
+
+	f.mu.Lock()
+	for name, obj := range f.objects {
+		if strings.HasPrefix(name, prefix) {
+			result.Contents = append(result.Contents, content{
+				Key:          name,
+				LastModified: obj.modified.UTC().Format(time.RFC3339),
+				ETag:         obj.etag(),
+				Size:         int64(len(obj.data)),
+			})
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+
+	w.Header().Set("Content-Type", "application/xml")
+	if err := xml.NewEncoder(w).Encode(&result); err != nil {
+		f.t.Error(err)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	t.Parallel()
+
+	testStorage(t, func(t *testing.T) Storage {
+		_, st := newFakeS3Store(t)
+		return st
+	})
+}
+
+func TestS3Store_atomicCreate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	f, st := newFakeS3Store(t)
+
+	// Another upload creates the object after it was checked
+	f.beforePut = func(name string) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.objects[name]; !ok {
+			f.objects[name] = &fakeS3Object{data: []byte("other"), header: http.Header{}, modified: time.Now()}
+		}
+	}
+
+	w := st.NewWriter(ctx, "a", &WriterOptions{DoesNotExist: true})
+	if _, err := io.WriteString(w, "mine"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); !isPreconditionFailed(err) {
+		t.Errorf("expected precondition failure, got %v", err)
+	}
+	if got := string(f.objects["a"].data); got != "other" {
+		t.Errorf("expected %q to be %q", got, "other")
+	}
+}
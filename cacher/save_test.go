@@ -0,0 +1,206 @@
+package cacher
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSave_marker(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		marker string
+		want   map[string]string
+	}{
+		{
+			name: "none",
+			want: map[string]string{"file": "file", ".marker": "a#1\n", "sub/.marker": "sub"},
+		},
+		{
+			name:   "root",
+			marker: ".marker",
+			want:   map[string]string{"file": "file", "sub/.marker": "sub"},
+		},
+		{
+			name:   "nested",
+			marker: "./sub/.marker",
+			want:   map[string]string{"file": "file", ".marker": "a#1\n"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c, _ := newTestCacher(t)
+
+			if err := c.Save(ctx, &SaveRequest{
+				Bucket: testBucket,
+				Dir:    writeFiles(t, map[string]string{"file": "file", ".marker": "a#1\n", "sub/.marker": "sub"}),
+				Key:    "a",
+				Marker: tc.marker,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			if err := c.Restore(ctx, &RestoreRequest{
+				Bucket: testBucket,
+				Dir:    dir,
+				Keys:   []string{"a"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFiles(t, dir); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %q to be %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSave_respectGitignore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c, _ := newTestCacher(t)
+
+	if err := c.Save(ctx, &SaveRequest{
+		Bucket: testBucket,
+		Dir: writeFiles(t, map[string]string{
+			".git/config":       "config",
+			".git/info/exclude": "excluded\n",
+			".gitignore":        "*.log\n",
+			"excluded":          "excluded",
+			"file":              "file",
+			"file.log":          "log",
+			"sub/.git":          "gitdir: ../.git/modules/sub\n",
+			"sub/file":          "file",
+		}),
+		Key:              "a",
+		RespectGitignore: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := c.Restore(ctx, &RestoreRequest{
+		Bucket: testBucket,
+		Dir:    dir,
+		Keys:   []string{"a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{".gitignore": "*.log\n", "file": "file", "sub/file": "file"}
+	if got := readFiles(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestSave_filters(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{
+		"a.o":         "a",
+		"a.c":         "a",
+		"sub/b.o":     "b",
+		"sub/b.log":   "b",
+		"tmp/c.o":     "c",
+		"keep/d.log":  "d",
+		"build/e.o":   "e",
+		"sub/build/f": "f",
+	}
+
+	cases := []struct {
+		name    string
+		include []string
+		exclude []string
+		ignore  string
+		want    []string
+	}{
+		{
+			name: "everything",
+			want: []string{"a.c", "a.o", "build/e.o", "keep/d.log", "sub/b.log", "sub/b.o", "sub/build/f", "tmp/c.o"},
+		},
+		{
+			name:    "include",
+			include: []string{"**/*.o", "sub/build"},
+			want:    []string{"a.o", "build/e.o", "sub/b.o", "sub/build/f", "tmp/c.o"},
+		},
+		{
+			name:    "exclude",
+			exclude: []string{"**/*.log", "tmp"},
+			want:    []string{"a.c", "a.o", "build/e.o", "sub/b.o", "sub/build/f"},
+		},
+		{
+			name:    "include_and_exclude",
+			include: []string{"**/*.o"},
+			exclude: []string{"tmp", "build"},
+			want:    []string{"a.o", "sub/b.o"},
+		},
+		{
+			name:   "ignore_file",
+			ignore: "*.log\n!keep/*.log\n/build/\n*.c\n",
+			want:   []string{".gcscacherignore", "a.o", "keep/d.log", "sub/b.o", "sub/build/f", "tmp/c.o"},
+		},
+		{
+			// Files in an ignored directory cannot be negated, like with git
+			name:   "ignore_file_negated_dir",
+			ignore: "tmp/\n!tmp/c.o\n",
+			want:   []string{".gcscacherignore", "a.c", "a.o", "build/e.o", "keep/d.log", "sub/b.log", "sub/b.o", "sub/build/f"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c, _ := newTestCacher(t)
+
+			src := make(map[string]string, len(files)+1)
+			for k, v := range files {
+				src[k] = v
+			}
+			if tc.ignore != "" {
+				src[".gcscacherignore"] = tc.ignore
+			}
+
+			if err := c.Save(ctx, &SaveRequest{
+				Bucket:  testBucket,
+				Dir:     writeFiles(t, src),
+				Key:     "a",
+				Include: tc.include,
+				Exclude: tc.exclude,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			if err := c.Restore(ctx, &RestoreRequest{
+				Bucket: testBucket,
+				Dir:    dir,
+				Keys:   []string{"a"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for name := range readFiles(t, dir) {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %q to be %q", got, tc.want)
+			}
+		})
+	}
+}
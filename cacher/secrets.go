@@ -0,0 +1,36 @@
+package cacher
+
+import (
+	"strings"
+)
+
+// DefaultSecretPatterns is a list of patterns for files which commonly contain
+// credentials, for use with SaveRequest.Secrets.
+var DefaultSecretPatterns = []string{
+	".env",
+	"id_rsa",
+	"id_dsa",
+	"id_ecdsa",
+	"id_ed25519",
+	"*.pem",
+	"*.p12",
+	"*.pfx",
+	"credentials.json",
+	".netrc",
+}
+
+// addSecrets adds patterns, in gitignore syntax, for paths which likely
+// contain secrets.
+func (f *pathFilter) addSecrets(patterns []string) error {
+	rules, err := parseIgnore(strings.NewReader(strings.Join(patterns, "\n")), "")
+	if err != nil {
+		return err
+	}
+	f.secrets = append(f.secrets, rules...)
+	return nil
+}
+
+// secret returns true if the relative path matches a secret pattern.
+func (f *pathFilter) secret(rel string, dir bool) bool {
+	return ignored(f.secrets, rel, dir)
+}
@@ -0,0 +1,103 @@
+package cacher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// defaultSignedURLExpires is the default duration for which signed URLs
+	// are valid, and maxSignedURLExpires is the longest duration Cloud Storage
+	// and S3 accept.
+	defaultSignedURLExpires = time.Hour
+	maxSignedURLExpires     = 7 * 24 * time.Hour
+)
+
+// SignURLRequest is used as input to the SignURL operation.
+type SignURLRequest struct {
+	// Bucket is the name of the bucket which holds the cache.
+	Bucket string
+
+	// Key is the name of the object.
+	Key string
+
+	// Expires is how long the URL is valid. The default is one hour, and the
+	// maximum is seven days.
+	Expires time.Duration
+}
+
+// SignURL returns a signed URL with which anyone can download the cached
+// object until it expires, without credentials of their own, so caches can be
+// shared with systems or people that have no Google Cloud identity. The URL is
+// signed with the key of the service account, through the IAM Credentials API
+// if the credentials have no private key, or with the HMAC key. Only Cloud
+// Storage and S3 buckets support signed URLs.
+func (c *Cacher) SignURL(ctx context.Context, i *SignURLRequest) (string, error) {
+	if i == nil {
+		return "", fmt.Errorf("missing sign options")
+	}
+
+	bucket := i.Bucket
+	if bucket == "" {
+		return "", fmt.Errorf("missing bucket")
+	}
+
+	key := i.Key
+	if key == "" {
+		return "", fmt.Errorf("missing key")
+	}
+
+	expires := i.Expires
+	if expires == 0 {
+		expires = defaultSignedURLExpires
+	}
+	if expires < 0 {
+		return "", fmt.Errorf("expiration must be positive")
+	}
+	if expires > maxSignedURLExpires {
+		return "", fmt.Errorf("expiration must be at most %s", maxSignedURLExpires)
+	}
+
+	st, err := c.bucket(ctx, bucket)
+	if err != nil {
+		return "", err
+	}
+
+	// Do not hand out URLs which do not work
+	if _, err := st.Attrs(ctx, key, 0); err != nil {
+		return "", fmt.Errorf("failed to get attributes of %s: %w", key, err)
+	}
+
+	c.log("signing url for %s valid for %s", key, expires)
+	switch s := st.(type) {
+	case *gcsStore:
+		// The signer is the principal which the credentials authenticate as,
+		// which the storage client cannot detect for every kind of credentials
+		signer, err := c.identity(ctx)
+		if err != nil {
+			return "", err
+		}
+		u, err := s.bucket.SignedURL(key, &storage.SignedURLOptions{
+			GoogleAccessID: signer,
+			Method:         http.MethodGet,
+			Expires:        time.Now().Add(expires),
+			Scheme:         storage.SigningSchemeV4,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to sign url for %s: %w", key, err)
+		}
+		return u, nil
+	case *s3Store:
+		u, err := s.client.PresignedGetObject(ctx, s.bucket, key, expires, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to sign url for %s: %w", key, err)
+		}
+		return u.String(), nil
+	default:
+		return "", fmt.Errorf("signed urls are only supported for Cloud Storage and S3 buckets")
+	}
+}
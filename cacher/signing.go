@@ -0,0 +1,263 @@
+package cacher
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	cloudkms "google.golang.org/api/cloudkms/v1"
+)
+
+// signatureMetadataKey is the object metadata key which holds the
+// base64-encoded signature of the archive's name and SHA256 digest.
+const signatureMetadataKey = "gcs-cacher-signature"
+
+// kmsKeyPrefix is the prefix of signing keys which refer to a Cloud KMS
+// asymmetric key version, like "gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1".
+// This matches the format used by cosign.
+const kmsKeyPrefix = "gcpkms://"
+
+// errInvalidSignature is returned when a signature does not match.
+var errInvalidSignature = errors.New("invalid signature")
+
+// signer signs archive digests.
+type signer interface {
+	sign(ctx context.Context, digest []byte) ([]byte, error)
+}
+
+// verifier verifies signatures of archive digests.
+type verifier interface {
+	verify(ctx context.Context, digest, sig []byte) error
+}
+
+// newSigner returns a signer for the key, which is either a Cloud KMS key
+// version or the path to a PEM-encoded private key.
+func (c *Cacher) newSigner(ctx context.Context, key string) (signer, error) {
+	if name := strings.TrimPrefix(key, kmsKeyPrefix); name != key {
+		opts, err := c.googleOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		svc, err := cloudkms.NewService(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kms client: %w", err)
+		}
+		return &kmsSigner{svc: svc, name: name}, nil
+	}
+
+	b, err := os.ReadFile(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	priv, err := parsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", key, err)
+	}
+	return &localSigner{key: priv}, nil
+}
+
+// newVerifier returns a verifier for the key, which is either a Cloud KMS key
+// version or the path to a PEM-encoded public key.
+func (c *Cacher) newVerifier(ctx context.Context, key string) (verifier, error) {
+	var b []byte
+	if name := strings.TrimPrefix(key, kmsKeyPrefix); name != key {
+		opts, err := c.googleOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		svc, err := cloudkms.NewService(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kms client: %w", err)
+		}
+
+		resp, err := svc.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.
+			GetPublicKey(name).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get public key %s: %w", name, err)
+		}
+		b = []byte(resp.Pem)
+	} else {
+		data, err := os.ReadFile(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read verification key: %w", err)
+		}
+		b = data
+	}
+
+	pub, err := parsePublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse verification key %s: %w", key, err)
+	}
+	return &localVerifier{key: pub}, nil
+}
+
+// signedDigest returns the digest which is signed for the archive with the
+// name and SHA256 digest. It covers the name, so a signed archive cannot be
+// copied to another key and still verify.
+func signedDigest(name string, digest []byte) []byte {
+	d := sha256.Sum256([]byte(name + "\n" + hex.EncodeToString(digest)))
+	return d[:]
+}
+
+// spoolVerified copies r to a temporary file and verifies the signature of its
+// name and SHA256 digest, so nothing is extracted from an archive with an
+// invalid signature. It returns the file and the hex-encoded digest. The caller
+// must close and remove the returned file.
+func (c *Cacher) spoolVerified(ctx context.Context, r io.Reader, name string, sig []byte, v verifier) (*os.File, string, error) {
+	f, err := os.CreateTemp("", "gcs-cacher-*.archive")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	cleanup := func(err error) error {
+		if cerr := f.Close(); cerr != nil {
+			err = fmt.Errorf("%v: failed to close %s: %w", err, f.Name(), cerr)
+		}
+		if rerr := os.Remove(f.Name()); rerr != nil {
+			err = fmt.Errorf("%v: failed to remove %s: %w", err, f.Name(), rerr)
+		}
+		return err
+	}
+
+	c.log("downloading archive to %s for verification", f.Name())
+	digest := sha256.New()
+	if _, err := c.copyBuffered(io.MultiWriter(f, digest), r); err != nil {
+		return nil, "", cleanup(fmt.Errorf("failed to download archive: %w", err))
+	}
+
+	if err := v.verify(ctx, signedDigest(name, digest.Sum(nil)), sig); err != nil {
+		err = fmt.Errorf("failed to verify archive signature: %w", err)
+		if errors.Is(err, errInvalidSignature) {
+			err = &corruptError{err: err}
+		}
+		return nil, "", cleanup(err)
+	}
+	c.log("verified archive signature")
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, "", cleanup(fmt.Errorf("failed to seek %s: %w", f.Name(), err))
+	}
+	return f, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// kmsSigner signs digests with a Cloud KMS asymmetric key version.
+type kmsSigner struct {
+	svc  *cloudkms.Service
+	name string
+}
+
+func (s *kmsSigner) sign(ctx context.Context, digest []byte) ([]byte, error) {
+	resp, err := s.svc.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.
+		AsymmetricSign(s.name, &cloudkms.AsymmetricSignRequest{
+			Digest: &cloudkms.Digest{
+				Sha256: base64.StdEncoding.EncodeToString(digest),
+			},
+		}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with %s: %w", s.name, err)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(resp.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signature: %w", err)
+	}
+	return sig, nil
+}
+
+// localSigner signs digests with a private key.
+type localSigner struct {
+	key crypto.Signer
+}
+
+func (s *localSigner) sign(_ context.Context, digest []byte) ([]byte, error) {
+	// Ed25519 signs messages instead of digests, so sign the digest itself
+	opts := crypto.Hash(0)
+	if _, ok := s.key.(ed25519.PrivateKey); !ok {
+		opts = crypto.SHA256
+	}
+
+	sig, err := s.key.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+	return sig, nil
+}
+
+// localVerifier verifies signatures with a public key.
+type localVerifier struct {
+	key crypto.PublicKey
+}
+
+func (v *localVerifier) verify(_ context.Context, digest, sig []byte) error {
+	switch key := v.key.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(key, digest, sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		// Cloud KMS RSA keys use either padding scheme
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig) == nil {
+			return nil
+		}
+		if rsa.VerifyPSS(key, crypto.SHA256, digest, sig, nil) == nil {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, digest, sig) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return errInvalidSignature
+}
+
+// parsePrivateKey parses a PEM-encoded PKCS8, PKCS1, or EC private key.
+func parsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key format %q", block.Type)
+}
+
+// parsePublicKey parses a PEM-encoded PKIX public key.
+func parsePublicKey(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
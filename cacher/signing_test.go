@@ -0,0 +1,133 @@
+package cacher
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRestore_verifyKey(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		setup func(t *testing.T, b *fakeGCSBucket)
+		err   bool
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name: "unsigned",
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				data, _, _ := b.object("a")
+				b.put("a", data, nil)
+			},
+			err: true,
+		},
+		{
+			name: "other_key",
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				copyObject(t, b, "b", "a")
+			},
+			err: true,
+		},
+		{
+			name: "tampered",
+			setup: func(t *testing.T, b *fakeGCSBucket) {
+				data, obj, _ := b.object("a")
+				data[len(data)-1] ^= 0xff
+				b.put("a", data, obj.Metadata)
+			},
+			err: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c, f := newTestCacher(t)
+			priv, pub := writeKeys(t)
+
+			for key, contents := range map[string]string{"a": "good", "b": "evil"} {
+				if err := c.Save(ctx, &SaveRequest{
+					Bucket:     testBucket,
+					Dir:        writeFiles(t, map[string]string{"file": contents}),
+					Key:        key,
+					SigningKey: priv,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.setup != nil {
+				tc.setup(t, f.bucket(testBucket))
+			}
+
+			dir := t.TempDir()
+			err := c.Restore(ctx, &RestoreRequest{
+				Bucket:    testBucket,
+				Dir:       dir,
+				Keys:      []string{"a"},
+				VerifyKey: pub,
+			})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if got := readFiles(t, dir); len(got) > 0 {
+					t.Errorf("expected nothing to be restored, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := readFiles(t, dir)["file"], "good"; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSave_signedWhenWritten(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c, f := newTestCacher(t)
+	priv, pub := writeKeys(t)
+
+	// Restores never see the object before it is signed, since the signature
+	// is written with it
+	if err := c.Save(ctx, &SaveRequest{
+		Bucket:     testBucket,
+		Dir:        writeFiles(t, map[string]string{"file": "good"}),
+		Key:        "a",
+		SigningKey: priv,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	patched := f.patched
+	f.mu.Unlock()
+	for _, name := range patched {
+		if name == "a" {
+			t.Error("expected signature to be written with the object")
+		}
+	}
+
+	dir := t.TempDir()
+	if err := c.Restore(ctx, &RestoreRequest{
+		Bucket:    testBucket,
+		Dir:       dir,
+		Keys:      []string{"a"},
+		VerifyKey: pub,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFiles(t, dir)["file"], "good"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
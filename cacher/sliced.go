@@ -0,0 +1,113 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+// defaultSliceSize is the default size of each range of a parallel download.
+const defaultSliceSize = 64 * 1024 * 1024
+
+// slice is the result of downloading a single range of an object.
+type slice struct {
+	buf []byte
+	err error
+}
+
+// slicedReader downloads an object as byte ranges, several at a time, and
+// returns their contents in order.
+type slicedReader struct {
+	cancel context.CancelFunc
+
+	// queue holds the pending slices in order. Its capacity limits the number
+	// of slices which are downloaded or buffered at once.
+	queue chan chan *slice
+
+	cur *bytes.Reader
+	err error
+}
+
+// newSlicedReader starts downloading the object, which is size bytes, in
+// slices of sliceSize bytes with up to concurrency slices in flight at once.
+func (c *Cacher) newSlicedReader(ctx context.Context, handle *objectHandle, size int64, concurrency int, sliceSize int64) *slicedReader {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &slicedReader{
+		cancel: cancel,
+		queue:  make(chan chan *slice, concurrency),
+		cur:    bytes.NewReader(nil),
+	}
+
+	go func() {
+		defer close(r.queue)
+
+		for offset := int64(0); offset < size; offset += sliceSize {
+			length := sliceSize
+			if offset+length > size {
+				length = size - offset
+			}
+
+			ch := make(chan *slice, 1)
+			select {
+			case r.queue <- ch:
+			case <-ctx.Done():
+				return
+			}
+
+			go func(offset, length int64) {
+				c.log("downloading range %d-%d", offset, offset+length-1)
+				buf, err := c.readRange(ctx, handle, offset, length)
+				ch <- &slice{buf: buf, err: err}
+			}(offset, length)
+		}
+	}()
+
+	return r
+}
+
+// readRange reads length bytes from the object starting at offset.
+func (c *Cacher) readRange(ctx context.Context, handle *objectHandle, offset, length int64) ([]byte, error) {
+	rr, err := c.newResumingReader(ctx, handle, offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create range reader: %w", err)
+	}
+	defer rr.Close()
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(rr, buf); err != nil {
+		return nil, fmt.Errorf("failed to read range %d-%d: %w", offset, offset+length-1, err)
+	}
+	return buf, nil
+}
+
+// Read reads from the slices in order, waiting for each to be downloaded.
+func (r *slicedReader) Read(p []byte) (int, error) {
+	for r.cur.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		ch, ok := <-r.queue
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+
+		s := <-ch
+		if s.err != nil {
+			r.err = s.err
+			continue
+		}
+		r.cur = bytes.NewReader(s.buf)
+	}
+	return r.cur.Read(p)
+}
+
+// Close stops any downloads in progress.
+func (r *slicedReader) Close() error {
+	r.cancel()
+	for range r.queue {
+	}
+	return nil
+}
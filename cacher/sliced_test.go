@@ -0,0 +1,224 @@
+package cacher
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRestore_sliced(t *testing.T) {
+	t.Parallel()
+
+	const sliceSize = 64 * 1024
+
+	random := make([]byte, 5*sliceSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"random": string(random),
+		"text":   strings.Repeat("text", 1024),
+	}
+
+	cases := []struct {
+		name string
+		fail int64
+		err  bool
+	}{
+		{
+			name: "ranges",
+			fail: -1,
+		},
+		{
+			name: "range_error",
+			fail: 2 * sliceSize,
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c, f := newTestCacher(t)
+
+			var mu sync.Mutex
+			var offsets []int64
+			f.mu.Lock()
+			f.onRead = func(name string, offset int64) (int, int64) {
+				if name != "a" {
+					return 0, -1
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				offsets = append(offsets, offset)
+				if offset == tc.fail {
+					return http.StatusBadRequest, 0
+				}
+				return 0, -1
+			}
+			f.mu.Unlock()
+
+			if err := c.Save(ctx, &SaveRequest{
+				Bucket:      testBucket,
+				Dir:         writeFiles(t, files),
+				Key:         "a",
+				Compression: CompressionNone,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			err := c.Restore(ctx, &RestoreRequest{
+				Bucket:            testBucket,
+				Dir:               dir,
+				Keys:              []string{"a"},
+				ParallelDownloads: 4,
+				SliceSize:         sliceSize,
+			})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readFiles(t, dir); !reflect.DeepEqual(got, files) {
+				t.Error("expected restored files to match saved files")
+			}
+
+			// The object is downloaded once, as ranges of the slice size
+			mu.Lock()
+			defer mu.Unlock()
+			sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+			for n, offset := range offsets {
+				if want := int64(n) * sliceSize; offset != want {
+					t.Fatalf("expected ranges from multiples of %d, got %d", sliceSize, offsets)
+				}
+			}
+			if len(offsets) < 6 {
+				t.Errorf("expected at least 6 ranges, got %d", offsets)
+			}
+		})
+	}
+}
+
+func TestRestore_interrupted(t *testing.T) {
+	t.Parallel()
+
+	const sliceSize = 64 * 1024
+
+	random := make([]byte, 5*sliceSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"random": string(random),
+		"text":   strings.Repeat("text", 1024),
+	}
+
+	cases := []struct {
+		name     string
+		parallel int
+		want     []int64
+	}{
+		{
+			name:     "stream",
+			parallel: 1,
+			want:     []int64{0, sliceSize / 2},
+		},
+		{
+			name:     "sliced",
+			parallel: 4,
+			want:     []int64{0, sliceSize / 2, sliceSize, sliceSize + sliceSize/2},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			c, f := newTestCacher(t)
+
+			// The first download from each offset which is a multiple of the
+			// slice size is interrupted halfway, like a flaky network, and so
+			// is the retry of the storage client, so the cacher resumes it
+			var mu sync.Mutex
+			var offsets []int64
+			interrupted := make(map[int64]bool)
+			f.mu.Lock()
+			f.onRead = func(name string, offset int64) (int, int64) {
+				if name != "a" {
+					return 0, -1
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				offsets = append(offsets, offset)
+				if interrupted[offset] {
+					return 0, -1
+				}
+				interrupted[offset] = true
+
+				switch offset % sliceSize {
+				case 0:
+					return 0, sliceSize / 2
+				case sliceSize / 2:
+					return http.StatusBadRequest, 0
+				}
+				return 0, -1
+			}
+			f.mu.Unlock()
+
+			if err := c.Save(ctx, &SaveRequest{
+				Bucket:      testBucket,
+				Dir:         writeFiles(t, files),
+				Key:         "a",
+				Compression: CompressionNone,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			if err := c.Restore(ctx, &RestoreRequest{
+				Bucket:            testBucket,
+				Dir:               dir,
+				Keys:              []string{"a"},
+				ParallelDownloads: tc.parallel,
+				SliceSize:         sliceSize,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFiles(t, dir); !reflect.DeepEqual(got, files) {
+				t.Error("expected restored files to match saved files")
+			}
+
+			// Every interrupted download is resumed where it stopped
+			mu.Lock()
+			defer mu.Unlock()
+			got := make(map[int64]bool)
+			for _, offset := range offsets {
+				got[offset] = true
+			}
+			for _, offset := range tc.want {
+				if !got[offset] {
+					t.Errorf("expected download from offset %d, got %d", offset, offsets)
+				}
+			}
+		})
+	}
+}
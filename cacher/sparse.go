@@ -0,0 +1,291 @@
+package cacher
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sparseBlockSize is the granularity at which holes are detected. It matches
+// the block size of most filesystems.
+const sparseBlockSize = 4096
+
+// copySparse copies r into f, seeking over blocks which are entirely zero
+// instead of writing them. On filesystems which support sparse files, this
+// leaves holes in the file instead of allocating disk space for the zeros. The
+// file must be empty.
+func copySparse(f *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, 32*sparseBlockSize)
+
+	var written int64
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		for start := 0; start < n; start += sparseBlockSize {
+			end := start + sparseBlockSize
+			if end > n {
+				end = n
+			}
+			block := buf[start:end]
+
+			if isZero(block) {
+				if _, err := f.Seek(int64(len(block)), io.SeekCurrent); err != nil {
+					return written, fmt.Errorf("failed to seek: %w", err)
+				}
+			} else {
+				if _, err := f.Write(block); err != nil {
+					return written, err
+				}
+			}
+			written += int64(len(block))
+		}
+
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+
+	// Seeking past the end of the file does not extend it, so a trailing hole
+	// must be created by truncating to the full size.
+	if err := f.Truncate(written); err != nil {
+		return written, fmt.Errorf("failed to truncate: %w", err)
+	}
+	return written, nil
+}
+
+// isZero returns true if b only contains zeros.
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sparseSegment is a region of a sparse file which holds data. Everything
+// between segments is a hole.
+type sparseSegment struct {
+	offset int64
+	length int64
+}
+
+// tarArchiveWriter is an archiveWriter that produces a tar file. Unlike
+// tar.Writer, which cannot write sparse files, it can also write files as GNU
+// sparse entries, which only store the segments with data.
+type tarArchiveWriter struct {
+	*tar.Writer
+
+	// w is the writer under the tar writer, to which sparse entries are
+	// written directly.
+	w io.Writer
+}
+
+// newTarArchiveWriter creates a tar archive writer that writes to w.
+func newTarArchiveWriter(w io.Writer) *tarArchiveWriter {
+	return &tarArchiveWriter{
+		Writer: tar.NewWriter(w),
+		w:      w,
+	}
+}
+
+// writeSparse writes the regular file f with the header as a sparse entry,
+// using the PAX format 1.0 of GNU tar, which stores only the segments. The
+// contents of the file, including zeros for the holes, are also written to
+// sum.
+func (tw *tarArchiveWriter) writeSparse(header *tar.Header, f *os.File, segments []sparseSegment, sum io.Writer) error {
+	// Pad the previous entry, so the sparse entry starts on a block boundary
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// GNU tar only extends the file to its full size if the map ends with an
+	// empty segment at the end of the file
+	if n := len(segments); n == 0 || segments[n-1].offset+segments[n-1].length < header.Size {
+		segments = append(segments, sparseSegment{offset: header.Size})
+	}
+
+	// The sparse map starts the data of the entry
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(segments))
+	var dataSize int64
+	for _, seg := range segments {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", seg.offset, seg.length)
+		dataSize += seg.length
+	}
+	sparseMap.Write(make([]byte, blockPadding(int64(sparseMap.Len()))))
+	size := int64(sparseMap.Len()) + dataSize
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     header.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(header.Size, 10),
+		"mtime":               formatPAXTime(header.ModTime.Unix(), int64(header.ModTime.Nanosecond())),
+	}
+	for k, v := range header.PAXRecords {
+		records[k] = v
+	}
+	if size > maxOctal(12) {
+		records["size"] = strconv.FormatInt(size, 10)
+	}
+	if int64(header.Uid) > maxOctal(8) {
+		records["uid"] = strconv.Itoa(header.Uid)
+	}
+	if int64(header.Gid) > maxOctal(8) {
+		records["gid"] = strconv.Itoa(header.Gid)
+	}
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pax bytes.Buffer
+	for _, k := range keys {
+		pax.WriteString(paxRecord(k, records[k]))
+	}
+
+	// The real name is only in the records, so tools which do not support
+	// sparse files extract the entry under a separate directory
+	dir, file := path.Split(header.Name)
+	paxHeader := ustarHeader(&tar.Header{
+		Name:     path.Join(dir, "PaxHeaders.0", file),
+		Typeflag: tar.TypeXHeader,
+		Size:     int64(pax.Len()),
+		ModTime:  header.ModTime,
+	})
+	pax.Write(make([]byte, blockPadding(int64(pax.Len()))))
+	fileHeader := ustarHeader(&tar.Header{
+		Name:     path.Join(dir, "GNUSparseFile.0", file),
+		Typeflag: tar.TypeReg,
+		Mode:     header.Mode,
+		Uid:      header.Uid,
+		Gid:      header.Gid,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+		Size:     size,
+		ModTime:  header.ModTime,
+	})
+
+	for _, b := range [][]byte{paxHeader, pax.Bytes(), fileHeader, sparseMap.Bytes()} {
+		if _, err := tw.w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	var pos int64
+	for _, seg := range segments {
+		if _, err := io.CopyN(sum, zeroReader{}, seg.offset-pos); err != nil {
+			return err
+		}
+		n, err := io.Copy(io.MultiWriter(tw.w, sum), io.NewSectionReader(f, seg.offset, seg.length))
+		if err != nil {
+			return err
+		}
+		if n != seg.length {
+			return fmt.Errorf("file changed while reading: read %d bytes at offset %d, expected %d", n, seg.offset, seg.length)
+		}
+		pos = seg.offset + seg.length
+	}
+	if _, err := io.CopyN(sum, zeroReader{}, header.Size-pos); err != nil {
+		return err
+	}
+
+	_, err := tw.w.Write(make([]byte, blockPadding(size)))
+	return err
+}
+
+// ustarHeader returns the 512-byte USTAR header block for the header. Names
+// are truncated and numbers must fit, since the PAX records hold the real
+// values.
+func ustarHeader(h *tar.Header) []byte {
+	b := make([]byte, 512)
+	name := h.Name
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	copy(b[0:100], name)
+	formatOctal(b[100:108], h.Mode)
+	formatOctal(b[108:116], int64(h.Uid)&maxOctal(8))
+	formatOctal(b[116:124], int64(h.Gid)&maxOctal(8))
+	formatOctal(b[124:136], h.Size&maxOctal(12))
+	formatOctal(b[136:148], h.ModTime.Unix())
+	b[156] = h.Typeflag
+	copy(b[257:263], "ustar\x00")
+	copy(b[263:265], "00")
+	copy(b[265:297], truncate(h.Uname, 32))
+	copy(b[297:329], truncate(h.Gname, 32))
+
+	// The checksum is computed with the checksum field set to spaces
+	copy(b[148:156], "        ")
+	var chksum int64
+	for _, c := range b {
+		chksum += int64(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", chksum))
+	return b
+}
+
+// formatOctal writes n to the field as a NUL-terminated octal number.
+func formatOctal(b []byte, n int64) {
+	copy(b, fmt.Sprintf("%0*o\x00", len(b)-1, n))
+}
+
+// maxOctal returns the largest number which fits in an octal field of the
+// width.
+func maxOctal(width int) int64 {
+	return 1<<(3*(width-1)) - 1
+}
+
+// truncate returns s truncated to n bytes, leaving room for a NUL.
+func truncate(s string, n int) string {
+	if len(s) >= n {
+		return s[:n-1]
+	}
+	return s
+}
+
+// blockPadding returns the number of bytes which pad n to a tar block.
+func blockPadding(n int64) int64 {
+	return -n & 511
+}
+
+// paxRecord formats a PAX record, which is prefixed with its own length.
+func paxRecord(k, v string) string {
+	size := len(k) + len(v) + len(" =\n")
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+
+	// The length of the length may have grown by a digit
+	if len(record) != size {
+		size = len(record)
+		record = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+	return record
+}
+
+// formatPAXTime formats a PAX timestamp, without trailing zeros.
+func formatPAXTime(sec, nsec int64) string {
+	if nsec == 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+	return strings.TrimRight(fmt.Sprintf("%d.%09d", sec, nsec), "0")
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
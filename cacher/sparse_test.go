@@ -0,0 +1,115 @@
+package cacher
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSave_sparse(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("sparse files are only saved on Linux and macOS")
+	}
+
+	ctx := context.Background()
+	c, gcs := newTestCacher(t)
+
+	// Write a file with data at the start and in the middle, and a hole at the
+	// end
+	const size = 8 << 20
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(bytes.Repeat([]byte("a"), 1<<20), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(bytes.Repeat([]byte("b"), 1<<20), 4<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join(dir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Save(ctx, &SaveRequest{
+		Bucket:   testBucket,
+		Dir:      dir,
+		Key:      "a",
+		Sparse:   true,
+		Manifest: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The archive must be readable by other tools, and smaller than the file if
+	// the filesystem reported the holes
+	data, _, ok := gcs.bucket(testBucket).object("a")
+	if !ok {
+		t.Fatal("missing archive")
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	header, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := header.Name, "disk.img"; got != want {
+		t.Errorf("expected name %q to be %q", got, want)
+	}
+	if got, want := header.Size, int64(size); got != want {
+		t.Errorf("expected size %d to be %d", got, want)
+	}
+	got, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("expected archived contents to match the file")
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected one entry, got %v", err)
+	}
+	t.Logf("archived %d byte file in %d bytes", size, len(archive))
+
+	// Restoring must produce the same file, matching the manifest
+	req := &RestoreRequest{
+		Bucket:         testBucket,
+		Dir:            t.TempDir(),
+		Keys:           []string{"a"},
+		Sparse:         true,
+		VerifyManifest: true,
+	}
+	if err := c.Restore(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := os.ReadFile(filepath.Join(req.Dir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, want) {
+		t.Error("expected restored contents to match the file")
+	}
+}
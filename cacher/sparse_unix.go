@@ -0,0 +1,56 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package cacher
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sparseSegments returns the segments of the file of the size which hold data.
+// It returns false if the file has no holes, or the filesystem does not report
+// them.
+func sparseSegments(f *os.File, size int64) ([]sparseSegment, bool, error) {
+	fd := int(f.Fd())
+
+	var segments []sparseSegment
+	var offset int64
+	for offset < size {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err != nil {
+			// There is no more data after the offset
+			if errors.Is(err, unix.ENXIO) {
+				break
+			}
+			// The filesystem does not support finding holes
+			if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTSUP) {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, false, err
+		}
+		if end > size {
+			end = size
+		}
+		if end > start {
+			segments = append(segments, sparseSegment{offset: start, length: end - start})
+		}
+		offset = end
+	}
+
+	if _, err := unix.Seek(fd, 0, unix.SEEK_SET); err != nil {
+		return nil, false, err
+	}
+
+	if len(segments) == 1 && segments[0].offset == 0 && segments[0].length == size {
+		return nil, false, nil
+	}
+	return segments, true, nil
+}
@@ -0,0 +1,111 @@
+package cacher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// archiveSpool holds the archive for a save in a temporary file, so it can be
+// built once and uploaded to several buckets, or signed before it is uploaded.
+// The archive is only built when the first bucket needs it, since every bucket
+// may already have the cache.
+type archiveSpool struct {
+	f    *os.File
+	size int64
+
+	// metadata is the metadata recorded while building the archive, including
+	// the SHA256 of the archive, and manifest is the manifest of its files, if
+	// requested.
+	metadata map[string]string
+	manifest *manifest
+
+	// err is the error from building the archive. Building is not retried,
+	// since it would fail the same way for every bucket.
+	err error
+}
+
+// build writes the archive for the request to the spool, unless it was
+// already built or failed to build. Its metadata is known once it is built, so
+// it can be written with the object.
+func (s *archiveSpool) build(ctx context.Context, c *Cacher, i *SaveRequest, compression Compression) (retErr error) {
+	if s.f != nil || s.err != nil {
+		return s.err
+	}
+	defer func() {
+		s.err = retErr
+	}()
+
+	// Ignore files found during the walk are added to the filter, so the walk
+	// needs its own
+	filter, err := newSaveFilter(i)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp("", "gcs-cacher-spool-*")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer func() {
+		if retErr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	metadata := make(map[string]string)
+	var m *manifest
+	if i.Manifest {
+		m = new(manifest)
+	}
+
+	c.log("spooling archive to %s", f.Name())
+	digest := sha256.New()
+	if err := c.writeEncryptedArchive(ctx, io.MultiWriter(f, digest), i, filter, m, compression, metadata); err != nil {
+		return err
+	}
+	metadata[sha256MetadataKey] = hex.EncodeToString(digest.Sum(nil))
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to get size of spool file: %w", err)
+	}
+
+	s.f = f
+	s.size = size
+	s.metadata = metadata
+	s.manifest = m
+	return nil
+}
+
+// copyTo writes the spooled archive to out and adds the metadata recorded
+// while building it.
+func (s *archiveSpool) copyTo(out io.Writer, metadata map[string]string) error {
+	if _, err := io.Copy(out, io.NewSectionReader(s.f, 0, s.size)); err != nil {
+		return fmt.Errorf("failed to copy spooled archive: %w", err)
+	}
+	for k, v := range s.metadata {
+		metadata[k] = v
+	}
+	return nil
+}
+
+// Close removes the spool file.
+func (s *archiveSpool) Close() error {
+	if s.f == nil {
+		return nil
+	}
+
+	if err := s.f.Close(); err != nil {
+		os.Remove(s.f.Name())
+		return fmt.Errorf("failed to close spool file: %w", err)
+	}
+	if err := os.Remove(s.f.Name()); err != nil {
+		return fmt.Errorf("failed to remove spool file: %w", err)
+	}
+	return nil
+}
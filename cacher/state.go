@@ -0,0 +1,110 @@
+package cacher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// uploadState records the parts of a parallel upload which were uploaded, so
+// an interrupted save can be resumed without uploading them again.
+type uploadState struct {
+	// Bucket and Key identify the cached object being uploaded.
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+
+	// Prefix is the prefix of the names of the parts.
+	Prefix string `json:"prefix"`
+
+	// PartSize is the size of each part in bytes.
+	PartSize int `json:"partSize"`
+
+	// Parts is the list of parts which were uploaded, in any order.
+	Parts []*uploadedPart `json:"parts"`
+}
+
+// uploadedPart is a single part which was uploaded.
+type uploadedPart struct {
+	// Index is the position of the part in the object.
+	Index int `json:"index"`
+
+	// Name is the name of the part object.
+	Name string `json:"name"`
+
+	// Size is the size of the part in bytes.
+	Size int `json:"size"`
+
+	// CRC32C is the CRC32C checksum of the part's contents.
+	CRC32C uint32 `json:"crc32c"`
+}
+
+// readUploadState reads the upload state from the file at name. It returns nil
+// if the file does not exist.
+func readUploadState(name string) (*uploadState, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read upload state: %w", err)
+	}
+
+	var s uploadState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse upload state %s: %w", name, err)
+	}
+	return &s, nil
+}
+
+// write replaces the file at name with the upload state.
+func (s *uploadState) write(name string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode upload state: %w", err)
+	}
+
+	// Write to a temporary file first, so the state is never truncated if the
+	// save is interrupted
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create upload state: %w", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write upload state: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to close upload state: %w", err)
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to save upload state: %w", err)
+	}
+	return nil
+}
+
+// part returns the uploaded part at the index, or nil if it was not uploaded.
+func (s *uploadState) part(index int) *uploadedPart {
+	for _, p := range s.Parts {
+		if p.Index == index {
+			return p
+		}
+	}
+	return nil
+}
+
+// add records the part as uploaded, replacing any previous part at the same
+// index.
+func (s *uploadState) add(p *uploadedPart) {
+	for i, existing := range s.Parts {
+		if existing.Index == p.Index {
+			s.Parts[i] = p
+			return
+		}
+	}
+	s.Parts = append(s.Parts, p)
+}
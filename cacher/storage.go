@@ -0,0 +1,252 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrObjectNotExist is returned by storage when an object does not exist.
+	ErrObjectNotExist = errors.New("object does not exist")
+
+	// ErrPreconditionFailed is returned by storage when the conditions for a
+	// write, update, or delete are not met. Errors may wrap it.
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// ObjectAttrs are the attributes of a stored object.
+type ObjectAttrs struct {
+	Bucket string
+	Name   string
+	Size   int64
+
+	ContentType     string
+	CacheControl    string
+	ContentEncoding string
+
+	// Updated is when the object was last written.
+	Updated time.Time
+
+	// CustomTime is a timestamp of the object set by Save and updated when it
+	// is restored, which lifecycle rules can act on. Only Cloud Storage
+	// records it.
+	CustomTime time.Time
+
+	// Generation identifies the contents of the object. It changes every time
+	// the object is written. It is zero if the storage does not track
+	// generations.
+	Generation int64
+
+	// Deleted is when the generation was replaced or deleted, if the storage
+	// keeps noncurrent generations. It is zero for the live generation.
+	Deleted time.Time
+
+	// CRC32C is the CRC32C checksum of the object's contents, using the
+	// Castagnoli table, if HasCRC32C is set. Not all storage computes it.
+	CRC32C    uint32
+	HasCRC32C bool
+
+	// KMSKeyName is the Cloud KMS key which encrypts the object, if any.
+	KMSKeyName string
+
+	// TemporaryHold and EventBasedHold prevent the object from being deleted
+	// or replaced until they are released. Only Cloud Storage supports holds.
+	TemporaryHold  bool
+	EventBasedHold bool
+
+	// Metadata is the custom metadata of the object.
+	Metadata map[string]string
+}
+
+// WriterOptions are the options for writing an object.
+type WriterOptions struct {
+	// DoesNotExist only writes the object if it does not exist, and
+	// GenerationMatch only replaces that generation of the object. If the
+	// condition is not met, the write fails with ErrPreconditionFailed.
+	DoesNotExist    bool
+	GenerationMatch int64
+
+	ContentType     string
+	CacheControl    string
+	ContentEncoding string
+	KMSKeyName      string
+	Metadata        map[string]string
+
+	// CustomTime is the custom time of the object, if the storage records it.
+	CustomTime time.Time
+
+	// CRC32C is the checksum of the contents, which the storage verifies if
+	// SendCRC32C is set.
+	CRC32C     uint32
+	SendCRC32C bool
+
+	// ChunkSize is the number of bytes sent in each request, if the storage
+	// uploads in chunks. Zero uses the storage's default, and a negative value
+	// sends the object in a single request.
+	ChunkSize int
+
+	// ProgressFunc is called with the number of bytes written so far.
+	ProgressFunc func(int64)
+}
+
+// ObjectWriter writes the contents of an object. Cancelling the context with
+// which it was created and closing it aborts the write.
+type ObjectWriter interface {
+	Write(p []byte) (int, error)
+	Close() error
+
+	// Attrs returns the attributes of the written object after it is closed.
+	Attrs() *ObjectAttrs
+}
+
+// Storage holds the objects of a single bucket. The cacher uses it for every
+// object it reads and writes, so implementing it supports other backends, or
+// keeping caches in memory in tests. Methods which take a generation operate
+// on the latest generation if it is zero, and storage which does not track
+// generations may reject any other generation.
+type Storage interface {
+	// Attrs returns the attributes of the object, or ErrObjectNotExist.
+	Attrs(ctx context.Context, name string, generation int64) (*ObjectAttrs, error)
+
+	// List returns the attributes of every object whose name starts with the
+	// prefix. The attributes may only include the name, size, generation, and
+	// update time, use Attrs for the rest.
+	List(ctx context.Context, prefix string) ([]*ObjectAttrs, error)
+
+	// NewReader reads length bytes of the object starting at offset, or the
+	// rest of the object if length is negative.
+	NewReader(ctx context.Context, name string, generation, offset, length int64) (io.ReadCloser, error)
+
+	// NewWriter creates or replaces the object. The object is only visible
+	// once the writer is closed, and the writer reports any error when it is
+	// closed.
+	NewWriter(ctx context.Context, name string, opts *WriterOptions) ObjectWriter
+
+	// Update sets the custom metadata keys of the object. Keys with an empty
+	// value are removed.
+	Update(ctx context.Context, name string, generation int64, metadata map[string]string) error
+
+	// Delete removes the object.
+	Delete(ctx context.Context, name string, generation int64) error
+}
+
+// objectHandle refers to a single generation of an object in storage.
+type objectHandle struct {
+	store      Storage
+	name       string
+	generation int64
+}
+
+// ObjectName returns the name of the object.
+func (h *objectHandle) ObjectName() string {
+	return h.name
+}
+
+// NewRangeReader reads length bytes of the object starting at offset, or the
+// rest of the object if length is negative.
+func (h *objectHandle) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	return h.store.NewReader(ctx, h.name, h.generation, offset, length)
+}
+
+// windowsDrive matches the leading slash before a Windows drive letter in the
+// path of a file URL.
+var windowsDrive = regexp.MustCompile(`^/[a-zA-Z]:`)
+
+// bucket returns the storage for the bucket, using the storage function from
+// the options if there is one. Otherwise buckets which are file URLs, like
+// file:///var/cache/ci, are directories on disk, s3:// URLs are S3 buckets,
+// azblob:// URLs are Azure Blob Storage containers, oci:// URLs are
+// repositories in a container registry, signed URLs are single objects, and
+// other http:// and https:// URLs are read-only prefixes on a web server.
+// Other buckets, with or without a gs:// prefix, are Cloud Storage buckets,
+// which are accessed through the XML API if there is an HMAC key.
+func (c *Cacher) bucket(ctx context.Context, name string) (Storage, error) {
+	if c.storageFunc != nil {
+		return c.storageFunc(ctx, name)
+	}
+
+	if strings.HasPrefix(name, "s3://") {
+		return newS3Store(name, c.roundTripper())
+	}
+	if strings.HasPrefix(name, "azblob://") {
+		return newAzureStore(name, c.roundTripper())
+	}
+	if strings.HasPrefix(name, "oci://") {
+		if c.noAuth {
+			return newOCIStore(ctx, name, nil, c.roundTripper())
+		}
+		opts, err := c.googleOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return newOCIStore(ctx, name, opts, c.roundTripper())
+	}
+	if isPresignedURL(name) {
+		return newPresignedStore(name, c.roundTripper())
+	}
+	if strings.HasPrefix(name, "https://") || strings.HasPrefix(name, "http://") {
+		return newHTTPStore(name, c.roundTripper())
+	}
+
+	if strings.HasPrefix(name, "file://") {
+		u, err := url.Parse(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bucket %q: %w", name, err)
+		}
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, fmt.Errorf("bucket %q must be an absolute path, like file:///var/cache", name)
+		}
+
+		pth := u.Path
+		if windowsDrive.MatchString(pth) {
+			pth = pth[1:]
+		}
+		if pth == "" {
+			return nil, fmt.Errorf("bucket %q is missing a path", name)
+		}
+		return newFileStore(name, filepath.FromSlash(pth)), nil
+	}
+
+	if c.hmacAccessID != "" {
+		return newHMACStore(name, c.endpoint, c.hmacAccessID, c.hmacSecret, c.roundTripper())
+	}
+
+	client, err := c.storageClient()
+	if err != nil {
+		return nil, err
+	}
+	handle := client.Bucket(strings.TrimPrefix(name, "gs://"))
+	if c.billingProject != "" {
+		handle = handle.UserProject(c.billingProject)
+	}
+	return &gcsStore{bucket: handle}, nil
+}
+
+// displayBucket returns the bucket without the query of a URL, which may hold
+// credentials, like the signature of a signed URL, so it can be logged.
+func displayBucket(bucket string) string {
+	if i := strings.Index(bucket, "?"); i >= 0 && strings.Contains(bucket, "://") {
+		return bucket[:i]
+	}
+	return bucket
+}
+
+// objectURL returns the URL of the object in the bucket. Buckets without a
+// scheme are in Cloud Storage. Query parameters, like the endpoint of an S3
+// bucket, are not part of the URL.
+func objectURL(bucket, name string) string {
+	if !strings.Contains(bucket, "://") {
+		bucket = "gs://" + bucket
+	}
+	if i := strings.Index(bucket, "?"); i >= 0 {
+		bucket = bucket[:i]
+	}
+	return strings.TrimSuffix(bucket, "/") + "/" + name
+}
@@ -0,0 +1,206 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testStorage checks the behavior which the cacher relies on from every store.
+// newStore returns an empty store.
+func testStorage(t *testing.T, newStore func(t *testing.T) Storage) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	write := func(t *testing.T, st Storage, name, contents string, opts *WriterOptions) error {
+		t.Helper()
+
+		if opts == nil {
+			opts = &WriterOptions{}
+		}
+		w := st.NewWriter(ctx, name, opts)
+		if _, err := io.WriteString(w, contents); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	}
+
+	read := func(t *testing.T, st Storage, name string, offset, length int64) string {
+		t.Helper()
+
+		r, err := st.NewReader(ctx, name, 0, offset, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	t.Run("not_exist", func(t *testing.T) {
+		st := newStore(t)
+
+		if _, err := st.Attrs(ctx, "missing", 0); !errors.Is(err, ErrObjectNotExist) {
+			t.Errorf("expected %v to be %v", err, ErrObjectNotExist)
+		}
+		if _, err := st.NewReader(ctx, "missing", 0, 0, -1); !errors.Is(err, ErrObjectNotExist) {
+			t.Errorf("expected %v to be %v", err, ErrObjectNotExist)
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		st := newStore(t)
+
+		if err := write(t, st, "dir/a", "hello world", &WriterOptions{
+			ContentType:  "text/plain",
+			CacheControl: "no-store",
+			Metadata:     map[string]string{"key": "value"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		attrs, err := st.Attrs(ctx, "dir/a", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Name != "dir/a" || attrs.Size != 11 {
+			t.Errorf("expected dir/a with 11 bytes, got %s with %d", attrs.Name, attrs.Size)
+		}
+		if attrs.ContentType != "text/plain" || attrs.CacheControl != "no-store" {
+			t.Errorf("expected headers to be kept, got %q and %q", attrs.ContentType, attrs.CacheControl)
+		}
+		if got, want := attrs.Metadata, map[string]string{"key": "value"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+
+		for _, tc := range []struct {
+			offset, length int64
+			want           string
+		}{
+			{0, -1, "hello world"},
+			{6, -1, "world"},
+			{0, 5, "hello"},
+			{4, 3, "o w"},
+			{0, 0, ""},
+		} {
+			if got := read(t, st, "dir/a", tc.offset, tc.length); got != tc.want {
+				t.Errorf("expected %d bytes at %d to be %q, got %q", tc.length, tc.offset, tc.want, got)
+			}
+		}
+	})
+
+	t.Run("chunks", func(t *testing.T) {
+		st := newStore(t)
+
+		// Larger than a single chunk, so stores which upload in parts do
+		contents := string(bytes.Repeat([]byte("0123456789abcdef"), 400*1024))
+		if err := write(t, st, "large", contents, &WriterOptions{ChunkSize: 5 * 1024 * 1024}); err != nil {
+			t.Fatal(err)
+		}
+		if got := read(t, st, "large", 0, -1); got != contents {
+			t.Errorf("expected %d bytes, got %d", len(contents), len(got))
+		}
+		if got, want := read(t, st, "large", 6*1024*1024-3, 6), contents[6*1024*1024-3:6*1024*1024+3]; got != want {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+	})
+
+	t.Run("does_not_exist", func(t *testing.T) {
+		st := newStore(t)
+
+		if err := write(t, st, "a", "first", &WriterOptions{DoesNotExist: true}); err != nil {
+			t.Fatal(err)
+		}
+		err := write(t, st, "a", "second", &WriterOptions{DoesNotExist: true})
+		if !errors.Is(err, ErrPreconditionFailed) {
+			t.Errorf("expected %v to be %v", err, ErrPreconditionFailed)
+		}
+		if got := read(t, st, "a", 0, -1); got != "first" {
+			t.Errorf("expected %q to be %q", got, "first")
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		st := newStore(t)
+
+		for _, name := range []string{"p/b", "p/a", "q"} {
+			if err := write(t, st, name, name, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		list, err := st.List(ctx, "p/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, attrs := range list {
+			got = append(got, attrs.Name)
+		}
+		sort.Strings(got)
+		if want := []string{"p/a", "p/b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		st := newStore(t)
+
+		if err := write(t, st, "a", "contents", &WriterOptions{
+			ContentType: "text/plain",
+			Metadata:    map[string]string{"keep": "1", "remove": "2"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := st.Attrs(ctx, "a", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := st.Update(ctx, "a", attrs.Generation, map[string]string{"remove": "", "add": "3"}); err != nil {
+			t.Fatal(err)
+		}
+
+		attrs, err = st.Attrs(ctx, "a", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := attrs.Metadata, map[string]string{"keep": "1", "add": "3"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+		if attrs.ContentType != "text/plain" {
+			t.Errorf("expected content type to be kept, got %q", attrs.ContentType)
+		}
+		if got := read(t, st, "a", 0, -1); got != "contents" {
+			t.Errorf("expected %q to be %q", got, "contents")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		st := newStore(t)
+
+		if err := write(t, st, "a", "contents", nil); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := st.Attrs(ctx, "a", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := st.Delete(ctx, "a", attrs.Generation); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.Attrs(ctx, "a", 0); !errors.Is(err, ErrObjectNotExist) {
+			t.Errorf("expected %v to be %v", err, ErrObjectNotExist)
+		}
+	})
+}
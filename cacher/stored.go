@@ -0,0 +1,101 @@
+package cacher
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// zstdRawBlockSize is the size of each raw block in a stored zstd frame, which
+// is also the frame's window size.
+const zstdRawBlockSize = 128 * 1024
+
+// storable returns true if data can be stored without compression in archives
+// with the compression, while remaining a valid stream.
+func (c Compression) storable() bool {
+	switch c {
+	case "", CompressionGzip, CompressionZstd:
+		return true
+	default:
+		return false
+	}
+}
+
+// newStoreWriter returns a writer which writes a single segment in the format
+// of the compression, but without compressing the data.
+func newStoreWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case "", CompressionGzip:
+		gzw, err := gzip.NewWriterLevel(w, gzip.NoCompression)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip writer: %w", err)
+		}
+		return gzw, nil
+	case CompressionZstd:
+		return &zstdStoreWriter{w: w, buf: make([]byte, 0, zstdRawBlockSize)}, nil
+	default:
+		return nil, fmt.Errorf("cannot store data with %s compression", c)
+	}
+}
+
+// zstdStoreWriter writes a zstd frame made of raw blocks.
+type zstdStoreWriter struct {
+	w       io.Writer
+	buf     []byte
+	started bool
+}
+
+// Write buffers p, writing each block once it is full.
+func (z *zstdStoreWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		l := zstdRawBlockSize - len(z.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		z.buf = append(z.buf, p[:l]...)
+		p = p[l:]
+		n += l
+
+		if len(z.buf) == zstdRawBlockSize {
+			if err := z.block(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last block, finishing the frame.
+func (z *zstdStoreWriter) Close() error {
+	return z.block(true)
+}
+
+// block writes the buffered data as a raw block, starting the frame first if
+// needed.
+func (z *zstdStoreWriter) block(last bool) error {
+	if !z.started {
+		// The magic number, a frame header descriptor without a content size,
+		// checksum, or dictionary, and a window descriptor for 128KiB
+		header := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x38}
+		if _, err := z.w.Write(header); err != nil {
+			return err
+		}
+		z.started = true
+	}
+
+	// The block header holds the last block flag, the raw block type of zero,
+	// and the size, in little-endian order
+	v := uint32(len(z.buf)) << 3
+	if last {
+		v |= 1
+	}
+	if _, err := z.w.Write([]byte{byte(v), byte(v >> 8), byte(v >> 16)}); err != nil {
+		return err
+	}
+	if _, err := z.w.Write(z.buf); err != nil {
+		return err
+	}
+	z.buf = z.buf[:0]
+	return nil
+}
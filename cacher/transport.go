@@ -0,0 +1,119 @@
+package cacher
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// googleAccessDomains are the domains of the virtual IPs for Private Google
+// Access, by name.
+var googleAccessDomains = map[string]string{
+	"private":    "private.googleapis.com",
+	"restricted": "restricted.googleapis.com",
+}
+
+// newTransport creates the transport for HTTP requests, which uses the proxy
+// and trusts the PEM-encoded certificates in addition to the system's. If
+// googleAccess is set, connections to Google APIs are made to the virtual IPs
+// for Private Google Access instead. It returns nil if none are set, so the
+// default transport is used.
+func newTransport(proxy string, caCerts []byte, googleAccess string) (*http.Transport, error) {
+	if proxy == "" && len(caCerts) == 0 && googleAccess == "" {
+		return nil, nil
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if googleAccess != "" {
+		domain, ok := googleAccessDomains[googleAccess]
+		if !ok {
+			return nil, fmt.Errorf("invalid private google access %q, expected private or restricted", googleAccess)
+		}
+
+		// Only the connection goes to the virtual IPs, requests and TLS still
+		// use the name of the API, so certificates are verified as usual
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, port, err := net.SplitHostPort(addr); err == nil && isGoogleAPI(host) {
+				addr = net.JoinHostPort(domain, port)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy %q: %w", proxy, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			return nil, fmt.Errorf("proxy %q must be an http, https, or socks5 URL", proxy)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	if len(caCerts) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caCerts) {
+			return nil, fmt.Errorf("failed to parse CA certificates, expected PEM")
+		}
+		t.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	return t, nil
+}
+
+// isGoogleAPI returns true if the host serves Google APIs, which are reachable
+// through the virtual IPs for Private Google Access. This includes registries,
+// which are also served from the virtual IPs.
+func isGoogleAPI(host string) bool {
+	return strings.HasSuffix(host, ".googleapis.com") || isGoogleRegistry(host)
+}
+
+// roundTripper returns the transport for HTTP requests to storage other than
+// Cloud Storage.
+func (c *Cacher) roundTripper() http.RoundTripper {
+	if c.transport == nil {
+		return http.DefaultTransport
+	}
+	return c.transport
+}
+
+// googleOptions returns the options for creating Google Cloud clients. With a
+// custom transport, clients send requests through it, authenticated with the
+// credentials from the options, and tokens are fetched through it too.
+func (c *Cacher) googleOptions(ctx context.Context) ([]option.ClientOption, error) {
+	if c.transport == nil {
+		return c.opts, nil
+	}
+
+	opts := c.opts[:len(c.opts):len(c.opts)]
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+		// Emulators do not authenticate requests
+		opts = append(opts, option.WithoutAuthentication())
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: c.transport})
+	rt, err := htransport.NewTransport(ctx, c.transport, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transport: %w", err)
+	}
+	return append(opts, option.WithHTTPClient(&http.Client{Transport: rt})), nil
+}
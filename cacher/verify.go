@@ -0,0 +1,107 @@
+package cacher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// sha256MetadataKey is the object metadata key which holds the hex-encoded
+// SHA256 digest of the object's contents.
+const sha256MetadataKey = "gcs-cacher-sha256"
+
+// VerifyRequest is used as input to the verify method.
+type VerifyRequest struct {
+	// Bucket is the name of the bucket which holds the cache.
+	Bucket string
+
+	// Key is the name of the object to verify.
+	Key string
+}
+
+// Verify downloads the cached object and confirms that its contents match the
+// CRC32C computed by the store, if it has one, and the SHA256 recorded when it
+// was saved, without extracting it. Objects saved before digests were recorded
+// are only checked against the CRC32C.
+func (c *Cacher) Verify(ctx context.Context, i *VerifyRequest) (retErr error) {
+	if i == nil {
+		retErr = fmt.Errorf("missing verify options")
+		return
+	}
+
+	bucket := i.Bucket
+	if bucket == "" {
+		retErr = fmt.Errorf("missing bucket")
+		return
+	}
+
+	key := i.Key
+	if key == "" {
+		retErr = fmt.Errorf("missing key")
+		return
+	}
+
+	st, err := c.bucket(ctx, bucket)
+	if err != nil {
+		retErr = err
+		return
+	}
+	attrs, err := st.Attrs(ctx, key, 0)
+	if err != nil {
+		retErr = fmt.Errorf("failed to get object attributes: %w", err)
+		return
+	}
+
+	// Read the generation which was found, even if the object is overwritten
+	r, err := st.NewReader(ctx, key, attrs.Generation, 0, -1)
+	if err != nil {
+		retErr = fmt.Errorf("failed to create object reader: %w", err)
+		return
+	}
+	defer func() {
+		if cerr := r.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: failed to close object reader: %w", retErr, cerr)
+				return
+			}
+			retErr = fmt.Errorf("failed to close object reader: %w", cerr)
+		}
+	}()
+
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	digest := sha256.New()
+	c.log("reading %s", key)
+	n, err := c.copyBuffered(io.MultiWriter(crc, digest), r)
+	if err != nil {
+		retErr = fmt.Errorf("failed to read object: %w", err)
+		return
+	}
+
+	if n != attrs.Size {
+		retErr = fmt.Errorf("read %d bytes, expected %d", n, attrs.Size)
+		return
+	}
+
+	if attrs.HasCRC32C {
+		if got := crc.Sum32(); got != attrs.CRC32C {
+			retErr = fmt.Errorf("object has CRC32C %08x, expected %08x", got, attrs.CRC32C)
+			return
+		}
+		c.log("verified CRC32C %08x", attrs.CRC32C)
+	}
+
+	want, ok := attrs.Metadata[sha256MetadataKey]
+	if !ok {
+		c.log("object does not have a recorded SHA256")
+		return
+	}
+	if got := hex.EncodeToString(digest.Sum(nil)); got != want {
+		retErr = fmt.Errorf("object has SHA256 %s, expected %s", got, want)
+		return
+	}
+	c.log("verified SHA256 %s", want)
+	return
+}
@@ -0,0 +1,104 @@
+package cacher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// walkFunc is called for each file found by the walker. The name is the path
+// to the file on disk and rel is the path relative to the root of the walk,
+// using forward slashes. The root itself is visited with an empty rel.
+type walkFunc func(name, rel string, fi os.FileInfo) error
+
+// walker walks a directory tree in lexical order.
+type walker struct {
+	c *Cacher
+
+	// dereference follows symlinks and visits their targets instead.
+	dereference bool
+
+	// oneFileSystem does not descend into directories on a different device
+	// than the root, like mount points. The directories themselves are still
+	// visited.
+	oneFileSystem bool
+
+	// dev is the device of the root.
+	dev uint64
+}
+
+// walk walks the tree rooted at root, calling fn for each file or directory.
+// The root is always resolved, even if it is a symlink. If fn returns
+// filepath.SkipDir for a directory, its contents are skipped.
+func (w *walker) walk(root string, fn walkFunc) error {
+	fi, err := os.Stat(longPath(root))
+	if err != nil {
+		return err
+	}
+	if w.oneFileSystem {
+		w.dev, _ = deviceID(fi)
+	}
+	return w.walkOne(root, "", fi, nil, fn)
+}
+
+func (w *walker) walkOne(name, rel string, fi os.FileInfo, parents []os.FileInfo, fn walkFunc) error {
+	c := w.c
+	c.log("walking file %s", name)
+
+	if w.dereference && fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Stat(longPath(name))
+		if err != nil {
+			return fmt.Errorf("failed to follow symlink %s: %w", name, err)
+		}
+
+		// Following a link to a parent directory would recurse forever
+		for _, parent := range parents {
+			if os.SameFile(parent, target) {
+				c.log("skipping %s (symlink loop)", name)
+				return nil
+			}
+		}
+		fi = target
+	}
+
+	if err := fn(name, rel, fi); err != nil {
+		if err == filepath.SkipDir && fi.IsDir() {
+			return nil
+		}
+		return err
+	}
+
+	if !fi.IsDir() {
+		return nil
+	}
+
+	if w.oneFileSystem {
+		if dev, ok := deviceID(fi); ok && dev != w.dev {
+			c.log("not descending into %s (different file system)", name)
+			return nil
+		}
+	}
+
+	entries, err := os.ReadDir(longPath(name))
+	if err != nil {
+		return err
+	}
+
+	parents = append(parents, fi)
+	for _, entry := range entries {
+		child, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		childRel := entry.Name()
+		if rel != "" {
+			childRel = rel + "/" + childRel
+		}
+
+		if err := w.walkOne(filepath.Join(name, entry.Name()), childRel, child, parents, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
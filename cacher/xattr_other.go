@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package cacher
+
+import (
+	"fmt"
+)
+
+// readXattrs is not supported on this platform.
+func readXattrs(name string) (map[string]string, error) {
+	return nil, fmt.Errorf("extended attributes are not supported on this platform")
+}
+
+// writeXattrs is not supported on this platform.
+func writeXattrs(name string, attrs map[string]string) error {
+	return fmt.Errorf("extended attributes are not supported on this platform")
+}
@@ -0,0 +1,64 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package cacher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of the file at name, without
+// following symlinks. On Linux, this includes POSIX ACLs, which are stored as
+// extended attributes.
+func readXattrs(name string) (map[string]string, error) {
+	size, err := unix.Llistxattr(name, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list extended attributes: %w", err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(name, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list extended attributes: %w", err)
+	}
+
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(string(buf[:size]), "\x00") {
+		if attr == "" {
+			continue
+		}
+
+		vsize, err := unix.Lgetxattr(name, attr, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get extended attribute %s: %w", attr, err)
+		}
+		val := make([]byte, vsize)
+		vsize, err = unix.Lgetxattr(name, attr, val)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get extended attribute %s: %w", attr, err)
+		}
+		attrs[attr] = string(val[:vsize])
+	}
+	return attrs, nil
+}
+
+// writeXattrs sets the given extended attributes on the file at name, without
+// following symlinks.
+func writeXattrs(name string, attrs map[string]string) error {
+	for attr, val := range attrs {
+		if err := unix.Lsetxattr(name, attr, []byte(val), 0); err != nil {
+			return fmt.Errorf("failed to set extended attribute %s: %w", attr, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sethvargo/gcs-cacher/cacher"
+)
+
+// command is a subcommand of the CLI. Each command has its own flag set, with
+// the flags it uses.
+type command struct {
+	name string
+
+	// args describes the arguments after the flags, and help what the command
+	// does.
+	args string
+	help string
+
+	// flags are the names of the flags of the command, in addition to the
+	// client and runtime flags which every command has.
+	flags []string
+
+	// usages replaces the help of flags which is written for saving and
+	// restoring alike, like -bucket, with help for this command.
+	usages map[string]string
+
+	// run runs the command with the arguments which remain after the flags.
+	run func(ctx context.Context, c *cacher.Cacher, args []string) error
+}
+
+// bucketUsage is the help of -bucket for commands which use a single bucket.
+const bucketUsage = "Bucket name without gs:// prefix, an s3://, azblob://, or oci:// URL, or a file:// URL of a directory."
+
+var (
+	// clientFlags configure how Google Cloud and other storage is accessed.
+	clientFlags = []string{
+		"grpc", "endpoint", "credentials-file", "external-account-config", "access-token",
+		"hmac-access-id", "hmac-secret", "no-auth", "impersonate-service-account",
+		"billing-project", "proxy", "ca-file", "private-google-access",
+	}
+
+	// runtimeFlags control how the command runs.
+	runtimeFlags = []string{
+		"debug", "allow-failure", "timeout", "concurrency", "buffer-size", "memory-limit", "hash-cache",
+	}
+
+	commands = []*command{
+		{
+			name: "save",
+			args: "KEY",
+			help: "Save the directory to the cache with the key.",
+			flags: []string{
+				"bucket", "dir", "compression", "compression-level", "compression-workers", "format",
+				"index", "update", "force", "chunk-size", "disable-buffering", "parallel-uploads",
+				"part-size", "state-file", "lookup-timeout", "transfer-timeout", "lock", "lock-ttl",
+				"external-compressor", "store-incompressible", "xattrs", "sparse", "dereference",
+				"normalize", "strict", "warn-skipped", "prefix", "one-file-system", "respect-gitignore",
+				"include", "exclude", "marker", "deny-secrets", "secret", "exclude-secrets",
+				"encryption-key-file", "kms-key", "signing-key", "provenance", "builder-id", "source-uri",
+				"source-commit", "manifest", "metadata", "temporary-hold", "event-based-hold",
+				"content-type", "cache-control", "content-encoding", "create-bucket", "project",
+				"location", "storage-class", "uniform-access",
+			},
+			usages: map[string]string{
+				"bucket":           "Bucket name without gs:// prefix, an s3://, azblob://, or oci:// URL, a file:// URL of a directory, or a signed URL of the cache (can use multiple times to save to each).",
+				"dir":              "Directory to cache.",
+				"compression":      "Compression algorithm (gzip, zstd, lz4, none) (defaults to gzip).",
+				"format":           "Archive format (tar, zip) (defaults to tar).",
+				"lookup-timeout":   "Maximum time to check for the cached object (defaults to unlimited).",
+				"transfer-timeout": "Maximum time to create and upload the archive (defaults to unlimited).",
+				"xattrs":           "Save extended attributes and POSIX ACLs.",
+				"sparse":           "Store only the blocks with data of sparse files, like VM images.",
+				"provenance":       "Record a provenance attestation.",
+				"builder-id":       "Builder identity recorded in provenance.",
+				"marker":           "File within the directory which records the restored object, which is not saved.",
+			},
+			run: runSave,
+		},
+		{
+			name: "restore",
+			args: "KEY...",
+			help: "Restore the best match for the keys into the directory.",
+			flags: []string{
+				"bucket", "dir", "compression", "format", "generation", "first-match", "check", "dry-run",
+				"path", "subpath", "strip-components", "map", "clean", "skip-if-present", "marker",
+				"max-bytes", "max-files", "umask", "file-mode", "dir-mode", "parallel-downloads",
+				"slice-size", "extract-workers", "lookup-timeout", "transfer-timeout", "disable-touch",
+				"external-compressor", "preserve-owner", "xattrs", "sparse", "normalize",
+				"case-collisions", "encryption-key-file", "require-kms-key", "trusted-creator",
+				"verify-key", "provenance", "builder-id", "verify-manifest",
+			},
+			usages: map[string]string{
+				"bucket":              "Bucket name without gs:// prefix, an s3://, azblob://, or oci:// URL, a file:// URL of a directory, a signed URL of the cache, or an https:// URL (can use multiple times to restore from the first with a match).",
+				"dir":                 "Directory into which to restore.",
+				"compression":         "Compression algorithm of the archive (gzip, zstd, lz4, none) (defaults to detecting it).",
+				"format":              "Archive format (tar, zip) (defaults to detecting it).",
+				"generation":          "Restore a specific generation of the object named by the key.",
+				"lookup-timeout":      "Maximum time to find the cached object (defaults to unlimited).",
+				"transfer-timeout":    "Maximum time to download and extract the cache (defaults to unlimited).",
+				"external-compressor": "Use pigz, zstd, or lz4 binaries for decompression when installed.",
+				"xattrs":              "Restore extended attributes and POSIX ACLs.",
+				"sparse":              "Write blocks of zeros in sparse files, like VM images, as holes.",
+				"encryption-key-file": "File with the 32-byte key (raw or base64) with which archives were encrypted client-side.",
+				"provenance":          "Require a provenance attestation signed by the -verify-key.",
+				"builder-id":          "Builder identity required in provenance.",
+			},
+			run: runRestore,
+		},
+		{
+			name:  "verify",
+			args:  "KEY",
+			help:  "Verify the cache with the key is intact without restoring it.",
+			flags: []string{"bucket"},
+			usages: map[string]string{
+				"bucket": bucketUsage,
+			},
+			run: runVerify,
+		},
+		{
+			name:  "generations",
+			args:  "KEY",
+			help:  "List the generations of the cache with the key, including noncurrent generations in versioned buckets.",
+			flags: []string{"bucket"},
+			usages: map[string]string{
+				"bucket": bucketUsage,
+			},
+			run: runGenerations,
+		},
+		{
+			name:  "rollback",
+			args:  "KEY",
+			help:  "Roll the cache with the key back to the noncurrent generation, or undelete it.",
+			flags: []string{"bucket", "generation"},
+			usages: map[string]string{
+				"bucket":     bucketUsage,
+				"generation": "Noncurrent generation to roll back to.",
+			},
+			run: runRollback,
+		},
+		{
+			name:  "sign",
+			args:  "KEY",
+			help:  "Print a signed URL of the cache with the key, so it can be downloaded without credentials.",
+			flags: []string{"bucket", "expires"},
+			usages: map[string]string{
+				"bucket": bucketUsage,
+			},
+			run: runSign,
+		},
+		{
+			name:  "release",
+			args:  "KEY",
+			help:  "Release the holds on the cache with the key, so it can be deleted or replaced.",
+			flags: []string{"bucket"},
+			usages: map[string]string{
+				"bucket": bucketUsage,
+			},
+			run: runRelease,
+		},
+		{
+			name:  "lifecycle",
+			help:  "Configure lifecycle rules on the bucket which delete unused caches and incomplete uploads.",
+			flags: []string{"bucket", "lifecycle-days"},
+			usages: map[string]string{
+				"bucket": bucketUsage,
+			},
+			run: runLifecycle,
+		},
+		{
+			name:  "bench",
+			help:  "Benchmark compressing a sample of the directory with each compression and level.",
+			flags: []string{"dir", "sample-size", "compression-workers", "include", "exclude", "respect-gitignore"},
+			usages: map[string]string{
+				"dir":               "Directory to sample.",
+				"include":           "Glob pattern of paths to include in the sample, excluding everything else (can use multiple times).",
+				"exclude":           "Glob pattern of paths to exclude from the sample (can use multiple times).",
+				"respect-gitignore": "Skip files which git would ignore.",
+			},
+			run: runBench,
+		},
+	}
+)
+
+// findCommand returns the command with the name, or nil if there is none.
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// flagSet returns the flag set with the flags of the command. Errors are not
+// printed by the flag set, since they are returned.
+func (cmd *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	for _, lists := range [][]string{cmd.flags, clientFlags, runtimeFlags} {
+		for _, name := range lists {
+			flagDefs[name](fs)
+		}
+	}
+	for name, usage := range cmd.usages {
+		fs.Lookup(name).Usage = usage
+	}
+
+	fs.Usage = func() {
+		synopsis := "gcs-cacher " + cmd.name + " [flags]"
+		if cmd.args != "" {
+			synopsis += " " + cmd.args
+		}
+		fmt.Fprintf(stderr, "Usage: %s\n\n%s\n\nFlags:\n", synopsis, cmd.help)
+		fs.SetOutput(stderr)
+		fs.PrintDefaults()
+		fs.SetOutput(io.Discard)
+	}
+	return fs
+}
+
+// parseArgs parses the flags, which may come before or after the other
+// arguments, like "save -bucket my-bucket go -dir pkg", and returns the other
+// arguments. Everything after "--" is an argument.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		remaining := fs.Args()
+		if len(remaining) == 0 {
+			return rest, nil
+		}
+		if consumed := len(args) - len(remaining); consumed > 0 && args[consumed-1] == "--" {
+			return append(rest, remaining...), nil
+		}
+		rest = append(rest, remaining[0])
+		args = remaining[1:]
+	}
+}
+
+// usage prints the commands to stderr.
+func usage() {
+	fmt.Fprintf(stderr, "Usage: gcs-cacher COMMAND [flags] [arguments]\n\nCommands:\n")
+	tw := tabwriter.NewWriter(stderr, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.help)
+	}
+	tw.Flush()
+	fmt.Fprintf(stderr, "\nRun \"gcs-cacher help COMMAND\" for the flags of a command.\n")
+}
+
+// help prints the usage of the command named in args, or of every command.
+func help(args []string) error {
+	if len(args) == 0 {
+		usage()
+		return nil
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	cmd.flagSet().Usage()
+	return nil
+}
+
+// oneKey returns the key, which is the only argument.
+func oneKey(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("expected exactly one key")
+	}
+	return args[0], nil
+}
+
+// archiveFlags are the parsed flags which describe archives.
+type archiveFlags struct {
+	compression    cacher.Compression
+	format         cacher.Format
+	normalization  cacher.Normalization
+	caseCollisions cacher.CaseCollisions
+	encryptionKey  []byte
+}
+
+// parseArchiveFlags parses the flags which describe archives, which saving and
+// restoring share.
+func parseArchiveFlags() (*archiveFlags, error) {
+	var af archiveFlags
+	var err error
+
+	if af.compression, err = cacher.ParseCompression(compression); err != nil {
+		return nil, err
+	}
+	if af.format, err = cacher.ParseFormat(format); err != nil {
+		return nil, err
+	}
+	if af.normalization, err = cacher.ParseNormalization(normalize); err != nil {
+		return nil, err
+	}
+	if af.caseCollisions, err = cacher.ParseCaseCollisions(caseCollisions); err != nil {
+		return nil, err
+	}
+
+	if encryptionKeyFile != "" {
+		b, err := os.ReadFile(encryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key: %w", err)
+		}
+		af.encryptionKey, err = cacher.ParseEncryptionKey(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &af, nil
+}
+
+func runSave(ctx context.Context, c *cacher.Cacher, args []string) error {
+	key, err := oneKey(args)
+	if err != nil {
+		return err
+	}
+
+	af, err := parseArchiveFlags()
+	if err != nil {
+		return err
+	}
+
+	parsed, err := parseTemplate(c, key)
+	if err != nil {
+		return err
+	}
+
+	if createBucket {
+		for _, b := range buckets {
+			if err := c.CreateBucket(ctx, &cacher.CreateBucketRequest{
+				Bucket:        b,
+				Project:       project,
+				Location:      location,
+				StorageClass:  storageClass,
+				UniformAccess: uniformAccess,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	var prov *cacher.Provenance
+	if provenance {
+		prov = &cacher.Provenance{
+			BuilderID:    builderID,
+			SourceURI:    sourceURI,
+			SourceCommit: sourceCommit,
+		}
+	}
+
+	objectMetadata := make(map[string]string, len(metadata))
+	for _, m := range metadata {
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid metadata %q, expected key=value", m)
+		}
+		objectMetadata[parts[0]] = parts[1]
+	}
+
+	var secretPatterns []string
+	if denySecrets {
+		secretPatterns = append(secretPatterns, cacher.DefaultSecretPatterns...)
+	}
+	secretPatterns = append(secretPatterns, secrets...)
+
+	bucket, replicas := splitBuckets()
+
+	if err := c.Save(ctx, &cacher.SaveRequest{
+		Bucket:   bucket,
+		Replicas: replicas,
+		Dir:      dir,
+		Key:      parsed,
+
+		Compression:         af.compression,
+		CompressionWorkers:  compressionWorkers,
+		CompressionLevel:    compressionLevel,
+		Format:              af.format,
+		Index:               index,
+		Update:              update,
+		Force:               force,
+		ChunkSize:           chunkSize,
+		DisableBuffering:    disableBuffering,
+		ParallelUploads:     parallelUploads,
+		PartSize:            partSize,
+		StateFile:           stateFile,
+		LookupTimeout:       lookupTimeout,
+		TransferTimeout:     transferTimeout,
+		Lock:                lock,
+		LockTTL:             lockTTL,
+		ExternalCompressor:  externalCompressor,
+		StoreIncompressible: storeIncompressible,
+		Xattrs:              xattrs,
+		Sparse:              sparse,
+		Dereference:         dereference,
+		Normalization:       af.normalization,
+		Strict:              strict,
+		WarnSkipped:         warnSkipped,
+		Prefix:              prefix,
+		OneFileSystem:       oneFileSystem,
+		EncryptionKey:       af.encryptionKey,
+		KMSKey:              kmsKey,
+		SigningKey:          signingKey,
+		Provenance:          prov,
+		Manifest:            manifest,
+		Metadata:            objectMetadata,
+		TemporaryHold:       temporaryHold,
+		EventBasedHold:      eventBasedHold,
+		ContentType:         contentType,
+		CacheControl:        cacheControl,
+		ContentEncoding:     contentEncoding,
+		RespectGitignore:    respectGitignore,
+		Include:             include,
+		Exclude:             exclude,
+		Marker:              marker,
+		Secrets:             secretPatterns,
+		ExcludeSecrets:      excludeSecrets,
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "finished saving cache\n")
+	return nil
+}
+
+func runRestore(ctx context.Context, c *cacher.Cacher, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected at least one key")
+	}
+
+	af, err := parseArchiveFlags()
+	if err != nil {
+		return err
+	}
+
+	bucket, fallbacks := splitBuckets()
+
+	keys := make([]string, len(args))
+	for i, key := range args {
+		parsed, err := parseTemplate(c, key)
+		if err != nil {
+			return err
+		}
+		keys[i] = parsed
+	}
+
+	if check {
+		name, err := c.Lookup(ctx, &cacher.LookupRequest{
+			Bucket:     bucket,
+			Fallbacks:  fallbacks,
+			Keys:       keys,
+			FirstMatch: firstMatch,
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(stdout, "cache hit: %s\n", name)
+		return nil
+	}
+
+	umaskMode, err := parseMode("umask", umask)
+	if err != nil {
+		return err
+	}
+	forcedFileMode, err := parseMode("file mode", fileMode)
+	if err != nil {
+		return err
+	}
+	forcedDirMode, err := parseMode("directory mode", dirMode)
+	if err != nil {
+		return err
+	}
+
+	dirMappings := make(map[string]string, len(mappings))
+	for _, m := range mappings {
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid mapping %q, expected prefix=dir", m)
+		}
+		dirMappings[parts[0]] = parts[1]
+	}
+
+	if err := c.Restore(ctx, &cacher.RestoreRequest{
+		Bucket:    bucket,
+		Fallbacks: fallbacks,
+		Dir:       dir,
+		Keys:      keys,
+
+		Compression:         af.compression,
+		Format:              af.format,
+		Generation:          generation,
+		FirstMatch:          firstMatch,
+		Paths:               paths,
+		Subpath:             subpath,
+		StripComponents:     stripComponents,
+		Mappings:            dirMappings,
+		Clean:               clean,
+		SkipIfPresent:       skipIfPresent,
+		Marker:              marker,
+		EncryptionKey:       af.encryptionKey,
+		RequireKMSKey:       requireKMSKey,
+		TrustedCreators:     trustedCreators,
+		VerifyKey:           verifyKey,
+		RequireProvenance:   provenance,
+		ProvenanceBuilderID: builderID,
+		VerifyManifest:      verifyManifest,
+		MaxBytes:            maxBytes,
+		ParallelDownloads:   parallelDownloads,
+		SliceSize:           sliceSize,
+		ExtractWorkers:      extractWorkers,
+		LookupTimeout:       lookupTimeout,
+		TransferTimeout:     transferTimeout,
+		MaxFiles:            maxFiles,
+		Umask:               umaskMode,
+		FileMode:            forcedFileMode,
+		DirMode:             forcedDirMode,
+		DryRun:              dryRun,
+		DisableTouch:        disableTouch,
+		ExternalCompressor:  externalCompressor,
+		PreserveOwner:       preserveOwner,
+		Xattrs:              xattrs,
+		Sparse:              sparse,
+		Normalization:       af.normalization,
+		CaseCollisions:      af.caseCollisions,
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "finished restoring cache\n")
+	return nil
+}
+
+func runVerify(ctx context.Context, c *cacher.Cacher, args []string) error {
+	key, err := oneKey(args)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := singleBucket()
+	if err != nil {
+		return err
+	}
+
+	parsed, err := parseTemplate(c, key)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Verify(ctx, &cacher.VerifyRequest{
+		Bucket: bucket,
+		Key:    parsed,
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "cache is intact\n")
+	return nil
+}
+
+func runRelease(ctx context.Context, c *cacher.Cacher, args []string) error {
+	key, err := oneKey(args)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := singleBucket()
+	if err != nil {
+		return err
+	}
+
+	parsed, err := parseTemplate(c, key)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Release(ctx, &cacher.ReleaseRequest{
+		Bucket: bucket,
+		Key:    parsed,
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "released cache\n")
+	return nil
+}
+
+func runGenerations(ctx context.Context, c *cacher.Cacher, args []string) error {
+	key, err := oneKey(args)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := singleBucket()
+	if err != nil {
+		return err
+	}
+
+	parsed, err := parseTemplate(c, key)
+	if err != nil {
+		return err
+	}
+
+	list, err := c.Generations(ctx, &cacher.GenerationsRequest{
+		Bucket: bucket,
+		Key:    parsed,
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "GENERATION\tUPDATED\tSIZE\tSTATE\n")
+	for _, attrs := range list {
+		state := "live"
+		if !attrs.Deleted.IsZero() {
+			state = "noncurrent since " + attrs.Deleted.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\n", attrs.Generation, attrs.Updated.UTC().Format(time.RFC3339), attrs.Size, state)
+	}
+	return tw.Flush()
+}
+
+func runRollback(ctx context.Context, c *cacher.Cacher, args []string) error {
+	key, err := oneKey(args)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := singleBucket()
+	if err != nil {
+		return err
+	}
+
+	parsed, err := parseTemplate(c, key)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := c.Rollback(ctx, &cacher.RollbackRequest{
+		Bucket:     bucket,
+		Key:        parsed,
+		Generation: generation,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "rolled back to generation %d as generation %d\n", generation, attrs.Generation)
+	return nil
+}
+
+func runSign(ctx context.Context, c *cacher.Cacher, args []string) error {
+	key, err := oneKey(args)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := singleBucket()
+	if err != nil {
+		return err
+	}
+
+	parsed, err := parseTemplate(c, key)
+	if err != nil {
+		return err
+	}
+
+	u, err := c.SignURL(ctx, &cacher.SignURLRequest{
+		Bucket:  bucket,
+		Key:     parsed,
+		Expires: expires,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "%s\n", u)
+	return nil
+}
+
+func runLifecycle(ctx context.Context, c *cacher.Cacher, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("no arguments expected")
+	}
+
+	bucket, err := singleBucket()
+	if err != nil {
+		return err
+	}
+
+	if err := c.ConfigureLifecycle(ctx, &cacher.LifecycleRequest{
+		Bucket: bucket,
+		Days:   lifecycleDays,
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "configured lifecycle rules\n")
+	return nil
+}
+
+func runBench(ctx context.Context, c *cacher.Cacher, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("no arguments expected")
+	}
+
+	results, err := c.Bench(ctx, &cacher.BenchRequest{
+		Dir:                dir,
+		SampleSize:         sampleSize,
+		CompressionWorkers: compressionWorkers,
+		Include:            include,
+		Exclude:            exclude,
+		RespectGitignore:   respectGitignore,
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "COMPRESSION\tLEVEL\tSIZE\tRATIO\tCOMPRESS\tDECOMPRESS\n")
+	for _, r := range results {
+		level := "default"
+		if r.Level != 0 {
+			level = strconv.Itoa(r.Level)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.3f\t%s\t%s\n", r.Compression, level, r.Size, r.Ratio(),
+			r.CompressTime.Round(time.Millisecond), r.DecompressTime.Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
@@ -7,8 +7,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/sethvargo/gcs-cacher/cacher"
 	"github.com/sethvargo/go-signalcontext"
@@ -19,8 +21,13 @@ var (
 	stdout = os.Stdout
 	stderr = os.Stderr
 
-	// bucket is the Cloud Storage bucket.
-	bucket string
+	// buckets is the list of buckets. Each is a Cloud Storage bucket, an s3://
+	// URL of an S3 bucket, an azblob:// URL of an Azure container, an oci://
+	// URL of a registry repository, a file:// URL of a directory, a signed URL
+	// of the cached object, or an https:// URL to restore from without
+	// credentials. Saves are replicated to every bucket, and restores use the
+	// first bucket with a match.
+	buckets repeatedFlag
 
 	// cache is the key to use to cache.
 	cache string
@@ -28,6 +35,38 @@ var (
 	// restore is the list of restore keys to use to restore.
 	restore stringSliceFlag
 
+	// verify is the key of the cache to verify.
+	verify string
+
+	// release is the key of the cache on which to release holds.
+	release string
+
+	// generations is the key of the cache of which to list the generations,
+	// and rollback is the key of the cache to roll back to generation.
+	generations string
+	rollback    string
+
+	// sign is the key of the cache for which to create a signed URL which is
+	// valid for expires.
+	sign    string
+	expires time.Duration
+
+	// temporaryHold and eventBasedHold place holds on saved caches.
+	temporaryHold  bool
+	eventBasedHold bool
+
+	// bench benchmarks compression of the directory, using sampleSize bytes.
+	bench      bool
+	sampleSize int64
+
+	// lifecycle configures lifecycle rules on the bucket which delete caches
+	// after lifecycleDays without being saved or restored.
+	lifecycle     bool
+	lifecycleDays int
+
+	// compressionLevel is the compression level.
+	compressionLevel int
+
 	// allowFailure allows a command to fail.
 	allowFailure bool
 
@@ -38,26 +77,624 @@ var (
 	// hash is the glob pattern to hash.
 	hash string
 
+	// compression is the compression algorithm for the archive.
+	compression string
+
+	// compressionWorkers is the number of goroutines to use for compression.
+	compressionWorkers int
+
+	// format is the archive format.
+	format string
+
+	// chunkSize is the size of each request in a resumable upload.
+	chunkSize int
+
+	// disableBuffering uploads in a single request.
+	disableBuffering bool
+
+	// parallelUploads is the number of parts uploaded at once.
+	parallelUploads int
+
+	// partSize is the size of each part of a parallel upload.
+	partSize int
+
+	// parallelDownloads is the number of ranges downloaded at once.
+	parallelDownloads int
+
+	// sliceSize is the size of each range of a parallel download.
+	sliceSize int64
+
+	// extractWorkers is the number of goroutines which write restored files.
+	extractWorkers int
+
+	// stateFile records the progress of uploads so they can be resumed.
+	stateFile string
+
+	// lock acquires a lock on the key before saving.
+	lock bool
+
+	// lockTTL is how long the lock is held if it is not released.
+	lockTTL time.Duration
+
+	// force replaces an existing cache.
+	force bool
+
+	// update replaces an existing cache if its contents changed.
+	update bool
+
+	// index writes an index of the archive when saving.
+	index bool
+
+	// paths is the list of paths within the archive to restore.
+	paths repeatedFlag
+
+	// subpath is the directory within the archive to restore.
+	subpath string
+
+	// stripComponents is the number of leading path components to remove when
+	// restoring.
+	stripComponents int
+
+	// mappings is the list of prefix=dir pairs for restoring parts of the
+	// archive to other directories.
+	mappings repeatedFlag
+
+	// metadata is the list of key=value pairs of custom metadata for saved
+	// caches.
+	metadata repeatedFlag
+
+	// contentType, cacheControl, and contentEncoding are the HTTP headers of
+	// saved caches.
+	contentType     string
+	cacheControl    string
+	contentEncoding string
+
+	// clean removes the contents of the directory before restoring.
+	clean bool
+
+	// skipIfPresent skips restoring if the cache is already present.
+	skipIfPresent bool
+
+	// marker is the file which records the restored object.
+	marker string
+
+	// maxBytes and maxFiles limit the size and number of restored files.
+	maxBytes int64
+	maxFiles int64
+
+	// umask, fileMode, and dirMode control the permissions of restored files, as
+	// octal strings.
+	umask    string
+	fileMode string
+	dirMode  string
+
+	// generation is the object generation to restore.
+	generation int64
+
+	// firstMatch searches restore keys strictly in order.
+	firstMatch bool
+
+	// check reports whether the restore keys match a cached object without
+	// restoring it.
+	check bool
+
+	// dryRun lists the entries which would be restored.
+	dryRun bool
+
+	// disableTouch does not update the custom time of restored caches.
+	disableTouch bool
+
+	// externalCompressor uses an external compression binary when available.
+	externalCompressor bool
+
+	// storeIncompressible stores already compressed files without compressing
+	// them again.
+	storeIncompressible bool
+
+	// preserveOwner restores file ownership when running as root.
+	preserveOwner bool
+
+	// xattrs saves and restores extended attributes.
+	xattrs bool
+
+	// sparse saves and restores files with holes as sparse files.
+	sparse bool
+
+	// dereference follows symlinks when saving.
+	dereference bool
+
+	// normalize is the Unicode normalization form for file names.
+	normalize string
+
+	// strict fails saving if there are files which cannot be archived.
+	strict bool
+
+	// warnSkipped logs each file which is skipped when saving.
+	warnSkipped bool
+
+	// prefix is the directory within the archive in which to store entries.
+	prefix string
+
+	// oneFileSystem stays on the file system of the directory when saving.
+	oneFileSystem bool
+
+	// respectGitignore skips files ignored by git when saving.
+	respectGitignore bool
+
+	// encryptionKeyFile is the path to the client-side encryption key.
+	encryptionKeyFile string
+
+	// kmsKey is the Cloud KMS key used to encrypt saved objects.
+	kmsKey string
+
+	// requireKMSKey is the Cloud KMS key restored objects must be encrypted
+	// with.
+	requireKMSKey string
+
+	// trustedCreators is the list of principals allowed to have created
+	// restored caches.
+	trustedCreators repeatedFlag
+
+	// signingKey is the key used to sign archives when saving.
+	signingKey string
+
+	// verifyKey is the key used to verify archive signatures when restoring.
+	verifyKey string
+
+	// provenance records a provenance attestation when saving, and requires one
+	// when restoring.
+	provenance bool
+
+	// builderID, sourceURI, and sourceCommit describe the build in provenance
+	// attestations.
+	builderID    string
+	sourceURI    string
+	sourceCommit string
+
+	// manifest uploads a manifest of the saved files.
+	manifest bool
+
+	// verifyManifest verifies restored files against the manifest.
+	verifyManifest bool
+
+	// include is the list of patterns to include when saving.
+	include repeatedFlag
+
+	// exclude is the list of patterns to exclude when saving.
+	exclude repeatedFlag
+
+	// denySecrets refuses to save files which likely contain secrets.
+	denySecrets bool
+
+	// secrets is the list of additional patterns for files which likely contain
+	// secrets.
+	secrets repeatedFlag
+
+	// excludeSecrets skips files which likely contain secrets instead of
+	// failing.
+	excludeSecrets bool
+
+	// caseCollisions is the action for names which collide on case-insensitive
+	// filesystems.
+	caseCollisions string
+
+	// timeout limits how long the entire operation may take.
+	timeout time.Duration
+
+	// lookupTimeout and transferTimeout limit how long finding and
+	// transferring the cache may take.
+	lookupTimeout   time.Duration
+	transferTimeout time.Duration
+
+	// concurrency is the default number of goroutines for parallel work.
+	concurrency int
+
+	// bufferSize is the size of copy buffers, and memoryLimit is the
+	// approximate maximum memory used for buffers.
+	bufferSize  int
+	memoryLimit int64
+
+	// hashCache is the file in which the results of hashGlob are cached.
+	hashCache string
+
+	// grpc uses the gRPC storage API.
+	grpc bool
+
+	// endpoint is the Cloud Storage endpoint to use instead of the default.
+	endpoint string
+
+	// billingProject is billed for requests to requester pays buckets.
+	billingProject string
+
+	// credentialsFile is the file with the Google Cloud credentials, and
+	// externalAccountConfig is the file with an external account
+	// configuration for workload identity federation.
+	credentialsFile       string
+	externalAccountConfig string
+
+	// accessToken is an OAuth access token for Google Cloud.
+	accessToken string
+
+	// noAuth sends Google Cloud requests without credentials.
+	noAuth bool
+
+	// hmacAccessID and hmacSecret are an HMAC key for Cloud Storage.
+	hmacAccessID string
+	hmacSecret   string
+
+	// impersonateServiceAccount is the service account to impersonate, or a
+	// comma-separated chain of delegates ending with it.
+	impersonateServiceAccount string
+
+	// createBucket creates missing buckets when saving, in project with the
+	// location, storage class, and uniform bucket-level access.
+	createBucket  bool
+	project       string
+	location      string
+	storageClass  string
+	uniformAccess bool
+
+	// proxy is the URL of the proxy for HTTP requests, and caFile is a file of
+	// PEM-encoded certificates to trust.
+	proxy  string
+	caFile string
+
+	// privateGoogleAccess is the virtual IP through which Google APIs are
+	// reached, private or restricted.
+	privateGoogleAccess string
+
 	// debug enables debug logging.
 	debug bool
 )
 
-func init() {
-	flag.StringVar(&bucket, "bucket", "", "Bucket name without gs:// prefix.")
-	flag.StringVar(&dir, "dir", "", "Directory to cache or restore.")
-
-	flag.StringVar(&cache, "cache", "", "Key with which to cache.")
-	flag.Var(&restore, "restore", "Keys to search to restore (can use multiple times).")
-	flag.BoolVar(&allowFailure, "allow-failure", false, "Allow the command to fail.")
-	flag.StringVar(&hash, "hash", "", "Glob pattern to hash.")
-
-	flag.BoolVar(&debug, "debug", false, "Print verbose debug logs.")
+// flagDefs defines each flag on a flag set, so commands only have the flags
+// they use, and the original interface has every flag.
+var flagDefs = map[string]func(fs *flag.FlagSet){
+	"bucket": func(fs *flag.FlagSet) {
+		fs.Var(&buckets, "bucket", "Bucket name without gs:// prefix, an s3://, azblob://, or oci:// URL, a file:// URL of a directory, a signed URL of the cache, or an https:// URL to restore from (can use multiple times to save to each, or restore from the first with a match).")
+	},
+	"dir": func(fs *flag.FlagSet) {
+		fs.StringVar(&dir, "dir", "", "Directory to cache or restore.")
+	},
+	"cache": func(fs *flag.FlagSet) {
+		fs.StringVar(&cache, "cache", "", "Key with which to cache.")
+	},
+	"restore": func(fs *flag.FlagSet) {
+		fs.Var(&restore, "restore", "Keys to search to restore (can use multiple times).")
+	},
+	"verify": func(fs *flag.FlagSet) {
+		fs.StringVar(&verify, "verify", "", "Key of the cache to verify without restoring.")
+	},
+	"generations": func(fs *flag.FlagSet) {
+		fs.StringVar(&generations, "generations", "", "Key of the cache of which to list the generations, including noncurrent generations in versioned buckets.")
+	},
+	"rollback": func(fs *flag.FlagSet) {
+		fs.StringVar(&rollback, "rollback", "", "Key of the cache to roll back to the noncurrent generation given by -generation, or to undelete.")
+	},
+	"sign": func(fs *flag.FlagSet) {
+		fs.StringVar(&sign, "sign", "", "Key of the cache for which to print a signed URL, so it can be downloaded without credentials.")
+	},
+	"expires": func(fs *flag.FlagSet) {
+		fs.DurationVar(&expires, "expires", 0, "How long the signed URL is valid, at most 7 days (defaults to 1h).")
+	},
+	"release": func(fs *flag.FlagSet) {
+		fs.StringVar(&release, "release", "", "Key of the cache on which to release holds, so it can be deleted or replaced.")
+	},
+	"temporary-hold": func(fs *flag.FlagSet) {
+		fs.BoolVar(&temporaryHold, "temporary-hold", false, "Place a temporary hold on the saved cache, so it cannot be deleted or replaced until released.")
+	},
+	"event-based-hold": func(fs *flag.FlagSet) {
+		fs.BoolVar(&eventBasedHold, "event-based-hold", false, "Place an event-based hold on the saved cache, which starts the bucket's retention period when released.")
+	},
+	"bench": func(fs *flag.FlagSet) {
+		fs.BoolVar(&bench, "bench", false, "Benchmark compressing a sample of the directory with each compression and level.")
+	},
+	"lifecycle": func(fs *flag.FlagSet) {
+		fs.BoolVar(&lifecycle, "lifecycle", false, "Configure lifecycle rules on the bucket which delete unused caches and incomplete uploads.")
+	},
+	"lifecycle-days": func(fs *flag.FlagSet) {
+		fs.IntVar(&lifecycleDays, "lifecycle-days", 30, "Days after which caches which were not saved or restored are deleted by the lifecycle rules.")
+	},
+	"sample-size": func(fs *flag.FlagSet) {
+		fs.Int64Var(&sampleSize, "sample-size", 0, "Bytes of the directory to sample when benchmarking (defaults to 64MiB).")
+	},
+	"allow-failure": func(fs *flag.FlagSet) {
+		fs.BoolVar(&allowFailure, "allow-failure", false, "Allow the command to fail.")
+	},
+	"hash": func(fs *flag.FlagSet) {
+		fs.StringVar(&hash, "hash", "", "Glob pattern to hash.")
+	},
+	"compression": func(fs *flag.FlagSet) {
+		fs.StringVar(&compression, "compression", "", "Compression algorithm (gzip, zstd, lz4, none). Defaults to gzip when saving and is detected when restoring.")
+	},
+	"compression-level": func(fs *flag.FlagSet) {
+		fs.IntVar(&compressionLevel, "compression-level", 0, "Compression level, as for the gzip (1-9), zstd (1-22), or lz4 (1-9) tools (defaults to the default level).")
+	},
+	"format": func(fs *flag.FlagSet) {
+		fs.StringVar(&format, "format", "", "Archive format (tar, zip). Defaults to tar when saving and is detected when restoring.")
+	},
+	"chunk-size": func(fs *flag.FlagSet) {
+		fs.IntVar(&chunkSize, "chunk-size", 0, "Bytes buffered and sent in each upload request (defaults to 128MB).")
+	},
+	"disable-buffering": func(fs *flag.FlagSet) {
+		fs.BoolVar(&disableBuffering, "disable-buffering", false, "Upload in a single request without buffering, which cannot be retried.")
+	},
+	"parallel-uploads": func(fs *flag.FlagSet) {
+		fs.IntVar(&parallelUploads, "parallel-uploads", 0, "Upload large archives as this many parts at once, composed into the cache.")
+	},
+	"part-size": func(fs *flag.FlagSet) {
+		fs.IntVar(&partSize, "part-size", 0, "Bytes in each part of a parallel upload (defaults to 64MiB).")
+	},
+	"parallel-downloads": func(fs *flag.FlagSet) {
+		fs.IntVar(&parallelDownloads, "parallel-downloads", 0, "Download large archives as this many ranges at once when restoring.")
+	},
+	"slice-size": func(fs *flag.FlagSet) {
+		fs.Int64Var(&sliceSize, "slice-size", 0, "Bytes in each range of a parallel download (defaults to 64MiB).")
+	},
+	"extract-workers": func(fs *flag.FlagSet) {
+		fs.IntVar(&extractWorkers, "extract-workers", 0, "Number of goroutines which write small files in the background when restoring.")
+	},
+	"state-file": func(fs *flag.FlagSet) {
+		fs.StringVar(&stateFile, "state-file", "", "Local file which records upload progress, so an interrupted save can be resumed.")
+	},
+	"lock": func(fs *flag.FlagSet) {
+		fs.BoolVar(&lock, "lock", false, "Acquire a lock on the key before saving, and skip saving if another build holds it.")
+	},
+	"lock-ttl": func(fs *flag.FlagSet) {
+		fs.DurationVar(&lockTTL, "lock-ttl", 0, "How long the lock is held if it is never released (defaults to 1h).")
+	},
+	"force": func(fs *flag.FlagSet) {
+		fs.BoolVar(&force, "force", false, "Replace the cache if it already exists, even if its contents did not change.")
+	},
+	"update": func(fs *flag.FlagSet) {
+		fs.BoolVar(&update, "update", false, "Replace the cache if it already exists and its contents changed.")
+	},
+	"index": func(fs *flag.FlagSet) {
+		fs.BoolVar(&index, "index", false, "Write an archive index so paths can be restored individually.")
+	},
+	"path": func(fs *flag.FlagSet) {
+		fs.Var(&paths, "path", "Paths within the archive to restore (can use multiple times).")
+	},
+	"subpath": func(fs *flag.FlagSet) {
+		fs.StringVar(&subpath, "subpath", "", "Directory within the archive to restore into the target directory.")
+	},
+	"strip-components": func(fs *flag.FlagSet) {
+		fs.IntVar(&stripComponents, "strip-components", 0, "Number of leading path components to remove when restoring.")
+	},
+	"map": func(fs *flag.FlagSet) {
+		fs.Var(&mappings, "map", "Restore a directory within the archive to another directory, as prefix=dir (can use multiple times).")
+	},
+	"clean": func(fs *flag.FlagSet) {
+		fs.BoolVar(&clean, "clean", false, "Remove the contents of the directory before restoring.")
+	},
+	"skip-if-present": func(fs *flag.FlagSet) {
+		fs.BoolVar(&skipIfPresent, "skip-if-present", false, "Skip restoring if the directory is not empty, or if the marker records the matching object.")
+	},
+	"marker": func(fs *flag.FlagSet) {
+		fs.StringVar(&marker, "marker", "", "File within the directory which records the restored object.")
+	},
+	"max-bytes": func(fs *flag.FlagSet) {
+		fs.Int64Var(&maxBytes, "max-bytes", 0, "Maximum total size in bytes of restored files (defaults to unlimited).")
+	},
+	"max-files": func(fs *flag.FlagSet) {
+		fs.Int64Var(&maxFiles, "max-files", 0, "Maximum number of restored files and directories (defaults to unlimited).")
+	},
+	"umask": func(fs *flag.FlagSet) {
+		fs.StringVar(&umask, "umask", "", "Permission bits to remove from restored files and directories, in octal (e.g. 022).")
+	},
+	"file-mode": func(fs *flag.FlagSet) {
+		fs.StringVar(&fileMode, "file-mode", "", "Permissions for restored files instead of the archived ones, in octal (e.g. 0644).")
+	},
+	"dir-mode": func(fs *flag.FlagSet) {
+		fs.StringVar(&dirMode, "dir-mode", "", "Permissions for restored directories instead of the archived ones, in octal (e.g. 0755).")
+	},
+	"generation": func(fs *flag.FlagSet) {
+		fs.Int64Var(&generation, "generation", 0, "Restore a specific generation of the object named by the restore key, or the generation to roll back to.")
+	},
+	"first-match": func(fs *flag.FlagSet) {
+		fs.BoolVar(&firstMatch, "first-match", false, "Search restore keys in order and use the first key with a match, instead of the newest match of any key.")
+	},
+	"check": func(fs *flag.FlagSet) {
+		fs.BoolVar(&check, "check", false, "Report which object the restore keys match without restoring it. Exits with status 2 on a cache miss.")
+	},
+	"disable-touch": func(fs *flag.FlagSet) {
+		fs.BoolVar(&disableTouch, "disable-touch", false, "Do not update the custom time of the restored cache, which lifecycle rules use to delete unused caches.")
+	},
+	"dry-run": func(fs *flag.FlagSet) {
+		fs.BoolVar(&dryRun, "dry-run", false, "List the files which would be restored and their sizes without writing anything.")
+	},
+	"external-compressor": func(fs *flag.FlagSet) {
+		fs.BoolVar(&externalCompressor, "external-compressor", false, "Use pigz, zstd, or lz4 binaries for compression when installed.")
+	},
+	"store-incompressible": func(fs *flag.FlagSet) {
+		fs.BoolVar(&storeIncompressible, "store-incompressible", false, "Store files which are already compressed, like jars and images, without compressing them again.")
+	},
+	"preserve-owner": func(fs *flag.FlagSet) {
+		fs.BoolVar(&preserveOwner, "preserve-owner", false, "Restore file ownership from the archive (requires root).")
+	},
+	"xattrs": func(fs *flag.FlagSet) {
+		fs.BoolVar(&xattrs, "xattrs", false, "Save and restore extended attributes and POSIX ACLs.")
+	},
+	"sparse": func(fs *flag.FlagSet) {
+		fs.BoolVar(&sparse, "sparse", false, "Keep holes in sparse files, like VM images, instead of filling them with zeros.")
+	},
+	"dereference": func(fs *flag.FlagSet) {
+		fs.BoolVar(&dereference, "dereference", false, "Follow symlinks and archive their targets when saving.")
+	},
+	"normalize": func(fs *flag.FlagSet) {
+		fs.StringVar(&normalize, "normalize", "", "Unicode normalization for file names (nfc, nfd).")
+	},
+	"case-collisions": func(fs *flag.FlagSet) {
+		fs.StringVar(&caseCollisions, "case-collisions", "error", "Action when names collide on a case-insensitive filesystem (error, warn, ignore).")
+	},
+	"strict": func(fs *flag.FlagSet) {
+		fs.BoolVar(&strict, "strict", false, "Fail saving if there are files which cannot be archived, like sockets or devices.")
+	},
+	"warn-skipped": func(fs *flag.FlagSet) {
+		fs.BoolVar(&warnSkipped, "warn-skipped", false, "Log each file which is skipped when saving.")
+	},
+	"prefix": func(fs *flag.FlagSet) {
+		fs.StringVar(&prefix, "prefix", "", "Directory within the archive in which to store entries when saving.")
+	},
+	"one-file-system": func(fs *flag.FlagSet) {
+		fs.BoolVar(&oneFileSystem, "one-file-system", false, "Do not descend into mount points when saving.")
+	},
+	"respect-gitignore": func(fs *flag.FlagSet) {
+		fs.BoolVar(&respectGitignore, "respect-gitignore", false, "Skip files which git would ignore when saving.")
+	},
+	"encryption-key-file": func(fs *flag.FlagSet) {
+		fs.StringVar(&encryptionKeyFile, "encryption-key-file", "", "File with a 32-byte key (raw or base64) to encrypt archives client-side.")
+	},
+	"kms-key": func(fs *flag.FlagSet) {
+		fs.StringVar(&kmsKey, "kms-key", "", "Cloud KMS key name used to encrypt saved objects (CMEK).")
+	},
+	"require-kms-key": func(fs *flag.FlagSet) {
+		fs.StringVar(&requireKMSKey, "require-kms-key", "", "Refuse to restore objects which are not encrypted with this Cloud KMS key.")
+	},
+	"trusted-creator": func(fs *flag.FlagSet) {
+		fs.Var(&trustedCreators, "trusted-creator", "Only restore caches created by this principal, like a service account email (can use multiple times).")
+	},
+	"signing-key": func(fs *flag.FlagSet) {
+		fs.StringVar(&signingKey, "signing-key", "", "Sign archives when saving with a Cloud KMS key (gcpkms://...) or PEM private key file.")
+	},
+	"verify-key": func(fs *flag.FlagSet) {
+		fs.StringVar(&verifyKey, "verify-key", "", "Require archives to be signed by a Cloud KMS key (gcpkms://...) or PEM public key file when restoring.")
+	},
+	"provenance": func(fs *flag.FlagSet) {
+		fs.BoolVar(&provenance, "provenance", false, "Record a provenance attestation when saving, or require one when restoring.")
+	},
+	"builder-id": func(fs *flag.FlagSet) {
+		fs.StringVar(&builderID, "builder-id", "", "Builder identity recorded in provenance, or required when restoring.")
+	},
+	"source-uri": func(fs *flag.FlagSet) {
+		fs.StringVar(&sourceURI, "source-uri", "", "Source location recorded in provenance.")
+	},
+	"source-commit": func(fs *flag.FlagSet) {
+		fs.StringVar(&sourceCommit, "source-commit", "", "Source commit recorded in provenance.")
+	},
+	"metadata": func(fs *flag.FlagSet) {
+		fs.Var(&metadata, "metadata", "Custom metadata for the saved cache, like the commit or build ID, as key=value (can use multiple times).")
+	},
+	"content-type": func(fs *flag.FlagSet) {
+		fs.StringVar(&contentType, "content-type", "", "Content type of the saved cache (default depends on the compression).")
+	},
+	"cache-control": func(fs *flag.FlagSet) {
+		fs.StringVar(&cacheControl, "cache-control", "public,max-age=3600", "Cache-Control of the saved cache, like private for caches which CDNs must not store.")
+	},
+	"content-encoding": func(fs *flag.FlagSet) {
+		fs.StringVar(&contentEncoding, "content-encoding", "", "Content-Encoding of the saved cache (gzip), so HTTP clients decompress it to a tar.")
+	},
+	"manifest": func(fs *flag.FlagSet) {
+		fs.BoolVar(&manifest, "manifest", false, "Upload a manifest of file digests when saving.")
+	},
+	"verify-manifest": func(fs *flag.FlagSet) {
+		fs.BoolVar(&verifyManifest, "verify-manifest", false, "Verify restored files against the manifest uploaded when saving.")
+	},
+	"include": func(fs *flag.FlagSet) {
+		fs.Var(&include, "include", "Glob pattern of paths to include when saving, excluding everything else (can use multiple times).")
+	},
+	"exclude": func(fs *flag.FlagSet) {
+		fs.Var(&exclude, "exclude", "Glob pattern of paths to exclude when saving (can use multiple times).")
+	},
+	"deny-secrets": func(fs *flag.FlagSet) {
+		fs.BoolVar(&denySecrets, "deny-secrets", false, "Refuse to save files which commonly contain secrets, like .env, id_rsa, *.pem, and credentials.json.")
+	},
+	"secret": func(fs *flag.FlagSet) {
+		fs.Var(&secrets, "secret", "Pattern of paths which contain secrets and must not be saved, in gitignore syntax (can use multiple times).")
+	},
+	"exclude-secrets": func(fs *flag.FlagSet) {
+		fs.BoolVar(&excludeSecrets, "exclude-secrets", false, "Leave files matching secret patterns out of the cache with a warning instead of failing.")
+	},
+	"compression-workers": func(fs *flag.FlagSet) {
+		fs.IntVar(&compressionWorkers, "compression-workers", 0, "Number of compression workers (defaults to the number of CPUs).")
+	},
+	"timeout": func(fs *flag.FlagSet) {
+		fs.DurationVar(&timeout, "timeout", 0, "Maximum time for the entire operation (defaults to unlimited).")
+	},
+	"lookup-timeout": func(fs *flag.FlagSet) {
+		fs.DurationVar(&lookupTimeout, "lookup-timeout", 0, "Maximum time to check for or find the cached object (defaults to unlimited).")
+	},
+	"transfer-timeout": func(fs *flag.FlagSet) {
+		fs.DurationVar(&transferTimeout, "transfer-timeout", 0, "Maximum time to upload or download and extract the cache (defaults to unlimited).")
+	},
+	"concurrency": func(fs *flag.FlagSet) {
+		fs.IntVar(&concurrency, "concurrency", 0, "Default number of goroutines for compression, parallel uploads and downloads, and extraction.")
+	},
+	"buffer-size": func(fs *flag.FlagSet) {
+		fs.IntVar(&bufferSize, "buffer-size", 0, "Bytes in each buffer used to copy files and objects (defaults to 256KiB).")
+	},
+	"memory-limit": func(fs *flag.FlagSet) {
+		fs.Int64Var(&memoryLimit, "memory-limit", 0, "Approximate maximum bytes used for buffers (defaults to unlimited).")
+	},
+	"hash-cache": func(fs *flag.FlagSet) {
+		fs.StringVar(&hashCache, "hash-cache", "", "File in which hashGlob results are cached while the files are unchanged.")
+	},
+	"grpc": func(fs *flag.FlagSet) {
+		fs.BoolVar(&grpc, "grpc", false, "Use the gRPC storage API, with DirectPath on Google Cloud when available.")
+	},
+	"endpoint": func(fs *flag.FlagSet) {
+		fs.StringVar(&endpoint, "endpoint", "", "Cloud Storage endpoint to use instead of the default, like a private endpoint.")
+	},
+	"create-bucket": func(fs *flag.FlagSet) {
+		fs.BoolVar(&createBucket, "create-bucket", false, "Create the bucket when saving if it does not exist.")
+	},
+	"project": func(fs *flag.FlagSet) {
+		fs.StringVar(&project, "project", "", "Project in which to create the bucket (defaults to the project of the credentials).")
+	},
+	"location": func(fs *flag.FlagSet) {
+		fs.StringVar(&location, "location", "", "Location of the created bucket, like us-central1 (defaults to the US multi-region).")
+	},
+	"storage-class": func(fs *flag.FlagSet) {
+		fs.StringVar(&storageClass, "storage-class", "", "Storage class of the created bucket, like STANDARD or NEARLINE.")
+	},
+	"uniform-access": func(fs *flag.FlagSet) {
+		fs.BoolVar(&uniformAccess, "uniform-access", true, "Enable uniform bucket-level access on the created bucket.")
+	},
+	"credentials-file": func(fs *flag.FlagSet) {
+		fs.StringVar(&credentialsFile, "credentials-file", os.Getenv("GCS_CACHER_CREDENTIALS_FILE"), "JSON file with Google Cloud credentials, like a service account key, instead of Application Default Credentials (defaults to $GCS_CACHER_CREDENTIALS_FILE).")
+	},
+	"external-account-config": func(fs *flag.FlagSet) {
+		fs.StringVar(&externalAccountConfig, "external-account-config", os.Getenv("GCS_CACHER_EXTERNAL_ACCOUNT_CONFIG"), "JSON file with an external account configuration for workload identity federation (defaults to $GCS_CACHER_EXTERNAL_ACCOUNT_CONFIG).")
+	},
+	"access-token": func(fs *flag.FlagSet) {
+		fs.StringVar(&accessToken, "access-token", os.Getenv("GCS_CACHER_ACCESS_TOKEN"), "OAuth access token for Google Cloud, which must be valid for the whole operation (defaults to $GCS_CACHER_ACCESS_TOKEN).")
+	},
+	"hmac-access-id": func(fs *flag.FlagSet) {
+		fs.StringVar(&hmacAccessID, "hmac-access-id", os.Getenv("GCS_CACHER_HMAC_ACCESS_ID"), "Access ID of an HMAC key with which to access Cloud Storage through the XML API (defaults to $GCS_CACHER_HMAC_ACCESS_ID).")
+	},
+	"hmac-secret": func(fs *flag.FlagSet) {
+		fs.StringVar(&hmacSecret, "hmac-secret", os.Getenv("GCS_CACHER_HMAC_SECRET"), "Secret of the HMAC key (defaults to $GCS_CACHER_HMAC_SECRET).")
+	},
+	"no-auth": func(fs *flag.FlagSet) {
+		fs.BoolVar(&noAuth, "no-auth", false, "Send Google Cloud requests without credentials, like restores from public buckets.")
+	},
+	"impersonate-service-account": func(fs *flag.FlagSet) {
+		fs.StringVar(&impersonateServiceAccount, "impersonate-service-account", "", "Service account to impersonate, or a comma-separated chain of delegates ending with it.")
+	},
+	"billing-project": func(fs *flag.FlagSet) {
+		fs.StringVar(&billingProject, "billing-project", "", "Project billed for requests to requester pays buckets.")
+	},
+	"proxy": func(fs *flag.FlagSet) {
+		fs.StringVar(&proxy, "proxy", "", "URL of the proxy for HTTP requests (defaults to HTTPS_PROXY and HTTP_PROXY).")
+	},
+	"ca-file": func(fs *flag.FlagSet) {
+		fs.StringVar(&caFile, "ca-file", "", "File of PEM-encoded CA certificates to trust in addition to the system's, like a proxy's.")
+	},
+	"private-google-access": func(fs *flag.FlagSet) {
+		fs.StringVar(&privateGoogleAccess, "private-google-access", "", "Connect to Google APIs through the private or restricted virtual IPs, like inside VPC Service Controls.")
+	},
+	"debug": func(fs *flag.FlagSet) {
+		fs.BoolVar(&debug, "debug", false, "Print verbose debug logs.")
+	},
 }
 
 func main() {
 	ctx, done := signalcontext.OnInterrupt()
 
 	err := realMain(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		err = fmt.Errorf("interrupted: %w", err)
+	}
 	done()
 
 	if err != nil {
@@ -70,70 +707,199 @@ func main() {
 		}
 
 		if !allowFailure {
+			if check && errors.Is(err, cacher.ErrCacheMiss) {
+				os.Exit(2)
+			}
 			os.Exit(1)
 		}
 	}
 }
 
 func realMain(ctx context.Context) error {
-	args := os.Args
+	args := os.Args[1:]
+	if len(args) == 0 {
+		usage()
+		return fmt.Errorf("missing command")
+	}
+
+	if args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		usage()
+		return nil
+	}
+
+	// Flags without a command are the original interface, in which the flag
+	// for the operation selects the command
+	if strings.HasPrefix(args[0], "-") {
+		return legacyMain(ctx, args)
+	}
+
+	if args[0] == "help" {
+		return help(args[1:])
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		usage()
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	fs := cmd.flagSet()
+	rest, err := parseArgs(fs, args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		fs.Usage()
+		return err
+	}
+	return run(ctx, cmd, rest)
+}
+
+// legacyMain runs the command selected by the flags, like -cache or -restore,
+// which was the only interface before there were commands. Every flag is
+// accepted.
+func legacyMain(ctx context.Context, args []string) error {
+	for _, def := range flagDefs {
+		def(flag.CommandLine)
+	}
+
 	for _, arg := range args {
-		if arg == "-h" || arg == "--help" || arg == "help" {
+		if arg == "-h" || arg == "-help" || arg == "--help" || arg == "help" {
+			usage()
+			fmt.Fprintf(stderr, "\nWithout a command, the flag for the operation, like -cache or -restore,\nselects it, and every flag is accepted:\n")
+			flag.CommandLine.SetOutput(stderr)
 			flag.PrintDefaults()
 			return nil
 		}
 	}
 
-	flag.Parse()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
 	if len(flag.Args()) > 0 {
 		return fmt.Errorf("no arguments expected")
 	}
 
-	c, err := cacher.New(ctx)
+	var name string
+	var keys []string
+	switch {
+	case cache != "":
+		name, keys = "save", []string{cache}
+	case restore != nil:
+		name, keys = "restore", restore
+	case verify != "":
+		name, keys = "verify", []string{verify}
+	case release != "":
+		name, keys = "release", []string{release}
+	case generations != "":
+		name, keys = "generations", []string{generations}
+	case rollback != "":
+		name, keys = "rollback", []string{rollback}
+	case sign != "":
+		name, keys = "sign", []string{sign}
+	case lifecycle:
+		name = "lifecycle"
+	case bench:
+		name = "bench"
+	default:
+		return fmt.Errorf("missing command operation")
+	}
+	return run(ctx, findCommand(name), keys)
+}
+
+// run creates the cacher from the flags and runs the command.
+func run(ctx context.Context, cmd *command, args []string) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	c, err := newCacher(ctx)
 	if err != nil {
 		return err
 	}
-	c.Debug(debug)
+	return cmd.run(ctx, c, args)
+}
 
-	switch {
-	case cache != "":
-		parsed, err := parseTemplate(c, cache)
+// newCacher creates the cacher with the client and runtime flags.
+func newCacher(ctx context.Context) (*cacher.Cacher, error) {
+	var opts []cacher.Option
+	if grpc {
+		opts = append(opts, cacher.WithGRPC())
+	}
+	if endpoint != "" {
+		opts = append(opts, cacher.WithEndpoint(endpoint))
+	}
+	if credentialsFile != "" {
+		opts = append(opts, cacher.WithCredentialsFile(credentialsFile))
+	}
+	if externalAccountConfig != "" {
+		b, err := os.ReadFile(externalAccountConfig)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to read external account configuration: %w", err)
 		}
-
-		if err := c.Save(ctx, &cacher.SaveRequest{
-			Bucket: bucket,
-			Dir:    dir,
-			Key:    parsed,
-		}); err != nil {
-			return err
+		opts = append(opts, cacher.WithExternalAccount(b))
+	}
+	if accessToken != "" {
+		opts = append(opts, cacher.WithAccessToken(accessToken))
+	}
+	if noAuth {
+		opts = append(opts, cacher.WithoutAuthentication())
+	}
+	if hmacAccessID != "" || hmacSecret != "" {
+		opts = append(opts, cacher.WithHMACKey(hmacAccessID, hmacSecret))
+	}
+	if impersonateServiceAccount != "" {
+		chain := strings.Split(impersonateServiceAccount, ",")
+		opts = append(opts, cacher.WithImpersonation(chain[len(chain)-1], chain[:len(chain)-1]...))
+	}
+	if billingProject != "" {
+		opts = append(opts, cacher.WithBillingProject(billingProject))
+	}
+	if proxy != "" {
+		opts = append(opts, cacher.WithProxy(proxy))
+	}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificates: %w", err)
 		}
+		opts = append(opts, cacher.WithCACertificates(b))
+	}
+	if privateGoogleAccess != "" {
+		opts = append(opts, cacher.WithPrivateGoogleAccess(privateGoogleAccess))
+	}
 
-		fmt.Fprintf(stdout, "finished saving cache\n")
-		return nil
-	case restore != nil:
-		keys := make([]string, len(restore))
-		for i, key := range restore {
-			parsed, err := parseTemplate(c, key)
-			if err != nil {
-				return err
-			}
-			keys[i] = parsed
-		}
+	c, err := cacher.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.Debug(debug)
+	c.Concurrency(concurrency)
+	c.BufferSize(bufferSize)
+	c.MemoryLimit(memoryLimit)
+	c.HashCache(hashCache)
+	return c, nil
+}
 
-		if err := c.Restore(ctx, &cacher.RestoreRequest{
-			Bucket: bucket,
-			Dir:    dir,
-			Keys:   keys,
-		}); err != nil {
-			return err
-		}
+// splitBuckets returns the first bucket and the rest of the buckets.
+func splitBuckets() (string, []string) {
+	if len(buckets) == 0 {
+		return "", nil
+	}
+	return buckets[0], buckets[1:]
+}
 
-		fmt.Fprintf(stdout, "finished restoring cache\n")
-		return nil
+// singleBucket returns the bucket for operations which only use one.
+func singleBucket() (string, error) {
+	switch len(buckets) {
+	case 0:
+		return "", nil
+	case 1:
+		return buckets[0], nil
 	default:
-		return fmt.Errorf("missing command operation")
+		return "", fmt.Errorf("multiple buckets are only supported when saving or restoring")
 	}
 }
 
@@ -161,6 +927,21 @@ func templateFuncs(c *cacher.Cacher) template.FuncMap {
 	}
 }
 
+// parseMode parses an octal permission string. An empty string is zero.
+func parseMode(name, s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0777 {
+		return 0, fmt.Errorf("invalid %s %q, expected octal permissions", name, s)
+	}
+	return os.FileMode(v), nil
+}
+
+// stringSliceFlag is a list of values, which can be separated by commas or
+// given by using the flag multiple times.
 type stringSliceFlag []string
 
 func (s *stringSliceFlag) String() string {
@@ -180,3 +961,22 @@ func (s *stringSliceFlag) Set(value string) error {
 	*s = append(*s, vals...)
 	return nil
 }
+
+// repeatedFlag is a list of values given by using the flag multiple times.
+// Unlike stringSliceFlag, values are not split on commas, so they can contain
+// them, like the glob **/*.{go,mod}.
+type repeatedFlag []string
+
+func (s *repeatedFlag) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *repeatedFlag) Set(value string) error {
+	if value = strings.TrimSpace(value); value != "" {
+		*s = append(*s, value)
+	}
+	return nil
+}